@@ -0,0 +1,102 @@
+package main
+
+// aiaPriorityOrder lists the major interrupts in the default priority order
+// of the AIA, highest first.
+var aiaPriorityOrder = []uint64{11, 3, 7, 9, 1, 5, 12, 10, 2, 6, 13}
+
+// EnableAIA replaces the PLIC with the APLIC and IMSIC and enables the Smaia
+// and Ssaia CSRs.
+func (cpu *Cpu) EnableAIA() {
+	cpu.Ext.Smaia = true
+	cpu.Bus.aia = true
+}
+
+// topi returns the highest-priority interrupt in pending as mtopi and stopi
+// report it: the interrupt number in bits 27:16, and in bits 7:0 the
+// priority, which is always 1 as the iprio registers are read-only zero.
+func topi(pending uint64) uint64 {
+	for _, i := range aiaPriorityOrder {
+		if (pending>>i)&1 != 0 {
+			return i<<16 | 1
+		}
+	}
+	return 0
+}
+
+// readAIA reads the Smaia and Ssaia CSRs backed by the interrupt controllers.
+func (cpu *Cpu) readAIA(csrAddr uint64) uint64 {
+	cpu.UpdateTimers()
+	cpu.updateAIA()
+	switch csrAddr {
+	case MIREG:
+		return cpu.Bus.imsic.m.loadIReg(cpu.Csr.Load(MISELECT), cpu.XLEN())
+	case SIREG:
+		return cpu.Bus.imsic.s.loadIReg(cpu.Csr.Load(SISELECT), cpu.XLEN())
+	case MTOPEI:
+		return cpu.Bus.imsic.m.topei()
+	case STOPEI:
+		return cpu.Bus.imsic.s.topei()
+	case MTOPI:
+		return topi(cpu.Csr.Load(MIP) & cpu.Csr.Load(MIE) &^ cpu.Csr.Load(MIDELEG))
+	case STOPI:
+		// VS-level interrupts delegated to the guest are not S-level ones.
+		hideleg := cpu.Csr.Load(HIDELEG) & (MASK_VS_INT | MASK_SGEIP)
+		return topi(cpu.Csr.Load(MIP) & cpu.Csr.Load(MIE) & cpu.Csr.Load(MIDELEG) &^ hideleg)
+	}
+	return 0
+}
+
+// writeAIA writes mireg or sireg, or claims the interrupt mtopei or stopei
+// reports, whatever the value written.
+func (cpu *Cpu) writeAIA(csrAddr, value uint64) {
+	switch csrAddr {
+	case MIREG:
+		cpu.Bus.imsic.m.storeIReg(cpu.Csr.Load(MISELECT), value, cpu.XLEN())
+	case SIREG:
+		cpu.Bus.imsic.s.storeIReg(cpu.Csr.Load(SISELECT), value, cpu.XLEN())
+	case MTOPEI:
+		cpu.Bus.imsic.m.claim()
+	case STOPEI:
+		cpu.Bus.imsic.s.claim()
+	}
+	cpu.updateAIA()
+}
+
+// updateAIA drives MEIP and SEIP from the M-level and S-level interrupt files
+// and APLIC domains.
+func (cpu *Cpu) updateAIA() {
+	if !cpu.Ext.Smaia {
+		return
+	}
+	var pending uint64
+	if cpu.Bus.imsic.m.topei() != 0 || cpu.Bus.aplic.m.Pending() {
+		pending |= MASK_MEIP
+	}
+	if cpu.Bus.imsic.s.topei() != 0 || cpu.Bus.aplic.s.Pending() {
+		pending |= MASK_SEIP
+	}
+	cpu.Csr.SetExternalPending(pending)
+}
+
+// checkAIAAccess returns the exception raised by an access to an Smaia or
+// Ssaia CSR, or nil. There are no guest interrupt files, so the VS-level
+// registers these map to while V=1 are left to the hypervisor to emulate.
+func (cpu *Cpu) checkAIAAccess(inst, csrAddr uint64) *Exception {
+	if !cpu.Ext.Smaia {
+		return NewException(IllegalInstruction, inst)
+	}
+	if cpu.Csr.V {
+		return NewException(VirtualInstruction, inst)
+	}
+	switch csrAddr {
+	case MIREG:
+		if !validISelect(cpu.Csr.Load(MISELECT), cpu.XLEN()) {
+			return NewException(IllegalInstruction, inst)
+		}
+	case SIREG:
+		if !validISelect(cpu.Csr.Load(SISELECT), cpu.XLEN()) {
+			return NewException(IllegalInstruction, inst)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,381 @@
+package main
+
+import "math/bits"
+
+// aplicDomain is one interrupt domain of the APLIC. Each source is active in
+// at most one domain: the M-level root domain owns it unless sourcecfg.D
+// delegates it to the S-level child domain.
+type aplicDomain struct {
+	domaincfg uint64
+	sourcecfg [APLIC_SOURCES]uint64
+	target    [APLIC_SOURCES]uint64
+	ip, ie    uint64
+	// The interrupt delivery control of hart 0, used in direct mode.
+	idelivery  uint64
+	iforce     uint64
+	ithreshold uint64
+	// msiAddr is the address of the IMSIC interrupt file MSIs go to.
+	msiAddr uint64
+}
+
+// Aplic is an Advanced Platform-Level Interrupt Controller with an M-level root
+// domain and an S-level child domain, delivering interrupts to hart 0 either
+// directly or as MSIs to its IMSIC.
+type Aplic struct {
+	m, s aplicDomain
+	// input holds the interrupt wires of the level-sensitive sources.
+	// Devices signal an interrupt once, so a wire stays asserted until its
+	// interrupt is claimed or forwarded as an MSI.
+	input uint64
+	// mmsiaddrcfgh and smsiaddrcfgh hold the lock bit and the upper bits of
+	// the IMSIC page numbers.
+	mmsiaddrcfgh uint64
+	smsiaddrcfgh uint64
+	// msis are the MSIs forwarded but not yet written, as address and
+	// identity pairs.
+	msis [][2]uint64
+}
+
+func NewAplic() Aplic {
+	return Aplic{
+		m: aplicDomain{msiAddr: IMSIC_M_BASE},
+		s: aplicDomain{msiAddr: IMSIC_S_BASE},
+	}
+}
+
+func (a *Aplic) domain(addr uint64) *aplicDomain {
+	if addr >= APLIC_S_BASE {
+		return &a.s
+	}
+	return &a.m
+}
+
+// active reports whether source i is active in domain d.
+func (d *aplicDomain) active(i uint64) bool {
+	return i != 0 && i < APLIC_SOURCES &&
+		d.sourcecfg[i]&SOURCECFG_D == 0 && d.sourcecfg[i]&MASK_SOURCECFG_SM != APLIC_SM_INACTIVE
+}
+
+// activeMask returns the sources active in domain d.
+func (d *aplicDomain) activeMask() uint64 {
+	var mask uint64
+	for i := uint64(1); i < APLIC_SOURCES; i++ {
+		if d.active(i) {
+			mask |= 1 << i
+		}
+	}
+	return mask
+}
+
+func (d *aplicDomain) msiMode() bool {
+	return d.domaincfg&DOMAINCFG_DM != 0
+}
+
+func (d *aplicDomain) level(i uint64) bool {
+	sm := d.sourcecfg[i] & MASK_SOURCECFG_SM
+	return sm == APLIC_SM_LEVEL1 || sm == APLIC_SM_LEVEL0
+}
+
+// rectified returns the input of source i as domain d sees it: inverted for
+// the active-low modes and zero for a detached source.
+func (a *Aplic) rectified(d *aplicDomain, i uint64) bool {
+	in := (a.input>>i)&1 != 0
+	switch d.sourcecfg[i] & MASK_SOURCECFG_SM {
+	case APLIC_SM_EDGE0, APLIC_SM_LEVEL0:
+		return !in
+	case APLIC_SM_EDGE1, APLIC_SM_LEVEL1:
+		return in
+	}
+	return false
+}
+
+// setPending sets the pending bit of source i on behalf of software. That of a
+// level-sensitive source follows its input in direct mode, and may only be
+// set while the input is asserted in MSI mode.
+func (a *Aplic) setPending(d *aplicDomain, i uint64) {
+	if !d.active(i) {
+		return
+	}
+	if d.level(i) && (!d.msiMode() || !a.rectified(d, i)) {
+		return
+	}
+	d.ip |= 1 << i
+}
+
+// clearPending clears the pending bit of source i on behalf of software.
+func (a *Aplic) clearPending(d *aplicDomain, i uint64) {
+	if !d.active(i) || (d.level(i) && !d.msiMode()) {
+		return
+	}
+	d.ip &^= 1 << i
+}
+
+// Interrupt signals an interrupt from the device wired to source irq, making
+// it pending in the domain the source is active in. The pulse has both a
+// rising and a falling edge, so either edge mode sees it.
+func (a *Aplic) Interrupt(irq uint64) {
+	if irq == 0 || irq >= APLIC_SOURCES {
+		return
+	}
+	d := &a.m
+	if a.m.sourcecfg[irq]&SOURCECFG_D != 0 {
+		d = &a.s
+	}
+	if !d.active(irq) || d.sourcecfg[irq]&MASK_SOURCECFG_SM == APLIC_SM_DETACHED {
+		return
+	}
+	if d.level(irq) {
+		a.input |= 1 << irq
+	}
+	if !d.level(irq) || a.rectified(d, irq) {
+		d.ip |= 1 << irq
+	}
+	a.forward()
+}
+
+// release deasserts the wire of a source whose interrupt has been claimed.
+func (a *Aplic) release(d *aplicDomain, i uint64) {
+	a.input &^= 1 << i
+	d.ip &^= 1 << i
+	if d.level(i) && a.rectified(d, i) {
+		d.ip |= 1 << i
+	}
+}
+
+// forward turns the pending and enabled sources of the domains in MSI mode
+// into MSIs to their targets' identities.
+func (a *Aplic) forward() {
+	for _, d := range []*aplicDomain{&a.m, &a.s} {
+		if !d.msiMode() || d.domaincfg&DOMAINCFG_IE == 0 {
+			continue
+		}
+		for ready := d.ip & d.ie & d.activeMask(); ready != 0; ready &= ready - 1 {
+			i := uint64(bits.TrailingZeros64(ready))
+			a.msis = append(a.msis, [2]uint64{d.msiAddr, d.target[i] & MASK_TARGET_EIID})
+			a.input &^= 1 << i
+			d.ip &^= 1 << i
+		}
+	}
+}
+
+// topi returns the highest-priority pending and enabled source of a domain in
+// direct mode, with its priority, as the IDC's topi register reports it.
+func (d *aplicDomain) topi() uint64 {
+	if d.msiMode() {
+		return 0
+	}
+	var top, prio uint64
+	for ready := d.ip & d.ie & d.activeMask(); ready != 0; ready &= ready - 1 {
+		i := uint64(bits.TrailingZeros64(ready))
+		p := d.target[i] & MASK_TARGET_IPRIO
+		if d.ithreshold != 0 && p >= d.ithreshold {
+			continue
+		}
+		if top == 0 || p < prio {
+			top, prio = i, p
+		}
+	}
+	if top == 0 {
+		return 0
+	}
+	return top<<16 | prio
+}
+
+// Pending reports whether a domain in direct mode signals an external
+// interrupt to the hart.
+func (d *aplicDomain) Pending() bool {
+	if d.msiMode() || d.domaincfg&DOMAINCFG_IE == 0 || d.idelivery == 0 {
+		return false
+	}
+	return d.iforce != 0 || d.topi() != 0
+}
+
+func (a *Aplic) Load(addr, size uint64) (uint64, *Exception) {
+	if size != 32 {
+		return 0, NewException(LoadAccessFault, addr)
+	}
+	d := a.domain(addr)
+	offset := addr % APLIC_SIZE
+	switch {
+	case offset == APLIC_DOMAINCFG:
+		return DOMAINCFG_RO | d.domaincfg, nil
+	case offset >= APLIC_SOURCECFG && offset < APLIC_SOURCECFG+4*(APLIC_SOURCES-1):
+		return d.sourcecfg[(offset-APLIC_SOURCECFG)/4+1], nil
+	case offset == APLIC_MMSIADDRCFG && d == &a.m:
+		return a.m.msiAddr / PAGE_SIZE & 0xffff_ffff, nil
+	case offset == APLIC_MMSIADDRCFGH && d == &a.m:
+		return a.mmsiaddrcfgh, nil
+	case offset == APLIC_SMSIADDRCFG && d == &a.m:
+		return a.s.msiAddr / PAGE_SIZE & 0xffff_ffff, nil
+	case offset == APLIC_SMSIADDRCFGH && d == &a.m:
+		return a.smsiaddrcfgh, nil
+	case offset >= APLIC_SETIP && offset < APLIC_SETIP+8:
+		return aplicWord(d.ip&d.activeMask(), offset-APLIC_SETIP), nil
+	case offset >= APLIC_IN_CLRIP && offset < APLIC_IN_CLRIP+8:
+		var in uint64
+		for i := uint64(1); i < APLIC_SOURCES; i++ {
+			if d.active(i) && a.rectified(d, i) {
+				in |= 1 << i
+			}
+		}
+		return aplicWord(in, offset-APLIC_IN_CLRIP), nil
+	case offset >= APLIC_SETIE && offset < APLIC_SETIE+8:
+		return aplicWord(d.ie&d.activeMask(), offset-APLIC_SETIE), nil
+	case offset >= APLIC_TARGET && offset < APLIC_TARGET+4*(APLIC_SOURCES-1):
+		return d.target[(offset-APLIC_TARGET)/4+1], nil
+	case offset == APLIC_IDELIVERY:
+		return d.idelivery, nil
+	case offset == APLIC_IFORCE:
+		return d.iforce, nil
+	case offset == APLIC_ITHRESHOLD:
+		return d.ithreshold, nil
+	case offset == APLIC_TOPI:
+		return d.topi(), nil
+	case offset == APLIC_CLAIMI:
+		return a.claim(d), nil
+	}
+	return 0, nil
+}
+
+// claim returns topi and clears the pending bit of the source it names. A
+// claim with nothing pending returns 0 and clears iforce.
+func (a *Aplic) claim(d *aplicDomain) uint64 {
+	topi := d.topi()
+	if topi == 0 {
+		d.iforce = 0
+		return 0
+	}
+	a.release(d, topi>>16)
+	return topi
+}
+
+func (a *Aplic) Store(addr, size, value uint64) *Exception {
+	if size != 32 {
+		return NewException(StoreAMOAccessFault, addr)
+	}
+	d := a.domain(addr)
+	offset := addr % APLIC_SIZE
+	value = uint64(uint32(value))
+	switch {
+	case offset == APLIC_DOMAINCFG:
+		d.domaincfg = value & (DOMAINCFG_IE | DOMAINCFG_DM)
+	case offset >= APLIC_SOURCECFG && offset < APLIC_SOURCECFG+4*(APLIC_SOURCES-1):
+		a.storeSourcecfg(d, (offset-APLIC_SOURCECFG)/4+1, value)
+	case offset == APLIC_MMSIADDRCFG && d == &a.m:
+		if a.mmsiaddrcfgh&MSIADDRCFGH_L == 0 {
+			a.m.msiAddr = (a.mmsiaddrcfgh&MASK_MSIADDRCFGH_PPN<<32 | value) * PAGE_SIZE
+		}
+	case offset == APLIC_MMSIADDRCFGH && d == &a.m:
+		if a.mmsiaddrcfgh&MSIADDRCFGH_L == 0 {
+			a.mmsiaddrcfgh = value & (MSIADDRCFGH_L | MASK_MSIADDRCFGH_PPN)
+			a.m.msiAddr = a.m.msiAddr&(0xffff_ffff*PAGE_SIZE) | value&MASK_MSIADDRCFGH_PPN<<32*PAGE_SIZE
+		}
+	case offset == APLIC_SMSIADDRCFG && d == &a.m:
+		if a.mmsiaddrcfgh&MSIADDRCFGH_L == 0 {
+			a.s.msiAddr = (a.smsiaddrcfgh&MASK_MSIADDRCFGH_PPN<<32 | value) * PAGE_SIZE
+		}
+	case offset == APLIC_SMSIADDRCFGH && d == &a.m:
+		if a.mmsiaddrcfgh&MSIADDRCFGH_L == 0 {
+			a.smsiaddrcfgh = value & MASK_MSIADDRCFGH_PPN
+			a.s.msiAddr = a.s.msiAddr&(0xffff_ffff*PAGE_SIZE) | value&MASK_MSIADDRCFGH_PPN<<32*PAGE_SIZE
+		}
+	case offset >= APLIC_SETIP && offset < APLIC_SETIP+8:
+		for bitsSet := value; bitsSet != 0; bitsSet &= bitsSet - 1 {
+			a.setPending(d, (offset-APLIC_SETIP)*8+uint64(bits.TrailingZeros64(bitsSet)))
+		}
+	case offset == APLIC_SETIPNUM:
+		a.setPending(d, value)
+	case offset >= APLIC_IN_CLRIP && offset < APLIC_IN_CLRIP+8:
+		for bitsSet := value; bitsSet != 0; bitsSet &= bitsSet - 1 {
+			a.clearPending(d, (offset-APLIC_IN_CLRIP)*8+uint64(bits.TrailingZeros64(bitsSet)))
+		}
+	case offset == APLIC_CLRIPNUM:
+		a.clearPending(d, value)
+	case offset >= APLIC_SETIE && offset < APLIC_SETIE+8:
+		d.ie |= value << ((offset - APLIC_SETIE) * 8) & d.activeMask()
+	case offset == APLIC_SETIENUM:
+		if d.active(value) {
+			d.ie |= 1 << value
+		}
+	case offset >= APLIC_CLRIE && offset < APLIC_CLRIE+8:
+		d.ie &^= value << ((offset - APLIC_CLRIE) * 8)
+	case offset == APLIC_CLRIENUM:
+		if value < APLIC_SOURCES {
+			d.ie &^= 1 << value
+		}
+	case offset == APLIC_SETIPNUM_LE:
+		a.setPending(d, value)
+	case offset == APLIC_SETIPNUM_BE:
+		a.setPending(d, uint64(bits.ReverseBytes32(uint32(value))))
+	case offset == APLIC_GENMSI:
+		if d.msiMode() {
+			a.msis = append(a.msis, [2]uint64{d.msiAddr, value & MASK_TARGET_EIID})
+		}
+	case offset >= APLIC_TARGET && offset < APLIC_TARGET+4*(APLIC_SOURCES-1):
+		i := (offset-APLIC_TARGET)/4 + 1
+		switch {
+		case !d.active(i):
+		case d.msiMode():
+			d.target[i] = value & MASK_TARGET_EIID
+		case value&MASK_TARGET_IPRIO == 0:
+			// Priority 0 is not allowed and reads back as 1.
+			d.target[i] = 1
+		default:
+			d.target[i] = value & MASK_TARGET_IPRIO
+		}
+	case offset == APLIC_IDELIVERY:
+		d.idelivery = value & 1
+	case offset == APLIC_IFORCE:
+		d.iforce = value & 1
+	case offset == APLIC_ITHRESHOLD:
+		d.ithreshold = value & MASK_TARGET_IPRIO
+	}
+	a.forward()
+	return nil
+}
+
+// storeSourcecfg writes sourcecfg[i] of domain d. Only the root domain may
+// delegate, and the child domain may only configure the sources delegated to
+// it. Reserved source modes make the source inactive.
+func (a *Aplic) storeSourcecfg(d *aplicDomain, i, value uint64) {
+	if d == &a.s && a.m.sourcecfg[i]&SOURCECFG_D == 0 {
+		return
+	}
+	switch {
+	case value&SOURCECFG_D != 0 && d == &a.m:
+		// Delegate to child domain 0, the S-level domain.
+		value = SOURCECFG_D
+	case value&SOURCECFG_D != 0:
+		value = 0
+	default:
+		switch value & MASK_SOURCECFG_SM {
+		case APLIC_SM_INACTIVE, APLIC_SM_DETACHED, APLIC_SM_EDGE1, APLIC_SM_EDGE0, APLIC_SM_LEVEL1, APLIC_SM_LEVEL0:
+			value &= MASK_SOURCECFG_SM
+		default:
+			value = 0
+		}
+	}
+	if d == &a.m && value&SOURCECFG_D == 0 && a.m.sourcecfg[i]&SOURCECFG_D != 0 {
+		// Taking a source back leaves it inactive in the child domain.
+		a.s.sourcecfg[i], a.s.target[i] = 0, 0
+		a.s.ip &^= 1 << i
+		a.s.ie &^= 1 << i
+	}
+	d.sourcecfg[i] = value
+	if !d.active(i) {
+		d.target[i] = 0
+		d.ip &^= 1 << i
+		d.ie &^= 1 << i
+	} else if !d.msiMode() && d.target[i] == 0 {
+		d.target[i] = 1
+	}
+	if d.active(i) && d.level(i) && a.rectified(d, i) {
+		d.ip |= 1 << i
+	}
+}
+
+// aplicWord returns the 32 bits of a source bitmap that the register at
+// offset 0 or 4 of an array holds.
+func aplicWord(bitmap, offset uint64) uint64 {
+	return (bitmap >> (offset * 8)) & 0xffff_ffff
+}
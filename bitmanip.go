@@ -0,0 +1,64 @@
+package main
+
+// clmul returns the low half of the carry-less product of a and b.
+func clmul(a, b uint64) uint64 {
+	var x uint64
+	for i := 0; i < 64; i++ {
+		if (b>>i)&1 == 1 {
+			x ^= a << i
+		}
+	}
+	return x
+}
+
+// clmulh returns the high half of the carry-less product of a and b.
+func clmulh(a, b uint64) uint64 {
+	var x uint64
+	for i := 1; i < 64; i++ {
+		if (b>>i)&1 == 1 {
+			x ^= a >> (64 - i)
+		}
+	}
+	return x
+}
+
+// clmulr returns bits 126:63 of the carry-less product of a and b.
+func clmulr(a, b uint64) uint64 {
+	var x uint64
+	for i := 0; i < 64; i++ {
+		if (b>>i)&1 == 1 {
+			x ^= a >> (63 - i)
+		}
+	}
+	return x
+}
+
+// orcb sets every byte of v that has any bit set to 0xff.
+func orcb(v uint64) uint64 {
+	var x uint64
+	for i := 0; i < 64; i += 8 {
+		if (v>>i)&0xff != 0 {
+			x |= 0xff << i
+		}
+	}
+	return x
+}
+
+// zip interleaves the low and high halves of v: bit i goes to bit 2i and bit
+// 16+i to bit 2i+1.
+func zip(v uint32) uint32 {
+	var x uint32
+	for i := 0; i < 16; i++ {
+		x |= (v>>i)&1<<(2*i) | (v>>(16+i))&1<<(2*i+1)
+	}
+	return x
+}
+
+// unzip is the inverse of zip.
+func unzip(v uint32) uint32 {
+	var x uint32
+	for i := 0; i < 16; i++ {
+		x |= (v>>(2*i))&1<<i | (v>>(2*i+1))&1<<(16+i)
+	}
+	return x
+}
@@ -6,6 +6,10 @@ type Bus struct {
 	clint       Clint
 	uart        Uart
 	virtioBlock VirtioBlock
+	// aia replaces the PLIC with the APLIC and maps the IMSIC.
+	aia   bool
+	aplic Aplic
+	imsic Imsic
 }
 
 func NewBus(code []uint8, diskImage []uint8) Bus {
@@ -15,6 +19,8 @@ func NewBus(code []uint8, diskImage []uint8) Bus {
 		clint:       NewClint(),
 		uart:        NewUart(),
 		virtioBlock: NewVirtioBlock(diskImage),
+		aplic:       NewAplic(),
+		imsic:       NewImsic(),
 	}
 }
 
@@ -22,6 +28,10 @@ func (b *Bus) Load(addr, size uint64) (uint64, *Exception) {
 	switch {
 	case addr >= CLINT_BASE && addr <= CLINT_END:
 		return b.clint.Load(addr, size)
+	case b.aia && isAplic(addr):
+		return b.aplic.Load(addr, size)
+	case b.aia && isImsic(addr):
+		return b.imsic.Load(addr, size)
 	case addr >= PLIC_BASE && addr <= PLIC_END:
 		return b.plic.Load(addr, size)
 	case addr >= DRAM_BASE && addr <= DRAM_END:
@@ -38,6 +48,12 @@ func (b *Bus) Store(addr, size, value uint64) *Exception {
 	switch {
 	case addr >= CLINT_BASE && addr <= CLINT_END:
 		return b.clint.Store(addr, size, value)
+	case b.aia && isAplic(addr):
+		exception := b.aplic.Store(addr, size, value)
+		b.deliverMSIs()
+		return exception
+	case b.aia && isImsic(addr):
+		return b.imsic.Store(addr, size, value)
 	case addr >= PLIC_BASE && addr <= PLIC_END:
 		return b.plic.Store(addr, size, value)
 	case addr >= DRAM_BASE && addr <= DRAM_END:
@@ -49,3 +65,29 @@ func (b *Bus) Store(addr, size, value uint64) *Exception {
 	}
 	return NewException(StoreAMOAccessFault, addr)
 }
+
+func isAplic(addr uint64) bool {
+	return addr >= APLIC_M_BASE && addr < APLIC_M_BASE+APLIC_SIZE ||
+		addr >= APLIC_S_BASE && addr < APLIC_S_BASE+APLIC_SIZE
+}
+
+func isImsic(addr uint64) bool {
+	return addr >= IMSIC_M_BASE && addr < IMSIC_M_BASE+IMSIC_SIZE ||
+		addr >= IMSIC_S_BASE && addr <= IMSIC_END
+}
+
+// Interrupt signals an interrupt from the device wired to APLIC source irq.
+func (b *Bus) Interrupt(irq uint64) {
+	b.aplic.Interrupt(irq)
+	b.deliverMSIs()
+}
+
+// deliverMSIs writes the MSIs the APLIC has forwarded. Like any other bus
+// write, one to an address without an IMSIC is dropped.
+func (b *Bus) deliverMSIs() {
+	msis := b.aplic.msis
+	b.aplic.msis = nil
+	for _, msi := range msis {
+		b.Store(msi[0], 32, msi[1])
+	}
+}
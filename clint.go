@@ -9,6 +9,11 @@ func NewClint() Clint {
 	return Clint{}
 }
 
+// Tick advances mtime by one timer tick.
+func (c *Clint) Tick() {
+	c.mtime++
+}
+
 func (c *Clint) Load(addr, size uint64) (uint64, *Exception) {
 	if size != 64 {
 		return 0, NewException(LoadAccessFault, addr)
@@ -0,0 +1,103 @@
+package main
+
+import "fmt"
+
+// SetCacheBlockSize sets the cache-block size in bytes used by the CMO
+// instructions.
+func (cpu *Cpu) SetCacheBlockSize(size uint64) error {
+	if size < 8 || size > PAGE_SIZE || size&(size-1) != 0 {
+		return fmt.Errorf("invalid cache-block size %d: must be a power of two from 8 to %d", size, PAGE_SIZE)
+	}
+	cpu.CacheBlockSize = size
+	return nil
+}
+
+// checkCBOEnable returns the exception raised by a cache-block operation
+// enabled by field in menvcfg, henvcfg and senvcfg, or nil. Each level gates
+// the ones below it.
+func (cpu *Cpu) checkCBOEnable(inst, field uint64) *Exception {
+	if cpu.Mode == Machine {
+		return nil
+	}
+	if cpu.Csr.Load(MENVCFG)&field == 0 {
+		return NewException(IllegalInstruction, inst)
+	}
+	senvcfg := cpu.Csr.Load(SENVCFG)
+	if cpu.Csr.V {
+		if cpu.Csr.Load(HENVCFG)&field == 0 || (cpu.Mode == User && senvcfg&field == 0) {
+			return NewException(VirtualInstruction, inst)
+		}
+	} else if cpu.Mode == User && senvcfg&field == 0 {
+		return NewException(IllegalInstruction, inst)
+	}
+	return nil
+}
+
+// ExecuteCacheBlock executes the Zicbom and Zicboz instructions on the cache
+// block holding the address in rs1. Caches are not modelled, so memory is
+// always coherent and clean, flush and inval only check the access.
+func (cpu *Cpu) ExecuteCacheBlock(inst uint64) (uint64, *Exception) {
+	rd := (inst >> 7) & 0x1f
+	rs1 := (inst >> 15) & 0x1f
+	funct12 := inst >> 20
+
+	if rd != 0 {
+		return 0, NewException(IllegalInstruction, inst)
+	}
+	var field uint64
+	switch {
+	case funct12 == 0x0 && cpu.Ext.Zicbom:
+		// cbo.inval; with CBIE = 01 it flushes instead, which is the same
+		// here.
+		field = ENVCFG_CBIE
+	case (funct12 == 0x1 || funct12 == 0x2) && cpu.Ext.Zicbom:
+		// cbo.clean, cbo.flush
+		field = ENVCFG_CBCFE
+	case funct12 == 0x4 && cpu.Ext.Zicboz:
+		// cbo.zero
+		field = ENVCFG_CBZE
+	default:
+		return 0, NewException(IllegalInstruction, inst)
+	}
+	if exception := cpu.checkCBOEnable(inst, field); exception != nil {
+		return 0, exception
+	}
+
+	addr := cpu.Regs[rs1]
+	size := cpu.CacheBlockSize
+	if funct12 == 0x4 {
+		pAddr, exception := cpu.Translate(addr, Store)
+		if exception != nil {
+			return 0, exception
+		}
+		block := pAddr &^ (size - 1)
+		if exception := cpu.CheckPMP(addr, block, size*8, Store); exception != nil {
+			return 0, exception
+		}
+		if cpu.Reservation.Overlaps(block, size*8) {
+			cpu.Reservation.Clear()
+		}
+		for off := uint64(0); off < size; off += 8 {
+			if exception := cpu.Bus.Store(block+off, 64, 0); exception != nil {
+				return 0, NewException(StoreAMOAccessFault, addr)
+			}
+		}
+		return cpu.UpdatePC()
+	}
+
+	// Management operations need load or store permission, and report
+	// faults as store faults.
+	pAddr, exception := cpu.Translate(addr, Load)
+	if exception != nil {
+		pAddr, exception = cpu.Translate(addr, Store)
+		if exception != nil {
+			return 0, exception
+		}
+	}
+	block := pAddr &^ (size - 1)
+	mode := cpu.TranslationMode(Store)
+	if !cpu.Csr.PMPAllows(block, size*8, Load, mode) && !cpu.Csr.PMPAllows(block, size*8, Store, mode) {
+		return 0, NewException(StoreAMOAccessFault, addr)
+	}
+	return cpu.UpdatePC()
+}
@@ -6,6 +6,21 @@ const (
 	DRAM_END  = DRAM_BASE + DRAM_SIZE - 1
 
 	CSRS_NUM = 4096
+
+	// Vector register length in bits unless configured otherwise, and the
+	// widest supported vector element.
+	DEFAULT_VLEN = 128
+	ELEN         = 64
+
+	// Cache-block size in bytes for the CMO instructions unless configured
+	// otherwise.
+	DEFAULT_CACHE_BLOCK_SIZE = 64
+
+	// Major opcodes reserved for custom instructions.
+	OPCODE_CUSTOM_0 = 0x0b
+	OPCODE_CUSTOM_1 = 0x2b
+	OPCODE_CUSTOM_2 = 0x5b
+	OPCODE_CUSTOM_3 = 0x7b
 )
 
 // CLINT
@@ -30,6 +45,76 @@ const (
 	PLIC_SCLAIM    = PLIC_BASE + 0x201004
 )
 
+// APLIC, which replaces the PLIC with AIA: the M-level root domain sits at
+// the PLIC's address and its S-level child domain after it.
+const (
+	APLIC_M_BASE = 0xc000000
+	APLIC_S_BASE = 0xd000000
+	APLIC_SIZE   = 0x8000
+	// Interrupt sources 1-63.
+	APLIC_SOURCES = 64
+
+	// Register offsets within a domain.
+	APLIC_DOMAINCFG    = 0x0000
+	APLIC_SOURCECFG    = 0x0004
+	APLIC_MMSIADDRCFG  = 0x1bc0
+	APLIC_MMSIADDRCFGH = 0x1bc4
+	APLIC_SMSIADDRCFG  = 0x1bc8
+	APLIC_SMSIADDRCFGH = 0x1bcc
+	APLIC_SETIP        = 0x1c00
+	APLIC_SETIPNUM     = 0x1cdc
+	APLIC_IN_CLRIP     = 0x1d00
+	APLIC_CLRIPNUM     = 0x1ddc
+	APLIC_SETIE        = 0x1e00
+	APLIC_SETIENUM     = 0x1edc
+	APLIC_CLRIE        = 0x1f00
+	APLIC_CLRIENUM     = 0x1fdc
+	APLIC_SETIPNUM_LE  = 0x2000
+	APLIC_SETIPNUM_BE  = 0x2004
+	APLIC_GENMSI       = 0x3000
+	APLIC_TARGET       = 0x3004
+	// Interrupt delivery control of hart 0, for direct delivery.
+	APLIC_IDELIVERY  = 0x4000
+	APLIC_IFORCE     = 0x4004
+	APLIC_ITHRESHOLD = 0x4008
+	APLIC_TOPI       = 0x4018
+	APLIC_CLAIMI     = 0x401c
+
+	// domaincfg fields; bits 31:24 read as 0x80.
+	DOMAINCFG_IE = 1 << 8
+	DOMAINCFG_DM = 1 << 2
+	DOMAINCFG_RO = 0x80 << 24
+	// sourcecfg: D delegates the source to the child domain, otherwise SM is
+	// the source mode.
+	SOURCECFG_D       = 1 << 10
+	MASK_SOURCECFG_SM = 0b111
+	APLIC_SM_INACTIVE = 0
+	APLIC_SM_DETACHED = 1
+	APLIC_SM_EDGE1    = 4
+	APLIC_SM_EDGE0    = 5
+	APLIC_SM_LEVEL1   = 6
+	APLIC_SM_LEVEL0   = 7
+	// target: the priority for direct delivery, the EIID for MSIs.
+	MASK_TARGET_IPRIO = 0xff
+	MASK_TARGET_EIID  = 0x7ff
+	// msiaddrcfgh: the lock bit and bits 43:32 of the IMSIC page number.
+	MSIADDRCFGH_L        = 1 << 31
+	MASK_MSIADDRCFGH_PPN = 0xfff
+)
+
+// IMSIC interrupt files of hart 0.
+const (
+	IMSIC_M_BASE = 0x24000000
+	IMSIC_S_BASE = 0x28000000
+	IMSIC_SIZE   = 0x1000
+	IMSIC_END    = IMSIC_S_BASE + IMSIC_SIZE - 1
+
+	IMSIC_SETEIPNUM_LE = 0x0
+	IMSIC_SETEIPNUM_BE = 0x4
+	// Interrupt identities 1-255.
+	IMSIC_IDS = 256
+)
+
 // UART
 const (
 	UART_BASE = 0x1000_0000
@@ -62,9 +147,62 @@ const (
 
 // CSR and MASK
 const (
+	// Unprivileged floating-point CSRs.
+	/// Floating-point accrued exceptions.
+	FFLAGS = 0x001
+	/// Floating-point dynamic rounding mode.
+	FRM = 0x002
+	/// Floating-point control and status register (frm + fflags).
+	FCSR = 0x003
+
+	// Unprivileged vector CSRs.
+	/// Vector start position.
+	VSTART = 0x008
+	/// Fixed-point accrued saturation flag.
+	VXSAT = 0x009
+	/// Fixed-point rounding mode.
+	VXRM = 0x00a
+	/// Vector control and status register (vxrm + vxsat).
+	VCSR = 0x00f
+
+	// Unprivileged entropy source CSR.
+	/// Seed for cryptographic random bit generators.
+	SEED = 0x015
+	/// Vector length.
+	VL = 0xc20
+	/// Vector data type register.
+	VTYPE = 0xc21
+	/// VLEN/8 (vector register length in bytes).
+	VLENB = 0xc22
+
+	// Unprivileged counters/timers.
+	/// Cycle counter for RDCYCLE instruction.
+	CYCLE = 0xc00
+	/// Timer for RDTIME instruction.
+	TIME = 0xc01
+	/// Instructions-retired counter for RDINSTRET instruction.
+	INSTRET = 0xc02
+	/// Performance-monitoring counters.
+	HPMCOUNTER3  = 0xc03
+	HPMCOUNTER31 = 0xc1f
+	/// Upper 32 bits of cycle, time, instret and hpmcounter3-31, RV32 only.
+	CYCLEH        = 0xc80
+	HPMCOUNTER31H = 0xc9f
+
+	/// Vendor ID.
+	MVENDORID = 0xf11
+	/// Architecture ID.
+	MARCHID = 0xf12
+	/// Implementation ID.
+	MIMPID = 0xf13
+	/// Hardware thread ID.
 	MHARTID = 0xf14
+	/// Pointer to the configuration data structure.
+	MCONFIGPTR = 0xf15
 	/// Machine status register.
 	MSTATUS = 0x300
+	/// ISA and extensions.
+	MISA = 0x301
 	/// Machine exception delefation register.
 	MEDELEG = 0x302
 	/// Machine interrupt delefation register.
@@ -75,6 +213,20 @@ const (
 	MTVEC = 0x305
 	/// Machine counter enable.
 	MCOUNTEREN = 0x306
+	/// Machine environment configuration register.
+	MENVCFG = 0x30a
+	/// Upper 32 bits of mstatus, RV32 only.
+	MSTATUSH = 0x310
+	/// Upper 32 bits of menvcfg, RV32 only.
+	MENVCFGH = 0x31a
+	/// Machine counter-inhibit register.
+	MCOUNTINHIBIT = 0x320
+	/// Machine performance-monitoring event selectors.
+	MHPMEVENT3  = 0x323
+	MHPMEVENT31 = 0x33f
+	/// Upper 32 bits of mhpmevent3-31, RV32 only (Sscofpmf).
+	MHPMEVENT3H  = 0x723
+	MHPMEVENT31H = 0x73f
 	/// Scratch register for machine trap handlers.
 	MSCRATCH = 0x340
 	/// Machine exception program counter.
@@ -85,6 +237,47 @@ const (
 	MTVAL = 0x343
 	/// Machine interrupt pending.
 	MIP = 0x344
+	/// Physical memory protection configuration; only the even registers
+	/// exist on RV64.
+	PMPCFG0  = 0x3a0
+	PMPCFG14 = 0x3ae
+	/// Physical memory protection address registers.
+	PMPADDR0  = 0x3b0
+	PMPADDR1  = 0x3b1
+	PMPADDR2  = 0x3b2
+	PMPADDR63 = 0x3ef
+	/// Machine indirect register select (Smaia).
+	MISELECT = 0x350
+	/// Machine indirect register alias.
+	MIREG = 0x351
+	/// Machine top external interrupt.
+	MTOPEI = 0x35c
+	/// Machine top interrupt.
+	MTOPI = 0xfb0
+	/// Machine security configuration (Smepmp).
+	MSECCFG = 0x747
+	/// Upper 32 bits of mseccfg, RV32 only.
+	MSECCFGH = 0x757
+	/// Debug/trace trigger register select.
+	TSELECT = 0x7a0
+	/// Debug/trace trigger data registers of the selected trigger.
+	TDATA1 = 0x7a1
+	TDATA2 = 0x7a2
+	TDATA3 = 0x7a3
+	/// Trigger types supported by the selected trigger.
+	TINFO = 0x7a4
+	/// Trigger control.
+	TCONTROL = 0x7a5
+	/// Machine cycle counter.
+	MCYCLE = 0xb00
+	/// Machine instructions-retired counter.
+	MINSTRET = 0xb02
+	/// Machine performance-monitoring counters.
+	MHPMCOUNTER3  = 0xb03
+	MHPMCOUNTER31 = 0xb1f
+	/// Upper 32 bits of mcycle, minstret and mhpmcounter3-31, RV32 only.
+	MCYCLEH        = 0xb80
+	MHPMCOUNTER31H = 0xb9f
 
 	// Supervisor-level CSRs.
 	/// Supervisor status register.
@@ -93,6 +286,10 @@ const (
 	SIE = 0x104
 	/// Supervisor trap handler base address.
 	STVEC = 0x105
+	/// Supervisor counter enable.
+	SCOUNTEREN = 0x106
+	/// Supervisor environment configuration register.
+	SENVCFG = 0x10a
 	/// Scratch register for supervisor trap handlers.
 	SSCRATCH = 0x140
 	/// Supervisor exception program counter.
@@ -105,6 +302,77 @@ const (
 	SIP = 0x144
 	/// Supervisor address translation and protection.
 	SATP = 0x180
+	/// Supervisor indirect register select (Ssaia).
+	SISELECT = 0x150
+	/// Supervisor indirect register alias.
+	SIREG = 0x151
+	/// Supervisor top external interrupt.
+	STOPEI = 0x15c
+	/// Supervisor top interrupt.
+	STOPI = 0xdb0
+	/// Supervisor count overflow (Sscofpmf).
+	SCOUNTOVF = 0xda0
+	/// Supervisor timer compare (Sstc).
+	STIMECMP = 0x14d
+	/// Upper 32 bits of stimecmp, RV32 only.
+	STIMECMPH = 0x15d
+
+	// Hypervisor CSRs.
+	/// Hypervisor status register.
+	HSTATUS = 0x600
+	/// Hypervisor exception delegation register.
+	HEDELEG = 0x602
+	/// Hypervisor interrupt delegation register.
+	HIDELEG = 0x603
+	/// Hypervisor interrupt-enable register.
+	HIE = 0x604
+	/// Delta for VS/VU-mode timer.
+	HTIMEDELTA = 0x605
+	/// Hypervisor counter enable.
+	HCOUNTEREN = 0x606
+	/// Hypervisor guest external interrupt-enable register.
+	HGEIE = 0x607
+	/// Hypervisor environment configuration register.
+	HENVCFG = 0x60a
+	/// Hypervisor bad guest physical address.
+	HTVAL = 0x643
+	/// Hypervisor interrupt pending.
+	HIP = 0x644
+	/// Hypervisor virtual interrupt pending.
+	HVIP = 0x645
+	/// Hypervisor trap instruction (transformed).
+	HTINST = 0x64a
+	/// Hypervisor guest address translation and protection.
+	HGATP = 0x680
+	/// Hypervisor guest external interrupt pending.
+	HGEIP = 0xe12
+	/// Machine trap instruction (transformed).
+	MTINST = 0x34a
+	/// Machine bad guest physical address.
+	MTVAL2 = 0x34b
+
+	// Virtual supervisor CSRs, which stand in for the supervisor CSRs while
+	// V=1.
+	/// Virtual supervisor status register.
+	VSSTATUS = 0x200
+	/// Virtual supervisor interrupt-enable register.
+	VSIE = 0x204
+	/// Virtual supervisor trap handler base address.
+	VSTVEC = 0x205
+	/// Virtual supervisor scratch register.
+	VSSCRATCH = 0x240
+	/// Virtual supervisor exception program counter.
+	VSEPC = 0x241
+	/// Virtual supervisor trap cause.
+	VSCAUSE = 0x242
+	/// Virtual supervisor bad address or instruction.
+	VSTVAL = 0x243
+	/// Virtual supervisor interrupt pending.
+	VSIP = 0x244
+	/// Virtual supervisor timer compare.
+	VSTIMECMP = 0x24d
+	/// Virtual supervisor address translation and protection.
+	VSATP = 0x280
 
 	// mstatus and sstatus field mask
 	MASK_SIE     = 1 << 1
@@ -127,9 +395,19 @@ const (
 	MASK_SXL     = 0b11 << 34
 	MASK_SBE     = 1 << 36
 	MASK_MBE     = 1 << 37
+	MASK_GVA     = 1 << 38
+	MASK_MPV     = 1 << 39
 	MASK_SD      = 1 << 63
-	MASK_SSTATUS = MASK_SIE | MASK_SPIE | MASK_UBE | MASK_SPP | MASK_FS |
+	MASK_SSTATUS = MASK_SIE | MASK_SPIE | MASK_UBE | MASK_SPP | MASK_VS | MASK_FS |
 		MASK_XS | MASK_SUM | MASK_MXR | MASK_UXL | MASK_SD
+	// Fields software can write; XS, UXL, SXL and the endianness bits are
+	// fixed, and SD is computed.
+	MASK_MSTATUS_WRITABLE = MASK_SIE | MASK_MIE | MASK_SPIE | MASK_MPIE | MASK_SPP | MASK_VS |
+		MASK_MPP | MASK_FS | MASK_MPRV | MASK_SUM | MASK_MXR | MASK_TVM | MASK_TW | MASK_TSR |
+		MASK_GVA | MASK_MPV
+	// UXL and SXL encodings of a 32-bit and a 64-bit XLEN.
+	XL_32 = 1
+	XL_64 = 2
 
 	// MIP / SIP field mask
 	MASK_SSIP = 1 << 1
@@ -138,8 +416,247 @@ const (
 	MASK_MTIP = 1 << 7
 	MASK_SEIP = 1 << 9
 	MASK_MEIP = 1 << 11
+	// Hypervisor interrupts in MIP / HIP
+	MASK_VSSIP  = 1 << 2
+	MASK_VSTIP  = 1 << 6
+	MASK_VSEIP  = 1 << 10
+	MASK_SGEIP  = 1 << 12
+	MASK_VS_INT = MASK_VSSIP | MASK_VSTIP | MASK_VSEIP
+	// Local counter-overflow interrupt (Sscofpmf)
+	MASK_LCOFIP = 1 << 13
+	// Interrupts that exist, and those software may set or clear in mip.
+	MASK_MIE_WRITABLE = MASK_SSIP | MASK_MSIP | MASK_STIP | MASK_MTIP | MASK_SEIP | MASK_MEIP |
+		MASK_VS_INT | MASK_SGEIP | MASK_LCOFIP
+	MASK_MIP_WRITABLE = MASK_SSIP | MASK_STIP | MASK_SEIP | MASK_VSSIP | MASK_LCOFIP
+	// Only supervisor interrupts can be delegated; the VS-level and guest
+	// external interrupts always are.
+	MASK_MIDELEG_WRITABLE = MASK_SSIP | MASK_STIP | MASK_SEIP | MASK_LCOFIP
+	MASK_MIDELEG_FORCED   = MASK_VS_INT | MASK_SGEIP
+	// Every exception but environment calls from M-mode can be delegated.
+	MASK_MEDELEG_WRITABLE = 0xb3ff | 1<<10 | 0xf<<20
+	// HS-mode cannot pass on its own environment calls, environment calls
+	// from VS-mode, guest-page faults or virtual-instruction exceptions.
+	MASK_HEDELEG_WRITABLE = 0xb1ff
+	MASK_HIDELEG_WRITABLE = MASK_VS_INT
+
+	// hstatus fields
+	MASK_HSTATUS_GVA  = 1 << 6
+	MASK_HSTATUS_SPV  = 1 << 7
+	MASK_HSTATUS_SPVP = 1 << 8
+	MASK_HSTATUS_HU   = 1 << 9
+	MASK_VTVM         = 1 << 20
+	MASK_VTW          = 1 << 21
+	MASK_VTSR         = 1 << 22
+	MASK_VSXL         = 0b11 << 32
+	// VSBE and VGEIN are read-only zero and VSXL is fixed.
+	MASK_HSTATUS_WRITABLE = MASK_HSTATUS_GVA | MASK_HSTATUS_SPV | MASK_HSTATUS_SPVP |
+		MASK_HSTATUS_HU | MASK_VTVM | MASK_VTW | MASK_VTSR
 
 	MASK_PPN = (1 << 44) - 1
+	// hgatp.VMID, 14 bits wide.
+	MASK_VMID = ((1 << 14) - 1) << 44
+
+	// satp modes
+	SATP_MODE_BARE = 0
+	SATP_MODE_SV32 = 1
+	SATP_MODE_SV39 = 8
+	SATP_MODE_SV48 = 9
+	SATP_MODE_SV57 = 10
+
+	// menvcfg/senvcfg fields
+	ENVCFG_FIOM   = 1 << 0
+	ENVCFG_CBIE   = 0b11 << 4
+	ENVCFG_CBCFE  = 1 << 6
+	ENVCFG_CBZE   = 1 << 7
+	MENVCFG_ADUE  = 1 << 61
+	MENVCFG_PBMTE = 1 << 62
+	MENVCFG_STCE  = 1 << 63
+	// Fields with an effect; the rest are read-only zero.
+	MASK_ENVCFG_CBO       = ENVCFG_CBIE | ENVCFG_CBCFE | ENVCFG_CBZE
+	MASK_MENVCFG_WRITABLE = ENVCFG_FIOM | MASK_ENVCFG_CBO | MENVCFG_ADUE | MENVCFG_PBMTE | MENVCFG_STCE
+	MASK_HENVCFG_WRITABLE = ENVCFG_FIOM | MASK_ENVCFG_CBO | MENVCFG_ADUE | MENVCFG_PBMTE | MENVCFG_STCE
+	MASK_SENVCFG_WRITABLE = ENVCFG_FIOM | MASK_ENVCFG_CBO
+
+	// page table entry flags
+	PTE_V = 1 << 0
+	PTE_R = 1 << 1
+	PTE_W = 1 << 2
+	PTE_X = 1 << 3
+	PTE_U = 1 << 4
+	PTE_G = 1 << 5
+	PTE_A = 1 << 6
+	PTE_D = 1 << 7
+	// Svpbmt memory type, and the Svnapot bit marking a 64 KiB page.
+	MASK_PTE_PBMT = 0b11 << 61
+	PTE_N         = 1 << 63
+	// Bits 60:54 are reserved in leaf and non-leaf PTEs alike.
+	MASK_PTE_RESERVED = 0x7f << 54
+
+	// Svpbmt memory types; the fourth encoding is reserved.
+	PBMT_PMA      = 0
+	PBMT_NC       = 1
+	PBMT_IO       = 2
+	PBMT_RESERVED = 3
+
+	// pmpcfg fields
+	PMP_R     = 1 << 0
+	PMP_W     = 1 << 1
+	PMP_X     = 1 << 2
+	MASK_PMPA = 0b11 << 3
+	PMP_L     = 1 << 7
+	// pmpcfg.A address-matching modes
+	PMP_A_OFF   = 0
+	PMP_A_TOR   = 1
+	PMP_A_NA4   = 2
+	PMP_A_NAPOT = 3
+	PMP_ENTRIES = 64
+	// pmpaddr holds bits 55:2 of a physical address.
+	MASK_PMPADDR = (1 << 54) - 1
+
+	// mseccfg fields
+	MSECCFG_MML  = 1 << 0
+	MSECCFG_MMWP = 1 << 1
+	MSECCFG_RLB  = 1 << 2
+	// Zkr: access to seed from U-mode and S-mode.
+	MSECCFG_USEED = 1 << 8
+	MSECCFG_SSEED = 1 << 9
+
+	// seed fields: OPST in bits 31:30 and the entropy in bits 15:0.
+	SEED_OPST_ES16 = 0b10 << 30
+	SEED_OPST_DEAD = 0b11 << 30
+
+	// Sdtrig trigger module: the number of triggers and the tdata1 types.
+	TRIGGER_COUNT     = 4
+	TRIGGER_ICOUNT    = 3
+	TRIGGER_ITRIGGER  = 4
+	TRIGGER_ETRIGGER  = 5
+	TRIGGER_MCONTROL6 = 6
+	TRIGGER_DISABLED  = 15
+	// tinfo: Sdtrig version 1.0 and the supported types.
+	TINFO_VERSION_1 = 1 << 24
+	MASK_TINFO_INFO = 1<<TRIGGER_ICOUNT | 1<<TRIGGER_ITRIGGER | 1<<TRIGGER_ETRIGGER |
+		1<<TRIGGER_MCONTROL6 | 1<<TRIGGER_DISABLED
+	// tcontrol fields
+	TCONTROL_MTE  = 1 << 3
+	TCONTROL_MPTE = 1 << 7
+	// mcontrol6 fields
+	MCONTROL6_LOAD       = 1 << 0
+	MCONTROL6_STORE      = 1 << 1
+	MCONTROL6_EXECUTE    = 1 << 2
+	MCONTROL6_U          = 1 << 3
+	MCONTROL6_S          = 1 << 4
+	MCONTROL6_M          = 1 << 6
+	MASK_MCONTROL6_MATCH = 0xf << 7
+	MCONTROL6_CHAIN      = 1 << 11
+	MCONTROL6_SELECT     = 1 << 21
+	MCONTROL6_HIT0       = 1 << 22
+	MCONTROL6_VU         = 1 << 23
+	MCONTROL6_VS         = 1 << 24
+	// icount fields
+	ICOUNT_U          = 1 << 6
+	ICOUNT_S          = 1 << 7
+	ICOUNT_PENDING    = 1 << 8
+	ICOUNT_M          = 1 << 9
+	MASK_ICOUNT_COUNT = 0x3fff << 10
+	ICOUNT_HIT        = 1 << 24
+	ICOUNT_VU         = 1 << 25
+	ICOUNT_VS         = 1 << 26
+	// itrigger and etrigger fields
+	XTRIGGER_U   = 1 << 6
+	XTRIGGER_S   = 1 << 7
+	XTRIGGER_M   = 1 << 9
+	XTRIGGER_VU  = 1 << 11
+	XTRIGGER_VS  = 1 << 12
+	XTRIGGER_HIT = 1 << 58
+	// Fields with an effect; action is fixed at 0, a breakpoint exception,
+	// since there is no debug mode, and mcontrol6.size at 0, any size.
+	MASK_MCONTROL6_WRITABLE = MCONTROL6_LOAD | MCONTROL6_STORE | MCONTROL6_EXECUTE | MCONTROL6_U |
+		MCONTROL6_S | MCONTROL6_M | MASK_MCONTROL6_MATCH | MCONTROL6_CHAIN | MCONTROL6_SELECT |
+		MCONTROL6_HIT0 | MCONTROL6_VU | MCONTROL6_VS
+	MASK_ICOUNT_WRITABLE = ICOUNT_U | ICOUNT_S | ICOUNT_PENDING | ICOUNT_M | MASK_ICOUNT_COUNT |
+		ICOUNT_HIT | ICOUNT_VU | ICOUNT_VS
+	MASK_XTRIGGER_WRITABLE = XTRIGGER_U | XTRIGGER_S | XTRIGGER_M | XTRIGGER_VU | XTRIGGER_VS | XTRIGGER_HIT
+
+	// miselect/siselect values: the major interrupt priorities and the
+	// registers of the IMSIC interrupt file.
+	ISELECT_IPRIO0      = 0x30
+	ISELECT_IPRIO15     = 0x3f
+	ISELECT_EIDELIVERY  = 0x70
+	ISELECT_EITHRESHOLD = 0x72
+	ISELECT_EIP0        = 0x80
+	ISELECT_EIP63       = 0xbf
+	ISELECT_EIE0        = 0xc0
+	ISELECT_EIE63       = 0xff
+
+	// mcountinhibit/mcounteren fields
+	MASK_CY = 1 << 0
+	MASK_TM = 1 << 1
+	MASK_IR = 1 << 2
+
+	// mhpmevent fields (Sscofpmf): the overflow flag, the per-mode inhibits
+	// and the event selector.
+	MHPMEVENT_OF            = 1 << 63
+	MHPMEVENT_MINH          = 1 << 62
+	MHPMEVENT_SINH          = 1 << 61
+	MHPMEVENT_UINH          = 1 << 60
+	MHPMEVENT_VSINH         = 1 << 59
+	MHPMEVENT_VUINH         = 1 << 58
+	MASK_MHPMEVENT_EVENT    = 1<<56 - 1
+	MASK_MHPMEVENT_WRITABLE = MHPMEVENT_OF | MHPMEVENT_MINH | MHPMEVENT_SINH | MHPMEVENT_UINH |
+		MHPMEVENT_VSINH | MHPMEVENT_VUINH | MASK_MHPMEVENT_EVENT
+
+	// Events mhpmevent3-31 can count. There is no TLB, so every access that
+	// goes through paging misses and walks the page table.
+	HPM_EVENT_NONE         = 0
+	HPM_EVENT_LOAD         = 1
+	HPM_EVENT_STORE        = 2
+	HPM_EVENT_BRANCH       = 3
+	HPM_EVENT_BRANCH_TAKEN = 4
+	HPM_EVENT_TRAP         = 5
+	HPM_EVENT_ITLB_MISS    = 6
+	HPM_EVENT_DTLB_MISS    = 7
+	HPM_EVENT_PAGE_WALK    = 8
+	HPM_EVENT_COUNT        = 9
+
+	// mstatus.FS/VS/XS states
+	FS_OFF     = 0
+	FS_INITIAL = 1
+	FS_CLEAN   = 2
+	FS_DIRTY   = 3
+
+	// fcsr fields and fflags exception flags
+	MASK_FFLAGS = 0x1f
+	MASK_FRM    = 0b111 << 5
+	FFLAGS_NX   = 1 << 0
+	FFLAGS_UF   = 1 << 1
+	FFLAGS_OF   = 1 << 2
+	FFLAGS_DZ   = 1 << 3
+	FFLAGS_NV   = 1 << 4
+
+	// vtype.vill, set when vtype holds an unsupported configuration
+	VTYPE_VILL = 1 << 63
+
+	// vcsr fields and fixed-point rounding modes
+	MASK_VXSAT = 1 << 0
+	MASK_VXRM  = 0b11 << 1
+	VXRM_RNU   = 0
+	VXRM_RNE   = 1
+	VXRM_RDN   = 2
+	VXRM_ROD   = 3
+
+	// misa fields
+	MISA_MXL_32 = 1 << 62
+	MISA_MXL_64 = 2 << 62
+	MISA_A      = 1 << ('A' - 'A')
+	MISA_C      = 1 << ('C' - 'A')
+	MISA_D      = 1 << ('D' - 'A')
+	MISA_F      = 1 << ('F' - 'A')
+	MISA_H      = 1 << ('H' - 'A')
+	MISA_I      = 1 << ('I' - 'A')
+	MISA_M      = 1 << ('M' - 'A')
+	MISA_S      = 1 << ('S' - 'A')
+	MISA_U      = 1 << ('U' - 'A')
+	MISA_V      = 1 << ('V' - 'A')
 )
 
 // virtio
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"crypto/rand"
 	"fmt"
+	"io"
+	"math"
+	"math/bits"
 	"strconv"
 	"strings"
+	"time"
 	"unsafe"
 )
 
@@ -25,12 +30,89 @@ const (
 
 type Cpu struct {
 	Regs         [32]uint64
+	FRegs        [32]uint64
 	Pc           uint64
 	Mode         Mode
 	Bus          Bus
 	Csr          CSR
 	EnablePaging bool
 	PageTable    uint64
+	PageLevels   int
+	Reservation  Reservation
+	// InstLen is the length in bytes of the instruction being executed.
+	InstLen uint64
+	Ext     Extensions
+	// VRegs holds the 32 vector registers back to back, VLEN/8 bytes each.
+	VRegs []byte
+	// VLEN is the vector register length in bits.
+	VLEN uint64
+	// CacheBlockSize is the size in bytes of the blocks cbo.* operate on.
+	CacheBlockSize uint64
+	// Waiting is set by wfi until an interrupt becomes pending.
+	Waiting bool
+	// Entropy backs the seed CSR.
+	Entropy io.Reader
+	// Misaligned selects whether misaligned loads and stores trap.
+	Misaligned MisalignedPolicy
+	// custom holds the custom instructions added by RegisterCustom.
+	custom []CustomInstruction
+}
+
+// Extensions switches optional extensions on and off, so software can be
+// tested both with and without them.
+type Extensions struct {
+	Zba bool
+	Zbb bool
+	Zbc bool
+	Zbs bool
+	// Zicbom and Zicboz are the cache-block management and zero
+	// instructions. The Zicbop prefetches are ori hints and always run.
+	Zicbom bool
+	Zicboz bool
+	// Zfh is full half-precision arithmetic; without it only the Zfhmin
+	// loads, stores, moves and conversions remain.
+	Zfh bool
+	Zfa bool
+	// Scalar cryptography: bit-manipulation for crypto, AES, SHA-2, the
+	// ShangMi SM3/SM4 algorithms and the seed entropy source.
+	Zbkb  bool
+	Zbkc  bool
+	Zbkx  bool
+	Zknd  bool
+	Zkne  bool
+	Zknh  bool
+	Zksed bool
+	Zksh  bool
+	Zkr   bool
+	// Svnapot 64 KiB pages, Svpbmt memory types and the Svinval
+	// fine-grained TLB invalidation instructions.
+	Svnapot bool
+	Svpbmt  bool
+	Svinval bool
+	// Zacas atomic compare-and-swap, and Zabha byte and halfword AMOs.
+	Zacas bool
+	Zabha bool
+	// Smaia and Ssaia are the AIA CSRs, enabled with the APLIC and IMSIC by
+	// EnableAIA.
+	Smaia bool
+}
+
+// Reservation is the reservation set registered by lr.w/lr.d and consumed by
+// sc.w/sc.d. Addr is a physical address.
+type Reservation struct {
+	Valid bool
+	Addr  uint64
+	Size  uint64
+}
+
+// Overlaps reports whether an access of size bits at physical addr touches the
+// reserved bytes.
+func (r *Reservation) Overlaps(addr, size uint64) bool {
+	return r.Valid && addr < r.Addr+r.Size/8 && r.Addr < addr+size/8
+}
+
+func (r *Reservation) Clear() {
+	r.Valid = false
 }
 
 var (
@@ -47,77 +129,491 @@ func NewCPU(code, diskImage []uint8) *Cpu {
 	regs[2] = DRAM_END
 	return &Cpu{
 		Regs:         regs,
+		VRegs:        make([]byte, 32*DEFAULT_VLEN/8),
+		VLEN:         DEFAULT_VLEN,
 		Pc:           DRAM_BASE,
 		Mode:         Machine,
 		Bus:          NewBus(code, diskImage),
 		Csr:          NewCSR(),
 		EnablePaging: false,
 		PageTable:    0,
+		PageLevels:   0,
+		InstLen:      4,
+		Ext: Extensions{
+			Zba:     true,
+			Zbb:     true,
+			Zbc:     true,
+			Zbs:     true,
+			Zicbom:  true,
+			Zicboz:  true,
+			Zfh:     true,
+			Zfa:     true,
+			Zbkb:    true,
+			Zbkc:    true,
+			Zbkx:    true,
+			Zknd:    true,
+			Zkne:    true,
+			Zknh:    true,
+			Zksed:   true,
+			Zksh:    true,
+			Zkr:     true,
+			Svnapot: true,
+			Svpbmt:  true,
+			Svinval: true,
+			Zacas:   true,
+			Zabha:   true,
+		},
+		CacheBlockSize: DEFAULT_CACHE_BLOCK_SIZE,
+		Entropy:        rand.Reader,
+		Misaligned:     MisalignedEmulate,
 	}
 }
 
 func (cpu *Cpu) Load(addr, size uint64) (uint64, *Exception) {
-	pAddr, exception := cpu.Translate(addr, Load)
+	if exception := cpu.checkMcontrol6(MCONTROL6_LOAD, addr, 0, false); exception != nil {
+		return 0, exception
+	}
+	value, exception := cpu.load(addr, size)
+	if exception != nil {
+		return 0, exception
+	}
+	// Triggers on the loaded value fire before it reaches the register.
+	if exception := cpu.checkMcontrol6(MCONTROL6_LOAD, addr, value, true); exception != nil {
+		return 0, exception
+	}
+	return value, nil
+}
+
+func (cpu *Cpu) load(addr, size uint64) (uint64, *Exception) {
+	if exception := cpu.checkAlignment(addr, size, Load); exception != nil {
+		return 0, exception
+	}
+	if n := pageSplit(addr, size); n != 0 {
+		return cpu.loadSplit(addr, size, n, cpu.translateAccess)
+	}
+	pAddr, exception := cpu.translateAccess(addr, size, Load)
 	if exception != nil {
 		return 0, exception
 	}
-	return cpu.Bus.Load(pAddr, size)
+	value, exception := cpu.Bus.Load(pAddr, size)
+	if exception != nil {
+		// Report the virtual address in tval.
+		return 0, NewException(exception.Type, addr)
+	}
+	return value, nil
 }
 
 func (cpu *Cpu) Store(addr, size, value uint64) *Exception {
-	pAddr, exception := cpu.Translate(addr, Store)
+	if exception := cpu.checkMcontrol6(MCONTROL6_STORE, addr, value, true); exception != nil {
+		return exception
+	}
+	if exception := cpu.checkAlignment(addr, size, Store); exception != nil {
+		return exception
+	}
+	if n := pageSplit(addr, size); n != 0 {
+		return cpu.storeSplit(addr, size, n, value, cpu.translateAccess)
+	}
+	pAddr, exception := cpu.translateAccess(addr, size, Store)
 	if exception != nil {
 		return exception
 	}
-	return cpu.Bus.Store(pAddr, size, value)
+	if cpu.Reservation.Overlaps(pAddr, size) {
+		cpu.Reservation.Clear()
+	}
+	if exception := cpu.Bus.Store(pAddr, size, value); exception != nil {
+		return NewException(exception.Type, addr)
+	}
+	return nil
+}
+
+func (cpu *Cpu) LoadReserved(addr, size uint64) (uint64, *Exception) {
+	if exception := cpu.checkMcontrol6(MCONTROL6_LOAD, addr, 0, false); exception != nil {
+		return 0, exception
+	}
+	pAddr, exception := cpu.Translate(addr, Load)
+	if exception != nil {
+		return 0, exception
+	}
+	if exception := cpu.CheckPMP(addr, pAddr, size, Load); exception != nil {
+		return 0, exception
+	}
+	value, exception := cpu.Bus.Load(pAddr, size)
+	if exception != nil {
+		return 0, exception
+	}
+	cpu.Reservation = Reservation{Valid: true, Addr: pAddr, Size: size}
+	return value, nil
+}
+
+// StoreConditional writes value only if the reservation registered by the
+// last LoadReserved still covers addr, and reports whether it did. The
+// reservation is released either way.
+func (cpu *Cpu) StoreConditional(addr, size, value uint64) (bool, *Exception) {
+	if exception := cpu.checkMcontrol6(MCONTROL6_STORE, addr, value, true); exception != nil {
+		return false, exception
+	}
+	pAddr, exception := cpu.Translate(addr, Store)
+	if exception != nil {
+		return false, exception
+	}
+	if exception := cpu.CheckPMP(addr, pAddr, size, Store); exception != nil {
+		return false, exception
+	}
+	reservation := cpu.Reservation
+	cpu.Reservation.Clear()
+	if !reservation.Valid || reservation.Addr != pAddr || reservation.Size != size {
+		return false, nil
+	}
+	if exception := cpu.Bus.Store(pAddr, size, value); exception != nil {
+		return false, exception
+	}
+	return true, nil
+}
+
+// AtomicMemoryOperation loads the value at addr, stores op(old, value) back and
+// returns the old value. Faults are reported as store/AMO faults.
+func (cpu *Cpu) AtomicMemoryOperation(addr, size, value uint64, op func(t, v uint64) uint64) (uint64, *Exception) {
+	pAddr, exception := cpu.atomicAddress(addr, size)
+	if exception != nil {
+		return 0, exception
+	}
+	t, exception := cpu.Bus.Load(pAddr, size)
+	if exception != nil {
+		return 0, NewException(StoreAMOAccessFault, addr)
+	}
+	if cpu.Reservation.Overlaps(pAddr, size) {
+		cpu.Reservation.Clear()
+	}
+	if exception := cpu.Bus.Store(pAddr, size, op(t, value)); exception != nil {
+		return 0, exception
+	}
+	return t, nil
+}
+
+// Step runs the hart for one instruction: it waits while the hart is stalled
+// in wfi, fetches and executes the next instruction, and takes any exception
+// and then any pending interrupt. It returns the exception that stops the
+// emulator, or nil.
+func (cpu *Cpu) Step() *Exception {
+	if cpu.Waiting {
+		cpu.WaitForInterrupt()
+		// The interrupt that ends the wait is taken before the instruction
+		// after wfi runs.
+		if interrupt := cpu.CheckPendingInterrupt(); interrupt != nil {
+			cpu.HandleInterrupt(*interrupt)
+		}
+		return nil
+	}
+	cpu.Csr.Tick()
+	cpu.Bus.clint.Tick()
+	inst, exception := cpu.Fetch()
+	if exception != nil {
+		cpu.HandleException(exception)
+		if cpu.isFatal(exception) {
+			return exception
+		}
+		return nil
+	}
+	newPC, exception := cpu.Execute(inst)
+	if exception != nil {
+		cpu.HandleException(exception)
+		if cpu.isFatal(exception) {
+			return exception
+		}
+	} else {
+		cpu.Pc = newPC
+		cpu.Csr.Retire()
+	}
+	if interrupt := cpu.CheckPendingInterrupt(); interrupt != nil {
+		cpu.HandleInterrupt(*interrupt)
+	}
+	return nil
 }
 
+// AtomicCompareSwapPair performs amocas.q, or amocas.d on RV32, whose size-bit
+// operands are held in register pairs: the old value is returned as its low
+// and high halves, and swap is stored only if it equals compare.
+func (cpu *Cpu) AtomicCompareSwapPair(addr, size uint64, compare, swap [2]uint64) ([2]uint64, *Exception) {
+	var old [2]uint64
+	pAddr, exception := cpu.atomicAddress(addr, size)
+	if exception != nil {
+		return old, exception
+	}
+	half := size / 2
+	for i := range old {
+		old[i], exception = cpu.Bus.Load(pAddr+uint64(i)*half/8, half)
+		if exception != nil {
+			return old, NewException(StoreAMOAccessFault, addr)
+		}
+	}
+	if old[0] != zeroExtend(compare[0], half) || old[1] != zeroExtend(compare[1], half) {
+		return old, nil
+	}
+	if cpu.Reservation.Overlaps(pAddr, size) {
+		cpu.Reservation.Clear()
+	}
+	for i := range swap {
+		if exception := cpu.Bus.Store(pAddr+uint64(i)*half/8, half, swap[i]); exception != nil {
+			return old, NewException(StoreAMOAccessFault, addr)
+		}
+	}
+	return old, nil
+}
+
+// amocasPair executes the register-pair forms of amocas, which need even
+// registers. x0 as rd or rs2 stands for a pair of zeros, and as rd discards the
+// old value.
+func (cpu *Cpu) amocasPair(inst, addr, size uint64) (uint64, *Exception) {
+	rd := (inst >> 7) & 0x1f
+	rs2 := (inst >> 20) & 0x1f
+	if rd%2 != 0 || rs2%2 != 0 {
+		return 0, NewException(IllegalInstruction, inst)
+	}
+	pair := func(r uint64) [2]uint64 {
+		if r == 0 {
+			return [2]uint64{}
+		}
+		return [2]uint64{cpu.Regs[r], cpu.Regs[r+1]}
+	}
+	old, exception := cpu.AtomicCompareSwapPair(addr, size, pair(rd), pair(rs2))
+	if exception != nil {
+		return 0, exception
+	}
+	if rd != 0 {
+		cpu.Regs[rd], cpu.Regs[rd+1] = signExtend(old[0], size/2), signExtend(old[1], size/2)
+	}
+	return cpu.UpdatePC()
+}
+
+// atomicAddress translates the address of an AMO, which needs both read and
+// write permission.
+func (cpu *Cpu) atomicAddress(addr, size uint64) (uint64, *Exception) {
+	if exception := cpu.checkMcontrol6(MCONTROL6_LOAD|MCONTROL6_STORE, addr, 0, false); exception != nil {
+		return 0, exception
+	}
+	pAddr, exception := cpu.Translate(addr, Store)
+	if exception != nil {
+		return 0, exception
+	}
+	mode := cpu.TranslationMode(Store)
+	if !cpu.Csr.PMPAllows(pAddr, size, Load, mode) || !cpu.Csr.PMPAllows(pAddr, size, Store, mode) {
+		return 0, NewException(StoreAMOAccessFault, addr)
+	}
+	return pAddr, nil
+}
+
+// Fetch reads the instruction at pc one 16-bit parcel at a time, so that a
+// 32-bit instruction straddling a page boundary translates each half
+// separately. Compressed instructions are returned as a single parcel.
 func (cpu *Cpu) Fetch() (uint64, *Exception) {
-	pAddr, exception := cpu.Translate(cpu.Pc, Store)
+	lo, exception := cpu.fetchParcel(cpu.Pc)
+	if exception != nil {
+		return 0, exception
+	}
+	if lo&0b11 != 0b11 {
+		return lo, nil
+	}
+	hi, exception := cpu.fetchParcel(cpu.Pc + 2)
+	if exception != nil {
+		return 0, exception
+	}
+	return lo | hi<<16, nil
+}
+
+func (cpu *Cpu) fetchParcel(addr uint64) (uint64, *Exception) {
+	pAddr, exception := cpu.Translate(addr, Instruction)
 	if exception != nil {
 		return 0, exception
 	}
-	if inst, exp := cpu.Bus.Load(pAddr, 32); exp != nil {
-		return 0, NewException(InstructionAccessFault, cpu.Pc)
+	if exception := cpu.CheckPMP(addr, pAddr, 16, Instruction); exception != nil {
+		return 0, exception
+	}
+	if parcel, exp := cpu.Bus.Load(pAddr, 16); exp != nil {
+		return 0, NewException(InstructionAccessFault, addr)
 	} else {
-		return inst, nil
+		return parcel, nil
 	}
 }
 
 func (cpu *Cpu) UpdatePC() (uint64, *Exception) {
-	return cpu.Pc + 4, nil
+	return cpu.Pc + cpu.InstLen, nil
+}
+
+// IAlign returns the instruction-address alignment in bytes: 2 with the C
+// extension enabled in misa, 4 otherwise.
+func (cpu *Cpu) IAlign() uint64 {
+	if cpu.Csr.Load(MISA)&MISA_C != 0 {
+		return 2
+	}
+	return 4
+}
+
+// Jump returns target as the next pc, or an instruction-address-misaligned
+// exception if it breaks IALIGN.
+func (cpu *Cpu) Jump(target uint64) (uint64, *Exception) {
+	if target&(cpu.IAlign()-1) != 0 {
+		return 0, NewException(InstructionAddrMisaligned, target)
+	}
+	return target, nil
 }
 
 func (cpu *Cpu) HandleException(e *Exception) {
+	// Faults taken while V=1 report a guest virtual address in tval.
+	gva := e.GVA || (cpu.Csr.V && e.HasAddress())
+	tval := e.Value()
+	if e.HasAddress() && cpu.XLEN() == 32 {
+		tval = uint64(uint32(tval))
+	}
+	mode, virt := cpu.Mode, cpu.Csr.V
+	cpu.takeTrap(e.Code(), tval, e.Tval2, gva)
+	cpu.matchTrap(e.Code(), mode, virt)
+}
+
+// takeTrap enters the trap handler for cause in M-mode, HS-mode or VS-mode,
+// following medeleg/mideleg and then hedeleg/hideleg for traps from a guest.
+// tval2 is written to mtval2/htval and gva to mstatus.GVA/hstatus.GVA.
+func (cpu *Cpu) takeTrap(cause, tval, tval2 uint64, gva bool) {
 	pc := cpu.Pc
 	mode := cpu.Mode
-	cause := e.Code()
-	trapInSMode := mode <= Supervisor && cpu.Csr.IsMedelegated(cause)
-	var (
-		STATUS, TVEC, CAUSE, TVAL, EPC, MASK_PIE, pie_i, MASK_IE, ie_i, MASK_PP, pp_i uint64
-	)
-	if trapInSMode {
+	virt := cpu.Csr.V
+	cpu.Csr.CountEvent(HPM_EVENT_TRAP, mode, virt)
+	interrupt := cause&MASK_INTERRUPT_BIT != 0
+	var delegated, hdelegated bool
+	if interrupt {
+		delegated = cpu.Csr.IsMidelegated(cause)
+		hdelegated = (cpu.Csr.Load(HIDELEG)>>uint32(cause))&1 == 1
+	} else {
+		delegated = cpu.Csr.IsMedelegated(cause)
+		hdelegated = (cpu.Csr.Load(HEDELEG)>>cause)&1 == 1
+	}
+	cpu.Reservation.Clear()
+	var STATUS, TVEC, CAUSE, TVAL, EPC, MASK_PIE, pie_i, MASK_IE, ie_i, MASK_PP, pp_i uint64
+	switch {
+	case mode <= Supervisor && virt && delegated && hdelegated:
+		cpu.Mode = Supervisor
+		if interrupt {
+			// The guest sees VS-level interrupts under their S-level codes.
+			cause--
+		}
+		STATUS, TVEC, CAUSE, TVAL, EPC, MASK_PIE, pie_i, MASK_IE, ie_i, MASK_PP, pp_i =
+			VSSTATUS, VSTVEC, VSCAUSE, VSTVAL, VSEPC, MASK_SPIE, 5, MASK_SIE, 1, MASK_SPP, 8
+	case mode <= Supervisor && delegated:
 		cpu.Mode = Supervisor
+		cpu.Csr.V = false
+		hstatus := cpu.Csr.Load(HSTATUS) &^ (MASK_HSTATUS_SPV | MASK_HSTATUS_GVA)
+		if virt {
+			hstatus = hstatus&^MASK_HSTATUS_SPVP | MASK_HSTATUS_SPV | uint64(mode)<<8
+		}
+		if gva {
+			hstatus |= MASK_HSTATUS_GVA
+		}
+		cpu.Csr.Store(HSTATUS, hstatus)
+		cpu.Csr.Store(HTVAL, tval2)
+		cpu.Csr.Store(HTINST, 0)
 		STATUS, TVEC, CAUSE, TVAL, EPC, MASK_PIE, pie_i, MASK_IE, ie_i, MASK_PP, pp_i =
 			SSTATUS, STVEC, SCAUSE, STVAL, SEPC, MASK_SPIE, 5, MASK_SIE, 1, MASK_SPP, 8
-	} else {
+	default:
 		cpu.Mode = Machine
+		cpu.Csr.V = false
+		mstatus := cpu.Csr.Load(MSTATUS) &^ (MASK_MPV | MASK_GVA)
+		if virt {
+			mstatus |= MASK_MPV
+		}
+		if gva {
+			mstatus |= MASK_GVA
+		}
+		cpu.Csr.Store(MSTATUS, mstatus)
+		cpu.Csr.Store(MTVAL2, tval2)
+		cpu.Csr.Store(MTINST, 0)
+		// tcontrol.MPTE saves MTE, which keeps triggers off in the handler.
+		cpu.Csr.Store(TCONTROL, (cpu.Csr.Load(TCONTROL)&TCONTROL_MTE)<<4)
 		STATUS, TVEC, CAUSE, TVAL, EPC, MASK_PIE, pie_i, MASK_IE, ie_i, MASK_PP, pp_i =
 			MSTATUS, MTVEC, MCAUSE, MTVAL, MEPC, MASK_MPIE, 7, MASK_MIE, 3, MASK_MPP, 11
 	}
-	cpu.Pc = cpu.Csr.Load(TVEC) & ^uint64(0b11)
+	tvec := cpu.Csr.Load(TVEC)
+	cpu.Pc = tvec & ^uint64(0b11)
+	if interrupt && tvec&0b11 == 1 {
+		cpu.Pc += (cause &^ MASK_INTERRUPT_BIT) << 2
+	}
 	cpu.Csr.Store(EPC, pc)
 	cpu.Csr.Store(CAUSE, cause)
-	cpu.Csr.Store(TVAL, e.Value())
+	cpu.Csr.Store(TVAL, tval)
 	status := cpu.Csr.Load(STATUS)
 	ie := (status & MASK_IE) >> ie_i
-	status = (status & ^uint64(MASK_PIE)) | (ie << pie_i)
-	status &= ^uint64(MASK_IE)
-	status = (status & ^uint64(MASK_PP)) | (uint64(mode) << pp_i)
+	status = (status & ^MASK_PIE) | (ie << pie_i)
+	status &= ^MASK_IE
+	status = (status & ^MASK_PP) | (uint64(mode) << pp_i)
 	cpu.Csr.Store(STATUS, status)
 }
 
+// isFatal reports whether the emulator stops after taking exception e: one of
+// the exceptions IsFatal lists, taken by a mode with no trap handler. A zero
+// trap vector counts as no handler, since it is the reset value and there is
+// no memory at address 0, so the hart would only fault again fetching from
+// it, forever.
+func (cpu *Cpu) isFatal(e *Exception) bool {
+	return e.IsFatal() && cpu.trapVector() == 0
+}
+
+// trapVector returns the trap vector base address of the mode the hart is in,
+// which after a trap is the mode that took it.
+func (cpu *Cpu) trapVector() uint64 {
+	tvec := uint64(STVEC)
+	switch {
+	case cpu.Mode == Machine:
+		tvec = MTVEC
+	case cpu.Csr.V:
+		tvec = VSTVEC
+	}
+	return cpu.Csr.Load(tvec) &^ 0b11
+}
+
+// Execute runs one instruction and returns the next pc. Compressed
+// instructions are expanded to their 32-bit equivalents first.
 func (cpu *Cpu) Execute(inst uint64) (uint64, *Exception) {
+	if exception := cpu.checkPendingTriggers(); exception != nil {
+		return 0, exception
+	}
+	if exception := cpu.checkMcontrol6(MCONTROL6_EXECUTE, cpu.Pc, inst, true); exception != nil {
+		return 0, exception
+	}
+	mode, virt := cpu.Mode, cpu.Csr.V
+	xlen := cpu.XLEN()
+	execute := cpu.execute
+	if xlen == 32 {
+		execute = cpu.execute32
+	}
+	var newPC uint64
+	var exception *Exception
+	executed := inst
+	if inst&0b11 != 0b11 {
+		cpu.InstLen = 2
+		expanded, ok := ExpandCompressed(inst, xlen)
+		if !ok || cpu.Csr.Load(MISA)&MISA_C == 0 {
+			return 0, NewException(IllegalInstruction, inst)
+		}
+		executed = expanded
+		newPC, exception = execute(expanded)
+		if exception != nil && exception.Type == IllegalInstruction {
+			exception.Store = inst
+		}
+	} else {
+		cpu.InstLen = 4
+		newPC, exception = execute(inst)
+	}
+	// The pc of a 32-bit mode, which may just have been entered by mret or
+	// sret, wraps at 4 GiB.
+	if exception == nil && cpu.XLEN() == 32 {
+		newPC = uint64(uint32(newPC))
+	}
+	if exception == nil {
+		cpu.countInstruction(mode, virt)
+		cpu.countRetired(executed, newPC, mode, virt)
+	}
+	return newPC, exception
+}
+
+func (cpu *Cpu) execute(inst uint64) (uint64, *Exception) {
 	opcode := inst & 0x7f
 	rd := (inst >> 7) & 0x1f
 	rs1 := (inst >> 15) & 0x1f
@@ -193,25 +689,127 @@ func (cpu *Cpu) Execute(inst uint64) (uint64, *Exception) {
 		default:
 			return 0, NewException(IllegalInstruction, inst)
 		}
+	case 0x07, 0x27:
+		if funct3 == 0x0 || funct3 >= 0x5 {
+			return cpu.ExecuteVectorMemory(inst)
+		}
+		return cpu.ExecuteFloat(inst)
+	case 0x43, 0x47, 0x4b, 0x4f, 0x53:
+		return cpu.ExecuteFloat(inst)
+	case 0x57:
+		return cpu.ExecuteVector(inst)
 	case 0x0f:
 		switch funct3 {
 		case 0x0:
 			return cpu.UpdatePC()
+		case 0x2:
+			return cpu.ExecuteCacheBlock(inst)
 		default:
 			return 0, NewException(IllegalInstruction, inst)
 		}
 	case 0x13:
 		imm := uint64(int64(int32(inst&0xfff00000)) >> 20)
 		shamt := uint32(imm & 0x3f)
+		funct6 := funct7 >> 1
 		switch funct3 {
 		case 0x0:
 			// addi
 			cpu.Regs[rd] = cpu.Regs[rs1] + imm
 			return cpu.UpdatePC()
 		case 0x1:
-			// slli
-			cpu.Regs[rd] = cpu.Regs[rs1] << uint64(shamt)
-			return cpu.UpdatePC()
+			switch {
+			case funct6 == 0x00:
+				// slli
+				cpu.Regs[rd] = cpu.Regs[rs1] << uint64(shamt)
+				return cpu.UpdatePC()
+			case funct6 == 0x0a && cpu.Ext.Zbs:
+				// bseti
+				cpu.Regs[rd] = cpu.Regs[rs1] | (1 << shamt)
+				return cpu.UpdatePC()
+			case funct6 == 0x12 && cpu.Ext.Zbs:
+				// bclri
+				cpu.Regs[rd] = cpu.Regs[rs1] & ^(uint64(1) << shamt)
+				return cpu.UpdatePC()
+			case funct6 == 0x1a && cpu.Ext.Zbs:
+				// binvi
+				cpu.Regs[rd] = cpu.Regs[rs1] ^ (1 << shamt)
+				return cpu.UpdatePC()
+			case funct7 == 0x08 && rs2 <= 0x07 && cpu.Ext.Zknh:
+				switch rs2 {
+				case 0x00:
+					// sha256sum0
+					cpu.Regs[rd] = uint64(int64(int32(sha256sum0(uint32(cpu.Regs[rs1])))))
+				case 0x01:
+					// sha256sum1
+					cpu.Regs[rd] = uint64(int64(int32(sha256sum1(uint32(cpu.Regs[rs1])))))
+				case 0x02:
+					// sha256sig0
+					cpu.Regs[rd] = uint64(int64(int32(sha256sig0(uint32(cpu.Regs[rs1])))))
+				case 0x03:
+					// sha256sig1
+					cpu.Regs[rd] = uint64(int64(int32(sha256sig1(uint32(cpu.Regs[rs1])))))
+				case 0x04:
+					// sha512sum0
+					cpu.Regs[rd] = sha512sum0(cpu.Regs[rs1])
+				case 0x05:
+					// sha512sum1
+					cpu.Regs[rd] = sha512sum1(cpu.Regs[rs1])
+				case 0x06:
+					// sha512sig0
+					cpu.Regs[rd] = sha512sig0(cpu.Regs[rs1])
+				case 0x07:
+					// sha512sig1
+					cpu.Regs[rd] = sha512sig1(cpu.Regs[rs1])
+				}
+				return cpu.UpdatePC()
+			case funct7 == 0x08 && rs2 == 0x08 && cpu.Ext.Zksh:
+				// sm3p0
+				cpu.Regs[rd] = uint64(int64(int32(sm3p0(uint32(cpu.Regs[rs1])))))
+				return cpu.UpdatePC()
+			case funct7 == 0x08 && rs2 == 0x09 && cpu.Ext.Zksh:
+				// sm3p1
+				cpu.Regs[rd] = uint64(int64(int32(sm3p1(uint32(cpu.Regs[rs1])))))
+				return cpu.UpdatePC()
+			case funct7 == 0x18 && rs2 == 0x00 && cpu.Ext.Zknd:
+				// aes64im
+				cpu.Regs[rd] = aesMixColumns64(cpu.Regs[rs1], true)
+				return cpu.UpdatePC()
+			case inst>>24 == 0x31 && (cpu.Ext.Zknd || cpu.Ext.Zkne):
+				// aes64ks1i
+				rnum := rs2 & 0xf
+				if rnum > 0xa {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				cpu.Regs[rd] = aes64ks1i(cpu.Regs[rs1], rnum)
+				return cpu.UpdatePC()
+			case funct7 == 0x30 && cpu.Ext.Zbb:
+				switch rs2 {
+				case 0x00:
+					// clz
+					cpu.Regs[rd] = uint64(bits.LeadingZeros64(cpu.Regs[rs1]))
+					return cpu.UpdatePC()
+				case 0x01:
+					// ctz
+					cpu.Regs[rd] = uint64(bits.TrailingZeros64(cpu.Regs[rs1]))
+					return cpu.UpdatePC()
+				case 0x02:
+					// cpop
+					cpu.Regs[rd] = uint64(bits.OnesCount64(cpu.Regs[rs1]))
+					return cpu.UpdatePC()
+				case 0x04:
+					// sext.b
+					cpu.Regs[rd] = uint64(int64(int8(cpu.Regs[rs1])))
+					return cpu.UpdatePC()
+				case 0x05:
+					// sext.h
+					cpu.Regs[rd] = uint64(int64(int16(cpu.Regs[rs1])))
+					return cpu.UpdatePC()
+				default:
+					return 0, NewException(IllegalInstruction, inst)
+				}
+			default:
+				return 0, NewException(IllegalInstruction, inst)
+			}
 		case 0x2:
 			// slti
 			if int64(cpu.Regs[rs1]) < int64(imm) {
@@ -233,20 +831,41 @@ func (cpu *Cpu) Execute(inst uint64) (uint64, *Exception) {
 			cpu.Regs[rd] = cpu.Regs[rs1] ^ imm
 			return cpu.UpdatePC()
 		case 0x5:
-			switch funct7 >> 1 {
-			case 0x00:
+			switch {
+			case funct6 == 0x00:
 				// srli
 				cpu.Regs[rd] = cpu.Regs[rs1] >> shamt
 				return cpu.UpdatePC()
-			case 0x10:
+			case funct6 == 0x10:
 				// srai
 				cpu.Regs[rd] = uint64(int64(cpu.Regs[rs1]) >> shamt)
 				return cpu.UpdatePC()
+			case funct6 == 0x12 && cpu.Ext.Zbs:
+				// bexti
+				cpu.Regs[rd] = (cpu.Regs[rs1] >> shamt) & 1
+				return cpu.UpdatePC()
+			case funct6 == 0x18 && (cpu.Ext.Zbb || cpu.Ext.Zbkb):
+				// rori
+				cpu.Regs[rd] = bits.RotateLeft64(cpu.Regs[rs1], -int(shamt))
+				return cpu.UpdatePC()
+			case imm&0xfff == 0x287 && cpu.Ext.Zbb:
+				// orc.b
+				cpu.Regs[rd] = orcb(cpu.Regs[rs1])
+				return cpu.UpdatePC()
+			case imm&0xfff == 0x6b8 && (cpu.Ext.Zbb || cpu.Ext.Zbkb):
+				// rev8
+				cpu.Regs[rd] = bits.ReverseBytes64(cpu.Regs[rs1])
+				return cpu.UpdatePC()
+			case imm&0xfff == 0x687 && cpu.Ext.Zbkb:
+				// brev8
+				cpu.Regs[rd] = brev8(cpu.Regs[rs1])
+				return cpu.UpdatePC()
 			default:
 				return 0, NewException(IllegalInstruction, inst)
 			}
 		case 0x6:
-			// ori
+			// ori, and with rd = x0 the prefetch.i/prefetch.r/prefetch.w
+			// hints, which have nothing to do without caches
 			cpu.Regs[rd] = cpu.Regs[rs1] | imm
 			return cpu.UpdatePC()
 		case 0x7:
@@ -270,19 +889,49 @@ func (cpu *Cpu) Execute(inst uint64) (uint64, *Exception) {
 			cpu.Regs[rd] = uint64(int64(int32(cpu.Regs[rs1] + imm)))
 			return cpu.UpdatePC()
 		case 0x1:
-			// slliw
-			cpu.Regs[rd] = uint64(int64(int32(cpu.Regs[rs1] << shamt)))
-			return cpu.UpdatePC()
+			switch {
+			case funct7 == 0x00:
+				// slliw
+				cpu.Regs[rd] = uint64(int64(int32(cpu.Regs[rs1] << shamt)))
+				return cpu.UpdatePC()
+			case funct7>>1 == 0x02 && cpu.Ext.Zba:
+				// slli.uw
+				cpu.Regs[rd] = uint64(uint32(cpu.Regs[rs1])) << (imm & 0x3f)
+				return cpu.UpdatePC()
+			case funct7 == 0x30 && cpu.Ext.Zbb:
+				switch rs2 {
+				case 0x00:
+					// clzw
+					cpu.Regs[rd] = uint64(bits.LeadingZeros32(uint32(cpu.Regs[rs1])))
+					return cpu.UpdatePC()
+				case 0x01:
+					// ctzw
+					cpu.Regs[rd] = uint64(bits.TrailingZeros32(uint32(cpu.Regs[rs1])))
+					return cpu.UpdatePC()
+				case 0x02:
+					// cpopw
+					cpu.Regs[rd] = uint64(bits.OnesCount32(uint32(cpu.Regs[rs1])))
+					return cpu.UpdatePC()
+				default:
+					return 0, NewException(IllegalInstruction, inst)
+				}
+			default:
+				return 0, NewException(IllegalInstruction, inst)
+			}
 		case 0x5:
-			switch funct7 {
-			case 0x00:
+			switch {
+			case funct7 == 0x00:
 				// srliw
 				cpu.Regs[rd] = uint64(int64(int32(uint32(cpu.Regs[rs1]) >> shamt)))
 				return cpu.UpdatePC()
-			case 0x20:
+			case funct7 == 0x20:
 				// sraiw
 				cpu.Regs[rd] = uint64(int64(int32(cpu.Regs[rs1]) >> shamt))
 				return cpu.UpdatePC()
+			case funct7 == 0x30 && (cpu.Ext.Zbb || cpu.Ext.Zbkb):
+				// roriw
+				cpu.Regs[rd] = uint64(int64(int32(bits.RotateLeft32(uint32(cpu.Regs[rs1]), -int(shamt)))))
+				return cpu.UpdatePC()
 			default:
 				return 0, NewException(IllegalInstruction, inst)
 			}
@@ -325,70 +974,133 @@ func (cpu *Cpu) Execute(inst uint64) (uint64, *Exception) {
 			return 0, NewException(IllegalInstruction, inst)
 		}
 	case 0x2f:
+		// The aq/rl bits in inst[26:25] are accepted and ignored: this hart
+		// performs every memory access in program order.
 		funct5 := (funct7 & 0b1111100) >> 2
+		var size uint64
 		switch funct3 {
-		case 0x2:
-			switch funct5 {
-			case 0x00:
-				// amoadd.w
-				t, e := cpu.Load(cpu.Regs[rs1], 32)
-				if e != nil {
-					return 0, e
-				}
-				e = cpu.Store(cpu.Regs[rs1], 32, t+cpu.Regs[rs2])
-				if e != nil {
-					return 0, e
-				}
-				cpu.Regs[rd] = t
-				return cpu.UpdatePC()
-			case 0x01:
-				// amoswap.w
-				t, e := cpu.Load(cpu.Regs[rs1], 32)
-				if e != nil {
-					return 0, e
-				}
-				e = cpu.Store(cpu.Regs[rs1], 32, cpu.Regs[rs2])
-				if e != nil {
-					return 0, e
-				}
-				cpu.Regs[rd] = t
-				return cpu.UpdatePC()
-			default:
+		case 0x0, 0x1:
+			// Zabha has no byte or halfword lr/sc.
+			if !cpu.Ext.Zabha || funct5 == 0x02 || funct5 == 0x03 {
 				return 0, NewException(IllegalInstruction, inst)
 			}
+			size = 8 << funct3
+		case 0x2:
+			size = 32
 		case 0x3:
-			switch funct5 {
-			case 0x00:
-				// amoadd.d
-				t, e := cpu.Load(cpu.Regs[rs1], 64)
-				if e != nil {
-					return 0, e
+			size = 64
+		case 0x4:
+			if funct5 != 0x05 {
+				return 0, NewException(IllegalInstruction, inst)
+			}
+			size = 128
+		default:
+			return 0, NewException(IllegalInstruction, inst)
+		}
+		addr := cpu.Regs[rs1]
+		if addr%(size/8) != 0 {
+			if funct5 == 0x02 {
+				return 0, NewException(LoadAccessMisaligned, addr)
+			}
+			return 0, NewException(StoreAMOAddrMisaligned, addr)
+		}
+		var op func(t, v uint64) uint64
+		switch funct5 {
+		case 0x02:
+			// lr.w, lr.d
+			if rs2 != 0 {
+				return 0, NewException(IllegalInstruction, inst)
+			}
+			t, e := cpu.LoadReserved(addr, size)
+			if e != nil {
+				return 0, e
+			}
+			cpu.Regs[rd] = signExtend(t, size)
+			return cpu.UpdatePC()
+		case 0x03:
+			// sc.w, sc.d
+			ok, e := cpu.StoreConditional(addr, size, cpu.Regs[rs2])
+			if e != nil {
+				return 0, e
+			}
+			if ok {
+				cpu.Regs[rd] = 0
+			} else {
+				cpu.Regs[rd] = 1
+			}
+			return cpu.UpdatePC()
+		case 0x05:
+			// amocas.b, amocas.h, amocas.w, amocas.d, amocas.q
+			if !cpu.Ext.Zacas {
+				return 0, NewException(IllegalInstruction, inst)
+			}
+			if size == 2*cpu.XLEN() {
+				return cpu.amocasPair(inst, addr, size)
+			}
+			compare := cpu.Regs[rd]
+			// A failed comparison writes the old value back.
+			op = func(t, v uint64) uint64 {
+				if zeroExtend(t, size) == zeroExtend(compare, size) {
+					return v
 				}
-				e = cpu.Store(cpu.Regs[rs1], 64, t+cpu.Regs[rs2])
-				if e != nil {
-					return 0, e
+				return t
+			}
+		case 0x00:
+			// amoadd.b, amoadd.h, amoadd.w, amoadd.d
+			op = func(t, v uint64) uint64 { return t + v }
+		case 0x01:
+			// amoswap.b, amoswap.h, amoswap.w, amoswap.d
+			op = func(t, v uint64) uint64 { return v }
+		case 0x04:
+			// amoxor.b, amoxor.h, amoxor.w, amoxor.d
+			op = func(t, v uint64) uint64 { return t ^ v }
+		case 0x08:
+			// amoor.b, amoor.h, amoor.w, amoor.d
+			op = func(t, v uint64) uint64 { return t | v }
+		case 0x0c:
+			// amoand.b, amoand.h, amoand.w, amoand.d
+			op = func(t, v uint64) uint64 { return t & v }
+		case 0x10:
+			// amomin.b, amomin.h, amomin.w, amomin.d
+			op = func(t, v uint64) uint64 {
+				if int64(signExtend(t, size)) < int64(signExtend(v, size)) {
+					return t
 				}
-				cpu.Regs[rd] = t
-				return cpu.UpdatePC()
-			case 0x01:
-				// amoswap.d
-				t, e := cpu.Load(cpu.Regs[rs1], 64)
-				if e != nil {
-					return 0, e
+				return v
+			}
+		case 0x14:
+			// amomax.b, amomax.h, amomax.w, amomax.d
+			op = func(t, v uint64) uint64 {
+				if int64(signExtend(t, size)) > int64(signExtend(v, size)) {
+					return t
 				}
-				e = cpu.Store(cpu.Regs[rs1], 64, cpu.Regs[rs2])
-				if e != nil {
-					return 0, e
+				return v
+			}
+		case 0x18:
+			// amominu.b, amominu.h, amominu.w, amominu.d
+			op = func(t, v uint64) uint64 {
+				if zeroExtend(t, size) < zeroExtend(v, size) {
+					return t
 				}
-				cpu.Regs[rd] = t
-				return cpu.UpdatePC()
-			default:
-				return 0, NewException(IllegalInstruction, inst)
+				return v
+			}
+		case 0x1c:
+			// amomaxu.b, amomaxu.h, amomaxu.w, amomaxu.d
+			op = func(t, v uint64) uint64 {
+				if zeroExtend(t, size) > zeroExtend(v, size) {
+					return t
+				}
+				return v
 			}
 		default:
 			return 0, NewException(IllegalInstruction, inst)
 		}
-
+		t, e := cpu.AtomicMemoryOperation(addr, size, cpu.Regs[rs2], op)
+		if e != nil {
+			return 0, e
+		}
+		cpu.Regs[rd] = signExtend(t, size)
+		return cpu.UpdatePC()
 	case 0x33:
 		shamt := uint32(uint64(cpu.Regs[rs2] & 0x3f))
 		switch funct3 {
@@ -406,54 +1118,351 @@ func (cpu *Cpu) Execute(inst uint64) (uint64, *Exception) {
 				// sub
 				cpu.Regs[rd] = cpu.Regs[rs1] - cpu.Regs[rs2]
 				return cpu.UpdatePC()
+			case 0x19, 0x1b:
+				// aes64es, aes64esm
+				if !cpu.Ext.Zkne {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				x := aesSubBytes(aesShiftRows(cpu.Regs[rs1], cpu.Regs[rs2], false), false)
+				if funct7 == 0x1b {
+					x = aesMixColumns64(x, false)
+				}
+				cpu.Regs[rd] = x
+				return cpu.UpdatePC()
+			case 0x1d, 0x1f:
+				// aes64ds, aes64dsm
+				if !cpu.Ext.Zknd {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				x := aesSubBytes(aesShiftRows(cpu.Regs[rs1], cpu.Regs[rs2], true), true)
+				if funct7 == 0x1f {
+					x = aesMixColumns64(x, true)
+				}
+				cpu.Regs[rd] = x
+				return cpu.UpdatePC()
+			case 0x3f:
+				// aes64ks2
+				if !cpu.Ext.Zknd && !cpu.Ext.Zkne {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				cpu.Regs[rd] = aes64ks2(cpu.Regs[rs1], cpu.Regs[rs2])
+				return cpu.UpdatePC()
+			case 0x18, 0x38, 0x58, 0x78, 0x1a, 0x3a, 0x5a, 0x7a:
+				// sm4ed, sm4ks
+				if !cpu.Ext.Zksed {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				cpu.Regs[rd] = sm4(cpu.Regs[rs1], cpu.Regs[rs2], funct7>>5, funct7&0x1f == 0x1a)
+				return cpu.UpdatePC()
 			default:
 				return 0, NewException(IllegalInstruction, inst)
 			}
 		case 0x1:
-			// sll
-			cpu.Regs[rd] = cpu.Regs[rs1] << shamt
-			return cpu.UpdatePC()
+			switch funct7 {
+			case 0x00:
+				// sll
+				cpu.Regs[rd] = cpu.Regs[rs1] << shamt
+				return cpu.UpdatePC()
+			case 0x01:
+				// mulh
+				cpu.Regs[rd] = mulh(cpu.Regs[rs1], cpu.Regs[rs2])
+				return cpu.UpdatePC()
+			case 0x05:
+				// clmul
+				if !cpu.Ext.Zbc && !cpu.Ext.Zbkc {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				cpu.Regs[rd] = clmul(cpu.Regs[rs1], cpu.Regs[rs2])
+				return cpu.UpdatePC()
+			case 0x14:
+				// bset
+				if !cpu.Ext.Zbs {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				cpu.Regs[rd] = cpu.Regs[rs1] | (1 << (cpu.Regs[rs2] & 0x3f))
+				return cpu.UpdatePC()
+			case 0x24:
+				// bclr
+				if !cpu.Ext.Zbs {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				cpu.Regs[rd] = cpu.Regs[rs1] & ^(uint64(1) << (cpu.Regs[rs2] & 0x3f))
+				return cpu.UpdatePC()
+			case 0x30:
+				// rol
+				if !cpu.Ext.Zbb && !cpu.Ext.Zbkb {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				cpu.Regs[rd] = bits.RotateLeft64(cpu.Regs[rs1], int(cpu.Regs[rs2]&0x3f))
+				return cpu.UpdatePC()
+			case 0x34:
+				// binv
+				if !cpu.Ext.Zbs {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				cpu.Regs[rd] = cpu.Regs[rs1] ^ (1 << (cpu.Regs[rs2] & 0x3f))
+				return cpu.UpdatePC()
+			default:
+				return 0, NewException(IllegalInstruction, inst)
+			}
 		case 0x2:
-			// slt
-			if int64(cpu.Regs[rs1]) < int64(cpu.Regs[rs2]) {
-				cpu.Regs[rd] = 1
-			} else {
-				cpu.Regs[rd] = 0
+			switch funct7 {
+			case 0x00:
+				// slt
+				if int64(cpu.Regs[rs1]) < int64(cpu.Regs[rs2]) {
+					cpu.Regs[rd] = 1
+				} else {
+					cpu.Regs[rd] = 0
+				}
+				return cpu.UpdatePC()
+			case 0x01:
+				// mulhsu
+				cpu.Regs[rd] = mulhsu(cpu.Regs[rs1], cpu.Regs[rs2])
+				return cpu.UpdatePC()
+			case 0x05:
+				// clmulr
+				if !cpu.Ext.Zbc {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				cpu.Regs[rd] = clmulr(cpu.Regs[rs1], cpu.Regs[rs2])
+				return cpu.UpdatePC()
+			case 0x10:
+				// sh1add
+				if !cpu.Ext.Zba {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				cpu.Regs[rd] = (cpu.Regs[rs1] << 1) + cpu.Regs[rs2]
+				return cpu.UpdatePC()
+			case 0x14:
+				// xperm4
+				if !cpu.Ext.Zbkx {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				cpu.Regs[rd] = xperm(cpu.Regs[rs1], cpu.Regs[rs2], 4)
+				return cpu.UpdatePC()
+			default:
+				return 0, NewException(IllegalInstruction, inst)
 			}
-			return cpu.UpdatePC()
 		case 0x3:
-			// sltu
-			if cpu.Regs[rs1] < cpu.Regs[rs2] {
-				cpu.Regs[rd] = 1
-			} else {
-				cpu.Regs[rd] = 0
+			switch funct7 {
+			case 0x00:
+				// sltu
+				if cpu.Regs[rs1] < cpu.Regs[rs2] {
+					cpu.Regs[rd] = 1
+				} else {
+					cpu.Regs[rd] = 0
+				}
+				return cpu.UpdatePC()
+			case 0x01:
+				// mulhu
+				cpu.Regs[rd], _ = bits.Mul64(cpu.Regs[rs1], cpu.Regs[rs2])
+				return cpu.UpdatePC()
+			case 0x05:
+				// clmulh
+				if !cpu.Ext.Zbc && !cpu.Ext.Zbkc {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				cpu.Regs[rd] = clmulh(cpu.Regs[rs1], cpu.Regs[rs2])
+				return cpu.UpdatePC()
+			default:
+				return 0, NewException(IllegalInstruction, inst)
 			}
-			return cpu.UpdatePC()
 		case 0x4:
-			// xor
-			cpu.Regs[rd] = cpu.Regs[rs1] ^ cpu.Regs[rs2]
-			return cpu.UpdatePC()
+			switch funct7 {
+			case 0x00:
+				// xor
+				cpu.Regs[rd] = cpu.Regs[rs1] ^ cpu.Regs[rs2]
+				return cpu.UpdatePC()
+			case 0x01:
+				// div
+				dividend := int64(cpu.Regs[rs1])
+				divisor := int64(cpu.Regs[rs2])
+				switch {
+				case divisor == 0:
+					cpu.Regs[rd] = 0xffffffffffffffff
+				case dividend == math.MinInt64 && divisor == -1:
+					cpu.Regs[rd] = uint64(dividend)
+				default:
+					cpu.Regs[rd] = uint64(dividend / divisor)
+				}
+				return cpu.UpdatePC()
+			case 0x05:
+				// min
+				if !cpu.Ext.Zbb {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				if int64(cpu.Regs[rs1]) < int64(cpu.Regs[rs2]) {
+					cpu.Regs[rd] = cpu.Regs[rs1]
+				} else {
+					cpu.Regs[rd] = cpu.Regs[rs2]
+				}
+				return cpu.UpdatePC()
+			case 0x10:
+				// sh2add
+				if !cpu.Ext.Zba {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				cpu.Regs[rd] = (cpu.Regs[rs1] << 2) + cpu.Regs[rs2]
+				return cpu.UpdatePC()
+			case 0x04:
+				// pack
+				if !cpu.Ext.Zbkb {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				cpu.Regs[rd] = uint64(uint32(cpu.Regs[rs1])) | cpu.Regs[rs2]<<32
+				return cpu.UpdatePC()
+			case 0x14:
+				// xperm8
+				if !cpu.Ext.Zbkx {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				cpu.Regs[rd] = xperm(cpu.Regs[rs1], cpu.Regs[rs2], 8)
+				return cpu.UpdatePC()
+			case 0x20:
+				// xnor
+				if !cpu.Ext.Zbb && !cpu.Ext.Zbkb {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				cpu.Regs[rd] = ^(cpu.Regs[rs1] ^ cpu.Regs[rs2])
+				return cpu.UpdatePC()
+			default:
+				return 0, NewException(IllegalInstruction, inst)
+			}
 		case 0x5:
 			switch funct7 {
 			case 0x00:
 				// srl
 				cpu.Regs[rd] = cpu.Regs[rs1] >> shamt
 				return cpu.UpdatePC()
+			case 0x01:
+				// divu
+				if cpu.Regs[rs2] == 0 {
+					cpu.Regs[rd] = 0xffffffffffffffff
+				} else {
+					cpu.Regs[rd] = cpu.Regs[rs1] / cpu.Regs[rs2]
+				}
+				return cpu.UpdatePC()
 			case 0x20:
 				// sra
 				cpu.Regs[rd] = uint64(int64(cpu.Regs[rs1]) >> shamt)
 				return cpu.UpdatePC()
+			case 0x05:
+				// minu
+				if !cpu.Ext.Zbb {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				if cpu.Regs[rs1] < cpu.Regs[rs2] {
+					cpu.Regs[rd] = cpu.Regs[rs1]
+				} else {
+					cpu.Regs[rd] = cpu.Regs[rs2]
+				}
+				return cpu.UpdatePC()
+			case 0x24:
+				// bext
+				if !cpu.Ext.Zbs {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				cpu.Regs[rd] = (cpu.Regs[rs1] >> (cpu.Regs[rs2] & 0x3f)) & 1
+				return cpu.UpdatePC()
+			case 0x30:
+				// ror
+				if !cpu.Ext.Zbb && !cpu.Ext.Zbkb {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				cpu.Regs[rd] = bits.RotateLeft64(cpu.Regs[rs1], -int(cpu.Regs[rs2]&0x3f))
+				return cpu.UpdatePC()
 			default:
 				return 0, NewException(IllegalInstruction, inst)
 			}
 		case 0x6:
-			// or
-			cpu.Regs[rd] = cpu.Regs[rs1] | cpu.Regs[rs2]
-			return cpu.UpdatePC()
+			switch funct7 {
+			case 0x00:
+				// or
+				cpu.Regs[rd] = cpu.Regs[rs1] | cpu.Regs[rs2]
+				return cpu.UpdatePC()
+			case 0x01:
+				// rem
+				dividend := int64(cpu.Regs[rs1])
+				divisor := int64(cpu.Regs[rs2])
+				switch {
+				case divisor == 0:
+					cpu.Regs[rd] = uint64(dividend)
+				case dividend == math.MinInt64 && divisor == -1:
+					cpu.Regs[rd] = 0
+				default:
+					cpu.Regs[rd] = uint64(dividend % divisor)
+				}
+				return cpu.UpdatePC()
+			case 0x05:
+				// max
+				if !cpu.Ext.Zbb {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				if int64(cpu.Regs[rs1]) > int64(cpu.Regs[rs2]) {
+					cpu.Regs[rd] = cpu.Regs[rs1]
+				} else {
+					cpu.Regs[rd] = cpu.Regs[rs2]
+				}
+				return cpu.UpdatePC()
+			case 0x10:
+				// sh3add
+				if !cpu.Ext.Zba {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				cpu.Regs[rd] = (cpu.Regs[rs1] << 3) + cpu.Regs[rs2]
+				return cpu.UpdatePC()
+			case 0x20:
+				// orn
+				if !cpu.Ext.Zbb && !cpu.Ext.Zbkb {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				cpu.Regs[rd] = cpu.Regs[rs1] | ^cpu.Regs[rs2]
+				return cpu.UpdatePC()
+			default:
+				return 0, NewException(IllegalInstruction, inst)
+			}
 		case 0x7:
-			// and
-			cpu.Regs[rd] = cpu.Regs[rs1] & cpu.Regs[rs2]
-			return cpu.UpdatePC()
+			switch funct7 {
+			case 0x00:
+				// and
+				cpu.Regs[rd] = cpu.Regs[rs1] & cpu.Regs[rs2]
+				return cpu.UpdatePC()
+			case 0x01:
+				// remu
+				if cpu.Regs[rs2] == 0 {
+					cpu.Regs[rd] = cpu.Regs[rs1]
+				} else {
+					cpu.Regs[rd] = cpu.Regs[rs1] % cpu.Regs[rs2]
+				}
+				return cpu.UpdatePC()
+			case 0x05:
+				// maxu
+				if !cpu.Ext.Zbb {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				if cpu.Regs[rs1] > cpu.Regs[rs2] {
+					cpu.Regs[rd] = cpu.Regs[rs1]
+				} else {
+					cpu.Regs[rd] = cpu.Regs[rs2]
+				}
+				return cpu.UpdatePC()
+			case 0x04:
+				// packh
+				if !cpu.Ext.Zbkb {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				cpu.Regs[rd] = uint64(uint8(cpu.Regs[rs1])) | uint64(uint8(cpu.Regs[rs2]))<<8
+				return cpu.UpdatePC()
+			case 0x20:
+				// andn
+				if !cpu.Ext.Zbb && !cpu.Ext.Zbkb {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				cpu.Regs[rd] = cpu.Regs[rs1] & ^cpu.Regs[rs2]
+				return cpu.UpdatePC()
+			default:
+				return 0, NewException(IllegalInstruction, inst)
+			}
 		default:
 			return 0, NewException(IllegalInstruction, inst)
 		}
@@ -470,17 +1479,84 @@ func (cpu *Cpu) Execute(inst uint64) (uint64, *Exception) {
 				// addw
 				cpu.Regs[rd] = uint64(int64(int32(cpu.Regs[rs1] + cpu.Regs[rs2])))
 				return cpu.UpdatePC()
-			case 0x20:
-				// subw
-				cpu.Regs[rd] = uint64(int32(cpu.Regs[rs1] - cpu.Regs[rs2]))
+			case 0x01:
+				// mulw
+				cpu.Regs[rd] = uint64(int64(int32(cpu.Regs[rs1] * cpu.Regs[rs2])))
+				return cpu.UpdatePC()
+			case 0x20:
+				// subw
+				cpu.Regs[rd] = uint64(int32(cpu.Regs[rs1] - cpu.Regs[rs2]))
+				return cpu.UpdatePC()
+			case 0x04:
+				// add.uw
+				if !cpu.Ext.Zba {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				cpu.Regs[rd] = uint64(uint32(cpu.Regs[rs1])) + cpu.Regs[rs2]
+				return cpu.UpdatePC()
+			default:
+				return 0, NewException(IllegalInstruction, inst)
+			}
+		case 0x1:
+			switch funct7 {
+			case 0x00:
+				// sllw
+				cpu.Regs[rd] = uint64(int32(uint32(cpu.Regs[rs1]) << shamt))
+				return cpu.UpdatePC()
+			case 0x30:
+				// rolw
+				if !cpu.Ext.Zbb && !cpu.Ext.Zbkb {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				cpu.Regs[rd] = uint64(int64(int32(bits.RotateLeft32(uint32(cpu.Regs[rs1]), int(cpu.Regs[rs2]&0x1f)))))
+				return cpu.UpdatePC()
+			default:
+				return 0, NewException(IllegalInstruction, inst)
+			}
+		case 0x2:
+			switch funct7 {
+			case 0x10:
+				// sh1add.uw
+				if !cpu.Ext.Zba {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				cpu.Regs[rd] = (uint64(uint32(cpu.Regs[rs1])) << 1) + cpu.Regs[rs2]
+				return cpu.UpdatePC()
+			default:
+				return 0, NewException(IllegalInstruction, inst)
+			}
+		case 0x4:
+			switch funct7 {
+			case 0x01:
+				// divw
+				dividend := int32(cpu.Regs[rs1])
+				divisor := int32(cpu.Regs[rs2])
+				switch {
+				case divisor == 0:
+					cpu.Regs[rd] = 0xffffffffffffffff
+				case dividend == math.MinInt32 && divisor == -1:
+					cpu.Regs[rd] = uint64(int64(dividend))
+				default:
+					cpu.Regs[rd] = uint64(int64(dividend / divisor))
+				}
+				return cpu.UpdatePC()
+			case 0x10:
+				// sh2add.uw
+				if !cpu.Ext.Zba {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				cpu.Regs[rd] = (uint64(uint32(cpu.Regs[rs1])) << 2) + cpu.Regs[rs2]
+				return cpu.UpdatePC()
+			case 0x04:
+				// packw, which is zext.h with rs2 = x0
+				if !cpu.Ext.Zbkb && (!cpu.Ext.Zbb || rs2 != 0) {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				cpu.Regs[rd] = uint64(int64(int32(uint32(uint16(cpu.Regs[rs1])) | uint32(cpu.Regs[rs2])<<16)))
 				return cpu.UpdatePC()
 			default:
 				return 0, NewException(IllegalInstruction, inst)
 			}
-		case 0x1:
-			// sllw
-			cpu.Regs[rd] = uint64(int32(uint32(cpu.Regs[rs1]) << shamt))
-			return cpu.UpdatePC()
 		case 0x5:
 			switch funct7 {
 			case 0x00:
@@ -488,19 +1564,51 @@ func (cpu *Cpu) Execute(inst uint64) (uint64, *Exception) {
 				cpu.Regs[rd] = uint64(int32(uint32(cpu.Regs[rs1]) >> shamt))
 				return cpu.UpdatePC()
 			case 0x01:
-				// divu
-				if cpu.Regs[rs2] == 0 {
+				// divuw
+				dividend := uint32(cpu.Regs[rs1])
+				divisor := uint32(cpu.Regs[rs2])
+				if divisor == 0 {
 					cpu.Regs[rd] = 0xffffffffffffffff
 				} else {
-					dividend := cpu.Regs[rs1]
-					divisor := cpu.Regs[rs2]
-					cpu.Regs[rd] = dividend / divisor
+					cpu.Regs[rd] = uint64(int64(int32(dividend / divisor)))
 				}
 				return cpu.UpdatePC()
 			case 0x20:
 				// sraw
 				cpu.Regs[rd] = uint64(int32(cpu.Regs[rs1]) >> int32(shamt))
 				return cpu.UpdatePC()
+			case 0x30:
+				// rorw
+				if !cpu.Ext.Zbb && !cpu.Ext.Zbkb {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				cpu.Regs[rd] = uint64(int64(int32(bits.RotateLeft32(uint32(cpu.Regs[rs1]), -int(cpu.Regs[rs2]&0x1f)))))
+				return cpu.UpdatePC()
+			default:
+				return 0, NewException(IllegalInstruction, inst)
+			}
+		case 0x6:
+			switch funct7 {
+			case 0x01:
+				// remw
+				dividend := int32(cpu.Regs[rs1])
+				divisor := int32(cpu.Regs[rs2])
+				switch {
+				case divisor == 0:
+					cpu.Regs[rd] = uint64(int64(dividend))
+				case dividend == math.MinInt32 && divisor == -1:
+					cpu.Regs[rd] = 0
+				default:
+					cpu.Regs[rd] = uint64(int64(dividend % divisor))
+				}
+				return cpu.UpdatePC()
+			case 0x10:
+				// sh3add.uw
+				if !cpu.Ext.Zba {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				cpu.Regs[rd] = (uint64(uint32(cpu.Regs[rs1])) << 3) + cpu.Regs[rs2]
+				return cpu.UpdatePC()
 			default:
 				return 0, NewException(IllegalInstruction, inst)
 			}
@@ -508,12 +1616,12 @@ func (cpu *Cpu) Execute(inst uint64) (uint64, *Exception) {
 			switch funct7 {
 			case 0x01:
 				// remuw
-				if cpu.Regs[rs2] == 0 {
-					cpu.Regs[rd] = cpu.Regs[rs1]
+				dividend := uint32(cpu.Regs[rs1])
+				divisor := uint32(cpu.Regs[rs2])
+				if divisor == 0 {
+					cpu.Regs[rd] = uint64(int64(int32(dividend)))
 				} else {
-					dividend := cpu.Regs[rs1]
-					divisor := cpu.Regs[rs2]
-					cpu.Regs[rd] = uint64(int32(dividend % divisor))
+					cpu.Regs[rd] = uint64(int64(int32(dividend % divisor)))
 				}
 				return cpu.UpdatePC()
 			default:
@@ -531,37 +1639,37 @@ func (cpu *Cpu) Execute(inst uint64) (uint64, *Exception) {
 		case 0x0:
 			// beq
 			if cpu.Regs[rs1] == cpu.Regs[rs2] {
-				return cpu.Pc + imm, nil
+				return cpu.Jump(cpu.Pc + imm)
 			}
 			return cpu.UpdatePC()
 		case 0x1:
 			// bne
 			if cpu.Regs[rs1] != cpu.Regs[rs2] {
-				return cpu.Pc + imm, nil
+				return cpu.Jump(cpu.Pc + imm)
 			}
 			return cpu.UpdatePC()
 		case 0x4:
 			// blt
 			if int64(cpu.Regs[rs1]) < int64(cpu.Regs[rs2]) {
-				return cpu.Pc + imm, nil
+				return cpu.Jump(cpu.Pc + imm)
 			}
 			return cpu.UpdatePC()
 		case 0x5:
 			// bge
 			if int64(cpu.Regs[rs1]) >= int64(cpu.Regs[rs2]) {
-				return cpu.Pc + imm, nil
+				return cpu.Jump(cpu.Pc + imm)
 			}
 			return cpu.UpdatePC()
 		case 0x6:
 			// bltu
 			if cpu.Regs[rs1] < cpu.Regs[rs2] {
-				return cpu.Pc + imm, nil
+				return cpu.Jump(cpu.Pc + imm)
 			}
 			return cpu.UpdatePC()
 		case 0x7:
 			// bgeu
 			if cpu.Regs[rs1] >= cpu.Regs[rs2] {
-				return cpu.Pc + imm, nil
+				return cpu.Jump(cpu.Pc + imm)
 			}
 			return cpu.UpdatePC()
 		default:
@@ -569,25 +1677,75 @@ func (cpu *Cpu) Execute(inst uint64) (uint64, *Exception) {
 		}
 	case 0x67:
 		// jalr
-		t := cpu.Pc + 4
+		t := cpu.Pc + cpu.InstLen
 		imm := uint64(int64(int32(inst&0xfff00000)) >> 20)
-		newPC := (cpu.Regs[rs1] + imm) & ^(uint64(1))
+		newPC, exception := cpu.Jump((cpu.Regs[rs1] + imm) & ^(uint64(1)))
+		if exception != nil {
+			return 0, exception
+		}
 		cpu.Regs[rd] = t
 		return newPC, nil
 	case 0x6f:
 		// jal
-		cpu.Regs[rd] = cpu.Pc + 4
 		imm := uint64(int64(int32(inst&0x80000000))>>11) |
 			(inst & 0xff000) |
 			((inst >> 9) & 0x800) |
 			((inst >> 20) & 0x7fe)
-		return cpu.Pc + imm, nil
+		newPC, exception := cpu.Jump(cpu.Pc + imm)
+		if exception != nil {
+			return 0, exception
+		}
+		cpu.Regs[rd] = cpu.Pc + cpu.InstLen
+		return newPC, nil
 	case 0x73:
 		csrAddr := (inst & 0xfff00000) >> 20
+		// csrrs/csrrc and their immediate forms do not write with a zero
+		// rs1/uimm field.
+		write := funct3&0b11 == 0b01 || rs1 != 0
+		if funct3 != 0x0 && funct3 != 0x4 {
+			if exception := cpu.CheckCSRAccess(inst, csrAddr, write); exception != nil {
+				return 0, exception
+			}
+			csrAddr = cpu.Csr.Virtualize(csrAddr)
+		}
 		switch funct3 {
 		case 0x0:
-			if funct7 == 0x9 {
-				// sfence.vma
+			switch funct7 {
+			case 0x9, 0xb:
+				// sfence.vma, sinval.vma
+				if funct7 == 0xb && !cpu.Ext.Svinval {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				if cpu.Csr.V && (cpu.Mode == User || cpu.Csr.Load(HSTATUS)&MASK_VTVM != 0) {
+					return 0, NewException(VirtualInstruction, inst)
+				}
+				if cpu.Mode == User || (cpu.Mode == Supervisor && !cpu.Csr.V && cpu.Csr.Load(MSTATUS)&MASK_TVM != 0) {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				return cpu.UpdatePC()
+			case 0x11, 0x31, 0x13, 0x33:
+				// hfence.vvma, hfence.gvma, hinval.vvma, hinval.gvma
+				if funct7&0x2 != 0 && !cpu.Ext.Svinval {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				if cpu.Csr.V {
+					return 0, NewException(VirtualInstruction, inst)
+				}
+				if cpu.Mode == User || (funct7&^0x2 == 0x31 && cpu.Mode == Supervisor && cpu.Csr.Load(MSTATUS)&MASK_TVM != 0) {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				return cpu.UpdatePC()
+			case 0xc:
+				// sfence.w.inval, sfence.inval.ir
+				if !cpu.Ext.Svinval || rs2 > 1 || rs1 != 0 || rd != 0 {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				if cpu.Mode == User {
+					if cpu.Csr.V {
+						return 0, NewException(VirtualInstruction, inst)
+					}
+					return 0, NewException(IllegalInstruction, inst)
+				}
 				return cpu.UpdatePC()
 			}
 			switch rs2 {
@@ -596,173 +1754,438 @@ func (cpu *Cpu) Execute(inst uint64) (uint64, *Exception) {
 				case User:
 					return 0, NewException(EnvironmentCallFromUMode, cpu.Pc)
 				case Supervisor:
+					if cpu.Csr.V {
+						return 0, NewException(EnvironmentCallFromVSMode, cpu.Pc)
+					}
 					return 0, NewException(EnvironmentCallFromSMode, cpu.Pc)
 				case Machine:
 					return 0, NewException(EnvironmentCallFromMMode, cpu.Pc)
 				default:
 					panic("Invalud mode")
 				}
+			case 0x1:
+				// ebreak
+				return 0, NewException(Breakpoint, cpu.Pc)
 			case 0x2:
 				switch funct7 {
 				case 0x8:
 					// sret
-					sstatus := cpu.Csr.Load(SSTATUS)
+					if cpu.Csr.V && (cpu.Mode == User || cpu.Csr.Load(HSTATUS)&MASK_VTSR != 0) {
+						return 0, NewException(VirtualInstruction, inst)
+					}
+					if cpu.Mode == User || (cpu.Mode == Supervisor && !cpu.Csr.V && cpu.Csr.Load(MSTATUS)&MASK_TSR != 0) {
+						return 0, NewException(IllegalInstruction, inst)
+					}
+					// In VS-mode sret uses vsstatus and vsepc and stays in the
+					// guest; in HS-mode hstatus.SPV selects whether to enter it.
+					sstatusAddr, sepcAddr := cpu.Csr.Virtualize(SSTATUS), cpu.Csr.Virtualize(SEPC)
+					if !cpu.Csr.V {
+						hstatus := cpu.Csr.Load(HSTATUS)
+						cpu.Csr.V = hstatus&MASK_HSTATUS_SPV != 0
+						cpu.Csr.Store(HSTATUS, hstatus&^MASK_HSTATUS_SPV)
+					}
+					sstatus := cpu.Csr.Load(sstatusAddr)
 					cpu.Mode = Mode((sstatus & MASK_SPP) >> 8)
 					spie := (sstatus & MASK_SPIE) >> 5
 					sstatus = (sstatus & ^uint64(MASK_SIE)) | (spie << 1)
 					sstatus |= MASK_SPIE
 					sstatus &= ^uint64(MASK_SPP)
-					cpu.Csr.Store(SSTATUS, sstatus)
-					newPC := cpu.Csr.Load(SEPC) & ^uint64(0b11)
+					cpu.Csr.Store(sstatusAddr, sstatus)
+					newPC := cpu.Csr.Load(sepcAddr) & ^(cpu.IAlign() - 1)
 					return newPC, nil
 				case 0x18:
 					// mret
+					if cpu.Mode != Machine {
+						return 0, NewException(IllegalInstruction, inst)
+					}
 					mstatus := cpu.Csr.Load(MSTATUS)
 					cpu.Mode = Mode((mstatus & MASK_MPP) >> 11)
+					if cpu.Mode != Machine {
+						cpu.Csr.V = mstatus&MASK_MPV != 0
+					}
+					mstatus &^= MASK_MPV
 					mpie := (mstatus & MASK_MPIE) >> 7
 					mstatus = (mstatus & ^uint64(MASK_MIE)) | (mpie << 3)
 					mstatus |= MASK_MPIE
 					mstatus &= ^uint64(MASK_MPP)
 					mstatus &= ^uint64(MASK_MPRV)
 					cpu.Csr.Store(MSTATUS, mstatus)
-					newPC := cpu.Csr.Load(MEPC) & ^uint64(0b11)
+					tcontrol := cpu.Csr.Load(TCONTROL)
+					cpu.Csr.Store(TCONTROL, tcontrol&^TCONTROL_MTE|(tcontrol&TCONTROL_MPTE)>>4)
+					newPC := cpu.Csr.Load(MEPC) & ^(cpu.IAlign() - 1)
 					return newPC, nil
 				default:
 					return 0, NewException(IllegalInstruction, inst)
 				}
+			case 0x5:
+				if funct7 != 0x8 {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				// wfi
+				// Waiting is unbounded, so U-mode may never stall, and less
+				// privileged modes may not with mstatus.TW set. hstatus.VTW
+				// does the same for VS-mode.
+				if (cpu.Mode == User && !cpu.Csr.V) || (cpu.Mode != Machine && cpu.Csr.Load(MSTATUS)&MASK_TW != 0) {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				if cpu.Csr.V && (cpu.Mode == User || cpu.Csr.Load(HSTATUS)&MASK_VTW != 0) {
+					return 0, NewException(VirtualInstruction, inst)
+				}
+				cpu.Waiting = true
+				return cpu.UpdatePC()
 			default:
 				return 0, NewException(IllegalInstruction, inst)
 			}
 		case 0x1:
 			// csrrw
-			t := cpu.Csr.Load(csrAddr)
-			cpu.Csr.Store(csrAddr, cpu.Regs[rs1])
+			t := cpu.ReadCSR(csrAddr)
+			cpu.WriteCSR(csrAddr, cpu.Regs[rs1])
 			cpu.Regs[rd] = t
 			cpu.UpdatePaging(csrAddr)
 			return cpu.UpdatePC()
 		case 0x2:
 			// csrrs
-			t := cpu.Csr.Load(csrAddr)
-			cpu.Csr.Store(csrAddr, t|cpu.Regs[rs1])
+			t := cpu.ReadCSR(csrAddr)
+			if write {
+				cpu.WriteCSR(csrAddr, t|cpu.Regs[rs1])
+			}
 			cpu.Regs[rd] = t
 			cpu.UpdatePaging(csrAddr)
 			return cpu.UpdatePC()
 		case 0x3:
 			// csrrc
-			t := cpu.Csr.Load(csrAddr)
-			cpu.Csr.Store(csrAddr, t & ^cpu.Regs[rs1])
+			t := cpu.ReadCSR(csrAddr)
+			if write {
+				cpu.WriteCSR(csrAddr, t & ^cpu.Regs[rs1])
+			}
 			cpu.Regs[rd] = t
 			cpu.UpdatePaging(csrAddr)
 			return cpu.UpdatePC()
+		case 0x4:
+			return cpu.ExecuteHypervisorMemory(inst)
 		case 0x5:
 			// csrrwi
 			zimm := rs1
-			cpu.Regs[rd] = cpu.Csr.Load(csrAddr)
-			cpu.Csr.Store(csrAddr, zimm)
+			cpu.Regs[rd] = cpu.ReadCSR(csrAddr)
+			cpu.WriteCSR(csrAddr, zimm)
 			cpu.UpdatePaging(csrAddr)
 			return cpu.UpdatePC()
 		case 0x6:
 			// csrrsi
 			zimm := rs1
-			t := cpu.Csr.Load(csrAddr)
-			cpu.Csr.Store(csrAddr, t|zimm)
+			t := cpu.ReadCSR(csrAddr)
+			if write {
+				cpu.WriteCSR(csrAddr, t|zimm)
+			}
 			cpu.Regs[rd] = t
 			cpu.UpdatePaging(csrAddr)
 			return cpu.UpdatePC()
 		case 0x7:
 			// csrrci
 			zimm := rs1
-			t := cpu.Csr.Load(csrAddr)
-			cpu.Csr.Store(csrAddr, t & ^zimm)
+			t := cpu.ReadCSR(csrAddr)
+			if write {
+				cpu.WriteCSR(csrAddr, t & ^zimm)
+			}
 			cpu.Regs[rd] = t
 			cpu.UpdatePaging(csrAddr)
 			return cpu.UpdatePC()
 		default:
 			return 0, NewException(IllegalInstruction, inst)
 		}
+	case OPCODE_CUSTOM_0, OPCODE_CUSTOM_1, OPCODE_CUSTOM_2, OPCODE_CUSTOM_3:
+		return cpu.executeCustom(inst)
 	default:
 		return 0, NewException(IllegalInstruction, inst)
 	}
 }
 
+// CheckCSRAccess returns the exception raised by a CSR instruction that may
+// not access csrAddr in the current mode and state, or nil. write is set when
+// the instruction writes the CSR.
+func (cpu *Cpu) CheckCSRAccess(inst, csrAddr uint64, write bool) *Exception {
+	// The RV32-only CSRs holding upper halves follow the rules of the CSR
+	// they extend.
+	if addr, ok := csrHigh(csrAddr); ok && cpu.XLEN() == 32 {
+		csrAddr = addr
+	}
+	// Bits 9:8 hold the lowest privilege level that may access the CSR, and
+	// 0b11 in bits 11:10 marks it read-only.
+	if !cpu.Csr.Exists(csrAddr) || (write && (csrAddr>>10)&0b11 == 0b11) {
+		return NewException(IllegalInstruction, inst)
+	}
+	// Hypervisor and VS CSRs (level 0b10) belong to HS-mode. A guest touching
+	// a CSR that HS-mode could access raises a virtual-instruction exception.
+	level := Mode((csrAddr >> 8) & 0b11)
+	if cpu.Csr.V && (level == 0b10 || (level == Supervisor && cpu.Mode == User)) {
+		return NewException(VirtualInstruction, inst)
+	}
+	if level == 0b10 {
+		level = Supervisor
+	}
+	if level > cpu.Mode {
+		return NewException(IllegalInstruction, inst)
+	}
+	switch {
+	case csrAddr == SEED:
+		// seed must be written, so read-only accesses trap too.
+		if !cpu.Ext.Zkr || !write {
+			return NewException(IllegalInstruction, inst)
+		}
+		mseccfg := cpu.Csr.Load(MSECCFG)
+		switch {
+		case cpu.Mode == Machine:
+		case cpu.Csr.V && mseccfg&MSECCFG_SSEED != 0:
+			return NewException(VirtualInstruction, inst)
+		case cpu.Csr.V:
+			return NewException(IllegalInstruction, inst)
+		case cpu.Mode == Supervisor && mseccfg&MSECCFG_SSEED == 0,
+			cpu.Mode == User && mseccfg&MSECCFG_USEED == 0:
+			return NewException(IllegalInstruction, inst)
+		}
+	case csrAddr == MISELECT, csrAddr == MIREG, csrAddr == MTOPEI, csrAddr == MTOPI,
+		csrAddr == SISELECT, csrAddr == SIREG, csrAddr == STOPEI, csrAddr == STOPI:
+		return cpu.checkAIAAccess(inst, csrAddr)
+	case csrAddr == SATP:
+		if cpu.Csr.V && cpu.Csr.Load(HSTATUS)&MASK_VTVM != 0 {
+			return NewException(VirtualInstruction, inst)
+		}
+		if cpu.Mode == Supervisor && !cpu.Csr.V && cpu.Csr.Load(MSTATUS)&MASK_TVM != 0 {
+			return NewException(IllegalInstruction, inst)
+		}
+	case csrAddr == STIMECMP, csrAddr == VSTIMECMP:
+		// Sstc: menvcfg.STCE and mcounteren.TM let S-mode at the timer, and
+		// henvcfg.STCE and hcounteren.TM a guest.
+		if cpu.Mode < Machine && (cpu.Csr.Load(MENVCFG)&MENVCFG_STCE == 0 || cpu.Csr.Load(MCOUNTEREN)&MASK_TM == 0) {
+			return NewException(IllegalInstruction, inst)
+		}
+		if cpu.Csr.V && (cpu.Csr.Load(HENVCFG)&MENVCFG_STCE == 0 || cpu.Csr.Load(HCOUNTEREN)&MASK_TM == 0) {
+			return NewException(VirtualInstruction, inst)
+		}
+	case csrAddr == HGATP:
+		if cpu.Mode == Supervisor && cpu.Csr.Load(MSTATUS)&MASK_TVM != 0 {
+			return NewException(IllegalInstruction, inst)
+		}
+	case csrAddr >= FFLAGS && csrAddr <= FCSR:
+		if !cpu.Csr.FSEnabled() {
+			return NewException(IllegalInstruction, inst)
+		}
+	case csrAddr >= VSTART && csrAddr <= VCSR, csrAddr >= VL && csrAddr <= VLENB:
+		if !cpu.Csr.VSEnabled() {
+			return NewException(IllegalInstruction, inst)
+		}
+	case csrAddr >= CYCLE && csrAddr <= HPMCOUNTER31:
+		bit := uint64(1) << (csrAddr - CYCLE)
+		if cpu.Mode < Machine && cpu.Csr.Load(MCOUNTEREN)&bit == 0 {
+			return NewException(IllegalInstruction, inst)
+		}
+		if cpu.Csr.V && cpu.Csr.Load(HCOUNTEREN)&bit == 0 {
+			return NewException(VirtualInstruction, inst)
+		}
+		if cpu.Mode < Supervisor && cpu.Csr.Load(SCOUNTEREN)&bit == 0 {
+			if cpu.Csr.V {
+				return NewException(VirtualInstruction, inst)
+			}
+			return NewException(IllegalInstruction, inst)
+		}
+	}
+	return nil
+}
+
+// ReadCSR reads a CSR as seen by CSR instructions, including the ones backed
+// by devices rather than the CSR file.
+func (cpu *Cpu) ReadCSR(csrAddr uint64) uint64 {
+	if cpu.XLEN() == 32 {
+		return cpu.readCSR32(csrAddr)
+	}
+	return cpu.readCSR(csrAddr)
+}
+
+// WriteCSR writes a CSR on behalf of a CSR instruction.
+func (cpu *Cpu) WriteCSR(csrAddr, value uint64) {
+	if cpu.XLEN() == 32 {
+		cpu.writeCSR32(csrAddr, value)
+		return
+	}
+	cpu.writeCSR(csrAddr, value)
+}
+
+func (cpu *Cpu) writeCSR(csrAddr, value uint64) {
+	switch csrAddr {
+	case MIREG, SIREG, MTOPEI, STOPEI:
+		cpu.writeAIA(csrAddr, value)
+	default:
+		cpu.Csr.Store(csrAddr, value)
+	}
+}
+
+func (cpu *Cpu) readCSR(csrAddr uint64) uint64 {
+	switch csrAddr {
+	case TIME:
+		if cpu.Csr.V {
+			return cpu.Bus.clint.mtime + cpu.Csr.Load(HTIMEDELTA)
+		}
+		return cpu.Bus.clint.mtime
+	case MIP, SIP, HIP, VSIP:
+		cpu.UpdateTimers()
+		cpu.updateAIA()
+		return cpu.Csr.Load(csrAddr)
+	case MIREG, SIREG, MTOPEI, STOPEI, MTOPI, STOPI:
+		return cpu.readAIA(csrAddr)
+	case VLENB:
+		return cpu.VLEN / 8
+	case SCOUNTOVF:
+		return cpu.scountovf()
+	case SEED:
+		return cpu.ReadSeed()
+	default:
+		return cpu.Csr.Load(csrAddr)
+	}
+}
+
 func (cpu *Cpu) HandleInterrupt(interrupt Interrupt) {
-	pc := cpu.Pc
-	mode := cpu.Mode
-	cause := interrupt.Code()
-	trapInSMode := mode <= Supervisor && cpu.Csr.IsMidelegated(cause)
-	var STATUS, TVEC, CAUSE, TVAL, EPC, MASK_PIE, pie_i, MASK_IE, ie_i, MASK_PP, pp_i uint64
-	if trapInSMode {
-		cpu.Mode = Supervisor
-		STATUS, TVEC, CAUSE, TVAL, EPC, MASK_PIE, pie_i, MASK_IE, ie_i, MASK_PP, pp_i =
-			SSTATUS, STVEC, SCAUSE, STVAL, SEPC, MASK_SPIE, 5, MASK_SIE, 1, MASK_SPP, 8
-	} else {
-		cpu.Mode = Machine
-		STATUS, TVEC, CAUSE, TVAL, EPC, MASK_PIE, pie_i, MASK_IE, ie_i, MASK_PP, pp_i =
-			MSTATUS, MTVEC, MCAUSE, MTVAL, MEPC, MASK_MPIE, 7, MASK_MIE, 3, MASK_MPP, 11
+	mode, virt := cpu.Mode, cpu.Csr.V
+	cpu.takeTrap(interrupt.Code(), 0, 0, false)
+	cpu.matchTrap(interrupt.Code(), mode, virt)
+}
+
+// UpdateTimers compares the CLINT time against stimecmp, and the guest's time
+// against vstimecmp, to drive the Sstc timer interrupts.
+func (cpu *Cpu) UpdateTimers() {
+	mtime := cpu.Bus.clint.mtime
+	var pending uint64
+	if mtime >= cpu.Csr.Load(STIMECMP) {
+		pending |= MASK_STIP
 	}
-	tvec := cpu.Csr.Load(TVEC)
-	tvecMode := tvec & 0b11
-	tvecBase := tvec & ^uint64(0b11)
-	switch tvecMode {
-	case 0:
-		cpu.Pc = tvecBase
-	case 1:
-		cpu.Pc = tvecBase + cause<<2
+	if mtime+cpu.Csr.Load(HTIMEDELTA) >= cpu.Csr.Load(VSTIMECMP) {
+		pending |= MASK_VSTIP
 	}
-	cpu.Csr.Store(EPC, pc)
-	cpu.Csr.Store(CAUSE, cause)
-	cpu.Csr.Store(TVAL, 0)
-	status := cpu.Csr.Load(STATUS)
-	ie := (status & MASK_IE) >> ie_i
-	status = (status & ^MASK_PIE) | (ie << pie_i)
-	status &= ^MASK_IE
-	status = (status & ^MASK_PP) | (uint64(mode) << pp_i)
-	cpu.Csr.Store(STATUS, status)
+	cpu.Csr.SetTimerPending(pending)
 }
 
-func (cpu *Cpu) CheckPendingInterrupt() *Interrupt {
-	if cpu.Mode == Machine && (cpu.Csr.Load(MSTATUS)&MASK_MIE) == 0 {
-		return nil
+// timerDeadline returns the earliest future time at which an enabled Sstc
+// timer interrupt becomes pending.
+func (cpu *Cpu) timerDeadline() (uint64, bool) {
+	mtime := cpu.Bus.clint.mtime
+	mie := cpu.Csr.Load(MIE)
+	menvcfg := cpu.Csr.Load(MENVCFG)
+	var deadline uint64
+	found := false
+	if menvcfg&MENVCFG_STCE != 0 && mie&MASK_STIP != 0 {
+		if t := cpu.Csr.Load(STIMECMP); t > mtime {
+			deadline, found = t, true
+		}
 	}
-	if cpu.Mode == Supervisor && (cpu.Csr.Load(SSTATUS)&MASK_SIE) == 0 {
-		return nil
+	if menvcfg&cpu.Csr.Load(HENVCFG)&MENVCFG_STCE != 0 && mie&MASK_VSTIP != 0 {
+		if t := cpu.Csr.Load(VSTIMECMP) - cpu.Csr.Load(HTIMEDELTA); t > mtime && (!found || t < deadline) {
+			deadline, found = t, true
+		}
 	}
-	if cpu.Bus.uart.IsInterrupting() {
-		cpu.Bus.Store(PLIC_SCLAIM, 32, UART_IRQ)
-		cpu.Csr.Store(MIP, cpu.Csr.Load(MIP)|MASK_SEIP)
-	} else if cpu.Bus.virtioBlock.IsInterrupting() {
-		cpu.DiskAccess()
-		cpu.Bus.Store(PLIC_SCLAIM, 32, VIRTIO_IRQ)
-		cpu.Csr.Store(MIP, cpu.Csr.Load(MIP)|MASK_SEIP)
+	return deadline, found
+}
+
+// InterruptPending reports whether an interrupt is pending and enabled in mie,
+// regardless of the global enables. Device interrupts count as SEIP.
+func (cpu *Cpu) InterruptPending() bool {
+	cpu.UpdateTimers()
+	cpu.updateAIA()
+	pending := cpu.Csr.Load(MIP)
+	if cpu.Bus.uart.Pending() || cpu.Bus.virtioBlock.Pending() {
+		pending |= MASK_SEIP
 	}
-	pending := cpu.Csr.Load(MIE) & cpu.Csr.Load(MIP)
-	if (pending & MASK_MEIP) != 0 {
-		cpu.Csr.Store(MIP, cpu.Csr.Load(MIP) & ^uint64(MASK_MEIP))
-		return &MachineExternalInterrupt
+	return pending&cpu.Csr.Load(MIE) != 0
+}
+
+// WaitForInterrupt idles the host thread while the hart is stalled in wfi,
+// polling for a pending interrupt once a millisecond. Time skips ahead to the
+// next Sstc timer deadline, since it only advances as instructions run.
+func (cpu *Cpu) WaitForInterrupt() {
+	for !cpu.InterruptPending() {
+		if deadline, ok := cpu.timerDeadline(); ok {
+			cpu.Bus.clint.mtime = deadline
+			continue
+		}
+		time.Sleep(time.Millisecond)
 	}
-	if (pending & MASK_MSIP) != 0 {
-		cpu.Csr.Store(MIP, cpu.Csr.Load(MIP) & ^uint64(MASK_MSIP))
-		return &MachineSoftwareInterrupt
+	cpu.Waiting = false
+}
+
+func (cpu *Cpu) CheckPendingInterrupt() *Interrupt {
+	// Interrupts trapping to M-mode are enabled in less privileged modes or by
+	// mstatus.MIE, and those mideleg delegates to HS-mode in less privileged
+	// modes or by sstatus.SIE. HS-level interrupts are always enabled while a
+	// guest runs.
+	mEnabled := cpu.Mode < Machine || cpu.Csr.Load(MSTATUS)&MASK_MIE != 0
+	sEnabled := cpu.Mode < Supervisor || cpu.Csr.V || (cpu.Mode == Supervisor && cpu.Csr.Load(SSTATUS)&MASK_SIE != 0)
+	// The APLIC and IMSICs latch device interrupts themselves, so they are
+	// updated whatever the current mode enables. Without AIA, devices are only
+	// polled while interrupts of the current mode are enabled, so that one
+	// waiting in the PLIC claim register is taken before the next device
+	// replaces it.
+	if cpu.Ext.Smaia {
+		cpu.pollAIA()
+	} else if (cpu.Mode == Machine && mEnabled) || (cpu.Mode < Machine && sEnabled) {
+		cpu.pollDevices()
 	}
-	if (pending & MASK_MTIP) != 0 {
-		cpu.Csr.Store(MIP, cpu.Csr.Load(MIP) & ^uint64(MASK_MTIP))
-		return &MachineTimerInterrupt
+	cpu.UpdateTimers()
+	pending := cpu.Csr.Load(MIE) & cpu.Csr.Load(MIP)
+	mideleg := cpu.Csr.Load(MIDELEG)
+	// VS-level interrupts delegated by hideleg are taken only by the guest.
+	hideleg := cpu.Csr.Load(HIDELEG) & MASK_VS_INT
+	var enabled [3]uint64
+	if mEnabled {
+		enabled[0] = pending &^ mideleg
 	}
-	if (pending & MASK_SEIP) != 0 {
-		cpu.Csr.Store(MIP, cpu.Csr.Load(MIP) & ^uint64(MASK_SEIP))
-		return &SupervisorExternalInterrupt
+	if sEnabled {
+		enabled[1] = pending & mideleg &^ hideleg
 	}
-	if (pending & MASK_SSIP) != 0 {
-		cpu.Csr.Store(MIP, cpu.Csr.Load(MIP) & ^uint64(MASK_SSIP))
-		return &SupervisorSoftwareInterrupt
+	if cpu.Csr.V && (cpu.Mode == User || cpu.Csr.Load(VSSTATUS)&MASK_SIE != 0) {
+		enabled[2] = pending & hideleg
 	}
-	if (pending & MASK_STIP) != 0 {
-		cpu.Csr.Store(MIP, cpu.Csr.Load(MIP) & ^uint64(MASK_STIP))
-		return &SupervisorTimerInterrupt
+	for _, level := range enabled {
+		for _, interrupt := range interruptPriority {
+			bit := uint64(1) << *interrupt
+			if level&bit == 0 {
+				continue
+			}
+			// VS-level interrupts follow hvip and stay pending until the
+			// hypervisor clears them, and LCOFIP until software does.
+			if bit&(MASK_VS_INT|MASK_LCOFIP) == 0 {
+				cpu.Csr.ClearPending(bit)
+			}
+			return interrupt
+		}
 	}
 	return nil
 }
 
+// pollAIA signals the interrupts of the UART and virtio block device to the
+// APLIC, which decides where they go, and updates the pending bits the AIA
+// drives.
+func (cpu *Cpu) pollAIA() {
+	if cpu.Bus.uart.IsInterrupting() {
+		cpu.Bus.Interrupt(UART_IRQ)
+	}
+	if cpu.Bus.virtioBlock.IsInterrupting() {
+		cpu.DiskAccess()
+		cpu.Bus.Interrupt(VIRTIO_IRQ)
+	}
+	cpu.updateAIA()
+}
+
+// pollDevices raises the interrupts of the UART and virtio block device
+// through the PLIC.
+func (cpu *Cpu) pollDevices() {
+	if cpu.Bus.uart.IsInterrupting() {
+		cpu.Bus.Store(PLIC_SCLAIM, 32, UART_IRQ)
+		cpu.Csr.SetPending(MASK_SEIP)
+	} else if cpu.Bus.virtioBlock.IsInterrupting() {
+		cpu.DiskAccess()
+		cpu.Bus.Store(PLIC_SCLAIM, 32, VIRTIO_IRQ)
+		cpu.Csr.SetPending(MASK_SEIP)
+	}
+}
+
 func (cpu *Cpu) DiskAccess() {
 	descSize := uint64(unsafe.Sizeof(VirtqDesc{}))
 	descAddr := cpu.Bus.virtioBlock.DescAddr()
@@ -810,87 +2233,346 @@ func (cpu *Cpu) UpdatePaging(csrAddr uint64) {
 	}
 	satp := cpu.Csr.Load(SATP)
 	cpu.PageTable = (satp & MASK_PPN) * PAGE_SIZE
-	mode := satp >> 60
-	cpu.EnablePaging = mode == 8
+	cpu.PageLevels = satpLevels(satp >> 60)
+	cpu.EnablePaging = cpu.PageLevels != 0
+}
+
+// satpLevels returns the page table depth for a satp, vsatp or hgatp mode,
+// or 0 for Bare.
+func satpLevels(mode uint64) int {
+	switch mode {
+	case SATP_MODE_SV32:
+		return 2
+	case SATP_MODE_SV39:
+		return 3
+	case SATP_MODE_SV48:
+		return 4
+	case SATP_MODE_SV57:
+		return 5
+	default:
+		return 0
+	}
+}
+
+// TranslationMode returns the privilege mode whose permissions apply to an
+// access: with mstatus.MPRV set, M-mode loads and stores use mstatus.MPP.
+func (cpu *Cpu) TranslationMode(accessType AccessType) Mode {
+	mstatus := cpu.Csr.Load(MSTATUS)
+	if accessType != Instruction && cpu.Mode == Machine && mstatus&MASK_MPRV != 0 {
+		return Mode((mstatus & MASK_MPP) >> 11)
+	}
+	return cpu.Mode
+}
+
+// TranslationVirt reports whether an access goes through two-stage guest
+// translation: while V=1, or with mstatus.MPRV set and mstatus.MPV selecting
+// a guest mode.
+func (cpu *Cpu) TranslationVirt(accessType AccessType) bool {
+	mstatus := cpu.Csr.Load(MSTATUS)
+	if accessType != Instruction && cpu.Mode == Machine && mstatus&MASK_MPRV != 0 {
+		return Mode((mstatus&MASK_MPP)>>11) != Machine && mstatus&MASK_MPV != 0
+	}
+	return cpu.Csr.V
+}
+
+// CheckPMP raises an access fault for the virtual address addr when physical
+// memory protection denies the access to pAddr.
+func (cpu *Cpu) CheckPMP(addr, pAddr, size uint64, accessType AccessType) *Exception {
+	if !cpu.Csr.PMPAllows(pAddr, size, accessType, cpu.TranslationMode(accessType)) {
+		return accessFault(addr, accessType)
+	}
+	return nil
+}
+
+func pageFault(addr uint64, accessType AccessType) *Exception {
+	switch accessType {
+	case Instruction:
+		return NewException(InstructionPageFault, addr)
+	case Load:
+		return NewException(LoadPageFault, addr)
+	default:
+		return NewException(StoreAMOPageFault, addr)
+	}
+}
+
+func accessFault(addr uint64, accessType AccessType) *Exception {
+	switch accessType {
+	case Instruction:
+		return NewException(InstructionAccessFault, addr)
+	case Load:
+		return NewException(LoadAccessFault, addr)
+	default:
+		return NewException(StoreAMOAccessFault, addr)
+	}
 }
 
+// Translate translates a virtual address for an access in the current mode.
+// Addresses computed in a 32-bit mode wrap at 4 GiB.
 func (cpu *Cpu) Translate(addr uint64, accessType AccessType) (uint64, *Exception) {
-	if !cpu.EnablePaging {
+	if cpu.XLEN() == 32 {
+		addr = uint64(uint32(addr))
+	}
+	return cpu.translate(addr, accessType, cpu.TranslationMode(accessType), cpu.TranslationVirt(accessType), false)
+}
+
+// translate translates addr with the permissions of mode. With virt set the
+// address goes through the VS-stage (vsatp) and then the G-stage (hgatp);
+// hlvx asks for execute permission on a load.
+func (cpu *Cpu) translate(addr uint64, accessType AccessType, mode Mode, virt, hlvx bool) (uint64, *Exception) {
+	if mode == Machine {
 		return addr, nil
 	}
-	levels := 3
-	vpn := []uint64{
-		(addr >> 12) & 0x1ff,
-		(addr >> 21) & 0x1ff,
-		(addr >> 30) & 0x1ff,
+	mstatus := cpu.Csr.Load(MSTATUS)
+	menvcfg := cpu.Csr.Load(MENVCFG)
+	if !virt {
+		if !cpu.EnablePaging {
+			return addr, nil
+		}
+		cpu.countTLBMiss(accessType)
+		return cpu.walk(addr, accessType, pageWalk{
+			root:      cpu.PageTable,
+			levels:    cpu.PageLevels,
+			mode:      mode,
+			sum:       mstatus&MASK_SUM != 0,
+			mxr:       mstatus&MASK_MXR != 0,
+			adue:      menvcfg&MENVCFG_ADUE != 0,
+			pbmte:     menvcfg&MENVCFG_PBMTE != 0,
+			va:        addr,
+			faultType: accessType,
+		})
+	}
+
+	gpa := addr
+	vsatp := cpu.Csr.Load(VSATP)
+	if satpLevels(vsatp>>60) != 0 || satpLevels(cpu.Csr.Load(HGATP)>>60) != 0 {
+		cpu.countTLBMiss(accessType)
+	}
+	if levels := satpLevels(vsatp >> 60); levels != 0 {
+		vsstatus := cpu.Csr.Load(VSSTATUS)
+		var exception *Exception
+		gpa, exception = cpu.walk(addr, accessType, pageWalk{
+			root:   (vsatp & MASK_PPN) * PAGE_SIZE,
+			levels: levels,
+			mode:   mode,
+			sum:    vsstatus&MASK_SUM != 0,
+			// sstatus.MXR applies to both stages, vsstatus.MXR to this one.
+			mxr:       (mstatus|vsstatus)&MASK_MXR != 0,
+			adue:      menvcfg&cpu.Csr.Load(HENVCFG)&MENVCFG_ADUE != 0,
+			pbmte:     menvcfg&cpu.Csr.Load(HENVCFG)&MENVCFG_PBMTE != 0,
+			hlvx:      hlvx,
+			vs:        true,
+			va:        addr,
+			faultType: accessType,
+		})
+		if exception != nil {
+			exception.GVA = true
+			return 0, exception
+		}
+	}
+	pAddr, exception := cpu.gStage(gpa, accessType, addr, accessType, hlvx)
+	if exception != nil {
+		exception.GVA = true
+	}
+	return pAddr, exception
+}
+
+// pageWalk describes one stage of address translation.
+type pageWalk struct {
+	root   uint64
+	levels int
+	// mode is the privilege mode whose permissions apply.
+	mode                  Mode
+	sum, mxr, adue, pbmte bool
+	// hlvx asks for execute instead of read permission on loads.
+	hlvx bool
+	// guest marks the G-stage, which has 2 extra root index bits, requires
+	// U=1 and raises guest-page faults.
+	guest bool
+	// vs marks the VS-stage, whose page tables sit at guest physical
+	// addresses.
+	vs bool
+	// va and faultType describe the original access for faults.
+	va        uint64
+	faultType AccessType
+}
+
+// walk translates addr through one stage. Missing A/D bits are set in the PTE
+// when adue is set (Svadu) and raise a page fault otherwise (Svade).
+func (cpu *Cpu) walk(addr uint64, accessType AccessType, w pageWalk) (uint64, *Exception) {
+	cpu.Csr.CountEvent(HPM_EVENT_PAGE_WALK, cpu.Mode, cpu.Csr.V)
+	fault := func() *Exception {
+		if w.guest {
+			return guestPageFault(w.va, addr, w.faultType)
+		}
+		return pageFault(w.va, w.faultType)
+	}
+	// Sv32, the only two-level scheme, has 4-byte PTEs and 10-bit VPNs.
+	vpnBits, pteSize := 9, uint64(8)
+	if w.levels == 2 {
+		vpnBits, pteSize = 10, 4
+	}
+	vpnMask := uint64(1)<<vpnBits - 1
+	vaBits := uint64(12 + vpnBits*w.levels)
+	if w.guest {
+		// Guest physical addresses are zero-extended and 2 bits wider.
+		if addr>>(vaBits+2) != 0 {
+			return 0, fault()
+		}
+	} else if w.levels == 2 {
+		if addr>>vaBits != 0 {
+			return 0, fault()
+		}
+	} else if signExtend(addr, vaBits) != addr {
+		// The address must be sign-extended from its top translated bit.
+		return 0, fault()
 	}
-	a := cpu.PageTable
-	i := levels - 1
-	var pte uint64
+	a := w.root
+	i := w.levels - 1
+	var pte, pteAddr, index uint64
 	for {
+		index = (addr >> (12 + vpnBits*i)) & vpnMask
+		if w.guest && i == w.levels-1 {
+			index = (addr >> (12 + vpnBits*i)) & (vpnMask<<2 | 0b11)
+		}
 		var exception *Exception
-		pte, exception = cpu.Bus.Load(a+vpn[i]*8, 64)
+		pteAddr, exception = cpu.pteAddress(a+index*pteSize, Load, w)
 		if exception != nil {
 			return 0, exception
 		}
-		v := pte & 1
-		r := (pte >> 1) & 1
-		w := (pte >> 2) & 1
-		x := (pte >> 3) & 1
-		if v == 0 || (r == 0 && w == 1) {
-			switch accessType {
-			case Instruction:
-				return 0, NewException(InstructionPageFault, addr)
-			case Load:
-				return 0, NewException(LoadPageFault, addr)
-			case Store:
-				return 0, NewException(StoreAMOPageFault, addr)
-			}
-		}
-		if r == 1 || x == 1 {
+		// The walk itself is checked by PMP as an S-mode access.
+		if !cpu.Csr.PMPAllows(pteAddr, pteSize*8, Load, Supervisor) {
+			return 0, accessFault(w.va, w.faultType)
+		}
+		pte, exception = cpu.Bus.Load(pteAddr, pteSize*8)
+		if exception != nil {
+			return 0, accessFault(w.va, w.faultType)
+		}
+		if pte&PTE_V == 0 || (pte&PTE_R == 0 && pte&PTE_W != 0) || pte&MASK_PTE_RESERVED != 0 {
+			return 0, fault()
+		}
+		if pte&(PTE_R|PTE_X) != 0 {
 			break
 		}
+		// A, D, U, N and PBMT are reserved in non-leaf PTEs.
+		if pte&(PTE_A|PTE_D|PTE_U|PTE_N|MASK_PTE_PBMT) != 0 {
+			return 0, fault()
+		}
 		i -= 1
-		ppn := (pte >> 10) & 0x0fff_ffff_ffff
-		a = ppn * PAGE_SIZE
 		if i < 0 {
-			switch accessType {
-			case Instruction:
-				return 0, NewException(InstructionPageFault, addr)
-			case Load:
-				return 0, NewException(LoadPageFault, addr)
-			case Store:
-				return 0, NewException(StoreAMOPageFault, addr)
-			}
+			return 0, fault()
 		}
+		a = ((pte >> 10) & MASK_PPN) * PAGE_SIZE
+	}
+
+	// The memory types are checked but have no effect, since caches and
+	// memory ordering are not modelled.
+	if pbmt := (pte & MASK_PTE_PBMT) >> 61; pbmt != PBMT_PMA && (!cpu.Ext.Svpbmt || !w.pbmte || pbmt == PBMT_RESERVED) {
+		return 0, fault()
+	}
+	// A NAPOT PTE maps its 4 KiB page as part of a 64 KiB one, and encodes
+	// the size in PPN[3:0] = 0b1000.
+	napot := pte&PTE_N != 0
+	if napot && (!cpu.Ext.Svnapot || i != 0 || (pte>>10)&0xf != 0b1000) {
+		return 0, fault()
 	}
 
-	ppn := []uint64{
-		(pte >> 10) & 0x1ff,
-		(pte >> 19) & 0x1ff,
-		(pte >> 28) & 0x03ff_ffff,
+	var permitted bool
+	switch accessType {
+	case Instruction:
+		permitted = pte&PTE_X != 0
+	case Load:
+		if w.hlvx {
+			permitted = pte&PTE_X != 0
+		} else {
+			permitted = pte&PTE_R != 0 || (w.mxr && pte&PTE_X != 0)
+		}
+	case Store:
+		permitted = pte&PTE_W != 0
+	}
+	if w.guest {
+		// G-stage accesses are all checked as U-mode accesses.
+		if pte&PTE_U == 0 {
+			permitted = false
+		}
+	} else if pte&PTE_U != 0 {
+		// S-mode may read and write user pages only with SUM set, and may
+		// never execute them.
+		if w.mode == Supervisor && (accessType == Instruction || !w.sum) {
+			permitted = false
+		}
+	} else if w.mode == User {
+		permitted = false
+	}
+	if !permitted {
+		return 0, fault()
 	}
 
-	offset := addr & 0xfff
+	ppn := (pte >> 10) & MASK_PPN
+	// A superpage's PPN must be aligned to its size.
+	superpageMask := uint64(1)<<(vpnBits*i) - 1
+	if ppn&superpageMask != 0 {
+		return 0, fault()
+	}
+	if napot {
+		ppn &^= 0xf
+		superpageMask = 0xf
+	}
 
-	switch i {
-	case 0:
-		ppn := (pte >> 10) & 0x0fff_ffff_ffff
-		return (ppn << 12) | offset, nil
-	case 1, 2:
-		return (ppn[2] << 30) | (ppn[1] << 21) | (vpn[0] << 12) | offset, nil
-	default:
-		switch accessType {
-		case Instruction:
-			return 0, NewException(InstructionPageFault, addr)
-		case Load:
-			return 0, NewException(LoadPageFault, addr)
-		case Store:
-			return 0, NewException(StoreAMOPageFault, addr)
-		default:
-			panic("Illegal access type")
+	if pte&PTE_A == 0 || (accessType == Store && pte&PTE_D == 0) {
+		if !w.adue {
+			return 0, fault()
+		}
+		pte |= PTE_A
+		if accessType == Store {
+			pte |= PTE_D
+		}
+		var exception *Exception
+		pteAddr, exception = cpu.pteAddress(a+index*pteSize, Store, w)
+		if exception != nil {
+			return 0, exception
+		}
+		if !cpu.Csr.PMPAllows(pteAddr, pteSize*8, Store, Supervisor) {
+			return 0, accessFault(w.va, w.faultType)
+		}
+		if exception := cpu.Bus.Store(pteAddr, pteSize*8, pte); exception != nil {
+			return 0, accessFault(w.va, w.faultType)
 		}
 	}
+
+	return ppn<<12 | addr&(superpageMask<<12|0xfff), nil
+}
+
+// signExtend sign-extends the low size bits of v to 64 bits.
+func signExtend(v, size uint64) uint64 {
+	shift := 64 - size
+	return uint64(int64(v<<shift) >> shift)
+}
+
+// zeroExtend clears every bit of v above the low size bits.
+func zeroExtend(v, size uint64) uint64 {
+	shift := 64 - size
+	return v << shift >> shift
+}
+
+// mulh returns the upper 64 bits of the signed 128-bit product a*b.
+func mulh(a, b uint64) uint64 {
+	hi, _ := bits.Mul64(a, b)
+	if int64(a) < 0 {
+		hi -= b
+	}
+	if int64(b) < 0 {
+		hi -= a
+	}
+	return hi
+}
+
+// mulhsu returns the upper 64 bits of the product of signed a and unsigned b.
+func mulhsu(a, b uint64) uint64 {
+	hi, _ := bits.Mul64(a, b)
+	if int64(a) < 0 {
+		hi -= b
+	}
+	return hi
 }
 
 func (cpu *Cpu) DumpRegisters() {
@@ -929,6 +2611,18 @@ func (cpu *Cpu) Reg(r string) uint64 {
 			return cpu.Regs[index]
 		}
 	}
+	for i, abi := range RVFABI {
+		if abi == r {
+			return cpu.FRegs[i]
+		}
+	}
+	if strings.HasPrefix(r, "f") {
+		indexStr := r[1:]
+		index, err := strconv.ParseInt(indexStr, 10, 64)
+		if err == nil && index <= 31 {
+			return cpu.FRegs[index]
+		}
+	}
 	// csr
 	switch r {
 	case "mhartid":
@@ -951,6 +2645,8 @@ func (cpu *Cpu) Reg(r string) uint64 {
 		return cpu.Csr.Load(MIP)
 	case "mcounteren":
 		return cpu.Csr.Load(MCOUNTEREN)
+	case "menvcfg":
+		return cpu.Csr.Load(MENVCFG)
 	case "sstatus":
 		return cpu.Csr.Load(SSTATUS)
 	case "stvec":
@@ -967,6 +2663,26 @@ func (cpu *Cpu) Reg(r string) uint64 {
 		return cpu.Csr.Load(SIP)
 	case "SATP":
 		return cpu.Csr.Load(SATP)
+	case "fflags":
+		return cpu.Csr.Load(FFLAGS)
+	case "frm":
+		return cpu.Csr.Load(FRM)
+	case "fcsr":
+		return cpu.Csr.Load(FCSR)
+	case "vstart":
+		return cpu.Csr.Load(VSTART)
+	case "vxsat":
+		return cpu.Csr.Load(VXSAT)
+	case "vxrm":
+		return cpu.Csr.Load(VXRM)
+	case "vcsr":
+		return cpu.Csr.Load(VCSR)
+	case "vl":
+		return cpu.Csr.Load(VL)
+	case "vtype":
+		return cpu.Csr.Load(VTYPE)
+	case "vlenb":
+		return cpu.ReadCSR(VLENB)
 	}
 	panic(fmt.Sprintf("Invalid registers: %s", r))
 }
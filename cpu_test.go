@@ -1,6 +1,9 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
+	"math"
 	"os"
 	"os/exec"
 	"strings"
@@ -22,11 +25,19 @@ func generateAssembly(cFile string) {
 }
 
 func generateObj(assemblyFile string) {
+	generateObjWithArch(assemblyFile, "rv64g")
+}
+
+func generateObjWithArch(assemblyFile, march string) {
 	// cc := "riscv64-linux-gnu-gcc"
 	cc := "clang"
+	target, abi := "riscv64-linux-gnu", "lp64"
+	if strings.HasPrefix(march, "rv32") {
+		target, abi = "riscv32-linux-gnu", "ilp32"
+	}
 	pieces := strings.Split(assemblyFile, ".")
 	cmd := exec.Command(cc,
-		"-c", "-Wl,-Ttext=0x0", "-nostdlib", "--target=riscv64-linux-gnu", "-march=rv64g", "-mabi=lp64", "-mno-relax",
+		"-c", "-Wl,-Ttext=0x0", "-nostdlib", "--target="+target, "-march="+march, "-mabi="+abi, "-mno-relax",
 		"-o", pieces[0], assemblyFile)
 	err := cmd.Run()
 	if err != nil {
@@ -45,6 +56,10 @@ func generateBinary(objFile string) {
 }
 
 func testHelper(code, testname string, n int) (*Cpu, error) {
+	return testHelperWithArch(code, testname, "rv64g", n)
+}
+
+func testHelperWithArch(code, testname, march string, n int) (*Cpu, error) {
 	s, err := os.Stat("tmp")
 	if err != nil {
 		if !os.IsExist(err) {
@@ -67,14 +82,19 @@ func testHelper(code, testname string, n int) (*Cpu, error) {
 	if err != nil {
 		return nil, err
 	}
-	generateObj(fileName)
+	generateObjWithArch(fileName, march)
 	generateBinary(testname)
 	binaryCode, err := os.ReadFile(testname + ".bin")
 	if err != nil {
 		panic("read file error!")
 	}
 	cpu := NewCPU(binaryCode, nil)
+	if strings.HasPrefix(march, "rv32") {
+		cpu.SetXLEN(32)
+	}
 	for i := 0; i < n; i++ {
+		cpu.Csr.Tick()
+		cpu.Bus.clint.Tick()
 		inst, exception := cpu.Fetch()
 		if exception != nil {
 			// println("fetch inst exception occur!, " + exception.ToString())
@@ -86,17 +106,52 @@ func testHelper(code, testname string, n int) (*Cpu, error) {
 			break
 		}
 		cpu.Pc = newPC
+		cpu.Csr.Retire()
 	}
 	return cpu, nil
 }
 
+// trapHandler is an M-mode trap handler that shifts mcause into s0 and
+// returns to the instruction after the one that trapped.
+var trapHandler = []uint64{
+	0x342022f3, // csrr t0, mcause
+	0x00841413, // slli s0, s0, 8
+	0x00546433, // or s0, s0, t0
+	0x34102373, // csrr t1, mepc
+	0x00430313, // addi t1, t1, 4
+	0x34131073, // csrw mepc, t1
+	0x30200073, // mret
+}
+
+// storeCode writes insts to memory from addr on.
+func storeCode(cpu *Cpu, addr uint64, insts []uint64) {
+	for i, inst := range insts {
+		cpu.Bus.Store(addr+uint64(i)*4, 32, inst)
+	}
+}
+
+// runTrapping runs n steps of the main loop, and returns the exception that
+// ends the run, if any.
+func runTrapping(cpu *Cpu, n int) *Exception {
+	for i := 0; i < n; i++ {
+		if exception := cpu.Step(); exception != nil {
+			return exception
+		}
+	}
+	return nil
+}
+
 type TestExp struct {
 	RegName string
 	Expect  uint64
 }
 
 func riscvTest(t *testing.T, code, name string, n int, exps []TestExp) {
-	cpu, err := testHelper(code, name, n)
+	riscvTestWithArch(t, code, name, "rv64g", n, exps)
+}
+
+func riscvTestWithArch(t *testing.T, code, name, march string, n int, exps []TestExp) {
+	cpu, err := testHelperWithArch(code, name, march, n)
 	assert.Nil(t, err)
 	for _, exp := range exps {
 		assert.Equal(t, exp.Expect, cpu.Reg(exp.RegName))
@@ -302,6 +357,1691 @@ addw a2, a0, a1`
 	})
 }
 
+func TestMulDiv(t *testing.T) {
+	code := `addi a0, zero, -6
+addi a1, zero, 4
+mul  a2, a0, a1
+mulh a3, a0, a1
+mulhu a4, a0, a1
+div  a5, a0, a1
+rem  a6, a0, a1
+divu a7, a1, zero
+rem  s2, a0, zero
+mulw s3, a0, a1
+divw s4, a0, a1
+remuw s5, a0, a1`
+	riscvTest(t, code, "test_mul_div", 12, []TestExp{
+		{RegName: "a2", Expect: 0xffffffffffffffe8},
+		{RegName: "a3", Expect: 0xffffffffffffffff},
+		{RegName: "a4", Expect: 3},
+		{RegName: "a5", Expect: 0xffffffffffffffff},
+		{RegName: "a6", Expect: 0xfffffffffffffffe},
+		{RegName: "a7", Expect: 0xffffffffffffffff},
+		{RegName: "s2", Expect: 0xfffffffffffffffa},
+		{RegName: "s3", Expect: 0xffffffffffffffe8},
+		{RegName: "s4", Expect: 0xffffffffffffffff},
+		{RegName: "s5", Expect: 2},
+	})
+}
+
+func TestDivOverflow(t *testing.T) {
+	code := `addi a0, zero, -1
+slli a1, a0, 63
+div  a2, a1, a0
+rem  a3, a1, a0
+lui  a4, 0x80000
+divw a5, a4, a0
+remw a6, a4, a0`
+	riscvTest(t, code, "test_div_overflow", 7, []TestExp{
+		{RegName: "a2", Expect: 1 << 63},
+		{RegName: "a3", Expect: 0},
+		{RegName: "a5", Expect: 0xffffffff80000000},
+		{RegName: "a6", Expect: 0},
+	})
+}
+
+func TestAmo(t *testing.T) {
+	code := `andi sp, sp, -16
+addi t0, zero, -5
+sw   t0, 0(sp)
+addi t1, zero, 3
+amoadd.w a0, t1, (sp)
+amomin.w a1, t1, (sp)
+amomaxu.w a2, t1, (sp)
+amoxor.w.aqrl a3, t1, (sp)
+lw   a4, 0(sp)`
+	riscvTest(t, code, "test_amo", 9, []TestExp{
+		{RegName: "a0", Expect: 0xfffffffffffffffb},
+		{RegName: "a1", Expect: 0xfffffffffffffffe},
+		{RegName: "a2", Expect: 0xfffffffffffffffe},
+		{RegName: "a3", Expect: 0xfffffffffffffffe},
+		{RegName: "a4", Expect: 0xfffffffffffffffd},
+	})
+}
+
+func TestLrSc(t *testing.T) {
+	code := `andi sp, sp, -16
+addi t0, zero, 42
+sd   t0, 0(sp)
+lr.d a0, (sp)
+sc.d a1, t0, (sp)
+sc.d a2, t0, (sp)
+lr.w a3, (sp)
+sw   zero, 0(sp)
+sc.w a4, t0, (sp)`
+	riscvTest(t, code, "test_lr_sc", 9, []TestExp{
+		{RegName: "a0", Expect: 42},
+		{RegName: "a1", Expect: 0},
+		{RegName: "a2", Expect: 1},
+		{RegName: "a3", Expect: 42},
+		{RegName: "a4", Expect: 1},
+	})
+}
+
+func TestAmocas(t *testing.T) {
+	cpu := NewCPU(nil, nil)
+	addr := uint64(DRAM_BASE + 0x100)
+	cpu.Regs[12] = addr
+	cpu.Bus.Store(addr, 32, 7)
+	cpu.Regs[10], cpu.Regs[11] = 7, 9
+	_, exception := cpu.Execute(0x28b6252f) // amocas.w a0, a1, (a2)
+	assert.Nil(t, exception)
+	assert.Equal(t, uint64(7), cpu.Regs[10])
+	// The comparison now fails, and returns the new value.
+	_, exception = cpu.Execute(0x28b6252f) // amocas.w a0, a1, (a2)
+	assert.Nil(t, exception)
+	assert.Equal(t, uint64(9), cpu.Regs[10])
+	val, _ := cpu.Bus.Load(addr, 32)
+	assert.Equal(t, uint64(9), val)
+
+	// Byte and halfword AMOs leave the neighbouring bytes alone.
+	cpu.Bus.Store(addr, 64, 0x55007f)
+	cpu.Regs[11] = 1
+	_, exception = cpu.Execute(0x00b6052f) // amoadd.b a0, a1, (a2)
+	assert.Nil(t, exception)
+	assert.Equal(t, uint64(0x7f), cpu.Regs[10])
+	_, exception = cpu.Execute(0xa0b6052f) // amomax.b a0, a1, (a2)
+	assert.Nil(t, exception)
+	assert.Equal(t, uint64(0xffffffffffffff80), cpu.Regs[10])
+	cpu.Regs[10], cpu.Regs[11] = 0x0001, 0xbeef
+	_, exception = cpu.Execute(0x28b6152f) // amocas.h a0, a1, (a2)
+	assert.Nil(t, exception)
+	val, _ = cpu.Bus.Load(addr, 64)
+	assert.Equal(t, uint64(0x55beef), val)
+	_, exception = cpu.Execute(0x1006052f) // lr.b a0, (a2)
+	assert.Equal(t, NewException(IllegalInstruction, 0x1006052f), exception)
+
+	// amocas.q compares and swaps the pairs a4/a5 and a6/a7.
+	cpu.Bus.Store(addr, 64, 1)
+	cpu.Bus.Store(addr+8, 64, 2)
+	cpu.Regs[14], cpu.Regs[15], cpu.Regs[16], cpu.Regs[17] = 1, 2, 3, 4
+	_, exception = cpu.Execute(0x2906472f) // amocas.q a4, a6, (a2)
+	assert.Nil(t, exception)
+	assert.Equal(t, uint64(1), cpu.Regs[14])
+	assert.Equal(t, uint64(2), cpu.Regs[15])
+	val, _ = cpu.Bus.Load(addr+8, 64)
+	assert.Equal(t, uint64(4), val)
+	_, exception = cpu.Execute(0x290647af) // amocas.q a5, a6, (a2)
+	assert.Equal(t, NewException(IllegalInstruction, 0x290647af), exception)
+
+	cpu.Ext.Zacas = false
+	_, exception = cpu.Execute(0x28b6252f) // amocas.w a0, a1, (a2)
+	assert.Equal(t, NewException(IllegalInstruction, 0x28b6252f), exception)
+
+	// On RV32, amocas.d takes the pairs a0/a1 and a2/a3.
+	cpu = NewCPU(nil, nil)
+	assert.Nil(t, cpu.SetXLEN(32))
+	cpu.Bus.Store(addr, 64, 0xffffffff_00000001)
+	cpu.Regs[10], cpu.Regs[11], cpu.Regs[12], cpu.Regs[13], cpu.Regs[14] = 1, 0xffffffff, 5, 6, addr
+	_, exception = cpu.Execute(0x28c7352f) // amocas.d a0, a2, (a4)
+	assert.Nil(t, exception)
+	assert.Equal(t, uint64(1), cpu.Regs[10])
+	assert.Equal(t, uint64(0xffffffffffffffff), cpu.Regs[11])
+	val, _ = cpu.Bus.Load(addr, 64)
+	assert.Equal(t, uint64(0x6_00000005), val)
+}
+
+func TestCompressed(t *testing.T) {
+	code := `.option rvc
+addi a0, zero, 10
+addi a0, a0, 5
+slli a1, a0, 2
+lui  a2, 0x12345
+mv   a3, a1
+sub  a3, a3, a0
+auipc a4, 0
+addi a4, a4, 10
+jalr ra, 0(a4)
+addi a5, zero, 1
+addi a5, zero, 2`
+	riscvTest(t, code, "test_compressed", 10, []TestExp{
+		{RegName: "a0", Expect: 15},
+		{RegName: "a1", Expect: 60},
+		{RegName: "a2", Expect: 0x12345000},
+		{RegName: "a3", Expect: 45},
+		{RegName: "ra", Expect: DRAM_BASE + 24},
+		{RegName: "a5", Expect: 2},
+		{RegName: "pc", Expect: DRAM_BASE + 28},
+	})
+}
+
+func TestFloatDouble(t *testing.T) {
+	code := `andi sp, sp, -16
+addi a0, zero, 1
+fcvt.d.l fa0, a0
+addi a1, zero, 3
+fcvt.d.l fa1, a1
+fdiv.d fa2, fa0, fa1
+fmul.d fa3, fa2, fa1
+fsd  fa2, 0(sp)
+ld   a2, 0(sp)
+fcvt.l.d a3, fa3
+fsqrt.d fa4, fa1
+feq.d a4, fa3, fa0
+fmadd.d fa5, fa1, fa1, fa0
+fcvt.w.d a5, fa5
+csrr a6, fflags`
+	riscvTest(t, code, "test_float_double", 15, []TestExp{
+		{RegName: "a2", Expect: 0x3fd5555555555555},
+		{RegName: "fa3", Expect: 0x3ff0000000000000},
+		{RegName: "a3", Expect: 1},
+		{RegName: "fa4", Expect: 0x3ffbb67ae8584caa},
+		{RegName: "a4", Expect: 1},
+		{RegName: "a5", Expect: 10},
+		{RegName: "a6", Expect: FFLAGS_NX},
+	})
+}
+
+func TestFloatSingle(t *testing.T) {
+	code := `lui  a0, 0x3fc00
+fmv.w.x fa0, a0
+fcvt.w.s a1, fa0
+fcvt.w.s a2, fa0, rtz
+fcvt.w.s a3, fa0, rup
+fneg.s fa1, fa0
+fcvt.d.s fa2, fa1
+fclass.s a4, fa1
+fle.s a5, fa1, fa0
+fmv.x.w a6, fa1
+fcvt.s.d fa3, fa2`
+	riscvTest(t, code, "test_float_single", 11, []TestExp{
+		{RegName: "fa0", Expect: 0xffffffff3fc00000},
+		{RegName: "a1", Expect: 2},
+		{RegName: "a2", Expect: 1},
+		{RegName: "a3", Expect: 2},
+		{RegName: "fa2", Expect: 0xbff8000000000000},
+		{RegName: "a4", Expect: 1 << 1},
+		{RegName: "a5", Expect: 1},
+		{RegName: "a6", Expect: 0xffffffffbfc00000},
+		{RegName: "fa3", Expect: 0xffffffffbfc00000},
+	})
+}
+
+func TestFloatHalf(t *testing.T) {
+	code := `andi sp, sp, -16
+li a0, 0x3e00
+fmv.h.x fa0, a0
+fadd.h fa1, fa0, fa0
+fcvt.d.h fa2, fa1
+fcvt.w.h a1, fa1
+fsh fa1, 0(sp)
+lhu a2, 0(sp)
+flh fa3, 0(sp)
+fdiv.h fa4, fa0, fa1
+fmv.w.x fa5, a0
+fadd.h fa6, fa5, fa0
+fmv.x.h a3, fa6`
+	// Half-precision values not NaN-boxed in the register read as NaN.
+	riscvTestWithArch(t, code, "test_float_half", "rv64gc_zfh", 14, []TestExp{
+		{RegName: "fa0", Expect: 0xffffffffffff3e00},
+		{RegName: "fa1", Expect: 0xffffffffffff4200},
+		{RegName: "fa2", Expect: 0x4008000000000000},
+		{RegName: "a1", Expect: 3},
+		{RegName: "a2", Expect: 0x4200},
+		{RegName: "fa3", Expect: 0xffffffffffff4200},
+		{RegName: "fa4", Expect: 0xffffffffffff3800},
+		{RegName: "a3", Expect: 0x7e00},
+	})
+}
+
+func TestFloatZfa(t *testing.T) {
+	cpu := NewCPU(nil, nil)
+	for _, inst := range []uint64{
+		0xf21a8553, // fli.d fa0, 2.5
+		0xf41e85d3, // fli.h fa1, 65536.0
+		0xf0180053, // fli.s ft0, 1.0
+		0xf01f80d3, // fli.s ft1, nan
+		0x28102653, // fminm.s fa2, ft0, ft1
+		0x424506d3, // fround.d fa3, fa0, rne
+		0xa21545d3, // fleq.d a1, fa0, ft1
+	} {
+		_, exception := cpu.Execute(inst)
+		assert.Nil(t, exception)
+	}
+	assert.Equal(t, uint64(0x4004000000000000), cpu.FRegs[10])
+	// 2^16 is out of range of half precision.
+	assert.Equal(t, uint64(0xffffffffffff7c00), cpu.FRegs[11])
+	assert.Equal(t, uint64(0xffffffff7fc00000), cpu.FRegs[12])
+	assert.Equal(t, uint64(0x4000000000000000), cpu.FRegs[13])
+	assert.Equal(t, uint64(0), cpu.Regs[11])
+	assert.Equal(t, uint64(0), cpu.Csr.Load(FFLAGS))
+
+	// froundnx.d fa4, fa0, rup
+	_, exception := cpu.Execute(0x42553753)
+	assert.Nil(t, exception)
+	assert.Equal(t, uint64(0x4008000000000000), cpu.FRegs[14])
+	assert.Equal(t, uint64(FFLAGS_NX), cpu.Csr.Load(FFLAGS))
+
+	// fcvtmod.w.d a0, fa5, rtz keeps the low 32 bits of 2^32 + 5.5.
+	cpu.FRegs[15] = math.Float64bits(4294967301.5)
+	_, exception = cpu.Execute(0xc2879553)
+	assert.Nil(t, exception)
+	assert.Equal(t, uint64(5), cpu.Regs[10])
+	assert.Equal(t, uint64(FFLAGS_NV|FFLAGS_NX), cpu.Csr.Load(FFLAGS))
+	_, exception = cpu.Execute(0xc2878553)
+	assert.Equal(t, NewException(IllegalInstruction, 0xc2878553), exception)
+
+	cpu.Ext.Zfa = false
+	_, exception = cpu.Execute(0xf21a8553)
+	assert.Equal(t, NewException(IllegalInstruction, 0xf21a8553), exception)
+}
+
+func TestFloatDisabled(t *testing.T) {
+	code := `lui  t0, 0x6
+csrc mstatus, t0
+fmv.w.x fa0, zero
+addi a0, zero, 1`
+	riscvTest(t, code, "test_float_disabled", 4, []TestExp{
+		{RegName: "a0", Expect: 0},
+		{RegName: "pc", Expect: DRAM_BASE + 8},
+	})
+}
+
+func TestCounters(t *testing.T) {
+	code := `rdinstret a0
+nop
+rdinstret a1
+rdcycle a2
+rdtime a3
+addi t0, zero, 4
+csrw mcountinhibit, t0
+nop
+rdinstret a4
+csrw minstret, zero
+rdinstret a5`
+	riscvTest(t, code, "test_counters", 11, []TestExp{
+		{RegName: "a0", Expect: 0},
+		{RegName: "a1", Expect: 2},
+		{RegName: "a2", Expect: 4},
+		{RegName: "a3", Expect: 5},
+		{RegName: "a4", Expect: 6},
+		{RegName: "a5", Expect: 0},
+	})
+}
+
+func TestCounterEnable(t *testing.T) {
+	code := `auipc t0, 0
+addi t0, t0, 16
+csrw mepc, t0
+mret
+rdcycle a0
+addi a1, zero, 1`
+	riscvTest(t, code, "test_counter_enable", 6, []TestExp{
+		{RegName: "a1", Expect: 0},
+		{RegName: "pc", Expect: DRAM_BASE + 16},
+	})
+}
+
+func TestBitmanip(t *testing.T) {
+	code := `addi a0, zero, -2
+addi a1, zero, 3
+sh2add a2, a1, a1
+add.uw a3, a0, zero
+clz  a4, a1
+cpop a5, a0
+rev8 a6, a1
+orc.b a7, a1
+ror  s2, a1, a1
+andn s3, a1, a0
+min  s4, a0, a1
+minu s5, a0, a1
+clmul s6, a1, a1
+bset s7, zero, a1
+bexti s8, a1, 1
+sext.b s9, a0
+zext.h s10, a0
+rolw s11, a0, a1`
+	riscvTestWithArch(t, code, "test_bitmanip", "rv64g_zba_zbb_zbc_zbs", 20, []TestExp{
+		{RegName: "a2", Expect: 15},
+		{RegName: "a3", Expect: 0xfffffffe},
+		{RegName: "a4", Expect: 62},
+		{RegName: "a5", Expect: 63},
+		{RegName: "a6", Expect: 0x0300000000000000},
+		{RegName: "a7", Expect: 0xff},
+		{RegName: "s2", Expect: 0x6000000000000000},
+		{RegName: "s3", Expect: 1},
+		{RegName: "s4", Expect: 0xfffffffffffffffe},
+		{RegName: "s5", Expect: 3},
+		{RegName: "s6", Expect: 5},
+		{RegName: "s7", Expect: 8},
+		{RegName: "s8", Expect: 1},
+		{RegName: "s9", Expect: 0xfffffffffffffffe},
+		{RegName: "s10", Expect: 0xfffe},
+		{RegName: "s11", Expect: 0xfffffffffffffff7},
+	})
+}
+
+func TestBitmanipDisabled(t *testing.T) {
+	cpu := NewCPU(nil, nil)
+	cpu.Ext.Zba = false
+	// sh1add a0, a1, a2
+	_, exception := cpu.Execute(0x20c5a533)
+	assert.NotNil(t, exception)
+	assert.Equal(t, IllegalInstruction, exception.Type)
+}
+
+func TestVectorInteger(t *testing.T) {
+	code := `andi sp, sp, -16
+addi sp, sp, -16
+addi t0, zero, 1
+sw   t0, 0(sp)
+addi t0, zero, 2
+sw   t0, 4(sp)
+addi t0, zero, 3
+sw   t0, 8(sp)
+addi t0, zero, 4
+sw   t0, 12(sp)
+vsetivli a0, 4, e32, m1, ta, ma
+vle32.v v1, (sp)
+vadd.vi v2, v1, 5
+vmul.vv v3, v1, v2
+vmv.s.x v5, zero
+vredsum.vs v4, v3, v5
+vmv.x.s a1, v4
+vse32.v v3, (sp)
+lw   a2, 12(sp)
+vmslt.vi v0, v1, 3
+vmerge.vim v6, v1, -1, v0
+vmv.x.s a3, v6
+vcpop.m a4, v0
+vslidedown.vi v7, v1, 2
+vmv.x.s a5, v7
+vsetvli a6, zero, e8, m8, ta, ma
+vsetivli zero, 1, e8, m1, ta, ma
+vmv.v.i v8, -1
+vsaddu.vi v9, v8, 1
+vmv.x.s a7, v9
+csrr s2, vxsat`
+	riscvTestWithArch(t, code, "test_vector_integer", "rv64gv", 31, []TestExp{
+		{RegName: "a0", Expect: 4},
+		{RegName: "a1", Expect: 6 + 14 + 24 + 36},
+		{RegName: "a2", Expect: 36},
+		{RegName: "a3", Expect: 0xffffffffffffffff},
+		{RegName: "a4", Expect: 2},
+		{RegName: "a5", Expect: 3},
+		{RegName: "a6", Expect: 128},
+		{RegName: "a7", Expect: 0xffffffffffffffff},
+		{RegName: "s2", Expect: 1},
+		{RegName: "vl", Expect: 1},
+	})
+}
+
+func TestVectorMemory(t *testing.T) {
+	code := `andi sp, sp, -16
+addi sp, sp, -32
+addi t0, zero, 0x10
+sb   t0, 0(sp)
+addi t0, zero, 0x21
+sb   t0, 1(sp)
+addi t0, zero, 0x32
+sb   t0, 2(sp)
+addi t0, zero, 0x43
+sb   t0, 3(sp)
+vsetivli zero, 2, e8, m1, ta, ma
+vlseg2e8.v v1, (sp)
+vmv.x.s a0, v2
+addi t1, zero, 3
+vlse8.v v3, (sp), t1
+vslidedown.vi v4, v3, 1
+vmv.x.s a1, v4
+vmv.v.i v5, 2
+vluxei8.v v6, (sp), v5
+vmv.x.s a2, v6
+addi t2, sp, 46
+vle8ff.v v7, (t2)
+csrr a3, vl
+vsetivli zero, 4, e8, m1, ta, ma
+vle8ff.v v7, (t2)
+csrr a4, vl`
+	riscvTestWithArch(t, code, "test_vector_memory", "rv64gv", 26, []TestExp{
+		{RegName: "a0", Expect: 0x21},
+		{RegName: "a1", Expect: 0x43},
+		{RegName: "a2", Expect: 0x32},
+		{RegName: "a3", Expect: 2},
+		{RegName: "a4", Expect: 2},
+		{RegName: "vstart", Expect: 0},
+	})
+}
+
+func TestVectorFloat(t *testing.T) {
+	code := `andi sp, sp, -16
+addi sp, sp, -16
+lui  t0, 0x3f800
+sw   t0, 0(sp)
+lui  t0, 0x40800
+sw   t0, 4(sp)
+lui  t0, 0x41100
+sw   t0, 8(sp)
+vsetivli zero, 3, e32, m1, ta, ma
+vle32.v v1, (sp)
+vfsqrt.v v2, v1
+fmv.w.x ft0, zero
+vfmv.s.f v3, ft0
+vfredosum.vs v4, v2, v3
+vfmv.f.s fa0, v4
+vfcvt.x.f.v v5, v2
+vslidedown.vi v6, v5, 2
+vmv.x.s a0, v6
+vfwcvt.f.f.v v8, v2
+vsetivli zero, 3, e64, m2, ta, ma
+vfmacc.vv v8, v8, v8
+vslidedown.vi v10, v8, 1
+vfmv.f.s fa1, v10
+vmflt.vf v0, v8, fa1
+vcpop.m a1, v0`
+	riscvTestWithArch(t, code, "test_vector_float", "rv64gv", 25, []TestExp{
+		{RegName: "fa0", Expect: 0xffffffff40c00000},
+		{RegName: "a0", Expect: 3},
+		{RegName: "fa1", Expect: 0x4018000000000000},
+		{RegName: "a1", Expect: 1},
+	})
+}
+
+func TestVectorDisabled(t *testing.T) {
+	code := `addi t0, zero, 0x600
+csrc mstatus, t0
+vsetivli zero, 1, e8, m1, ta, ma
+addi a0, zero, 1`
+	riscvTestWithArch(t, code, "test_vector_disabled", "rv64gv", 4, []TestExp{
+		{RegName: "a0", Expect: 0},
+		{RegName: "pc", Expect: DRAM_BASE + 8},
+	})
+
+	// vtype is vill out of reset, so vector instructions trap before the
+	// first vset{i}vl{i}.
+	cpu := NewCPU(nil, nil)
+	_, exception := cpu.Execute(0x02008057) // vadd.vv v0, v0, v1
+	assert.Equal(t, NewException(IllegalInstruction, 0x02008057), exception)
+}
+
+func TestSv39(t *testing.T) {
+	cpu := NewCPU(nil, nil)
+	root := uint64(DRAM_BASE + 0x10000)
+	l1 := root + PAGE_SIZE
+	l0 := l1 + PAGE_SIZE
+	data := uint64(DRAM_BASE + 0x20000)
+	cpu.Bus.Store(root, 64, (l1>>12)<<10|PTE_V)
+	cpu.Bus.Store(l1, 64, (l0>>12)<<10|PTE_V)
+	// 0x1000: user read/write page, A and D clear.
+	cpu.Bus.Store(l0+8, 64, (data>>12)<<10|PTE_U|PTE_W|PTE_R|PTE_V)
+	// 0x40000000: gigapage whose PPN is not 1 GiB aligned.
+	cpu.Bus.Store(root+8, 64, (DRAM_BASE>>12+1)<<10|PTE_A|PTE_R|PTE_V)
+	cpu.Csr.Store(SATP, SATP_MODE_SV39<<60|root>>12)
+	cpu.UpdatePaging(SATP)
+
+	cpu.Mode = Supervisor
+	_, exception := cpu.Translate(0x1234, Load)
+	assert.Equal(t, NewException(LoadPageFault, 0x1234), exception)
+	cpu.Csr.Store(MSTATUS, cpu.Csr.Load(MSTATUS)|MASK_SUM)
+	pAddr, exception := cpu.Translate(0x1234, Load)
+	assert.Nil(t, exception)
+	assert.Equal(t, data+0x234, pAddr)
+
+	cpu.Mode = User
+	_, exception = cpu.Translate(0x1000, Instruction)
+	assert.Equal(t, NewException(InstructionPageFault, 0x1000), exception)
+	pte, _ := cpu.Bus.Load(l0+8, 64)
+	assert.Equal(t, uint64(PTE_A), pte&(PTE_A|PTE_D))
+	_, exception = cpu.Translate(0x1008, Store)
+	assert.Nil(t, exception)
+	pte, _ = cpu.Bus.Load(l0+8, 64)
+	assert.Equal(t, uint64(PTE_A|PTE_D), pte&(PTE_A|PTE_D))
+
+	// Svade: a clear A bit faults instead of being set.
+	cpu.Csr.Store(MENVCFG, 0)
+	cpu.Bus.Store(l0+8, 64, (data>>12)<<10|PTE_U|PTE_W|PTE_R|PTE_V)
+	_, exception = cpu.Translate(0x1000, Load)
+	assert.Equal(t, NewException(LoadPageFault, 0x1000), exception)
+
+	cpu.Mode = Supervisor
+	_, exception = cpu.Translate(0x40000000, Load)
+	assert.Equal(t, NewException(LoadPageFault, 0x40000000), exception)
+	_, exception = cpu.Translate(0x8000000000, Store)
+	assert.Equal(t, NewException(StoreAMOPageFault, 0x8000000000), exception)
+}
+
+func TestSv48Sv57(t *testing.T) {
+	cpu := NewCPU(nil, nil)
+	root := uint64(DRAM_BASE + 0x10000)
+	// An unsupported mode leaves satp unchanged.
+	cpu.Csr.Store(SATP, SATP_MODE_SV57<<60|root>>12)
+	cpu.Csr.Store(SATP, 11<<60|root>>12)
+	assert.Equal(t, uint64(SATP_MODE_SV57<<60|root>>12), cpu.Reg("SATP"))
+
+	// Root entry 1 is a leaf: a 256 TiB page under Sv57, 512 GiB under Sv48.
+	cpu.Bus.Store(root+8, 64, PTE_A|PTE_D|PTE_W|PTE_R|PTE_V)
+	cpu.Mode = Supervisor
+	cpu.UpdatePaging(SATP)
+	pAddr, exception := cpu.Translate(1<<48|0x123456789, Load)
+	assert.Nil(t, exception)
+	assert.Equal(t, uint64(0x123456789), pAddr)
+	_, exception = cpu.Translate(1<<57, Load)
+	assert.Equal(t, NewException(LoadPageFault, 1<<57), exception)
+
+	cpu.Csr.Store(SATP, SATP_MODE_SV48<<60|root>>12)
+	cpu.UpdatePaging(SATP)
+	pAddr, exception = cpu.Translate(1<<39|0x123456789, Store)
+	assert.Nil(t, exception)
+	assert.Equal(t, uint64(0x123456789), pAddr)
+	_, exception = cpu.Translate(1<<48, Store)
+	assert.Equal(t, NewException(StoreAMOPageFault, 1<<48), exception)
+}
+
+func TestSvnapotSvpbmt(t *testing.T) {
+	cpu := NewCPU(nil, nil)
+	root := uint64(DRAM_BASE + 0x10000)
+	l1 := root + PAGE_SIZE
+	l0 := l1 + PAGE_SIZE
+	data := uint64(DRAM_BASE + 0x20000)
+	cpu.Bus.Store(root, 64, (l1>>12)<<10|PTE_V)
+	cpu.Bus.Store(l1, 64, (l0>>12)<<10|PTE_V)
+	// 0x13000 is the fourth page of a 64 KiB NAPOT mapping of data.
+	cpu.Bus.Store(l0+0x13*8, 64, PTE_N|(data>>12|0b1000)<<10|PTE_A|PTE_D|PTE_R|PTE_V)
+	// 0x20000 has N set without the 64 KiB size encoding.
+	cpu.Bus.Store(l0+0x20*8, 64, PTE_N|(data>>12|0b0100)<<10|PTE_A|PTE_D|PTE_R|PTE_V)
+	// 0x1000 is an IO page and 0x2000 uses the reserved memory type.
+	cpu.Bus.Store(l0+8, 64, PBMT_IO<<61|(data>>12)<<10|PTE_A|PTE_D|PTE_R|PTE_V)
+	cpu.Bus.Store(l0+16, 64, PBMT_RESERVED<<61|(data>>12)<<10|PTE_A|PTE_D|PTE_R|PTE_V)
+	// 0x40000000 goes through a non-leaf PTE with a memory type.
+	cpu.Bus.Store(root+8, 64, PBMT_NC<<61|(l1>>12)<<10|PTE_V)
+	cpu.Csr.Store(SATP, SATP_MODE_SV39<<60|root>>12)
+	cpu.UpdatePaging(SATP)
+	cpu.Mode = Supervisor
+
+	pAddr, exception := cpu.Translate(0x13abc, Load)
+	assert.Nil(t, exception)
+	assert.Equal(t, data+0x3abc, pAddr)
+	_, exception = cpu.Translate(0x20000, Load)
+	assert.Equal(t, NewException(LoadPageFault, 0x20000), exception)
+	cpu.Ext.Svnapot = false
+	_, exception = cpu.Translate(0x13abc, Load)
+	assert.Equal(t, NewException(LoadPageFault, 0x13abc), exception)
+
+	// Memory types fault until menvcfg.PBMTE enables them.
+	_, exception = cpu.Translate(0x1000, Load)
+	assert.Equal(t, NewException(LoadPageFault, 0x1000), exception)
+	cpu.Csr.Store(MENVCFG, cpu.Csr.Load(MENVCFG)|MENVCFG_PBMTE)
+	pAddr, exception = cpu.Translate(0x1000, Load)
+	assert.Nil(t, exception)
+	assert.Equal(t, data, pAddr)
+	_, exception = cpu.Translate(0x2000, Load)
+	assert.Equal(t, NewException(LoadPageFault, 0x2000), exception)
+	_, exception = cpu.Translate(0x40001000, Load)
+	assert.Equal(t, NewException(LoadPageFault, 0x40001000), exception)
+}
+
+func TestSvinval(t *testing.T) {
+	cpu := NewCPU(nil, nil)
+	cpu.Mode = Supervisor
+	for _, inst := range []uint64{
+		0x16000073, // sinval.vma zero, zero
+		0x18000073, // sfence.w.inval
+		0x18100073, // sfence.inval.ir
+		0x66000073, // hinval.gvma zero, zero
+	} {
+		_, exception := cpu.Execute(inst)
+		assert.Nil(t, exception)
+	}
+	// sinval.vma follows the rules of sfence.vma.
+	cpu.Csr.Store(MSTATUS, cpu.Csr.Load(MSTATUS)|MASK_TVM)
+	_, exception := cpu.Execute(0x16000073)
+	assert.Equal(t, NewException(IllegalInstruction, 0x16000073), exception)
+	cpu.Mode = User
+	_, exception = cpu.Execute(0x18000073)
+	assert.Equal(t, NewException(IllegalInstruction, 0x18000073), exception)
+	cpu.Csr.V = true
+	_, exception = cpu.Execute(0x18100073)
+	assert.Equal(t, NewException(VirtualInstruction, 0x18100073), exception)
+	cpu.Ext.Svinval = false
+	cpu.Mode, cpu.Csr.V = Supervisor, false
+	_, exception = cpu.Execute(0x18000073)
+	assert.Equal(t, NewException(IllegalInstruction, 0x18000073), exception)
+}
+
+func TestMisaligned(t *testing.T) {
+	cpu := NewCPU(nil, nil)
+	root := uint64(DRAM_BASE + 0x10000)
+	l1 := root + PAGE_SIZE
+	l0 := l1 + PAGE_SIZE
+	lo := uint64(DRAM_BASE + 0x20000)
+	hi := uint64(DRAM_BASE + 0x30000)
+	cpu.Bus.Store(root, 64, (l1>>12)<<10|PTE_V)
+	cpu.Bus.Store(l1, 64, (l0>>12)<<10|PTE_V)
+	// 0x1000 and 0x2000 map to pages that are not adjacent; 0x3000 is unmapped.
+	cpu.Bus.Store(l0+8, 64, (lo>>12)<<10|PTE_D|PTE_A|PTE_W|PTE_R|PTE_V)
+	cpu.Bus.Store(l0+16, 64, (hi>>12)<<10|PTE_D|PTE_A|PTE_W|PTE_R|PTE_V)
+	cpu.Csr.Store(SATP, SATP_MODE_SV39<<60|root>>12)
+	cpu.UpdatePaging(SATP)
+	cpu.Mode = Supervisor
+
+	// A misaligned access crossing a page boundary translates each page.
+	assert.Nil(t, cpu.Store(0x1ffc, 64, 0x1122334455667788))
+	val, _ := cpu.Bus.Load(lo+0xffc, 32)
+	assert.Equal(t, uint64(0x55667788), val)
+	val, _ = cpu.Bus.Load(hi, 32)
+	assert.Equal(t, uint64(0x11223344), val)
+	val, exception := cpu.Load(0x1ffd, 32)
+	assert.Nil(t, exception)
+	assert.Equal(t, uint64(0x44556677), val)
+
+	// A fault on the second page reports its address and writes nothing.
+	assert.Equal(t, NewException(StoreAMOPageFault, 0x3000), cpu.Store(0x2ffe, 32, 0xffffffff))
+	val, _ = cpu.Bus.Load(hi+0xffe, 16)
+	assert.Equal(t, uint64(0), val)
+
+	// AMOs and LR/SC fault when misaligned under either policy.
+	cpu.Regs[12] = 0x1002
+	_, exception = cpu.Execute(0x1006252f) // lr.w a0, (a2)
+	assert.Equal(t, NewException(LoadAccessMisaligned, 0x1002), exception)
+	_, exception = cpu.Execute(0x00b6252f) // amoadd.w a0, a1, (a2)
+	assert.Equal(t, NewException(StoreAMOAddrMisaligned, 0x1002), exception)
+
+	policy, err := ParseMisalignedPolicy("trap")
+	assert.Nil(t, err)
+	cpu.Misaligned = policy
+	_, exception = cpu.Load(0x1001, 16)
+	assert.Equal(t, NewException(LoadAccessMisaligned, 0x1001), exception)
+	assert.Equal(t, NewException(StoreAMOAddrMisaligned, 0x1ffc), cpu.Store(0x1ffc, 64, 0))
+	val, exception = cpu.Load(0x1ffc, 32)
+	assert.Nil(t, exception)
+	assert.Equal(t, uint64(0x55667788), val)
+	_, err = ParseMisalignedPolicy("ignore")
+	assert.NotNil(t, err)
+}
+
+func TestMisalignedHandler(t *testing.T) {
+	cpu := NewCPU(nil, nil)
+	cpu.Misaligned = MisalignedTrap
+	storeCode(cpu, DRAM_BASE, []uint64{
+		0x00a5b0a3, // sd a0, 1(a1)
+		0x00100513, // addi a0, zero, 1
+	})
+	storeCode(cpu, DRAM_BASE+0x100, trapHandler)
+	cpu.Csr.Store(MTVEC, DRAM_BASE+0x100)
+	cpu.Regs[11] = DRAM_BASE + PAGE_SIZE
+	for i := 0; i < 2+len(trapHandler); i++ {
+		assert.Nil(t, cpu.Step())
+	}
+	assert.Equal(t, uint64(DRAM_BASE+8), cpu.Pc)
+	assert.Equal(t, uint64(StoreAMOAddrMisaligned), cpu.Regs[8])
+	assert.Equal(t, uint64(DRAM_BASE+PAGE_SIZE+1), cpu.Csr.Load(MTVAL))
+	assert.Equal(t, uint64(1), cpu.Regs[10])
+}
+
+func TestPMP(t *testing.T) {
+	cpu := NewCPU(nil, nil)
+	// With every entry off, PMP is unconfigured and allows everything,
+	// unless strict PMP denies unmatched S/U accesses as the spec does.
+	assert.True(t, cpu.Csr.PMPAllows(DRAM_BASE, 64, Load, User))
+	cpu.Csr.StrictPMP = true
+	assert.False(t, cpu.Csr.PMPAllows(DRAM_BASE, 64, Load, User))
+	assert.True(t, cpu.Csr.PMPAllows(DRAM_BASE, 64, Load, Machine))
+	cpu.Csr.StrictPMP = false
+
+	// 0: NA4 at 0x80001000, no permissions.
+	// 1: TOR 0x80001000..0x80002000, read only.
+	// 2: NAPOT 0x80000000..0x80010000, read/write/execute.
+	cpu.Csr.Store(PMPADDR0, 0x80001000>>2)
+	cpu.Csr.Store(PMPADDR1, 0x80002000>>2)
+	cpu.Csr.Store(PMPADDR2, 0x80000000>>2|(0x10000>>3-1))
+	cpu.Csr.Store(PMPCFG0, (PMP_A_NAPOT<<3|PMP_X|PMP_W|PMP_R)<<16|(PMP_A_TOR<<3|PMP_R)<<8|PMP_A_NA4<<3)
+	assert.False(t, cpu.Csr.PMPAllows(0x80001000, 32, Load, Supervisor))
+	assert.True(t, cpu.Csr.PMPAllows(0x80001004, 32, Load, Supervisor))
+	assert.False(t, cpu.Csr.PMPAllows(0x80001004, 32, Store, Supervisor))
+	assert.True(t, cpu.Csr.PMPAllows(0x80002000, 32, Store, User))
+	assert.True(t, cpu.Csr.PMPAllows(0x8000fff8, 64, Instruction, User))
+	// Straddling two entries fails even though both allow reads.
+	assert.False(t, cpu.Csr.PMPAllows(0x80001ffc, 64, Load, User))
+	// Once configured, unmatched S/U accesses fail.
+	assert.False(t, cpu.Csr.PMPAllows(0x80010000, 8, Load, User))
+	assert.True(t, cpu.Csr.PMPAllows(0x80001000, 32, Store, Machine))
+
+	// Locking entry 1 applies it to M mode and freezes it and pmpaddr0.
+	cpu.Csr.Store(PMPCFG0, cpu.Csr.Load(PMPCFG0)|PMP_L<<8)
+	assert.False(t, cpu.Csr.PMPAllows(0x80001004, 32, Store, Machine))
+	cpu.Csr.Store(PMPCFG0, 0)
+	cpu.Csr.Store(PMPADDR0, 0)
+	assert.Equal(t, uint64(PMP_L|PMP_A_TOR<<3|PMP_R), cpu.Csr.PMPCfg(1))
+	assert.Equal(t, uint64(0x80001000>>2), cpu.Csr.Load(PMPADDR0))
+
+	// Smepmp: with MML set, unmatched M-mode fetches fail and RLB cannot be
+	// set while an entry is locked.
+	cpu.Csr.Store(MSECCFG, MSECCFG_MML|MSECCFG_RLB)
+	assert.Equal(t, uint64(MSECCFG_MML), cpu.Csr.Load(MSECCFG))
+	assert.False(t, cpu.Csr.PMPAllows(0x90000000, 16, Instruction, Machine))
+	assert.True(t, cpu.Csr.PMPAllows(0x90000000, 64, Load, Machine))
+	assert.True(t, cpu.Csr.PMPAllows(0x80001004, 32, Load, Machine))
+	assert.False(t, cpu.Csr.PMPAllows(0x80001004, 32, Load, Supervisor))
+	assert.False(t, cpu.Csr.PMPAllows(0x80001004, 32, Store, Machine))
+}
+
+func TestFatalException(t *testing.T) {
+	for _, exceptionType := range []ExceptionType{
+		InstructionAddrMisaligned, InstructionAccessFault, IllegalInstruction,
+		LoadAccessMisaligned, LoadAccessFault, StoreAMOAddrMisaligned, StoreAMOAccessFault,
+	} {
+		exception := NewException(exceptionType, 0)
+		cpu := NewCPU(nil, nil)
+		cpu.HandleException(exception)
+		assert.True(t, cpu.isFatal(exception), exception.ToString())
+		cpu = NewCPU(nil, nil)
+		cpu.Csr.Store(MTVEC, DRAM_BASE+0x100)
+		cpu.HandleException(exception)
+		assert.False(t, cpu.isFatal(exception), exception.ToString())
+	}
+
+	// The handler is that of the mode taking the trap.
+	exception := NewException(IllegalInstruction, 0)
+	cpu := NewCPU(nil, nil)
+	cpu.Mode = Supervisor
+	cpu.Csr.Store(MEDELEG, 1<<IllegalInstruction)
+	cpu.Csr.Store(STVEC, DRAM_BASE+0x100)
+	cpu.HandleException(exception)
+	assert.False(t, cpu.isFatal(exception))
+	cpu.Mode = Supervisor
+	cpu.Csr.Store(STVEC, 0)
+	cpu.Csr.Store(MTVEC, DRAM_BASE+0x100)
+	cpu.HandleException(exception)
+	assert.True(t, cpu.isFatal(exception))
+
+	// Other exceptions are left to software either way.
+	exception = NewException(EnvironmentCallFromMMode, 0)
+	cpu = NewCPU(nil, nil)
+	cpu.HandleException(exception)
+	assert.False(t, cpu.isFatal(exception))
+}
+
+func TestAccessFaultHandler(t *testing.T) {
+	cpu := NewCPU(nil, nil)
+	storeCode(cpu, DRAM_BASE, []uint64{
+		0x0005b503, // ld a0, 0(a1)
+		0x00a5b023, // sd a0, 0(a1)
+	})
+	storeCode(cpu, DRAM_BASE+0x100, trapHandler)
+	// S-mode may run the code page but not touch the page after it.
+	cpu.Csr.Store(PMPADDR0, DRAM_BASE>>2|(PAGE_SIZE>>3-1))
+	cpu.Csr.Store(PMPCFG0, PMP_A_NAPOT<<3|PMP_X|PMP_R)
+	cpu.Regs[11] = DRAM_BASE + PAGE_SIZE
+
+	// Without a trap vector the fault ends the run.
+	cpu.Mode = Supervisor
+	assert.Equal(t, NewException(LoadAccessFault, DRAM_BASE+PAGE_SIZE), runTrapping(cpu, 1))
+
+	cpu.Pc = DRAM_BASE
+	cpu.Mode = Supervisor
+	cpu.Csr.Store(MTVEC, DRAM_BASE+0x100)
+	assert.Nil(t, runTrapping(cpu, 2*(1+len(trapHandler))))
+	assert.Equal(t, uint64(DRAM_BASE+8), cpu.Pc)
+	assert.Equal(t, Supervisor, cpu.Mode)
+	assert.Equal(t, uint64(5<<8|7), cpu.Regs[8])
+}
+
+func TestWfiEbreak(t *testing.T) {
+	cpu := NewCPU(nil, nil)
+	// ebreak
+	_, exception := cpu.Execute(0x00100073)
+	assert.Equal(t, NewException(Breakpoint, DRAM_BASE), exception)
+	// wfi
+	newPC, exception := cpu.Execute(0x10500073)
+	assert.Nil(t, exception)
+	assert.Equal(t, uint64(DRAM_BASE+4), newPC)
+	assert.True(t, cpu.Waiting)
+	cpu.Csr.Store(MIE, MASK_SSIP)
+	cpu.Csr.Store(MIP, MASK_SSIP)
+	cpu.WaitForInterrupt()
+	assert.False(t, cpu.Waiting)
+}
+
+func TestWfiWakeup(t *testing.T) {
+	// wfi; addi a0, zero, 1
+	cpu := NewCPU([]uint8{0x73, 0x00, 0x50, 0x10, 0x13, 0x05, 0x10, 0x00}, nil)
+	cpu.Csr.Store(MTVEC, DRAM_BASE+0x100)
+	cpu.Csr.Store(MIE, MASK_MSIP)
+	cpu.Csr.Store(MSTATUS, cpu.Csr.Load(MSTATUS)|MASK_MIE)
+	assert.Nil(t, cpu.Step())
+	assert.True(t, cpu.Waiting)
+	assert.Equal(t, uint64(DRAM_BASE+4), cpu.Pc)
+
+	// The interrupt that ends the wait is taken before the addi runs.
+	cpu.Csr.SetPending(MASK_MSIP)
+	assert.Nil(t, cpu.Step())
+	assert.False(t, cpu.Waiting)
+	assert.Equal(t, uint64(DRAM_BASE+0x100), cpu.Pc)
+	assert.Equal(t, uint64(DRAM_BASE+4), cpu.Csr.Load(MEPC))
+	assert.Equal(t, uint64(MASK_INTERRUPT_BIT|3), cpu.Csr.Load(MCAUSE))
+	assert.Equal(t, uint64(0), cpu.Regs[10])
+}
+
+func TestInterruptEnable(t *testing.T) {
+	cpu := NewCPU(nil, nil)
+	cpu.Csr.Store(MIE, MASK_MSIP|MASK_SSIP)
+	// Interrupts trapping to M-mode are taken in S-mode whatever mstatus.MIE
+	// and sstatus.SIE say, undelegated S-level ones included.
+	cpu.Mode = Supervisor
+	cpu.Csr.SetPending(MASK_MSIP | MASK_SSIP)
+	assert.Equal(t, &MachineSoftwareInterrupt, cpu.CheckPendingInterrupt())
+	assert.Equal(t, &SupervisorSoftwareInterrupt, cpu.CheckPendingInterrupt())
+
+	// Delegated, an S-level interrupt is never taken in M-mode, and in S-mode
+	// only with sstatus.SIE set.
+	cpu.Csr.Store(MIDELEG, cpu.Csr.Load(MIDELEG)|MASK_SSIP)
+	cpu.Csr.Store(MSTATUS, cpu.Csr.Load(MSTATUS)|MASK_MIE)
+	cpu.Csr.SetPending(MASK_SSIP)
+	cpu.Mode = Machine
+	assert.Nil(t, cpu.CheckPendingInterrupt())
+	cpu.Mode = Supervisor
+	assert.Nil(t, cpu.CheckPendingInterrupt())
+	cpu.Mode = User
+	assert.Equal(t, &SupervisorSoftwareInterrupt, cpu.CheckPendingInterrupt())
+	cpu.Csr.SetPending(MASK_SSIP)
+	cpu.Mode = Supervisor
+	cpu.Csr.Store(SSTATUS, cpu.Csr.Load(SSTATUS)|MASK_SIE)
+	assert.Equal(t, &SupervisorSoftwareInterrupt, cpu.CheckPendingInterrupt())
+}
+
+func TestSstc(t *testing.T) {
+	cpu := NewCPU(nil, nil)
+	cpu.Mode = Supervisor
+	// csrr a0, stimecmp
+	_, exception := cpu.Execute(0x14d02573)
+	assert.Equal(t, NewException(IllegalInstruction, 0x14d02573), exception)
+
+	cpu.Csr.Store(MENVCFG, cpu.Csr.Load(MENVCFG)|MENVCFG_STCE)
+	cpu.Csr.Store(MCOUNTEREN, MASK_TM)
+	cpu.Regs[10] = 100
+	// csrw stimecmp, a0
+	_, exception = cpu.Execute(0x14d51073)
+	assert.Nil(t, exception)
+	cpu.Bus.clint.mtime = 99
+	assert.Equal(t, uint64(0), cpu.ReadCSR(SIP)&MASK_STIP)
+	cpu.Bus.clint.mtime = 100
+	assert.Equal(t, uint64(MASK_STIP), cpu.ReadCSR(MIP)&MASK_STIP)
+	// The comparator, not software, owns STIP.
+	cpu.Csr.Store(MIP, 0)
+	assert.Equal(t, uint64(MASK_STIP), cpu.ReadCSR(MIP)&MASK_STIP)
+
+	cpu.Csr.Store(MIDELEG, MASK_STIP)
+	cpu.Csr.Store(MIE, MASK_STIP)
+	assert.Nil(t, cpu.CheckPendingInterrupt())
+	cpu.Csr.Store(SSTATUS, MASK_SIE)
+	assert.Equal(t, &SupervisorTimerInterrupt, cpu.CheckPendingInterrupt())
+
+	// wfi skips ahead to the next deadline.
+	cpu.Csr.Store(STIMECMP, 1000)
+	cpu.WaitForInterrupt()
+	assert.Equal(t, uint64(1000), cpu.Bus.clint.mtime)
+
+	// A guest's stimecmp is vstimecmp, compared against time + htimedelta.
+	cpu.Csr.V = true
+	_, exception = cpu.Execute(0x14d02573)
+	assert.Equal(t, NewException(VirtualInstruction, 0x14d02573), exception)
+	cpu.Csr.Store(HENVCFG, cpu.Csr.Load(HENVCFG)|MENVCFG_STCE)
+	cpu.Csr.Store(HCOUNTEREN, MASK_TM)
+	cpu.Csr.Store(HTIMEDELTA, 50)
+	cpu.Regs[10] = 1100
+	_, exception = cpu.Execute(0x14d51073)
+	assert.Nil(t, exception)
+	assert.Equal(t, uint64(1100), cpu.Csr.Load(VSTIMECMP))
+	assert.Equal(t, uint64(1000), cpu.Csr.Load(STIMECMP))
+	assert.Equal(t, uint64(0), cpu.ReadCSR(HIP)&MASK_VSTIP)
+	cpu.Bus.clint.mtime = 1050
+	assert.Equal(t, uint64(MASK_VSTIP), cpu.ReadCSR(HIP)&MASK_VSTIP)
+}
+
+func TestTriggers(t *testing.T) {
+	cpu := NewCPU(nil, nil)
+	setTrigger := func(i, data1, data2 uint64) {
+		cpu.Csr.Store(TSELECT, i)
+		cpu.Csr.Store(TDATA1, data1)
+		cpu.Csr.Store(TDATA2, data2)
+	}
+	cpu.Csr.Store(TSELECT, TRIGGER_COUNT)
+	assert.Equal(t, uint64(0), cpu.Csr.Load(TSELECT))
+	assert.Equal(t, uint64(TINFO_VERSION_1|MASK_TINFO_INFO), cpu.Csr.Load(TINFO))
+	// Legacy mcontrol (type 2) is not supported.
+	setTrigger(0, 2<<60|MCONTROL6_EXECUTE, 0)
+	assert.Equal(t, uint64(TRIGGER_DISABLED<<60), cpu.Csr.Load(TDATA1))
+
+	// M-mode triggers need tcontrol.MTE.
+	nop := uint64(0x00000013)
+	setTrigger(0, TRIGGER_MCONTROL6<<60|MCONTROL6_EXECUTE|MCONTROL6_M, DRAM_BASE)
+	_, exception := cpu.Execute(nop)
+	assert.Nil(t, exception)
+	cpu.Csr.Store(TCONTROL, TCONTROL_MTE)
+	_, exception = cpu.Execute(nop)
+	assert.Equal(t, NewException(Breakpoint, DRAM_BASE), exception)
+	assert.Equal(t, uint64(MCONTROL6_HIT0), cpu.Csr.Load(TDATA1)&MCONTROL6_HIT0)
+	// A trap into M-mode saves MTE in MPTE, and mret restores it.
+	cpu.HandleException(exception)
+	assert.Equal(t, uint64(TCONTROL_MPTE), cpu.Csr.Load(TCONTROL))
+	cpu.Csr.Store(MEPC, DRAM_BASE+4)
+	cpu.Csr.Store(MSTATUS, cpu.Csr.Load(MSTATUS)|MASK_MPP)
+	_, exception = cpu.Execute(0x30200073) // mret
+	assert.Nil(t, exception)
+	assert.Equal(t, uint64(TCONTROL_MTE|TCONTROL_MPTE), cpu.Csr.Load(TCONTROL))
+	setTrigger(0, 0, 0)
+
+	// A NAPOT load watchpoint on 16 bytes.
+	setTrigger(1, TRIGGER_MCONTROL6<<60|1<<7|MCONTROL6_LOAD|MCONTROL6_M, DRAM_BASE+0x1007)
+	_, exception = cpu.Load(DRAM_BASE+0x1008, 64)
+	assert.Equal(t, NewException(Breakpoint, DRAM_BASE+0x1008), exception)
+	_, exception = cpu.Load(DRAM_BASE+0x1010, 64)
+	assert.Nil(t, exception)
+	cpu.Regs[11] = DRAM_BASE + 0x1000
+	_, exception = cpu.Execute(0x0005b503) // ld a0, 0(a1)
+	assert.Equal(t, NewException(Breakpoint, DRAM_BASE+0x1000), exception)
+
+	// A store data trigger chained behind a store address trigger.
+	setTrigger(1, TRIGGER_MCONTROL6<<60|MCONTROL6_CHAIN|MCONTROL6_STORE|MCONTROL6_M, DRAM_BASE+0x2000)
+	setTrigger(2, TRIGGER_MCONTROL6<<60|MCONTROL6_SELECT|MCONTROL6_STORE|MCONTROL6_M, 42)
+	assert.Nil(t, cpu.Store(DRAM_BASE+0x2000, 64, 41))
+	assert.Nil(t, cpu.Store(DRAM_BASE+0x2008, 64, 42))
+	assert.Equal(t, NewException(Breakpoint, DRAM_BASE+0x2000), cpu.Store(DRAM_BASE+0x2000, 64, 42))
+	val, _ := cpu.Bus.Load(DRAM_BASE+0x2000, 64)
+	assert.Equal(t, uint64(41), val)
+	setTrigger(1, 0, 0)
+	setTrigger(2, 0, 0)
+
+	// icount fires before the instruction after the counted ones.
+	setTrigger(3, TRIGGER_ICOUNT<<60|2<<10|ICOUNT_M, 0)
+	_, exception = cpu.Execute(nop)
+	assert.Nil(t, exception)
+	_, exception = cpu.Execute(nop)
+	assert.Nil(t, exception)
+	assert.Equal(t, uint64(ICOUNT_PENDING), cpu.Csr.Load(TDATA1)&(ICOUNT_PENDING|MASK_ICOUNT_COUNT))
+	_, exception = cpu.Execute(nop)
+	assert.Equal(t, NewException(Breakpoint, 0), exception)
+	assert.Equal(t, uint64(ICOUNT_HIT), cpu.Csr.Load(TDATA1)&(ICOUNT_HIT|ICOUNT_PENDING))
+	setTrigger(3, 0, 0)
+
+	// etrigger fires at the start of the S-mode handler of a U-mode ecall.
+	setTrigger(0, TRIGGER_ETRIGGER<<60|XTRIGGER_U, 1<<EnvironmentCallFromUMode)
+	cpu.Csr.Store(MEDELEG, 1<<EnvironmentCallFromUMode)
+	cpu.Mode = User
+	cpu.HandleException(NewException(EnvironmentCallFromUMode, 0))
+	assert.Equal(t, Supervisor, cpu.Mode)
+	_, exception = cpu.Execute(nop)
+	assert.Equal(t, NewException(Breakpoint, 0), exception)
+	assert.Equal(t, uint64(XTRIGGER_HIT), cpu.Csr.Load(TDATA1)&XTRIGGER_HIT)
+	_, exception = cpu.Execute(nop)
+	assert.Nil(t, exception)
+}
+
+func TestTrapVirtualization(t *testing.T) {
+	cpu := NewCPU(nil, nil)
+	cpu.Csr.Store(MSTATUS, MASK_TW|MASK_TSR|MASK_TVM)
+	cpu.Mode = Supervisor
+	for _, inst := range []uint64{
+		0x10500073, // wfi
+		0x10200073, // sret
+		0x12000073, // sfence.vma
+		0x18002573, // csrr a0, satp
+		0x30200073, // mret
+	} {
+		_, exception := cpu.Execute(inst)
+		assert.Equal(t, NewException(IllegalInstruction, inst), exception)
+	}
+	cpu.Csr.Store(MSTATUS, 0)
+	_, exception := cpu.Execute(0x18002573)
+	assert.Nil(t, exception)
+	_, exception = cpu.Execute(0x12000073)
+	assert.Nil(t, exception)
+}
+
+func TestPMU(t *testing.T) {
+	cpu := NewCPU(nil, nil)
+	cpu.Csr.Store(MHPMEVENT3, HPM_EVENT_LOAD)
+	cpu.Csr.Store(MHPMEVENT3+1, HPM_EVENT_BRANCH_TAKEN)
+	cpu.Csr.Store(MHPMEVENT3+2, HPM_EVENT_BRANCH|MHPMEVENT_MINH)
+	cpu.Csr.Store(MHPMEVENT3+3, HPM_EVENT_TRAP)
+	// Events that do not exist count nothing.
+	cpu.Csr.Store(MHPMEVENT3+4, 100)
+	assert.Equal(t, uint64(0), cpu.Csr.Load(MHPMEVENT3+4))
+
+	cpu.Regs[12] = DRAM_BASE + 0x100
+	for _, inst := range []uint64{
+		0x00063503, // ld a0, 0(a2)
+		0x00000463, // beq zero, zero, 8
+		0x00001463, // bne zero, zero, 8
+	} {
+		_, exception := cpu.Execute(inst)
+		assert.Nil(t, exception)
+	}
+	assert.Equal(t, uint64(1), cpu.Csr.Load(MHPMCOUNTER3))
+	assert.Equal(t, uint64(1), cpu.Csr.Load(MHPMCOUNTER3+1))
+	assert.Equal(t, uint64(0), cpu.Csr.Load(MHPMCOUNTER3+2))
+	cpu.HandleException(NewException(IllegalInstruction, 0))
+	assert.Equal(t, uint64(1), cpu.Csr.Load(MHPMCOUNTER3+3))
+
+	// Wrapping sets OF and raises LCOFI, but only while OF is clear.
+	cpu.Csr.Store(MHPMCOUNTER3, ^uint64(0))
+	_, exception := cpu.Execute(0x00063503) // ld a0, 0(a2)
+	assert.Nil(t, exception)
+	assert.Equal(t, uint64(0), cpu.Csr.Load(MHPMCOUNTER3))
+	assert.Equal(t, uint64(MHPMEVENT_OF), cpu.Csr.Load(MHPMEVENT3)&MHPMEVENT_OF)
+	assert.Equal(t, uint64(MASK_LCOFIP), cpu.ReadCSR(MIP)&MASK_LCOFIP)
+	cpu.Csr.ClearPending(MASK_LCOFIP)
+	cpu.Csr.Store(MHPMCOUNTER3, ^uint64(0))
+	_, exception = cpu.Execute(0x00063503) // ld a0, 0(a2)
+	assert.Nil(t, exception)
+	assert.Equal(t, uint64(0), cpu.ReadCSR(MIP)&MASK_LCOFIP)
+	// mcountinhibit stops the counter.
+	cpu.Csr.Store(MCOUNTINHIBIT, 1<<3)
+	_, exception = cpu.Execute(0x00063503) // ld a0, 0(a2)
+	assert.Nil(t, exception)
+	assert.Equal(t, uint64(0), cpu.Csr.Load(MHPMCOUNTER3))
+
+	// scountovf shows S-mode the OF bits of the counters mcounteren exposes.
+	assert.Equal(t, uint64(1<<3), cpu.ReadCSR(SCOUNTOVF))
+	cpu.Mode = Supervisor
+	_, exception = cpu.Execute(0xda002573) // csrr a0, scountovf
+	assert.Nil(t, exception)
+	assert.Equal(t, uint64(0), cpu.Regs[10])
+	cpu.Csr.Store(MCOUNTEREN, 1<<3)
+	_, exception = cpu.Execute(0xda002573) // csrr a0, scountovf
+	assert.Nil(t, exception)
+	assert.Equal(t, uint64(1<<3), cpu.Regs[10])
+
+	// LCOFI can be delegated to S-mode.
+	cpu.Csr.Store(MIDELEG, MASK_LCOFIP)
+	cpu.Csr.Store(SIE, MASK_LCOFIP)
+	cpu.Csr.Store(SIP, MASK_LCOFIP)
+	cpu.Csr.Store(SSTATUS, MASK_SIE)
+	assert.Equal(t, &LocalCounterOverflowInterrupt, cpu.CheckPendingInterrupt())
+	// Taking it leaves LCOFIP for software to clear, and it has the lowest
+	// priority, below the VS-level interrupts.
+	assert.Equal(t, uint64(MASK_LCOFIP), cpu.ReadCSR(MIP)&MASK_LCOFIP)
+	cpu.Csr.Store(MIE, cpu.Csr.Load(MIE)|MASK_VSSIP)
+	cpu.Csr.SetPending(MASK_VSSIP)
+	assert.Equal(t, &VirtualSupervisorSoftwareInterrupt, cpu.CheckPendingInterrupt())
+}
+
+func TestAIA(t *testing.T) {
+	cpu := NewCPU(nil, nil)
+	// csrr a0, mtopei
+	_, exception := cpu.Execute(0x35c02573)
+	assert.Equal(t, NewException(IllegalInstruction, 0x35c02573), exception)
+	cpu.EnableAIA()
+
+	// The M-level interrupt file, programmed through miselect and mireg.
+	for _, reg := range [][2]uint64{{ISELECT_EIDELIVERY, 1}, {ISELECT_EIE0, 1 << 5}} {
+		cpu.Regs[10], cpu.Regs[11] = reg[0], reg[1]
+		// csrw miselect, a0
+		_, exception = cpu.Execute(0x35051073)
+		assert.Nil(t, exception)
+		// csrw mireg, a1
+		_, exception = cpu.Execute(0x35159073)
+		assert.Nil(t, exception)
+	}
+	assert.Nil(t, cpu.Bus.Store(IMSIC_M_BASE+IMSIC_SETEIPNUM_LE, 32, 5))
+	assert.Equal(t, uint64(MASK_MEIP), cpu.ReadCSR(MIP)&MASK_MEIP)
+	assert.Equal(t, uint64(5<<16|5), cpu.ReadCSR(MTOPEI))
+	cpu.Csr.Store(MIE, MASK_MEIP)
+	assert.Equal(t, uint64(11<<16|1), cpu.ReadCSR(MTOPI))
+	cpu.Csr.Store(MSTATUS, cpu.Csr.Load(MSTATUS)|MASK_MIE)
+	assert.Equal(t, &MachineExternalInterrupt, cpu.CheckPendingInterrupt())
+	// csrrw a0, mtopei, zero
+	_, exception = cpu.Execute(0x35c01573)
+	assert.Nil(t, exception)
+	assert.Equal(t, uint64(5<<16|5), cpu.Regs[10])
+	assert.Equal(t, uint64(0), cpu.ReadCSR(MTOPEI))
+	assert.Equal(t, uint64(0), cpu.ReadCSR(MIP)&MASK_MEIP)
+
+	// eie1 does not exist on RV64.
+	cpu.Regs[10] = ISELECT_EIE0 + 1
+	_, exception = cpu.Execute(0x35051073)
+	assert.Nil(t, exception)
+	_, exception = cpu.Execute(0x35159073)
+	assert.Equal(t, NewException(IllegalInstruction, 0x35159073), exception)
+
+	// Source 10 delegated to the S-level APLIC domain, in direct mode.
+	cpu.Bus.Store(APLIC_M_BASE+APLIC_SOURCECFG+4*9, 32, SOURCECFG_D)
+	cpu.Bus.Store(APLIC_S_BASE+APLIC_SOURCECFG+4*9, 32, APLIC_SM_LEVEL1)
+	cpu.Bus.Store(APLIC_S_BASE+APLIC_DOMAINCFG, 32, DOMAINCFG_IE)
+	cpu.Bus.Store(APLIC_S_BASE+APLIC_SETIENUM, 32, 10)
+	cpu.Bus.Store(APLIC_S_BASE+APLIC_TARGET+4*9, 32, 3)
+	cpu.Bus.Store(APLIC_S_BASE+APLIC_IDELIVERY, 32, 1)
+	cpu.Bus.Interrupt(10)
+	// The source is inactive in the root domain.
+	value, _ := cpu.Bus.Load(APLIC_M_BASE+APLIC_SETIP, 32)
+	assert.Equal(t, uint64(0), value)
+	assert.Equal(t, uint64(MASK_SEIP), cpu.ReadCSR(MIP)&MASK_SEIP)
+	cpu.Csr.Store(MIE, MASK_SEIP)
+	cpu.Csr.Store(MIDELEG, MASK_SEIP)
+	assert.Equal(t, uint64(9<<16|1), cpu.ReadCSR(STOPI))
+	assert.Equal(t, uint64(0), cpu.ReadCSR(MTOPI))
+	value, _ = cpu.Bus.Load(APLIC_S_BASE+APLIC_CLAIMI, 32)
+	assert.Equal(t, uint64(10<<16|3), value)
+	value, _ = cpu.Bus.Load(APLIC_S_BASE+APLIC_TOPI, 32)
+	assert.Equal(t, uint64(0), value)
+	assert.Equal(t, uint64(0), cpu.ReadCSR(MIP)&MASK_SEIP)
+
+	// The same source in MSI mode becomes identity 7 of the S-level file.
+	cpu.Bus.Store(APLIC_S_BASE+APLIC_DOMAINCFG, 32, DOMAINCFG_IE|DOMAINCFG_DM)
+	cpu.Bus.Store(APLIC_S_BASE+APLIC_TARGET+4*9, 32, 7)
+	cpu.Csr.Store(SISELECT, ISELECT_EIDELIVERY)
+	cpu.WriteCSR(SIREG, 1)
+	cpu.Csr.Store(SISELECT, ISELECT_EIE0)
+	cpu.WriteCSR(SIREG, 1<<7)
+	cpu.Bus.Interrupt(10)
+	assert.Equal(t, uint64(7<<16|7), cpu.ReadCSR(STOPEI))
+	assert.Equal(t, uint64(MASK_SEIP), cpu.ReadCSR(MIP)&MASK_SEIP)
+	value, _ = cpu.Bus.Load(APLIC_S_BASE+APLIC_SETIP, 32)
+	assert.Equal(t, uint64(0), value)
+
+	// An M-level interrupt reaches a hart in S-mode even with sstatus.SIE
+	// clear.
+	cpu.Mode = Supervisor
+	cpu.Csr.Store(SSTATUS, cpu.Csr.Load(SSTATUS)&^MASK_SIE)
+	cpu.Csr.Store(MIE, MASK_MEIP)
+	assert.Nil(t, cpu.Bus.Store(IMSIC_M_BASE+IMSIC_SETEIPNUM_LE, 32, 5))
+	assert.Equal(t, &MachineExternalInterrupt, cpu.CheckPendingInterrupt())
+}
+
+func TestCustomInstruction(t *testing.T) {
+	cpu := NewCPU(nil, nil)
+	_, exception := cpu.Execute(0x00c5850b) // mac a0, a1, a2
+	assert.Equal(t, NewException(IllegalInstruction, 0x00c5850b), exception)
+
+	// mac rd, rs1, rs2 in custom-0 multiplies and accumulates, and ldinc rd,
+	// (rs1) in custom-1 loads a doubleword and advances rs1 past it.
+	assert.Nil(t, cpu.RegisterCustom(CustomInstruction{
+		Name:  "mac",
+		Mask:  0xfe00707f,
+		Match: OPCODE_CUSTOM_0,
+		Execute: func(cpu *Cpu, f CustomFields) *Exception {
+			cpu.Regs[f.Rd] += cpu.Regs[f.Rs1] * cpu.Regs[f.Rs2]
+			return nil
+		},
+	}))
+	assert.Nil(t, cpu.RegisterCustom(CustomInstruction{
+		Name:  "ldinc",
+		Mask:  0x01f0707f,
+		Match: 0x2<<12 | OPCODE_CUSTOM_1,
+		Execute: func(cpu *Cpu, f CustomFields) *Exception {
+			value, exception := cpu.Load(cpu.Regs[f.Rs1], 64)
+			if exception != nil {
+				return exception
+			}
+			cpu.Regs[f.Rs1] += 8
+			cpu.Regs[f.Rd] = value
+			return nil
+		},
+	}))
+	assert.NotNil(t, cpu.RegisterCustom(CustomInstruction{Name: "add", Mask: 0x7f, Match: 0x33, Execute: func(*Cpu, CustomFields) *Exception { return nil }}))
+	assert.NotNil(t, cpu.RegisterCustom(CustomInstruction{Name: "nomask", Mask: 0x3000, Match: 0x300b, Execute: func(*Cpu, CustomFields) *Exception { return nil }}))
+
+	cpu.Regs[10], cpu.Regs[11], cpu.Regs[12] = 1, 6, 7
+	newPC, exception := cpu.Execute(0x00c5850b) // mac a0, a1, a2
+	assert.Nil(t, exception)
+	assert.Equal(t, uint64(43), cpu.Regs[10])
+	assert.Equal(t, cpu.Pc+4, newPC)
+
+	cpu.Bus.Store(DRAM_BASE+0x100, 64, 0x1234)
+	cpu.Regs[11] = DRAM_BASE + 0x100
+	_, exception = cpu.Execute(0x0005a52b) // ldinc a0, (a1)
+	assert.Nil(t, exception)
+	assert.Equal(t, uint64(0x1234), cpu.Regs[10])
+	assert.Equal(t, uint64(DRAM_BASE+0x108), cpu.Regs[11])
+	// Exceptions from the memory access are taken as usual.
+	cpu.Regs[11] = 0
+	_, exception = cpu.Execute(0x0005a52b) // ldinc a0, (a1)
+	assert.Equal(t, NewException(LoadAccessFault, 0), exception)
+	_, exception = cpu.Execute(0x0005b52b) // funct3 3 is not registered
+	assert.Equal(t, NewException(IllegalInstruction, 0x0005b52b), exception)
+
+	// On RV32 every register a handler writes is sign-extended, including
+	// inc rs1, rs2 in custom-2, which adds rs2 to rs1.
+	cpu = NewCPU(nil, nil)
+	assert.Nil(t, cpu.SetXLEN(32))
+	assert.Nil(t, cpu.RegisterCustom(CustomInstruction{
+		Name:  "inc",
+		Mask:  0xfe00707f,
+		Match: OPCODE_CUSTOM_2,
+		Execute: func(cpu *Cpu, f CustomFields) *Exception {
+			cpu.Regs[f.Rs1] += cpu.Regs[f.Rs2]
+			return nil
+		},
+	}))
+	cpu.Regs[10], cpu.Regs[11] = 0x7fffffff, 1
+	_, exception = cpu.Execute(0x00b5005b) // inc a0, a1
+	assert.Nil(t, exception)
+	assert.Equal(t, uint64(0xffffffff80000000), cpu.Regs[10])
+}
+
+func TestHypervisor(t *testing.T) {
+	cpu := NewCPU(nil, nil)
+	// G-stage: guest physical [0, 1 GiB) maps to DRAM.
+	groot := uint64(DRAM_BASE + 0x20000)
+	cpu.Bus.Store(groot, 64, (DRAM_BASE>>12)<<10|PTE_U|PTE_A|PTE_D|PTE_X|PTE_W|PTE_R|PTE_V)
+	cpu.Csr.Store(HGATP, SATP_MODE_SV39<<60|groot>>12)
+	cpu.Bus.Store(DRAM_BASE+0x100, 64, 0x1122334455667788)
+
+	// hlv.d a0, (a1) with vsatp Bare reads through the G-stage only.
+	cpu.Regs[11] = 0x100
+	_, exception := cpu.Execute(0x6c05c573)
+	assert.Nil(t, exception)
+	assert.Equal(t, uint64(0x1122334455667788), cpu.Regs[10])
+	cpu.Regs[11] = 1 << 30
+	_, exception = cpu.Execute(0x6c05c573)
+	assert.Equal(t, &Exception{Type: LoadGuestPageFault, Store: 1 << 30, Tval2: 1 << 28, GVA: true}, exception)
+
+	// The A bit of a leaf beyond the first 512 entries of the widened root
+	// table is set in that leaf, not in the entry its low index bits name.
+	cpu.Bus.Store(groot+0x200*8, 64, (DRAM_BASE>>12)<<10|PTE_U|PTE_X|PTE_W|PTE_R|PTE_V)
+	cpu.Regs[11] = 0x200<<30 | 0x100
+	_, exception = cpu.Execute(0x6c05c573)
+	assert.Nil(t, exception)
+	assert.Equal(t, uint64(0x1122334455667788), cpu.Regs[10])
+	pte, _ := cpu.Bus.Load(groot+0x200*8, 64)
+	assert.Equal(t, uint64(PTE_A), pte&PTE_A)
+	pte, _ = cpu.Bus.Load(groot, 64)
+	assert.Equal(t, uint64((DRAM_BASE>>12)<<10|PTE_U|PTE_A|PTE_D|PTE_X|PTE_W|PTE_R|PTE_V), pte)
+
+	// A misaligned access crossing a guest page is split into one access per
+	// page, unless the policy traps it.
+	cpu.Regs[11] = PAGE_SIZE - 4
+	cpu.Regs[12] = 0x0102030405060708
+	_, exception = cpu.Execute(0x6ec5c073) // hsv.d a2, (a1)
+	assert.Nil(t, exception)
+	low, _ := cpu.Bus.Load(DRAM_BASE+PAGE_SIZE-4, 32)
+	assert.Equal(t, uint64(0x05060708), low)
+	_, exception = cpu.Execute(0x6c05c573) // hlv.d a0, (a1)
+	assert.Nil(t, exception)
+	assert.Equal(t, uint64(0x0102030405060708), cpu.Regs[10])
+	cpu.Regs[11] = 1<<30 - 4
+	_, exception = cpu.Execute(0x6c05c573) // hlv.d a0, (a1)
+	assert.Equal(t, &Exception{Type: LoadGuestPageFault, Store: 1 << 30, Tval2: 1 << 28, GVA: true}, exception)
+	cpu.Misaligned = MisalignedTrap
+	cpu.Regs[11] = PAGE_SIZE - 4
+	_, exception = cpu.Execute(0x6c05c573) // hlv.d a0, (a1)
+	assert.Equal(t, &Exception{Type: LoadAccessMisaligned, Store: PAGE_SIZE - 4, GVA: true}, exception)
+	cpu.Misaligned = MisalignedEmulate
+
+	// VS-stage: guest virtual 2 GiB maps to guest physical 0.
+	cpu.Bus.Store(DRAM_BASE+0x30000+2*8, 64, PTE_A|PTE_D|PTE_W|PTE_R|PTE_V)
+	cpu.Csr.Store(VSATP, SATP_MODE_SV39<<60|0x30)
+	cpu.Csr.V = true
+	cpu.Mode = Supervisor
+	pAddr, exception := cpu.Translate(2<<30|0x100, Load)
+	assert.Nil(t, exception)
+	assert.Equal(t, uint64(DRAM_BASE+0x100), pAddr)
+	// The VS-stage page table itself is outside guest physical memory.
+	cpu.Csr.Store(VSATP, SATP_MODE_SV39<<60|(1<<30)>>12)
+	_, exception = cpu.Translate(2<<30, Store)
+	assert.Equal(t, &Exception{Type: StoreAMOGuestPageFault, Store: 2 << 30, Tval2: (1<<30 + 2*8) >> 2, GVA: true}, exception)
+
+	// VS-mode sees vsstatus as sstatus, and may not touch hypervisor CSRs.
+	cpu.Csr.Store(VSSTATUS, MASK_SUM)
+	_, exception = cpu.Execute(0x10002573) // csrr a0, sstatus
+	assert.Nil(t, exception)
+	assert.Equal(t, uint64(XL_64<<32|MASK_SUM), cpu.Regs[10])
+	for _, inst := range []uint64{
+		0x60002573, // csrr a0, hstatus
+		0x6c05c573, // hlv.d a0, (a1)
+		0x22000073, // hfence.vvma
+	} {
+		_, exception = cpu.Execute(inst)
+		assert.Equal(t, NewException(VirtualInstruction, inst), exception)
+	}
+
+	// An ecall from VS-mode traps to HS-mode, and sret returns to the guest.
+	cpu.Csr.Store(MEDELEG, 1<<EnvironmentCallFromVSMode)
+	_, exception = cpu.Execute(0x00000073)
+	assert.Equal(t, NewException(EnvironmentCallFromVSMode, DRAM_BASE), exception)
+	cpu.HandleException(exception)
+	assert.False(t, cpu.Csr.V)
+	assert.Equal(t, Supervisor, cpu.Mode)
+	assert.Equal(t, uint64(MASK_HSTATUS_SPV|MASK_HSTATUS_SPVP), cpu.Csr.Load(HSTATUS)&(MASK_HSTATUS_SPV|MASK_HSTATUS_SPVP))
+	_, exception = cpu.Execute(0x10200073)
+	assert.Nil(t, exception)
+	assert.True(t, cpu.Csr.V)
+	assert.Equal(t, Supervisor, cpu.Mode)
+
+	// Delegated through hedeleg, an ecall from VU-mode stays in the guest.
+	cpu.Csr.Store(MEDELEG, 1<<EnvironmentCallFromUMode)
+	cpu.Csr.Store(HEDELEG, 1<<EnvironmentCallFromUMode)
+	cpu.Mode = User
+	_, exception = cpu.Execute(0x00000073)
+	cpu.HandleException(exception)
+	assert.True(t, cpu.Csr.V)
+	assert.Equal(t, Supervisor, cpu.Mode)
+	assert.Equal(t, uint64(EnvironmentCallFromUMode), cpu.Csr.Load(VSCAUSE))
+}
+
+func TestCacheBlock(t *testing.T) {
+	cpu := NewCPU(nil, nil)
+	for off := uint64(0); off < 0x100; off += 8 {
+		cpu.Bus.Store(DRAM_BASE+0x1000+off, 64, ^uint64(0))
+	}
+	// cbo.zero a0 clears the whole 64-byte block holding a0.
+	cpu.Regs[10] = DRAM_BASE + 0x1048
+	_, exception := cpu.Execute(0x0045200f)
+	assert.Nil(t, exception)
+	for off := uint64(0); off < 0x100; off += 8 {
+		val, _ := cpu.Bus.Load(DRAM_BASE+0x1000+off, 64)
+		if off >= 0x40 && off < 0x80 {
+			assert.Equal(t, uint64(0), val)
+		} else {
+			assert.Equal(t, ^uint64(0), val)
+		}
+	}
+	assert.Nil(t, cpu.SetCacheBlockSize(128))
+	assert.NotNil(t, cpu.SetCacheBlockSize(96))
+
+	// Below M-mode each operation needs its menvcfg and senvcfg enables.
+	cpu.Mode = Supervisor
+	for _, inst := range []uint64{
+		0x0005200f, // cbo.inval (a0)
+		0x0015200f, // cbo.clean (a0)
+		0x0025200f, // cbo.flush (a0)
+		0x0045200f, // cbo.zero (a0)
+	} {
+		_, exception = cpu.Execute(inst)
+		assert.Equal(t, NewException(IllegalInstruction, inst), exception)
+	}
+	cpu.Csr.Store(MENVCFG, MASK_ENVCFG_CBO)
+	_, exception = cpu.Execute(0x0015200f)
+	assert.Nil(t, exception)
+	cpu.Mode = User
+	_, exception = cpu.Execute(0x0015200f)
+	assert.Equal(t, NewException(IllegalInstruction, 0x0015200f), exception)
+	cpu.Csr.Store(SENVCFG, ENVCFG_CBCFE)
+	_, exception = cpu.Execute(0x0015200f)
+	assert.Nil(t, exception)
+	cpu.Csr.V = true
+	_, exception = cpu.Execute(0x0015200f)
+	assert.Equal(t, NewException(VirtualInstruction, 0x0015200f), exception)
+
+	// CBIE = 0b10 is reserved and keeps the old value.
+	cpu.Csr.Store(MENVCFG, 0b10<<4)
+	assert.Equal(t, uint64(ENVCFG_CBIE), cpu.Csr.Load(MENVCFG))
+}
+
+func TestCryptoBitmanip(t *testing.T) {
+	code := `addi a0, zero, 0x123
+addi a1, zero, -1
+pack a2, a0, a1
+packh a3, a0, a1
+packw a4, a1, a0
+brev8 a5, a0
+xperm8 a6, a0, zero
+xperm4 a7, a0, a1`
+	riscvTestWithArch(t, code, "test_crypto_bitmanip", "rv64g_zbkb_zbkx", 8, []TestExp{
+		{RegName: "a2", Expect: 0xffffffff00000123},
+		{RegName: "a3", Expect: 0xff23},
+		{RegName: "a4", Expect: 0x0123ffff},
+		{RegName: "a5", Expect: 0x80c4},
+		{RegName: "a6", Expect: 0x2323232323232323},
+		{RegName: "a7", Expect: 0},
+	})
+}
+
+func TestCryptoAES(t *testing.T) {
+	cpu := NewCPU(nil, nil)
+	exec := func(inst, rs1, rs2 uint64) uint64 {
+		cpu.Regs[11], cpu.Regs[12] = rs1, rs2
+		_, exception := cpu.Execute(inst)
+		assert.Nil(t, exception)
+		return cpu.Regs[10]
+	}
+	// The AES-128 example of FIPS-197 appendix C.1.
+	key := []byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f}
+	plain := []byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	cipher := []byte{0x69, 0xc4, 0xe0, 0xd8, 0x6a, 0x7b, 0x04, 0x30, 0xd8, 0xcd, 0xb7, 0x80, 0x70, 0xb4, 0xc5, 0x5a}
+
+	var rk [22]uint64
+	rk[0], rk[1] = binary.LittleEndian.Uint64(key), binary.LittleEndian.Uint64(key[8:])
+	for i := uint64(0); i < 10; i++ {
+		tmp := exec(0x31059513|i<<20, rk[2*i+1], 0) // aes64ks1i a0, a1, i
+		rk[2*i+2] = exec(0x7ec58533, tmp, rk[2*i])  // aes64ks2 a0, a1, a2
+		rk[2*i+3] = exec(0x7ec58533, rk[2*i+2], rk[2*i+1])
+	}
+
+	s0 := binary.LittleEndian.Uint64(plain) ^ rk[0]
+	s1 := binary.LittleEndian.Uint64(plain[8:]) ^ rk[1]
+	for r := 1; r < 10; r++ {
+		// aes64esm a0, a1, a2
+		s0, s1 = exec(0x36c58533, s0, s1)^rk[2*r], exec(0x36c58533, s1, s0)^rk[2*r+1]
+	}
+	// aes64es a0, a1, a2
+	s0, s1 = exec(0x32c58533, s0, s1)^rk[20], exec(0x32c58533, s1, s0)^rk[21]
+	assert.Equal(t, binary.LittleEndian.Uint64(cipher), s0)
+	assert.Equal(t, binary.LittleEndian.Uint64(cipher[8:]), s1)
+
+	s0, s1 = s0^rk[20], s1^rk[21]
+	for r := 9; r > 0; r-- {
+		// aes64dsm a0, a1, a2 with the round key through aes64im a0, a1
+		k0, k1 := exec(0x30059513, rk[2*r], 0), exec(0x30059513, rk[2*r+1], 0)
+		s0, s1 = exec(0x3ec58533, s0, s1)^k0, exec(0x3ec58533, s1, s0)^k1
+	}
+	// aes64ds a0, a1, a2
+	s0, s1 = exec(0x3ac58533, s0, s1)^rk[0], exec(0x3ac58533, s1, s0)^rk[1]
+	assert.Equal(t, binary.LittleEndian.Uint64(plain), s0)
+	assert.Equal(t, binary.LittleEndian.Uint64(plain[8:]), s1)
+
+	// Round numbers above 0xa are reserved.
+	_, exception := cpu.Execute(0x31b59513)
+	assert.Equal(t, NewException(IllegalInstruction, 0x31b59513), exception)
+}
+
+func TestCryptoSHA(t *testing.T) {
+	cpu := NewCPU(nil, nil)
+	cpu.Regs[11] = 0x6a09e667
+	for _, test := range []struct {
+		inst   uint64
+		expect uint64
+	}{
+		{0x10059513, 0xffffffffce20b47e}, // sha256sum0 a0, a1
+		{0x10259513, 0xffffffffba0cf582}, // sha256sig0 a0, a1
+		{0x10859513, 0xffffffffb50bfca0}, // sm3p0 a0, a1
+		{0x10959513, 0xffffffffaa8f5790}, // sm3p1 a0, a1
+	} {
+		_, exception := cpu.Execute(test.inst)
+		assert.Nil(t, exception)
+		assert.Equal(t, test.expect, cpu.Regs[10])
+	}
+}
+
+func TestCryptoSM4(t *testing.T) {
+	cpu := NewCPU(nil, nil)
+	// sm4ed and sm4ks a0, a1, a2, bs fold in one byte of a2 at a time.
+	round := func(inst, x, word uint64) uint64 {
+		cpu.Regs[11] = x
+		for bs := uint64(0); bs < 4; bs++ {
+			cpu.Regs[12] = word
+			_, exception := cpu.Execute(inst | bs<<30)
+			assert.Nil(t, exception)
+			cpu.Regs[11] = cpu.Regs[10]
+		}
+		return uint64(uint32(cpu.Regs[10]))
+	}
+	// The example of GB/T 32907-2016 appendix A.1. The instructions work on
+	// words loaded little-endian, so FK and CK are byte-swapped.
+	block := []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0xfe, 0xdc, 0xba, 0x98, 0x76, 0x54, 0x32, 0x10}
+	fk := []uint64{0xc6bab1a3, 0x5033aa56, 0x97917d67, 0xdc2270b2}
+
+	var k, x [36]uint64
+	for i := 0; i < 4; i++ {
+		x[i] = uint64(binary.LittleEndian.Uint32(block[4*i:]))
+		k[i] = x[i] ^ fk[i]
+	}
+	for i := 0; i < 32; i++ {
+		var ck uint64
+		for j := 0; j < 4; j++ {
+			ck |= uint64((4*i+j)*7%256) << (8 * j)
+		}
+		k[i+4] = round(0x34c58533, k[i], k[i+1]^k[i+2]^k[i+3]^ck)
+		x[i+4] = round(0x30c58533, x[i], x[i+1]^x[i+2]^x[i+3]^k[i+4])
+	}
+	out := make([]byte, 16)
+	for i := 0; i < 4; i++ {
+		binary.LittleEndian.PutUint32(out[4*i:], uint32(x[35-i]))
+	}
+	assert.Equal(t, []byte{0x68, 0x1e, 0xdf, 0x34, 0xd2, 0x06, 0x96, 0x5e, 0x86, 0xb3, 0xe9, 0x4f, 0x53, 0x6e, 0x42, 0x46}, out)
+}
+
+func TestSeed(t *testing.T) {
+	cpu := NewCPU(nil, nil)
+	cpu.Entropy = bytes.NewReader([]byte{0x34, 0x12})
+	// csrrw a0, seed, zero
+	_, exception := cpu.Execute(0x01501573)
+	assert.Nil(t, exception)
+	assert.Equal(t, uint64(SEED_OPST_ES16|0x1234), cpu.Regs[10])
+	_, exception = cpu.Execute(0x01501573)
+	assert.Nil(t, exception)
+	assert.Equal(t, uint64(SEED_OPST_DEAD), cpu.Regs[10])
+
+	// csrr a0, seed does not write and is always illegal.
+	_, exception = cpu.Execute(0x01502573)
+	assert.Equal(t, NewException(IllegalInstruction, 0x01502573), exception)
+
+	// Lower modes need mseccfg.SSEED or USEED.
+	cpu.Mode = Supervisor
+	_, exception = cpu.Execute(0x01501573)
+	assert.Equal(t, NewException(IllegalInstruction, 0x01501573), exception)
+	cpu.Csr.Store(MSECCFG, MSECCFG_SSEED)
+	_, exception = cpu.Execute(0x01501573)
+	assert.Nil(t, exception)
+	cpu.Csr.V = true
+	_, exception = cpu.Execute(0x01501573)
+	assert.Equal(t, NewException(VirtualInstruction, 0x01501573), exception)
+	cpu.Csr.V = false
+	cpu.Mode = User
+	_, exception = cpu.Execute(0x01501573)
+	assert.Equal(t, NewException(IllegalInstruction, 0x01501573), exception)
+	cpu.Csr.Store(MSECCFG, MSECCFG_USEED)
+	_, exception = cpu.Execute(0x01501573)
+	assert.Nil(t, exception)
+}
+
+func TestRV32(t *testing.T) {
+	code := `li a0, -1
+srli a1, a0, 4
+li a2, 0x80000000
+mulhu a3, a0, a0
+divu a4, a2, a1
+li t0, 33
+sll a5, a0, t0
+sltu s2, a2, a1
+slt s3, a2, a1
+sw a1, 0x100(a2)
+lw s4, 0x100(a2)`
+	riscvTestWithArch(t, code, "test_rv32", "rv32gc", 11, []TestExp{
+		{RegName: "a1", Expect: 0x0fffffff},
+		{RegName: "a2", Expect: 0xffffffff80000000},
+		{RegName: "a3", Expect: 0xfffffffffffffffe},
+		{RegName: "a4", Expect: 8},
+		{RegName: "a5", Expect: 0xfffffffffffffffe},
+		{RegName: "s2", Expect: 0},
+		{RegName: "s3", Expect: 1},
+		{RegName: "s4", Expect: 0x0fffffff},
+	})
+}
+
+func TestRV32Machine(t *testing.T) {
+	cpu := NewCPU(nil, nil)
+	assert.Nil(t, cpu.SetXLEN(32))
+	assert.Equal(t, uint64(32), cpu.XLEN())
+	for _, inst := range []uint64{
+		0x00b53503, // ld a0, 11(a0)
+		0x00b5053b, // addw a0, a0, a1
+		0x02051513, // slli a0, a0, 32
+	} {
+		_, exception := cpu.Execute(inst)
+		assert.Equal(t, NewException(IllegalInstruction, inst), exception)
+	}
+
+	// csrr a0, misa
+	_, exception := cpu.Execute(0x30102573)
+	assert.Nil(t, exception)
+	assert.Equal(t, uint64(1<<30|MISA_A|MISA_C|MISA_D|MISA_F|MISA_I|MISA_M|MISA_S|MISA_U|MISA_V), cpu.Regs[10])
+
+	// csrw mcycleh, a0 and csrr a1, cycleh
+	cpu.Regs[10] = 0x12345678
+	_, exception = cpu.Execute(0xb8051073)
+	assert.Nil(t, exception)
+	_, exception = cpu.Execute(0xc80025f3)
+	assert.Nil(t, exception)
+	assert.Equal(t, uint64(0x12345678), cpu.Regs[11])
+	assert.Equal(t, uint64(0x12345678), cpu.Csr.Load(MCYCLE)>>32)
+
+	// The interrupt bit of mcause reads as bit 31.
+	cpu.HandleInterrupt(MachineTimerInterrupt)
+	_, exception = cpu.Execute(0x34202573)
+	assert.Nil(t, exception)
+	assert.Equal(t, uint64(0xffffffff80000007), cpu.Regs[10])
+
+	// Map VA 0x00401000 to DRAM_BASE+0x5000 through an Sv32 table at
+	// DRAM_BASE+0x1000, and switch it on with csrw satp, a0.
+	cpu.Bus.Store(DRAM_BASE+0x1000+4, 32, (DRAM_BASE+0x2000)>>12<<10|PTE_V)
+	cpu.Bus.Store(DRAM_BASE+0x2000+4, 32, (DRAM_BASE+0x5000)>>12<<10|PTE_V|PTE_R|PTE_W|PTE_U|PTE_A|PTE_D)
+	cpu.Regs[10] = 1<<31 | (DRAM_BASE+0x1000)>>12
+	_, exception = cpu.Execute(0x18051073)
+	assert.Nil(t, exception)
+	assert.Equal(t, uint64(SATP_MODE_SV32), cpu.Csr.Load(SATP)>>60)
+	cpu.Mode = User
+	pAddr, exception := cpu.Translate(0x00401234, Load)
+	assert.Nil(t, exception)
+	assert.Equal(t, uint64(DRAM_BASE+0x5234), pAddr)
+
+	// csrw pmpcfg1, a0 configures PMP entries 4-7.
+	cpu.Mode = Machine
+	cpu.Regs[10] = 0x1f
+	_, exception = cpu.Execute(0x3a151073)
+	assert.Nil(t, exception)
+	assert.Equal(t, uint64(0x1f), cpu.Csr.PMPCfg(4))
+}
+
+func TestRV32User(t *testing.T) {
+	cpu := NewCPU(nil, nil)
+	// csrw mstatus, a0 selects a 32-bit U-mode under a 64-bit M- and S-mode.
+	cpu.Regs[10] = cpu.Csr.Load(MSTATUS)&^MASK_UXL | XL_32<<32
+	_, exception := cpu.Execute(0x30051073)
+	assert.Nil(t, exception)
+	// csrs mstatus, a0 cannot select the reserved encoding 3.
+	cpu.Regs[10] = MASK_UXL | MASK_SXL
+	_, exception = cpu.Execute(0x30052073)
+	assert.Nil(t, exception)
+	assert.Equal(t, uint64(XL_32<<32|XL_64<<34), cpu.Csr.Load(MSTATUS)&(MASK_UXL|MASK_SXL))
+	assert.Equal(t, uint64(64), cpu.XLEN())
+
+	cpu.Mode = User
+	assert.Equal(t, uint64(32), cpu.XLEN())
+	cpu.Regs[10], cpu.Regs[11] = 0x7fffffff, 1
+	// add a0, a0, a1
+	_, exception = cpu.Execute(0x00b50533)
+	assert.Nil(t, exception)
+	assert.Equal(t, uint64(0xffffffff80000000), cpu.Regs[10])
+
+	// c.jal replaces c.addiw and links to the next instruction.
+	cpu.Pc = 0x1000
+	newPC, exception := cpu.Execute(0x2021)
+	assert.Nil(t, exception)
+	assert.Equal(t, uint64(0x1008), newPC)
+	assert.Equal(t, uint64(0x1002), cpu.Regs[1])
+}
+
 func TestCsrs1(t *testing.T) {
 	code := `addi t0, zero, 1
 addi t1, zero, 2
@@ -314,16 +2054,83 @@ csrrwi zero, sstatus, 4
 csrrsi zero, stvec, 5
 csrrwi zero, sepc, 6
 csrrci zero, sepc, 0 `
+	// Reserved bits and encodings are legalized: mstatus bit 0 is reserved
+	// and UXL/SXL are fixed, mtvec mode 2 is reserved and mepc bit 0 is zero.
 	riscvTest(t, code, "test_csrs1", 20, []TestExp{
-		{RegName: "mstatus", Expect: 1},
-		{RegName: "mtvec", Expect: 2},
-		{RegName: "mepc", Expect: 3},
-		{RegName: "sstatus", Expect: 0},
+		{RegName: "mstatus", Expect: XL_64<<34 | XL_64<<32},
+		{RegName: "mtvec", Expect: 0},
+		{RegName: "mepc", Expect: 2},
+		{RegName: "sstatus", Expect: XL_64 << 32},
 		{RegName: "stvec", Expect: 5},
 		{RegName: "sepc", Expect: 6},
 	})
 }
 
+func TestCsrWarl(t *testing.T) {
+	code := `li t0, -1
+csrw medeleg, t0
+csrr a0, medeleg
+csrw mideleg, t0
+csrr a1, mideleg
+csrw misa, zero
+csrr a3, misa
+li t1, 0x1000
+csrw mstatus, t1
+csrr a4, mstatus
+csrw mcounteren, t0
+csrr a5, mcounteren
+csrr a6, mvendorid`
+	riscvTest(t, code, "test_csr_warl", 20, []TestExp{
+		{RegName: "a0", Expect: MASK_MEDELEG_WRITABLE},
+		{RegName: "a1", Expect: 0x222 | MASK_LCOFIP | MASK_MIDELEG_FORCED},
+		{RegName: "a3", Expect: MISA_MXL_64 | MISA_A | MISA_C | MISA_D | MISA_F | MISA_H | MISA_I | MISA_M | MISA_S | MISA_U | MISA_V},
+		{RegName: "a4", Expect: XL_64<<34 | XL_64<<32},
+		{RegName: "a5", Expect: 0xffffffff},
+		{RegName: "a6", Expect: 0},
+	})
+}
+
+func TestCsrIllegal(t *testing.T) {
+	cpu := NewCPU(nil, nil)
+	// csrw cycle, zero
+	_, exception := cpu.Execute(0xc0001073)
+	assert.Equal(t, NewException(IllegalInstruction, 0xc0001073), exception)
+	// csrr a0, cycle
+	_, exception = cpu.Execute(0xc0002573)
+	assert.Nil(t, exception)
+	// csrr a0, 0x7c0
+	_, exception = cpu.Execute(0x7c002573)
+	assert.Equal(t, NewException(IllegalInstruction, 0x7c002573), exception)
+	// csrr a0, pmpcfg1
+	_, exception = cpu.Execute(0x3a102573)
+	assert.NotNil(t, exception)
+	cpu.Mode = Supervisor
+	// csrr a0, mstatus
+	_, exception = cpu.Execute(0x30002573)
+	assert.NotNil(t, exception)
+	// csrr a0, sstatus
+	_, exception = cpu.Execute(0x10002573)
+	assert.Nil(t, exception)
+}
+
+func TestCsrProbe(t *testing.T) {
+	cpu := NewCPU(nil, nil)
+	storeCode(cpu, DRAM_BASE, []uint64{
+		0x7c002573, // csrr a0, 0x7c0
+		0x00100593, // addi a1, zero, 1
+	})
+	storeCode(cpu, DRAM_BASE+0x100, trapHandler)
+	assert.Equal(t, NewException(IllegalInstruction, 0x7c002573), runTrapping(cpu, 1))
+
+	// Firmware probing for the CSR skips the access in its handler.
+	cpu.Pc = DRAM_BASE
+	cpu.Csr.Store(MTVEC, DRAM_BASE+0x100)
+	assert.Nil(t, runTrapping(cpu, 2+len(trapHandler)))
+	assert.Equal(t, uint64(DRAM_BASE+8), cpu.Pc)
+	assert.Equal(t, uint64(IllegalInstruction), cpu.Regs[8])
+	assert.Equal(t, uint64(1), cpu.Regs[11])
+}
+
 func TestCompileUart1(t *testing.T) {
 	generateAssembly("_test_uart1.c")
 	generateObj("tmp/_test_uart1.s")
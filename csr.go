@@ -1,24 +1,119 @@
 package main
 
+import "math/bits"
+
 type CSR struct {
 	csrs [CSRS_NUM]uint64
+	// instretWritten is set when an instruction writes minstret, so that
+	// instruction does not also count itself.
+	instretWritten bool
+	// StrictPMP fails S/U-mode accesses no PMP entry matches even while
+	// every entry is OFF.
+	StrictPMP bool
+	// V is the virtualization mode, set while the hart runs in VS or VU mode.
+	V bool
+	// timerIP holds STIP and VSTIP as driven by the Sstc comparators.
+	timerIP uint64
+	// externalIP holds MEIP and SEIP as driven by the AIA interrupt
+	// controllers.
+	externalIP uint64
+	// triggers are the Sdtrig triggers, selected by tselect.
+	triggers [TRIGGER_COUNT]trigger
+	// hpmEvents holds for each event the bitmap of the counters selecting it.
+	hpmEvents [HPM_EVENT_COUNT]uint32
 }
 
 func NewCSR() CSR {
+	csrs := [CSRS_NUM]uint64{}
+	csrs[MISA] = MISA_MXL_64 | MISA_A | MISA_C | MISA_D | MISA_F | MISA_I | MISA_M | MISA_S | MISA_U | MISA_V | MISA_H
+	// Start with the FPU and vector unit enabled so bare-metal programs can
+	// use them without setting mstatus.FS and mstatus.VS first.
+	csrs[MSTATUS] = XL_64<<34 | XL_64<<32 | FS_INITIAL<<13 | FS_INITIAL<<9
+	// Update A/D bits in hardware (Svadu) by default: software written for
+	// older emulators never sets them, and would page-fault forever.
+	csrs[MENVCFG] = MENVCFG_ADUE
+	csrs[HENVCFG] = MENVCFG_ADUE
+	csrs[MIDELEG] = MASK_MIDELEG_FORCED
+	csrs[HSTATUS] = XL_64 << 32
+	csrs[VSSTATUS] = XL_64 << 32
+	// vtype starts out vill, so vector instructions trap until a vset{i}vl{i}
+	// configures it.
+	csrs[VTYPE] = VTYPE_VILL
+	var triggers [TRIGGER_COUNT]trigger
+	for i := range triggers {
+		triggers[i].data1 = TRIGGER_DISABLED << 60
+	}
 	return CSR{
-		csrs: [CSRS_NUM]uint64{},
+		csrs:     csrs,
+		triggers: triggers,
+	}
+}
+
+// Exists reports whether addr names an implemented CSR.
+func (c *CSR) Exists(addr uint64) bool {
+	switch addr {
+	case FFLAGS, FRM, FCSR, SEED,
+		VSTART, VXSAT, VXRM, VCSR, VL, VTYPE, VLENB,
+		SSTATUS, SIE, STVEC, SCOUNTEREN, SENVCFG, SSCRATCH, SEPC, SCAUSE, STVAL, SIP, SATP, STIMECMP,
+		MSTATUS, MISA, MEDELEG, MIDELEG, MIE, MTVEC, MCOUNTEREN, MENVCFG, MCOUNTINHIBIT,
+		MSCRATCH, MEPC, MCAUSE, MTVAL, MIP, MSECCFG, MCYCLE, MINSTRET,
+		MISELECT, MIREG, MTOPEI, MTOPI, SISELECT, SIREG, STOPEI, STOPI, SCOUNTOVF,
+		TSELECT, TDATA1, TDATA2, TDATA3, TINFO, TCONTROL,
+		MVENDORID, MARCHID, MIMPID, MHARTID, MCONFIGPTR,
+		HSTATUS, HEDELEG, HIDELEG, HIE, HTIMEDELTA, HCOUNTEREN, HGEIE, HENVCFG,
+		HTVAL, HIP, HVIP, HTINST, HGATP, HGEIP, MTINST, MTVAL2,
+		VSSTATUS, VSIE, VSTVEC, VSSCRATCH, VSEPC, VSCAUSE, VSTVAL, VSIP, VSATP, VSTIMECMP:
+		return true
+	}
+	switch {
+	case addr >= CYCLE && addr <= HPMCOUNTER31,
+		addr >= MHPMCOUNTER3 && addr <= MHPMCOUNTER31,
+		addr >= MHPMEVENT3 && addr <= MHPMEVENT31,
+		addr >= PMPADDR0 && addr <= PMPADDR63:
+		return true
+	case addr >= PMPCFG0 && addr <= PMPCFG14:
+		// Only the even pmpcfg registers exist on RV64.
+		return addr%2 == 0
 	}
+	return false
 }
 
 func (c *CSR) Load(addr uint64) uint64 {
 	switch addr {
 	case SIE:
-		return c.csrs[MIE] & c.csrs[MIDELEG]
+		return c.csrs[MIE] & c.csrs[MIDELEG] & ^uint64(MASK_MIDELEG_FORCED)
+	case MIP:
+		return c.mip()
 	case SIP:
-		return c.csrs[MIP] & c.csrs[MIDELEG]
+		return c.mip() & c.csrs[MIDELEG] & ^uint64(MASK_MIDELEG_FORCED)
+	case HIE:
+		return c.csrs[MIE] & (MASK_VS_INT | MASK_SGEIP)
+	case HIP:
+		return c.mip() & (MASK_VS_INT | MASK_SGEIP)
+	case HVIP:
+		return c.csrs[MIP] & MASK_VS_INT
+	case VSIE:
+		// VS-level interrupts appear in vsie/vsip at the supervisor positions.
+		return (c.csrs[MIE] & c.csrs[HIDELEG] & MASK_VS_INT) >> 1
+	case VSIP:
+		return (c.mip() & c.csrs[HIDELEG] & MASK_VS_INT) >> 1
 	case SSTATUS:
 		return c.csrs[MSTATUS] & MASK_SSTATUS
+	case FFLAGS:
+		return c.csrs[FCSR] & MASK_FFLAGS
+	case FRM:
+		return (c.csrs[FCSR] & MASK_FRM) >> 5
+	case VXSAT:
+		return c.csrs[VCSR] & MASK_VXSAT
+	case VXRM:
+		return (c.csrs[VCSR] & MASK_VXRM) >> 1
+	case TDATA1, TDATA2, TDATA3, TINFO:
+		return c.loadTrigger(addr)
 	default:
+		if addr >= CYCLE && addr <= HPMCOUNTER31 {
+			// User-level counters are read-only shadows of the machine counters.
+			return c.csrs[addr-CYCLE+MCYCLE]
+		}
 		return c.csrs[addr]
 	}
 }
@@ -28,12 +123,281 @@ func (c *CSR) Store(addr, value uint64) {
 	case SIE:
 		c.csrs[MIE] = (c.csrs[MIE] & ^c.csrs[MIDELEG]) | (value & c.csrs[MIDELEG])
 	case SIP:
-		c.csrs[MIP] = (c.csrs[MIP] & ^c.csrs[MIDELEG]) | (value & c.csrs[MIDELEG])
+		// Only SSIP and LCOFIP are writable through sip.
+		mask := c.csrs[MIDELEG] & (MASK_SSIP | MASK_LCOFIP)
+		c.csrs[MIP] = (c.csrs[MIP] & ^mask) | (value & mask)
+	case HIE:
+		mask := uint64(MASK_VS_INT | MASK_SGEIP)
+		c.csrs[MIE] = (c.csrs[MIE] & ^mask) | (value & mask)
+	case HIP:
+		c.csrs[MIP] = (c.csrs[MIP] & ^uint64(MASK_VSSIP)) | (value & MASK_VSSIP)
+	case HVIP:
+		c.csrs[MIP] = (c.csrs[MIP] & ^uint64(MASK_VS_INT)) | (value & MASK_VS_INT)
+	case VSIE:
+		mask := c.csrs[HIDELEG] & MASK_VS_INT
+		c.csrs[MIE] = (c.csrs[MIE] & ^mask) | ((value << 1) & mask)
+	case VSIP:
+		mask := c.csrs[HIDELEG] & MASK_VSSIP
+		c.csrs[MIP] = (c.csrs[MIP] & ^mask) | ((value << 1) & mask)
+	case VSSTATUS:
+		status := (c.csrs[VSSTATUS] & ^uint64(MASK_MSTATUS_WRITABLE&MASK_SSTATUS)) |
+			(value & MASK_MSTATUS_WRITABLE & MASK_SSTATUS)
+		c.csrs[VSSTATUS] = withSD(status)
+	case HSTATUS:
+		c.csrs[HSTATUS] = (c.csrs[HSTATUS] & ^uint64(MASK_HSTATUS_WRITABLE)) | (value & MASK_HSTATUS_WRITABLE)
+	case HEDELEG:
+		c.csrs[HEDELEG] = value & MASK_HEDELEG_WRITABLE
+	case HIDELEG:
+		c.csrs[HIDELEG] = value & MASK_HIDELEG_WRITABLE
+	case HCOUNTEREN:
+		c.csrs[HCOUNTEREN] = value & 0xffff_ffff
+	case HENVCFG:
+		c.storeEnvcfg(HENVCFG, value, MASK_HENVCFG_WRITABLE)
+	case HGEIE, HGEIP:
+		// No guest external interrupt lines are implemented.
+	case HGATP:
+		// The root of an Sv39x4/Sv48x4/Sv57x4 table is 16 KiB aligned.
+		switch value >> 60 {
+		case SATP_MODE_BARE, SATP_MODE_SV39, SATP_MODE_SV48, SATP_MODE_SV57:
+			c.csrs[HGATP] = value & (0xf<<60 | MASK_VMID | MASK_PPN&^0b11)
+		}
+	case MIE:
+		c.csrs[MIE] = value & MASK_MIE_WRITABLE
+	case MIP:
+		c.csrs[MIP] = (c.csrs[MIP] & ^uint64(MASK_MIP_WRITABLE)) | (value & MASK_MIP_WRITABLE)
+	case MSTATUS:
+		c.storeMstatus(value, MASK_MSTATUS_WRITABLE|MASK_UXL|MASK_SXL)
 	case SSTATUS:
-		c.csrs[MSTATUS] = (c.csrs[MSTATUS] & ^uint64(MASK_SSTATUS)) | (value & MASK_SSTATUS)
+		c.storeMstatus(value, (MASK_MSTATUS_WRITABLE|MASK_UXL)&MASK_SSTATUS)
+	case MISA:
+		// WARL: the extensions cannot be switched off.
+	case MEDELEG:
+		c.csrs[MEDELEG] = value & MASK_MEDELEG_WRITABLE
+	case MIDELEG:
+		c.csrs[MIDELEG] = value&MASK_MIDELEG_WRITABLE | MASK_MIDELEG_FORCED
+	case MTVEC, STVEC, VSTVEC:
+		// Modes 2 and 3 are reserved; drop to direct or vectored.
+		c.csrs[addr] = value & ^uint64(0b10)
+	case MEPC, SEPC, VSEPC:
+		c.csrs[addr] = value & ^uint64(1)
+	case MCOUNTEREN, SCOUNTEREN:
+		c.csrs[addr] = value & 0xffff_ffff
+	case MENVCFG:
+		c.storeEnvcfg(MENVCFG, value, MASK_MENVCFG_WRITABLE)
+	case SENVCFG:
+		c.storeEnvcfg(SENVCFG, value, MASK_SENVCFG_WRITABLE)
+	case MVENDORID, MARCHID, MIMPID, MHARTID, MCONFIGPTR:
+		// Read-only.
+	case SEED:
+		// Writes are ignored; reads poll the entropy source.
+	case FFLAGS:
+		c.csrs[FCSR] = (c.csrs[FCSR] & ^uint64(MASK_FFLAGS)) | (value & MASK_FFLAGS)
+		c.MarkFSDirty()
+	case FRM:
+		c.csrs[FCSR] = (c.csrs[FCSR] & ^uint64(MASK_FRM)) | ((value << 5) & MASK_FRM)
+		c.MarkFSDirty()
+	case FCSR:
+		c.csrs[FCSR] = value & (MASK_FRM | MASK_FFLAGS)
+		c.MarkFSDirty()
+	case VSTART:
+		c.csrs[VSTART] = value
+		c.MarkVSDirty()
+	case VXSAT:
+		c.csrs[VCSR] = (c.csrs[VCSR] & ^uint64(MASK_VXSAT)) | (value & MASK_VXSAT)
+		c.MarkVSDirty()
+	case VXRM:
+		c.csrs[VCSR] = (c.csrs[VCSR] & ^uint64(MASK_VXRM)) | ((value << 1) & MASK_VXRM)
+		c.MarkVSDirty()
+	case VCSR:
+		c.csrs[VCSR] = value & (MASK_VXRM | MASK_VXSAT)
+		c.MarkVSDirty()
+	case VL, VTYPE, VLENB:
+		// Read-only; vl and vtype are only written by vset{i}vl{i}.
+	case MSECCFG:
+		c.storeMSECCFG(value)
+	case TSELECT:
+		// WARL: selecting a trigger that does not exist has no effect.
+		if value < TRIGGER_COUNT {
+			c.csrs[TSELECT] = value
+		}
+	case TDATA1:
+		c.storeTdata1(value)
+	case TDATA2:
+		c.triggers[c.csrs[TSELECT]].data2 = value
+	case TDATA3, TINFO:
+		// textra is read-only zero and tinfo read-only.
+	case TCONTROL:
+		c.csrs[TCONTROL] = value & (TCONTROL_MTE | TCONTROL_MPTE)
+	case SATP, VSATP:
+		// WARL: a write selecting an unsupported mode has no effect. Sv32 is
+		// the only mode of a 32-bit S-mode, and is not one of a 64-bit one.
+		switch value >> 60 {
+		case SATP_MODE_BARE:
+			c.csrs[addr] = value
+		case SATP_MODE_SV32:
+			if c.XLEN(Supervisor, addr == VSATP) == 32 {
+				c.csrs[addr] = value
+			}
+		case SATP_MODE_SV39, SATP_MODE_SV48, SATP_MODE_SV57:
+			if c.XLEN(Supervisor, addr == VSATP) == 64 {
+				c.csrs[addr] = value
+			}
+		}
+	case MINSTRET:
+		c.csrs[MINSTRET] = value
+		c.instretWritten = true
+	case MCOUNTINHIBIT:
+		c.csrs[MCOUNTINHIBIT] = value & 0xffff_fffd
 	default:
-		c.csrs[addr] = value
+		switch {
+		case addr >= PMPCFG0 && addr <= PMPCFG14+1:
+			c.storePMPCfg(addr, value)
+		case addr >= PMPADDR0 && addr <= PMPADDR63:
+			c.storePMPAddr(addr-PMPADDR0, value)
+		case addr >= MHPMEVENT3 && addr <= MHPMEVENT31:
+			c.storeMhpmevent(addr, value)
+		default:
+			c.csrs[addr] = value
+		}
+	}
+}
+
+// storeEnvcfg writes menvcfg, henvcfg or senvcfg. The reserved CBIE encoding
+// 0b10 leaves that field unchanged.
+func (c *CSR) storeEnvcfg(addr, value, mask uint64) {
+	if value&ENVCFG_CBIE == 0b10<<4 {
+		value = value&^ENVCFG_CBIE | c.csrs[addr]&ENVCFG_CBIE
+	}
+	c.csrs[addr] = value & mask
+}
+
+// storeMstatus writes the fields of mstatus selected by mask. Reserved MPP
+// values fall back to U-mode. UXL and SXL may select 32 or 64 bits on RV64 and
+// are fixed on RV32.
+func (c *CSR) storeMstatus(value, mask uint64) {
+	status := (c.csrs[MSTATUS] & ^mask) | (value & mask)
+	if (status&MASK_MPP)>>11 == 0b10 {
+		status &= ^uint64(MASK_MPP)
+	}
+	for _, field := range []uint64{MASK_UXL, MASK_SXL} {
+		xl := (status & field) >> bits.TrailingZeros64(field)
+		if c.csrs[MISA]>>62 != XL_64 || (xl != XL_32 && xl != XL_64) {
+			status = status&^field | c.csrs[MSTATUS]&field
+		}
 	}
+	c.csrs[MSTATUS] = withSD(status)
+}
+
+// mip returns mip with the AIA external interrupts and the Sstc timer
+// interrupts applied. With menvcfg.STCE set the comparator drives STIP in place
+// of software, and with henvcfg.STCE also set it is ORed into the VSTIP bit of
+// hvip.
+func (c *CSR) mip() uint64 {
+	mip := c.csrs[MIP] | c.externalIP
+	if c.csrs[MENVCFG]&MENVCFG_STCE == 0 {
+		return mip
+	}
+	mip = mip&^MASK_STIP | c.timerIP&MASK_STIP
+	if c.csrs[HENVCFG]&MENVCFG_STCE != 0 {
+		mip |= c.timerIP & MASK_VSTIP
+	}
+	return mip
+}
+
+// SetTimerPending sets the STIP and VSTIP outputs of the Sstc comparators.
+func (c *CSR) SetTimerPending(mask uint64) {
+	c.timerIP = mask & (MASK_STIP | MASK_VSTIP)
+}
+
+// SetExternalPending sets the MEIP and SEIP outputs of the AIA interrupt
+// controllers.
+func (c *CSR) SetExternalPending(mask uint64) {
+	c.externalIP = mask & (MASK_MEIP | MASK_SEIP)
+}
+
+// SetPending and ClearPending update mip on behalf of the hardware, including
+// the bits software cannot write.
+func (c *CSR) SetPending(mask uint64) {
+	c.csrs[MIP] |= mask
+}
+
+func (c *CSR) ClearPending(mask uint64) {
+	c.csrs[MIP] &= ^mask
+}
+
+// Tick advances mcycle by one unless inhibited.
+func (c *CSR) Tick() {
+	if c.csrs[MCOUNTINHIBIT]&MASK_CY == 0 {
+		c.csrs[MCYCLE]++
+	}
+}
+
+// Retire counts one retired instruction in minstret unless inhibited or the
+// instruction itself wrote minstret.
+func (c *CSR) Retire() {
+	if c.instretWritten {
+		c.instretWritten = false
+		return
+	}
+	if c.csrs[MCOUNTINHIBIT]&MASK_IR == 0 {
+		c.csrs[MINSTRET]++
+	}
+}
+
+// withSD recomputes the read-only mstatus.SD summary bit.
+func withSD(status uint64) uint64 {
+	dirty := (status&MASK_FS)>>13 == FS_DIRTY ||
+		(status&MASK_VS)>>9 == FS_DIRTY ||
+		(status&MASK_XS)>>15 == FS_DIRTY
+	if dirty {
+		return status | MASK_SD
+	}
+	return status & ^uint64(MASK_SD)
+}
+
+// FSEnabled reports whether the FPU is on. While V=1 it must also be on in
+// vsstatus, and MarkFSDirty then dirties both.
+func (c *CSR) FSEnabled() bool {
+	return c.csrs[MSTATUS]&MASK_FS != FS_OFF && (!c.V || c.csrs[VSSTATUS]&MASK_FS != FS_OFF)
+}
+
+func (c *CSR) MarkFSDirty() {
+	c.csrs[MSTATUS] = withSD(c.csrs[MSTATUS] | MASK_FS)
+	if c.V {
+		c.csrs[VSSTATUS] = withSD(c.csrs[VSSTATUS] | MASK_FS)
+	}
+}
+
+func (c *CSR) VSEnabled() bool {
+	return c.csrs[MSTATUS]&MASK_VS != FS_OFF && (!c.V || c.csrs[VSSTATUS]&MASK_VS != FS_OFF)
+}
+
+func (c *CSR) MarkVSDirty() {
+	c.csrs[MSTATUS] = withSD(c.csrs[MSTATUS] | MASK_VS)
+	if c.V {
+		c.csrs[VSSTATUS] = withSD(c.csrs[VSSTATUS] | MASK_VS)
+	}
+}
+
+// Virtualize maps a supervisor CSR to the VS CSR that replaces it while V=1.
+func (c *CSR) Virtualize(addr uint64) uint64 {
+	if !c.V {
+		return addr
+	}
+	switch addr {
+	case SSTATUS, SIE, STVEC, SSCRATCH, SEPC, SCAUSE, STVAL, SIP, SATP, STIMECMP:
+		return addr + VSSTATUS - SSTATUS
+	}
+	return addr
+}
+
+// SetVectorConfig sets vl and vtype on behalf of vset{i}vl{i}, which also
+// reset vstart.
+func (c *CSR) SetVectorConfig(vl, vtype uint64) {
+	c.csrs[VL] = vl
+	c.csrs[VTYPE] = vtype
+	c.csrs[VSTART] = 0
+	c.MarkVSDirty()
 }
 
 func (c *CSR) IsMedelegated(cause uint64) bool {
@@ -0,0 +1,81 @@
+package main
+
+import "fmt"
+
+// CustomFields are the fields of a custom instruction, decoded as an R-type
+// instruction. For the RoCC format, Funct3 holds the xd, xs1 and xs2 bits.
+type CustomFields struct {
+	Inst   uint64
+	Opcode uint64
+	Rd     uint64
+	Rs1    uint64
+	Rs2    uint64
+	Funct3 uint64
+	Funct7 uint64
+}
+
+// CustomInstruction is an instruction in the custom-0 to custom-3 opcode
+// space, executed by a handler registered with RegisterCustom.
+type CustomInstruction struct {
+	Name string
+	// The instruction matches the encodings inst with inst&Mask == Match.
+	// Mask must cover the opcode.
+	Mask  uint64
+	Match uint64
+	// Execute runs the instruction. It reads and writes cpu.Regs, and
+	// memory through cpu.Load and cpu.Store, which translate addresses and
+	// raise the usual exceptions. The pc advances past the instruction
+	// unless Execute returns an exception, which is then taken. On RV32
+	// every register is sign-extended from bit 31 afterwards, so Execute
+	// may compute in 64 bits.
+	Execute func(cpu *Cpu, fields CustomFields) *Exception
+}
+
+// RegisterCustom adds a custom instruction. Encodings matched by no custom
+// instruction raise illegal-instruction exceptions; where several match, the
+// one registered first runs.
+func (cpu *Cpu) RegisterCustom(instruction CustomInstruction) error {
+	if instruction.Execute == nil {
+		return fmt.Errorf("custom instruction %q has no Execute function", instruction.Name)
+	}
+	if instruction.Mask&0x7f != 0x7f || instruction.Match&^instruction.Mask != 0 {
+		return fmt.Errorf("custom instruction %q: mask %#x must cover the opcode and match %#x", instruction.Name, instruction.Mask, instruction.Match)
+	}
+	switch instruction.Match & 0x7f {
+	case OPCODE_CUSTOM_0, OPCODE_CUSTOM_1, OPCODE_CUSTOM_2, OPCODE_CUSTOM_3:
+	default:
+		return fmt.Errorf("custom instruction %q: opcode %#x is not custom-0 to custom-3", instruction.Name, instruction.Match&0x7f)
+	}
+	cpu.custom = append(cpu.custom, instruction)
+	return nil
+}
+
+// executeCustom runs the custom instruction matching inst.
+func (cpu *Cpu) executeCustom(inst uint64) (uint64, *Exception) {
+	for _, instruction := range cpu.custom {
+		if inst&instruction.Mask != instruction.Match {
+			continue
+		}
+		exception := instruction.Execute(cpu, CustomFields{
+			Inst:   inst,
+			Opcode: inst & 0x7f,
+			Rd:     (inst >> 7) & 0x1f,
+			Rs1:    (inst >> 15) & 0x1f,
+			Rs2:    (inst >> 20) & 0x1f,
+			Funct3: (inst >> 12) & 0x7,
+			Funct7: (inst >> 25) & 0x7f,
+		})
+		cpu.Regs[0] = 0
+		if cpu.XLEN() == 32 {
+			// Execute may have written any register, not only rd.
+			for i := range cpu.Regs {
+				cpu.Regs[i] = signExtend(cpu.Regs[i], 32)
+			}
+		}
+		if exception != nil {
+			return 0, exception
+		}
+		return cpu.UpdatePC()
+	}
+	return 0, NewException(IllegalInstruction, inst)
+}
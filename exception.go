@@ -17,15 +17,25 @@ const (
 	StoreAMOAccessFault       ExceptionType = 7
 	EnvironmentCallFromUMode  ExceptionType = 8
 	EnvironmentCallFromSMode  ExceptionType = 9
+	EnvironmentCallFromVSMode ExceptionType = 10
 	EnvironmentCallFromMMode  ExceptionType = 11
 	InstructionPageFault      ExceptionType = 12
 	LoadPageFault             ExceptionType = 13
 	StoreAMOPageFault         ExceptionType = 15
+	InstructionGuestPageFault ExceptionType = 20
+	LoadGuestPageFault        ExceptionType = 21
+	VirtualInstruction        ExceptionType = 22
+	StoreAMOGuestPageFault    ExceptionType = 23
 )
 
 type Exception struct {
 	Type  ExceptionType
 	Store uint64
+	// Tval2 is the guest physical address shifted right by 2 for guest-page
+	// faults, written to mtval2/htval.
+	Tval2 uint64
+	// GVA is set when Store holds a guest virtual address.
+	GVA bool
 }
 
 func (e Exception) ToString() string {
@@ -50,6 +60,8 @@ func (e Exception) ToString() string {
 		return fmt.Sprintf("Environment call from U-mode {0X%X", e.Store)
 	case EnvironmentCallFromSMode:
 		return fmt.Sprintf("Environment call from S-mode {0X%X", e.Store)
+	case EnvironmentCallFromVSMode:
+		return fmt.Sprintf("Environment call from VS-mode {0X%X", e.Store)
 	case EnvironmentCallFromMMode:
 		return fmt.Sprintf("Environment call from M-mode {0X%X", e.Store)
 	case InstructionPageFault:
@@ -58,6 +70,14 @@ func (e Exception) ToString() string {
 		return fmt.Sprintf("Load page fault 0X%X", e.Store)
 	case StoreAMOPageFault:
 		return fmt.Sprintf("Store or AMO page fault 0X%X", e.Store)
+	case InstructionGuestPageFault:
+		return fmt.Sprintf("Instruction guest-page fault 0X%X", e.Store)
+	case LoadGuestPageFault:
+		return fmt.Sprintf("Load guest-page fault 0X%X", e.Store)
+	case VirtualInstruction:
+		return fmt.Sprintf("Virtual instruction 0X%X", e.Store)
+	case StoreAMOGuestPageFault:
+		return fmt.Sprintf("Store or AMO guest-page fault 0X%X", e.Store)
 	}
 	panic("Unknown Exception Type!")
 }
@@ -70,9 +90,23 @@ func (e Exception) Code() uint64 {
 	return uint64(e.Type)
 }
 
+// HasAddress reports whether the exception's tval is a virtual address.
+func (e Exception) HasAddress() bool {
+	switch e.Type {
+	case InstructionAddrMisaligned, InstructionAccessFault, Breakpoint, LoadAccessMisaligned,
+		LoadAccessFault, StoreAMOAddrMisaligned, StoreAMOAccessFault, InstructionPageFault,
+		LoadPageFault, StoreAMOPageFault, InstructionGuestPageFault, LoadGuestPageFault,
+		StoreAMOGuestPageFault:
+		return true
+	}
+	return false
+}
+
+// IsFatal reports whether e ends the run when no handler takes it: the
+// address-misaligned, access-fault and illegal-instruction exceptions.
 func (e Exception) IsFatal() bool {
 	switch e.Type {
-	case InstructionAddrMisaligned, InstructionAccessFault, IllegalInstruction, LoadAccessFault, StoreAMOAddrMisaligned, StoreAMOAccessFault:
+	case InstructionAddrMisaligned, InstructionAccessFault, IllegalInstruction, LoadAccessMisaligned, LoadAccessFault, StoreAMOAddrMisaligned, StoreAMOAccessFault:
 		return true
 	}
 	return false
@@ -0,0 +1,433 @@
+package main
+
+var (
+	RVFABI [32]string = [32]string{
+		"ft0", "ft1", "ft2", "ft3", "ft4", "ft5", "ft6", "ft7",
+		"fs0", "fs1", "fa0", "fa1", "fa2", "fa3", "fa4", "fa5",
+		"fa6", "fa7", "fs2", "fs3", "fs4", "fs5", "fs6", "fs7",
+		"fs8", "fs9", "fs10", "fs11", "ft8", "ft9", "ft10", "ft11",
+	}
+)
+
+// floatFormat decodes the fmt field of an F/D/Zfh instruction.
+func floatFormat(fmt uint64) (FloatFormat, bool) {
+	switch fmt {
+	case 0b00:
+		return Float32, true
+	case 0b01:
+		return Float64, true
+	case 0b10:
+		return Float16, true
+	default:
+		return FloatFormat{}, false
+	}
+}
+
+// RoundingMode resolves the rm field of an instruction, reading frm for the
+// dynamic mode. It reports false for reserved modes.
+func (cpu *Cpu) RoundingMode(rm uint64) (RoundingMode, bool) {
+	if rm == uint64(RoundDynamic) {
+		rm = cpu.Csr.Load(FRM)
+	}
+	if rm > uint64(RoundNearestMax) {
+		return 0, false
+	}
+	return RoundingMode(rm), true
+}
+
+func (cpu *Cpu) SetFReg(r, value uint64) {
+	cpu.FRegs[r] = value
+	cpu.Csr.MarkFSDirty()
+}
+
+func (cpu *Cpu) AccrueFFlags(flags uint64) {
+	if flags != 0 {
+		cpu.Csr.Store(FFLAGS, cpu.Csr.Load(FFLAGS)|flags)
+	}
+}
+
+// ExecuteFloat executes the F, D, Zfh and Zfa extension instructions:
+// LOAD-FP, STORE-FP, the fused multiply-add opcodes and OP-FP.
+func (cpu *Cpu) ExecuteFloat(inst uint64) (uint64, *Exception) {
+	opcode := inst & 0x7f
+	rd := (inst >> 7) & 0x1f
+	rs1 := (inst >> 15) & 0x1f
+	rs2 := (inst >> 20) & 0x1f
+	rs3 := (inst >> 27) & 0x1f
+	funct3 := (inst >> 12) & 0x7
+	funct5 := (inst >> 27) & 0x1f
+
+	if !cpu.Csr.FSEnabled() {
+		return 0, NewException(IllegalInstruction, inst)
+	}
+
+	switch opcode {
+	case 0x07:
+		imm := uint64(int64(int32(inst)) >> 20)
+		addr := cpu.Regs[rs1] + imm
+		switch funct3 {
+		case 0x1:
+			// flh
+			val, err := cpu.Load(addr, 16)
+			if err != nil {
+				return 0, err
+			}
+			cpu.SetFReg(rd, Float16.Box(val))
+			return cpu.UpdatePC()
+		case 0x2:
+			// flw
+			val, err := cpu.Load(addr, 32)
+			if err != nil {
+				return 0, err
+			}
+			cpu.SetFReg(rd, Float32.Box(val))
+			return cpu.UpdatePC()
+		case 0x3:
+			// fld
+			val, err := cpu.Load(addr, 64)
+			if err != nil {
+				return 0, err
+			}
+			cpu.SetFReg(rd, val)
+			return cpu.UpdatePC()
+		default:
+			return 0, NewException(IllegalInstruction, inst)
+		}
+	case 0x27:
+		imm := uint64(int64(int32(inst&0xfe000000))>>20) | ((inst >> 7) & 0x1f)
+		addr := cpu.Regs[rs1] + imm
+		switch funct3 {
+		case 0x1:
+			// fsh
+			err := cpu.Store(addr, 16, cpu.FRegs[rs2])
+			if err != nil {
+				return 0, err
+			}
+			return cpu.UpdatePC()
+		case 0x2:
+			// fsw
+			err := cpu.Store(addr, 32, cpu.FRegs[rs2])
+			if err != nil {
+				return 0, err
+			}
+			return cpu.UpdatePC()
+		case 0x3:
+			// fsd
+			err := cpu.Store(addr, 64, cpu.FRegs[rs2])
+			if err != nil {
+				return 0, err
+			}
+			return cpu.UpdatePC()
+		default:
+			return 0, NewException(IllegalInstruction, inst)
+		}
+	case 0x43, 0x47, 0x4b, 0x4f:
+		f, ok := floatFormat((inst >> 25) & 0b11)
+		if !ok || (f == Float16 && !cpu.Ext.Zfh) {
+			return 0, NewException(IllegalInstruction, inst)
+		}
+		rm, ok := cpu.RoundingMode(funct3)
+		if !ok {
+			return 0, NewException(IllegalInstruction, inst)
+		}
+		a, b, c := f.Unbox(cpu.FRegs[rs1]), f.Unbox(cpu.FRegs[rs2]), f.Unbox(cpu.FRegs[rs3])
+		var result, flags uint64
+		switch opcode {
+		case 0x43:
+			// fmadd.s, fmadd.d, fmadd.h
+			result, flags = f.MulAdd(a, b, c, false, false, rm)
+		case 0x47:
+			// fmsub.s, fmsub.d, fmsub.h
+			result, flags = f.MulAdd(a, b, c, false, true, rm)
+		case 0x4b:
+			// fnmsub.s, fnmsub.d, fnmsub.h
+			result, flags = f.MulAdd(a, b, c, true, false, rm)
+		case 0x4f:
+			// fnmadd.s, fnmadd.d, fnmadd.h
+			result, flags = f.MulAdd(a, b, c, true, true, rm)
+		}
+		cpu.SetFReg(rd, f.Box(result))
+		cpu.AccrueFFlags(flags)
+		return cpu.UpdatePC()
+	case 0x53:
+		f, ok := floatFormat((inst >> 25) & 0b11)
+		if !ok {
+			return 0, NewException(IllegalInstruction, inst)
+		}
+		// Without Zfh, half precision only has the Zfhmin conversions and
+		// moves.
+		if f == Float16 && !cpu.Ext.Zfh && !(funct5 == 0x08 && rs2 < 0x4) &&
+			!((funct5 == 0x1c || funct5 == 0x1e) && funct3 == 0 && rs2 == 0) {
+			return 0, NewException(IllegalInstruction, inst)
+		}
+		a, b := f.Unbox(cpu.FRegs[rs1]), f.Unbox(cpu.FRegs[rs2])
+		switch funct5 {
+		case 0x00, 0x01, 0x02, 0x03, 0x0b:
+			rm, ok := cpu.RoundingMode(funct3)
+			if !ok || (funct5 == 0x0b && rs2 != 0) {
+				return 0, NewException(IllegalInstruction, inst)
+			}
+			var result, flags uint64
+			switch funct5 {
+			case 0x00:
+				// fadd.s, fadd.d, fadd.h
+				result, flags = f.Add(a, b, rm)
+			case 0x01:
+				// fsub.s, fsub.d, fsub.h
+				result, flags = f.Sub(a, b, rm)
+			case 0x02:
+				// fmul.s, fmul.d, fmul.h
+				result, flags = f.Mul(a, b, rm)
+			case 0x03:
+				// fdiv.s, fdiv.d, fdiv.h
+				result, flags = f.Div(a, b, rm)
+			case 0x0b:
+				// fsqrt.s, fsqrt.d, fsqrt.h
+				result, flags = f.Sqrt(a, rm)
+			}
+			cpu.SetFReg(rd, f.Box(result))
+			cpu.AccrueFFlags(flags)
+			return cpu.UpdatePC()
+		case 0x04:
+			sign := f.signBit()
+			var result uint64
+			switch funct3 {
+			case 0x0:
+				// fsgnj.s, fsgnj.d, fsgnj.h
+				result = (a & ^sign) | (b & sign)
+			case 0x1:
+				// fsgnjn.s, fsgnjn.d, fsgnjn.h
+				result = (a & ^sign) | (^b & sign)
+			case 0x2:
+				// fsgnjx.s, fsgnjx.d, fsgnjx.h
+				result = a ^ (b & sign)
+			default:
+				return 0, NewException(IllegalInstruction, inst)
+			}
+			cpu.SetFReg(rd, f.Box(result))
+			return cpu.UpdatePC()
+		case 0x05:
+			var result, flags uint64
+			switch funct3 {
+			case 0x0:
+				// fmin.s, fmin.d, fmin.h
+				result, flags = f.Min(a, b)
+			case 0x1:
+				// fmax.s, fmax.d, fmax.h
+				result, flags = f.Max(a, b)
+			case 0x2:
+				// fminm.s, fminm.d, fminm.h
+				if !cpu.Ext.Zfa {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				result, flags = f.Minimum(a, b)
+			case 0x3:
+				// fmaxm.s, fmaxm.d, fmaxm.h
+				if !cpu.Ext.Zfa {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				result, flags = f.Maximum(a, b)
+			default:
+				return 0, NewException(IllegalInstruction, inst)
+			}
+			cpu.SetFReg(rd, f.Box(result))
+			cpu.AccrueFFlags(flags)
+			return cpu.UpdatePC()
+		case 0x08:
+			rm, ok := cpu.RoundingMode(funct3)
+			if !ok {
+				return 0, NewException(IllegalInstruction, inst)
+			}
+			if rs2 == 0x4 || rs2 == 0x5 {
+				// fround.s, fround.d, fround.h, froundnx.s, froundnx.d,
+				// froundnx.h
+				if !cpu.Ext.Zfa {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				result, flags := f.RoundToInt(a, rm, rs2 == 0x5)
+				cpu.SetFReg(rd, f.Box(result))
+				cpu.AccrueFFlags(flags)
+				return cpu.UpdatePC()
+			}
+			from, ok := floatFormat(rs2)
+			if !ok || from == f {
+				return 0, NewException(IllegalInstruction, inst)
+			}
+			// fcvt.s.d, fcvt.d.s, fcvt.h.s, fcvt.s.h, fcvt.h.d, fcvt.d.h
+			result, flags := ConvertFloat(from, f, from.Unbox(cpu.FRegs[rs1]), rm)
+			cpu.SetFReg(rd, f.Box(result))
+			cpu.AccrueFFlags(flags)
+			return cpu.UpdatePC()
+		case 0x14:
+			var result bool
+			var flags uint64
+			switch funct3 {
+			case 0x0:
+				// fle.s, fle.d, fle.h
+				result, flags = f.Le(a, b)
+			case 0x1:
+				// flt.s, flt.d, flt.h
+				result, flags = f.Lt(a, b)
+			case 0x2:
+				// feq.s, feq.d, feq.h
+				result, flags = f.Eq(a, b)
+			case 0x4:
+				// fleq.s, fleq.d, fleq.h
+				if !cpu.Ext.Zfa {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				result, flags = f.LeQuiet(a, b)
+			case 0x5:
+				// fltq.s, fltq.d, fltq.h
+				if !cpu.Ext.Zfa {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				result, flags = f.LtQuiet(a, b)
+			default:
+				return 0, NewException(IllegalInstruction, inst)
+			}
+			if result {
+				cpu.Regs[rd] = 1
+			} else {
+				cpu.Regs[rd] = 0
+			}
+			cpu.AccrueFFlags(flags)
+			return cpu.UpdatePC()
+		case 0x18:
+			rm, ok := cpu.RoundingMode(funct3)
+			if !ok {
+				return 0, NewException(IllegalInstruction, inst)
+			}
+			var result, flags uint64
+			switch rs2 {
+			case 0x0:
+				// fcvt.w.s, fcvt.w.d, fcvt.w.h
+				result, flags = f.ToInt(a, 32, true, rm)
+			case 0x1:
+				// fcvt.wu.s, fcvt.wu.d, fcvt.wu.h
+				result, flags = f.ToInt(a, 32, false, rm)
+			case 0x2:
+				// fcvt.l.s, fcvt.l.d, fcvt.l.h
+				if cpu.XLEN() == 32 {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				result, flags = f.ToInt(a, 64, true, rm)
+			case 0x3:
+				// fcvt.lu.s, fcvt.lu.d, fcvt.lu.h
+				if cpu.XLEN() == 32 {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				result, flags = f.ToInt(a, 64, false, rm)
+			case 0x8:
+				// fcvtmod.w.d, which only exists with a static rtz
+				if !cpu.Ext.Zfa || f != Float64 || funct3 != uint64(RoundTowardZero) {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				result, flags = f.ToInt32Modular(a)
+			default:
+				return 0, NewException(IllegalInstruction, inst)
+			}
+			cpu.Regs[rd] = result
+			cpu.AccrueFFlags(flags)
+			return cpu.UpdatePC()
+		case 0x1a:
+			rm, ok := cpu.RoundingMode(funct3)
+			if !ok {
+				return 0, NewException(IllegalInstruction, inst)
+			}
+			x := cpu.Regs[rs1]
+			var result, flags uint64
+			switch rs2 {
+			case 0x0:
+				// fcvt.s.w, fcvt.d.w, fcvt.h.w
+				v := int64(int32(x))
+				result, flags = f.FromInt(v < 0, abs64(v), rm)
+			case 0x1:
+				// fcvt.s.wu, fcvt.d.wu, fcvt.h.wu
+				result, flags = f.FromInt(false, uint64(uint32(x)), rm)
+			case 0x2:
+				// fcvt.s.l, fcvt.d.l, fcvt.h.l
+				if cpu.XLEN() == 32 {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				v := int64(x)
+				result, flags = f.FromInt(v < 0, abs64(v), rm)
+			case 0x3:
+				// fcvt.s.lu, fcvt.d.lu, fcvt.h.lu
+				if cpu.XLEN() == 32 {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				result, flags = f.FromInt(false, x, rm)
+			default:
+				return 0, NewException(IllegalInstruction, inst)
+			}
+			cpu.SetFReg(rd, f.Box(result))
+			cpu.AccrueFFlags(flags)
+			return cpu.UpdatePC()
+		case 0x16:
+			// fmvp.d.x, which only exists on RV32
+			if !cpu.Ext.Zfa || f != Float64 || funct3 != 0 || cpu.XLEN() != 32 {
+				return 0, NewException(IllegalInstruction, inst)
+			}
+			cpu.SetFReg(rd, uint64(uint32(cpu.Regs[rs1]))|cpu.Regs[rs2]<<32)
+			return cpu.UpdatePC()
+		case 0x1c:
+			if rs2 == 0x1 && funct3 == 0 && f == Float64 && cpu.Ext.Zfa && cpu.XLEN() == 32 {
+				// fmvh.x.d
+				cpu.Regs[rd] = signExtend(cpu.FRegs[rs1]>>32, 32)
+				return cpu.UpdatePC()
+			}
+			if rs2 != 0 {
+				return 0, NewException(IllegalInstruction, inst)
+			}
+			switch funct3 {
+			case 0x0:
+				// fmv.x.w, fmv.x.d, fmv.x.h
+				if f == Float64 && cpu.XLEN() == 32 {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				cpu.Regs[rd] = signExtend(cpu.FRegs[rs1], uint64(f.ExpBits+f.FracBits+1))
+				return cpu.UpdatePC()
+			case 0x1:
+				// fclass.s, fclass.d, fclass.h
+				cpu.Regs[rd] = f.Classify(a)
+				return cpu.UpdatePC()
+			default:
+				return 0, NewException(IllegalInstruction, inst)
+			}
+		case 0x1e:
+			if funct3 != 0 {
+				return 0, NewException(IllegalInstruction, inst)
+			}
+			switch rs2 {
+			case 0x0:
+				// fmv.w.x, fmv.d.x, fmv.h.x
+				if f == Float64 && cpu.XLEN() == 32 {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				cpu.SetFReg(rd, f.Box(cpu.Regs[rs1]))
+			case 0x1:
+				// fli.s, fli.d, fli.h
+				if !cpu.Ext.Zfa {
+					return 0, NewException(IllegalInstruction, inst)
+				}
+				cpu.SetFReg(rd, f.Box(f.FLI(rs1)))
+			default:
+				return 0, NewException(IllegalInstruction, inst)
+			}
+			return cpu.UpdatePC()
+		default:
+			return 0, NewException(IllegalInstruction, inst)
+		}
+	default:
+		return 0, NewException(IllegalInstruction, inst)
+	}
+}
+
+// abs64 returns |v| as an unsigned value, so math.MinInt64 is representable.
+func abs64(v int64) uint64 {
+	if v < 0 {
+		return uint64(-v)
+	}
+	return uint64(v)
+}
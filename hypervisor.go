@@ -0,0 +1,150 @@
+package main
+
+func guestPageFault(va, gpa uint64, accessType AccessType) *Exception {
+	var t ExceptionType
+	switch accessType {
+	case Instruction:
+		t = InstructionGuestPageFault
+	case Load:
+		t = LoadGuestPageFault
+	default:
+		t = StoreAMOGuestPageFault
+	}
+	return &Exception{Type: t, Store: va, Tval2: gpa >> 2}
+}
+
+// gStage translates a guest physical address through hgatp. va and faultType
+// describe the guest access that caused it, for the guest-page fault.
+func (cpu *Cpu) gStage(gpa uint64, accessType AccessType, va uint64, faultType AccessType, hlvx bool) (uint64, *Exception) {
+	hgatp := cpu.Csr.Load(HGATP)
+	levels := satpLevels(hgatp >> 60)
+	if levels == 0 {
+		return gpa, nil
+	}
+	return cpu.walk(gpa, accessType, pageWalk{
+		root:      (hgatp & MASK_PPN) * PAGE_SIZE,
+		levels:    levels,
+		mode:      User,
+		mxr:       cpu.Csr.Load(MSTATUS)&MASK_MXR != 0,
+		adue:      cpu.Csr.Load(MENVCFG)&MENVCFG_ADUE != 0,
+		pbmte:     cpu.Csr.Load(MENVCFG)&MENVCFG_PBMTE != 0,
+		hlvx:      hlvx,
+		guest:     true,
+		va:        va,
+		faultType: faultType,
+	})
+}
+
+// pteAddress returns the physical address of a PTE. VS-stage page tables live
+// in guest physical memory, so their PTEs go through the G-stage as loads, or
+// as stores when A/D bits are written back.
+func (cpu *Cpu) pteAddress(addr uint64, accessType AccessType, w pageWalk) (uint64, *Exception) {
+	if !w.vs {
+		return addr, nil
+	}
+	return cpu.gStage(addr, accessType, w.va, w.faultType, false)
+}
+
+// ExecuteHypervisorMemory executes the hypervisor virtual-machine load and
+// store instructions, which access memory as the guest would in the mode
+// selected by hstatus.SPVP.
+func (cpu *Cpu) ExecuteHypervisorMemory(inst uint64) (uint64, *Exception) {
+	rd := (inst >> 7) & 0x1f
+	rs1 := (inst >> 15) & 0x1f
+	rs2 := (inst >> 20) & 0x1f
+	funct7 := (inst >> 25) & 0x7f
+
+	if funct7 < 0x30 || funct7 > 0x37 {
+		return 0, NewException(IllegalInstruction, inst)
+	}
+	size := uint64(8) << ((funct7 >> 1) & 0b11)
+	store := funct7&1 != 0
+	unsigned, hlvx := false, false
+	switch {
+	case store:
+		if rd != 0 {
+			return 0, NewException(IllegalInstruction, inst)
+		}
+	case rs2 == 0x0:
+	case rs2 == 0x1 && size != 64:
+		unsigned = true
+	case rs2 == 0x3 && (size == 16 || size == 32):
+		unsigned, hlvx = true, true
+	default:
+		return 0, NewException(IllegalInstruction, inst)
+	}
+
+	if cpu.Csr.V {
+		return 0, NewException(VirtualInstruction, inst)
+	}
+	hstatus := cpu.Csr.Load(HSTATUS)
+	if cpu.Mode == User && hstatus&MASK_HSTATUS_HU == 0 {
+		return 0, NewException(IllegalInstruction, inst)
+	}
+	mode := User
+	if hstatus&MASK_HSTATUS_SPVP != 0 {
+		mode = Supervisor
+	}
+
+	addr := cpu.Regs[rs1]
+	accessType := Load
+	if store {
+		accessType = Store
+	}
+	exception := cpu.checkAlignment(addr, size, accessType)
+	if exception != nil {
+		exception.GVA = true
+		return 0, exception
+	}
+	// The access is made with the guest's privileges, one guest page at a
+	// time when it is misaligned across a page boundary.
+	translate := func(addr, size uint64, accessType AccessType) (uint64, *Exception) {
+		pAddr, exception := cpu.translate(addr, accessType, mode, true, hlvx)
+		if exception != nil {
+			return 0, exception
+		}
+		if !cpu.Csr.PMPAllows(pAddr, size, accessType, mode) {
+			return 0, accessFault(addr, accessType)
+		}
+		return pAddr, nil
+	}
+	var val uint64
+	if n := pageSplit(addr, size); n != 0 {
+		if store {
+			exception = cpu.storeSplit(addr, size, n, cpu.Regs[rs2], translate)
+		} else {
+			val, exception = cpu.loadSplit(addr, size, n, translate)
+		}
+	} else {
+		var pAddr uint64
+		if pAddr, exception = translate(addr, size, accessType); exception == nil {
+			if store {
+				if cpu.Reservation.Overlaps(pAddr, size) {
+					cpu.Reservation.Clear()
+				}
+				exception = cpu.Bus.Store(pAddr, size, cpu.Regs[rs2])
+			} else {
+				val, exception = cpu.Bus.Load(pAddr, size)
+			}
+			if exception != nil {
+				exception = NewException(exception.Type, addr)
+			}
+		}
+	}
+	if exception != nil {
+		// Every fault reports the guest virtual address.
+		exception.GVA = true
+		return 0, exception
+	}
+	if store {
+		// hsv.b, hsv.h, hsv.w, hsv.d
+		return cpu.UpdatePC()
+	}
+	// hlv.b, hlv.bu, hlv.h, hlv.hu, hlv.w, hlv.wu, hlv.d, hlvx.hu, hlvx.wu
+	if unsigned {
+		cpu.Regs[rd] = val
+	} else {
+		cpu.Regs[rd] = signExtend(val, size)
+	}
+	return cpu.UpdatePC()
+}
@@ -0,0 +1,170 @@
+package main
+
+import "math/bits"
+
+// imsicFile is an IMSIC interrupt file: the pending and enable bits of
+// interrupt identities 1-255, which devices set by writing an identity to
+// seteipnum and the hart reads and claims through the *topei CSRs.
+type imsicFile struct {
+	eidelivery  uint64
+	eithreshold uint64
+	eip         [IMSIC_IDS / 64]uint64
+	eie         [IMSIC_IDS / 64]uint64
+}
+
+// topei returns the highest-priority (lowest-numbered) identity that is both
+// pending and enabled and under the threshold, as the *topei CSRs report it,
+// or 0 when there is none or delivery is off.
+func (f *imsicFile) topei() uint64 {
+	if f.eidelivery != 1 {
+		return 0
+	}
+	for i := range f.eip {
+		word := f.eip[i] & f.eie[i]
+		if i == 0 {
+			word &^= 1
+		}
+		if word == 0 {
+			continue
+		}
+		id := uint64(i*64 + bits.TrailingZeros64(word))
+		if f.eithreshold != 0 && id >= f.eithreshold {
+			return 0
+		}
+		return id<<16 | id
+	}
+	return 0
+}
+
+// claim clears the pending bit of the identity topei reports.
+func (f *imsicFile) claim() {
+	if id := f.topei() & 0x7ff; id != 0 {
+		f.eip[id/64] &^= 1 << (id % 64)
+	}
+}
+
+// setPending sets the pending bit of an identity, ignoring identity 0 and
+// those out of range.
+func (f *imsicFile) setPending(id uint64) {
+	if id != 0 && id < IMSIC_IDS {
+		f.eip[id/64] |= 1 << (id % 64)
+	}
+}
+
+// validISelect reports whether miselect or siselect value sel selects a
+// register reachable through mireg or sireg. eip and eie registers are 64
+// bits wide on RV64, so the odd ones do not exist there.
+func validISelect(sel, xlen uint64) bool {
+	switch {
+	case sel >= ISELECT_IPRIO0 && sel <= ISELECT_IPRIO15:
+		return xlen == 32 || sel%2 == 0
+	case sel == ISELECT_EIDELIVERY, sel == ISELECT_EITHRESHOLD:
+		return true
+	case sel >= ISELECT_EIP0 && sel <= ISELECT_EIE63:
+		return xlen == 32 || sel%2 == 0
+	}
+	return false
+}
+
+// loadIReg reads the register sel selects for mireg or sireg. The major
+// interrupt priorities are read-only zero, so interrupts are taken in the
+// default priority order.
+func (f *imsicFile) loadIReg(sel, xlen uint64) uint64 {
+	switch {
+	case sel == ISELECT_EIDELIVERY:
+		return f.eidelivery
+	case sel == ISELECT_EITHRESHOLD:
+		return f.eithreshold
+	case sel >= ISELECT_EIP0 && sel <= ISELECT_EIP63:
+		return imsicWord(&f.eip, sel-ISELECT_EIP0, xlen)
+	case sel >= ISELECT_EIE0 && sel <= ISELECT_EIE63:
+		return imsicWord(&f.eie, sel-ISELECT_EIE0, xlen)
+	}
+	return 0
+}
+
+// storeIReg writes the register sel selects for mireg or sireg.
+func (f *imsicFile) storeIReg(sel, value, xlen uint64) {
+	switch {
+	case sel == ISELECT_EIDELIVERY:
+		f.eidelivery = value & 1
+	case sel == ISELECT_EITHRESHOLD:
+		f.eithreshold = value & (IMSIC_IDS - 1)
+	case sel >= ISELECT_EIP0 && sel <= ISELECT_EIP63:
+		setIMSICWord(&f.eip, sel-ISELECT_EIP0, value, xlen)
+	case sel >= ISELECT_EIE0 && sel <= ISELECT_EIE63:
+		setIMSICWord(&f.eie, sel-ISELECT_EIE0, value, xlen)
+	}
+}
+
+// imsicWord returns eipk or eiek, which hold the bits of identities 32k up to
+// 32k+xlen-1. Bit 0 of eip0 and eie0, identity 0, is read-only zero.
+func imsicWord(words *[IMSIC_IDS / 64]uint64, k, xlen uint64) uint64 {
+	if k/2 >= uint64(len(words)) {
+		return 0
+	}
+	value := words[k/2]
+	if k == 0 {
+		value &^= 1
+	}
+	if xlen == 32 {
+		return value >> (32 * (k % 2)) & 0xffff_ffff
+	}
+	return value
+}
+
+func setIMSICWord(words *[IMSIC_IDS / 64]uint64, k, value, xlen uint64) {
+	if k/2 >= uint64(len(words)) {
+		return
+	}
+	if xlen == 32 {
+		shift := 32 * (k % 2)
+		value = words[k/2]&^(0xffff_ffff<<shift) | (value&0xffff_ffff)<<shift
+	}
+	if k/2 == 0 {
+		value &^= 1
+	}
+	words[k/2] = value
+}
+
+// Imsic holds the M-level and S-level interrupt files of hart 0, each in its
+// own page of the physical address space.
+type Imsic struct {
+	m imsicFile
+	s imsicFile
+}
+
+func NewImsic() Imsic {
+	return Imsic{}
+}
+
+func (i *Imsic) file(addr uint64) *imsicFile {
+	if addr >= IMSIC_S_BASE {
+		return &i.s
+	}
+	return &i.m
+}
+
+// Load reads an interrupt file page. seteipnum_le and seteipnum_be read as
+// zero.
+func (i *Imsic) Load(addr, size uint64) (uint64, *Exception) {
+	if size != 32 {
+		return 0, NewException(LoadAccessFault, addr)
+	}
+	return 0, nil
+}
+
+// Store writes an interrupt file page: an identity written to seteipnum_le,
+// or byte-swapped to seteipnum_be, becomes pending.
+func (i *Imsic) Store(addr, size, value uint64) *Exception {
+	if size != 32 {
+		return NewException(StoreAMOAccessFault, addr)
+	}
+	switch addr % IMSIC_SIZE {
+	case IMSIC_SETEIPNUM_LE:
+		i.file(addr).setPending(uint64(uint32(value)))
+	case IMSIC_SETEIPNUM_BE:
+		i.file(addr).setPending(uint64(bits.ReverseBytes32(uint32(value))))
+	}
+	return nil
+}
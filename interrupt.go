@@ -7,14 +7,33 @@ const (
 type Interrupt uint64
 
 var (
-	SupervisorSoftwareInterrupt Interrupt = 1
-	MachineSoftwareInterrupt    Interrupt = 3
-	SupervisorTimerInterrupt    Interrupt = 5
-	MachineTimerInterrupt       Interrupt = 7
-	SupervisorExternalInterrupt Interrupt = 9
-	MachineExternalInterrupt    Interrupt = 11
+	SupervisorSoftwareInterrupt        Interrupt = 1
+	VirtualSupervisorSoftwareInterrupt Interrupt = 2
+	MachineSoftwareInterrupt           Interrupt = 3
+	SupervisorTimerInterrupt           Interrupt = 5
+	VirtualSupervisorTimerInterrupt    Interrupt = 6
+	MachineTimerInterrupt              Interrupt = 7
+	SupervisorExternalInterrupt        Interrupt = 9
+	VirtualSupervisorExternalInterrupt Interrupt = 10
+	MachineExternalInterrupt           Interrupt = 11
+	LocalCounterOverflowInterrupt      Interrupt = 13
 )
 
+// interruptPriority lists the interrupts in the order they are taken when
+// several are pending and enabled at the same privilege level.
+var interruptPriority = []*Interrupt{
+	&MachineExternalInterrupt,
+	&MachineSoftwareInterrupt,
+	&MachineTimerInterrupt,
+	&SupervisorExternalInterrupt,
+	&SupervisorSoftwareInterrupt,
+	&SupervisorTimerInterrupt,
+	&VirtualSupervisorExternalInterrupt,
+	&VirtualSupervisorSoftwareInterrupt,
+	&VirtualSupervisorTimerInterrupt,
+	&LocalCounterOverflowInterrupt,
+}
+
 func (i Interrupt) Code() uint64 {
 	return uint64(i | MASK_INTERRUPT_BIT)
 }
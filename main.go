@@ -1,7 +1,9 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"math/rand"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -9,26 +11,72 @@ import (
 )
 
 func main() {
-	args := os.Args
-	if len(args) != 2 && len(args) != 3 {
-		fmt.Printf("run with <filename> <(optional) image>")
+	xlen := flag.Uint64("xlen", 64, "register width: 32 for an RV32 machine with Sv32 paging, or 64")
+	bitmanip := flag.Bool("bitmanip", true, "enable the Zba/Zbb/Zbc/Zbs bit-manipulation extensions")
+	vlen := flag.Uint64("vlen", DEFAULT_VLEN, "vector register length in bits")
+	cbsize := flag.Uint64("cbsize", DEFAULT_CACHE_BLOCK_SIZE, "cache-block size in bytes for the CMO instructions")
+	crypto := flag.Bool("crypto", true, "enable the scalar cryptography extensions")
+	misaligned := flag.String("misaligned", "emulate", "misaligned load/store policy: emulate, or trap to let firmware emulate them")
+	aia := flag.Bool("aia", false, "replace the PLIC with the AIA APLIC and IMSIC, and enable the Smaia/Ssaia CSRs")
+	entropySeed := flag.Int64("entropy-seed", 0, "seed for a deterministic seed CSR (0 uses host randomness)")
+	strictPMP := flag.Bool("strict-pmp", false, "fail S/U-mode accesses no PMP entry matches even while every entry is off, as the spec requires")
+	flag.Parse()
+	args := flag.Args()
+	if len(args) != 1 && len(args) != 2 {
+		fmt.Printf("run with [flags] <filename> <(optional) image>")
 		return
 	}
 
-	code, err := os.ReadFile(args[1])
+	code, err := os.ReadFile(args[0])
 	if err != nil {
 		panic("read file error!")
 	}
 
 	var diskImage []uint8
-	if len(args) == 3 {
-		diskImage, err = os.ReadFile(args[2])
+	if len(args) == 2 {
+		diskImage, err = os.ReadFile(args[1])
 		if err != nil {
 			panic("read file error!")
 		}
 	}
 
 	cpu := NewCPU(code, diskImage)
+	cpu.Ext.Zba = *bitmanip
+	cpu.Ext.Zbb = *bitmanip
+	cpu.Ext.Zbc = *bitmanip
+	cpu.Ext.Zbs = *bitmanip
+	cpu.Ext.Zbkb = *crypto
+	cpu.Ext.Zbkc = *crypto
+	cpu.Ext.Zbkx = *crypto
+	cpu.Ext.Zknd = *crypto
+	cpu.Ext.Zkne = *crypto
+	cpu.Ext.Zknh = *crypto
+	cpu.Ext.Zksed = *crypto
+	cpu.Ext.Zksh = *crypto
+	cpu.Ext.Zkr = *crypto
+	if *aia {
+		cpu.EnableAIA()
+	}
+	if *entropySeed != 0 {
+		cpu.Entropy = rand.New(rand.NewSource(*entropySeed))
+	}
+	cpu.Csr.StrictPMP = *strictPMP
+	if cpu.Misaligned, err = ParseMisalignedPolicy(*misaligned); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := cpu.SetXLEN(*xlen); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := cpu.SetVLEN(*vlen); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := cpu.SetCacheBlockSize(*cbsize); err != nil {
+		fmt.Println(err)
+		return
+	}
 
 	// 关闭终端缓冲
 	exec.Command("stty", "-F", "/dev/tty", "cbreak", "min", "1").Run()
@@ -37,7 +85,7 @@ func main() {
 	// 恢复终端显示
 	defer exec.Command("stty", "-F", "/dev/tty", "echo").Run()
 
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
@@ -47,27 +95,9 @@ func main() {
 	}()
 
 	for {
-		inst, exception := cpu.Fetch()
-		if exception != nil {
-			cpu.HandleException(exception)
-			if exception.IsFatal() {
-				fmt.Println(exception.ToString())
-				break
-			}
-			continue
-		}
-		newPC, exception := cpu.Execute(inst)
-		if exception != nil {
-			cpu.HandleException(exception)
-			if exception.IsFatal() {
-				fmt.Println(exception.ToString())
-				break
-			}
-		} else {
-			cpu.Pc = newPC
-		}
-		if interrupt := cpu.CheckPendingInterrupt(); interrupt != nil {
-			cpu.HandleInterrupt(*interrupt)
+		if exception := cpu.Step(); exception != nil {
+			fmt.Println(exception.ToString())
+			break
 		}
 	}
 }
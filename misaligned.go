@@ -0,0 +1,131 @@
+package main
+
+import "fmt"
+
+// MisalignedPolicy selects how loads and stores that are not naturally
+// aligned are handled. AMOs and LR/SC fault when misaligned either way.
+type MisalignedPolicy uint64
+
+const (
+	// MisalignedEmulate performs misaligned accesses transparently, splitting
+	// those that cross a page boundary into one access per page.
+	MisalignedEmulate MisalignedPolicy = iota
+	// MisalignedTrap raises address-misaligned exceptions, as hardware
+	// that leaves misaligned accesses to M-mode firmware does.
+	MisalignedTrap
+)
+
+// ParseMisalignedPolicy parses the name of a misaligned-access policy.
+func ParseMisalignedPolicy(name string) (MisalignedPolicy, error) {
+	switch name {
+	case "emulate":
+		return MisalignedEmulate, nil
+	case "trap":
+		return MisalignedTrap, nil
+	default:
+		return 0, fmt.Errorf("invalid misaligned-access policy %q: must be emulate or trap", name)
+	}
+}
+
+func misalignedFault(addr uint64, accessType AccessType) *Exception {
+	if accessType == Load {
+		return NewException(LoadAccessMisaligned, addr)
+	}
+	return NewException(StoreAMOAddrMisaligned, addr)
+}
+
+// checkAlignment raises an address-misaligned exception for an access of size
+// bits at addr that is not naturally aligned, unless the policy emulates it.
+func (cpu *Cpu) checkAlignment(addr, size uint64, accessType AccessType) *Exception {
+	if addr%(size/8) != 0 && cpu.Misaligned == MisalignedTrap {
+		return misalignedFault(addr, accessType)
+	}
+	return nil
+}
+
+// pageSplit returns the number of bytes of an access of size bits at addr that
+// lie in its first page, or 0 if the access does not cross a page boundary.
+func pageSplit(addr, size uint64) uint64 {
+	offset := addr % PAGE_SIZE
+	if offset+size/8 <= PAGE_SIZE {
+		return 0
+	}
+	return PAGE_SIZE - offset
+}
+
+// translateFunc translates the address of an access of size bits and checks
+// it against PMP, returning its physical address.
+type translateFunc func(addr, size uint64, accessType AccessType) (uint64, *Exception)
+
+// translateAccess is the translateFunc of ordinary loads and stores, which use
+// the current privileges.
+func (cpu *Cpu) translateAccess(addr, size uint64, accessType AccessType) (uint64, *Exception) {
+	pAddr, exception := cpu.Translate(addr, accessType)
+	if exception != nil {
+		return 0, exception
+	}
+	if exception := cpu.CheckPMP(addr, pAddr, size, accessType); exception != nil {
+		return 0, exception
+	}
+	return pAddr, nil
+}
+
+// translateSplit translates and checks both parts of an access that crosses a
+// page boundary after n bytes, so that a fault on either page is raised before
+// memory is touched. A fault on the second page reports its first address.
+func (cpu *Cpu) translateSplit(addr, size, n uint64, accessType AccessType, translate translateFunc) ([2]uint64, *Exception) {
+	var pAddrs [2]uint64
+	parts := [2][2]uint64{{addr, n}, {addr + n, size/8 - n}}
+	for i, part := range parts {
+		pAddr, exception := translate(part[0], part[1]*8, accessType)
+		if exception != nil {
+			return pAddrs, exception
+		}
+		pAddrs[i] = pAddr
+	}
+	return pAddrs, nil
+}
+
+// loadSplit performs a load that crosses a page boundary after n bytes one
+// byte at a time.
+func (cpu *Cpu) loadSplit(addr, size, n uint64, translate translateFunc) (uint64, *Exception) {
+	pAddrs, exception := cpu.translateSplit(addr, size, n, Load, translate)
+	if exception != nil {
+		return 0, exception
+	}
+	var value uint64
+	for i := uint64(0); i < size/8; i++ {
+		pAddr := pAddrs[0] + i
+		if i >= n {
+			pAddr = pAddrs[1] + i - n
+		}
+		b, exception := cpu.Bus.Load(pAddr, 8)
+		if exception != nil {
+			return 0, NewException(exception.Type, addr)
+		}
+		value |= b << (i * 8)
+	}
+	return value, nil
+}
+
+// storeSplit performs a store that crosses a page boundary after n bytes one
+// byte at a time.
+func (cpu *Cpu) storeSplit(addr, size, n, value uint64, translate translateFunc) *Exception {
+	pAddrs, exception := cpu.translateSplit(addr, size, n, Store, translate)
+	if exception != nil {
+		return exception
+	}
+	if cpu.Reservation.Overlaps(pAddrs[0], n*8) || cpu.Reservation.Overlaps(pAddrs[1], size-n*8) {
+		cpu.Reservation.Clear()
+	}
+	for i := uint64(0); i < size/8; i++ {
+		pAddr := pAddrs[0] + i
+		if i >= n {
+			pAddr = pAddrs[1] + i - n
+		}
+		if exception := cpu.Bus.Store(pAddr, 8, value>>(i*8)); exception != nil {
+			return NewException(exception.Type, addr)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import "math/bits"
+
+// PMPCfg returns the configuration byte of PMP entry i.
+func (c *CSR) PMPCfg(i uint64) uint64 {
+	return (c.csrs[PMPCFG0+i/8*2] >> (i % 8 * 8)) & 0xff
+}
+
+// pmpLocked reports whether entry i is locked against writes. mseccfg.RLB
+// lifts the lock.
+func (c *CSR) pmpLocked(i uint64) bool {
+	return c.PMPCfg(i)&PMP_L != 0 && c.csrs[MSECCFG]&MSECCFG_RLB == 0
+}
+
+// pmpRange returns the physical byte range [lo, hi) matched by PMP entry i.
+// It reports false for entries that match nothing.
+func (c *CSR) pmpRange(i uint64) (uint64, uint64, bool) {
+	addr := c.csrs[PMPADDR0+i]
+	switch (c.PMPCfg(i) & MASK_PMPA) >> 3 {
+	case PMP_A_TOR:
+		var lo uint64
+		if i > 0 {
+			lo = c.csrs[PMPADDR0+i-1] << 2
+		}
+		hi := addr << 2
+		return lo, hi, lo < hi
+	case PMP_A_NA4:
+		return addr << 2, addr<<2 + 4, true
+	case PMP_A_NAPOT:
+		// The number of trailing ones selects a 2^(n+3) byte region.
+		n := uint(bits.TrailingZeros64(^addr))
+		lo := (addr &^ (1<<n - 1)) << 2
+		return lo, lo + 8<<n, true
+	default:
+		return 0, 0, false
+	}
+}
+
+// PMPAllows reports whether physical memory protection permits an access of
+// size bits at physical address addr with the privileges of mode. The
+// lowest-numbered entry matching any byte decides, and fails the access unless
+// it covers every byte.
+//
+// While every entry is OFF, PMP is treated as unconfigured and S/U-mode
+// accesses are allowed, as older QEMU did, so kernels whose firmware never
+// programs PMP keep running. With StrictPMP set they fail, as the spec
+// requires.
+func (c *CSR) PMPAllows(addr, size uint64, accessType AccessType, mode Mode) bool {
+	end := addr + size/8
+	configured := false
+	for i := uint64(0); i < PMP_ENTRIES; i++ {
+		if c.PMPCfg(i)&MASK_PMPA != 0 {
+			configured = true
+		}
+		lo, hi, ok := c.pmpRange(i)
+		if !ok || end <= lo || addr >= hi {
+			continue
+		}
+		if addr < lo || end > hi {
+			return false
+		}
+		return c.pmpPermits(c.PMPCfg(i), accessType, mode)
+	}
+	mseccfg := c.csrs[MSECCFG]
+	if mode != Machine {
+		return !configured && !c.StrictPMP && mseccfg&MSECCFG_MMWP == 0
+	}
+	if mseccfg&MSECCFG_MMWP != 0 {
+		return false
+	}
+	// With MML set, M-mode may only execute from regions it has a rule for.
+	return mseccfg&MSECCFG_MML == 0 || accessType != Instruction
+}
+
+// pmpPermits applies the permissions of a matching entry, including the
+// Smepmp rules when mseccfg.MML is set.
+func (c *CSR) pmpPermits(cfg uint64, accessType AccessType, mode Mode) bool {
+	var need uint64
+	switch accessType {
+	case Instruction:
+		need = PMP_X
+	case Load:
+		need = PMP_R
+	default:
+		need = PMP_W
+	}
+	locked := cfg&PMP_L != 0
+	rwx := cfg & (PMP_R | PMP_W | PMP_X)
+	if c.csrs[MSECCFG]&MSECCFG_MML == 0 {
+		if mode == Machine && !locked {
+			return true
+		}
+		return rwx&need != 0
+	}
+
+	// Smepmp: locked rules are M-mode-only and unlocked rules S/U-only,
+	// except that W without R encodes the shared regions.
+	var perms uint64
+	switch {
+	case !locked && rwx == PMP_W:
+		perms = PMP_R
+		if mode == Machine {
+			perms = PMP_R | PMP_W
+		}
+	case !locked && rwx == PMP_W|PMP_X:
+		perms = PMP_R | PMP_W
+	case locked && rwx == PMP_W:
+		perms = PMP_X
+	case locked && rwx == PMP_W|PMP_X:
+		perms = PMP_X
+		if mode == Machine {
+			perms = PMP_R | PMP_X
+		}
+	case locked && rwx == PMP_R|PMP_W|PMP_X:
+		perms = PMP_R
+	case locked == (mode == Machine):
+		perms = rwx
+	}
+	return perms&need != 0
+}
+
+// storePMPCfg writes a pmpcfg register one entry at a time, skipping locked
+// entries and keeping the old value for reserved combinations.
+func (c *CSR) storePMPCfg(addr, value uint64) {
+	if (addr-PMPCFG0)%2 != 0 {
+		// pmpcfg1, pmpcfg3, ... do not exist on RV64.
+		return
+	}
+	base := (addr - PMPCFG0) * 4
+	mseccfg := c.csrs[MSECCFG]
+	for j := uint64(0); j < 8; j++ {
+		i := base + j
+		if c.pmpLocked(i) {
+			continue
+		}
+		cfg := (value >> (j * 8)) & (PMP_L | MASK_PMPA | PMP_X | PMP_W | PMP_R)
+		rwx := cfg & (PMP_R | PMP_W | PMP_X)
+		if mseccfg&MSECCFG_MML == 0 && rwx&(PMP_R|PMP_W) == PMP_W {
+			continue
+		}
+		if mseccfg&MSECCFG_MML != 0 && mseccfg&MSECCFG_RLB == 0 && cfg&PMP_L != 0 {
+			// New M-mode executable rules cannot be added under MML.
+			switch rwx {
+			case PMP_X, PMP_R | PMP_X, PMP_W, PMP_W | PMP_X:
+				continue
+			}
+		}
+		shift := (i % 8) * 8
+		reg := PMPCFG0 + i/8*2
+		c.csrs[reg] = c.csrs[reg]&^(0xff<<shift) | cfg<<shift
+	}
+}
+
+// storePMPAddr writes pmpaddr i unless the entry, or the top of a TOR range
+// it bounds, is locked.
+func (c *CSR) storePMPAddr(i, value uint64) {
+	if c.pmpLocked(i) {
+		return
+	}
+	if i+1 < PMP_ENTRIES && c.pmpLocked(i+1) && (c.PMPCfg(i+1)&MASK_PMPA)>>3 == PMP_A_TOR {
+		return
+	}
+	c.csrs[PMPADDR0+i] = value & MASK_PMPADDR
+}
+
+// storeMSECCFG writes mseccfg. MML and MMWP are sticky once set, and RLB cannot
+// be set while any entry is locked.
+func (c *CSR) storeMSECCFG(value uint64) {
+	old := c.csrs[MSECCFG]
+	next := old | value&(MSECCFG_MML|MSECCFG_MMWP)
+	next = next&^(MSECCFG_RLB|MSECCFG_USEED|MSECCFG_SSEED) | value&(MSECCFG_RLB|MSECCFG_USEED|MSECCFG_SSEED)
+	if old&MSECCFG_RLB == 0 && value&MSECCFG_RLB != 0 {
+		for i := uint64(0); i < PMP_ENTRIES; i++ {
+			if c.PMPCfg(i)&PMP_L != 0 {
+				next &^= MSECCFG_RLB
+				break
+			}
+		}
+	}
+	c.csrs[MSECCFG] = next
+}
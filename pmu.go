@@ -0,0 +1,101 @@
+package main
+
+import "math/bits"
+
+// storeMhpmevent writes mhpmevent3-31. An event selector naming an event that
+// is not implemented reads back as 0, which counts nothing.
+func (c *CSR) storeMhpmevent(addr, value uint64) {
+	value &= MASK_MHPMEVENT_WRITABLE
+	if value&MASK_MHPMEVENT_EVENT >= HPM_EVENT_COUNT {
+		value &^= MASK_MHPMEVENT_EVENT
+	}
+	counter := uint32(1) << (addr - MHPMEVENT3 + 3)
+	c.hpmEvents[c.csrs[addr]&MASK_MHPMEVENT_EVENT] &^= counter
+	c.hpmEvents[value&MASK_MHPMEVENT_EVENT] |= counter
+	c.csrs[addr] = value
+}
+
+// CountEvent increments the counters selecting event, unless mcountinhibit or
+// the inhibit bit of their mhpmevent for mode stops them. A counter wrapping
+// to zero sets its OF bit, and raises a local counter-overflow interrupt
+// unless OF was already set.
+func (c *CSR) CountEvent(event uint64, mode Mode, virt bool) {
+	for counters := c.hpmEvents[event] &^ uint32(c.csrs[MCOUNTINHIBIT]); counters != 0; counters &= counters - 1 {
+		i := uint64(bits.TrailingZeros32(counters))
+		mhpmevent := c.csrs[MHPMEVENT3+i-3]
+		// A clear inhibit bit selects the mode.
+		if !triggerSelects(^mhpmevent, MHPMEVENT_MINH, MHPMEVENT_SINH, MHPMEVENT_UINH, MHPMEVENT_VSINH, MHPMEVENT_VUINH, mode, virt) {
+			continue
+		}
+		c.csrs[MHPMCOUNTER3+i-3]++
+		if c.csrs[MHPMCOUNTER3+i-3] == 0 {
+			if mhpmevent&MHPMEVENT_OF == 0 {
+				c.csrs[MIP] |= MASK_LCOFIP
+			}
+			c.csrs[MHPMEVENT3+i-3] |= MHPMEVENT_OF
+		}
+	}
+}
+
+// countRetired counts the events of an instruction that retired in mode, with
+// newPC the address of the next instruction.
+func (cpu *Cpu) countRetired(inst, newPC uint64, mode Mode, virt bool) {
+	funct3 := (inst >> 12) & 0x7
+	funct5 := inst >> 27
+	switch inst & 0x7f {
+	case 0x03, 0x07:
+		cpu.Csr.CountEvent(HPM_EVENT_LOAD, mode, virt)
+	case 0x23, 0x27:
+		cpu.Csr.CountEvent(HPM_EVENT_STORE, mode, virt)
+	case 0x2f:
+		// lr counts as a load, sc as a store and other AMOs as both.
+		if funct5 != 0x03 {
+			cpu.Csr.CountEvent(HPM_EVENT_LOAD, mode, virt)
+		}
+		if funct5 != 0x02 {
+			cpu.Csr.CountEvent(HPM_EVENT_STORE, mode, virt)
+		}
+	case 0x63:
+		cpu.Csr.CountEvent(HPM_EVENT_BRANCH, mode, virt)
+		if newPC != cpu.Pc+cpu.InstLen {
+			cpu.Csr.CountEvent(HPM_EVENT_BRANCH_TAKEN, mode, virt)
+		}
+	case 0x73:
+		if funct3 == 0x4 {
+			// hlv, hlvx, hsv
+			if (inst>>25)&1 == 0 {
+				cpu.Csr.CountEvent(HPM_EVENT_LOAD, mode, virt)
+			} else {
+				cpu.Csr.CountEvent(HPM_EVENT_STORE, mode, virt)
+			}
+		}
+	}
+}
+
+// countTLBMiss counts a translation that walks the page tables as an
+// instruction or data TLB miss.
+func (cpu *Cpu) countTLBMiss(accessType AccessType) {
+	event := uint64(HPM_EVENT_DTLB_MISS)
+	if accessType == Instruction {
+		event = HPM_EVENT_ITLB_MISS
+	}
+	cpu.Csr.CountEvent(event, cpu.Mode, cpu.Csr.V)
+}
+
+// scountovf returns the OF bits of mhpmevent3-31, limited outside M-mode to
+// the counters mcounteren, and for a guest hcounteren, make visible.
+func (cpu *Cpu) scountovf() uint64 {
+	var ovf uint64
+	for i := uint64(3); i < 32; i++ {
+		if cpu.Csr.Load(MHPMEVENT3+i-3)&MHPMEVENT_OF != 0 {
+			ovf |= 1 << i
+		}
+	}
+	if cpu.Mode < Machine {
+		ovf &= cpu.Csr.Load(MCOUNTEREN)
+	}
+	if cpu.Csr.V {
+		ovf &= cpu.Csr.Load(HCOUNTEREN)
+	}
+	return ovf
+}
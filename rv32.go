@@ -0,0 +1,325 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// In a 32-bit mode the registers keep their 64-bit width and hold every value
+// sign-extended from bit 31. Most RV64 instructions then produce the right low
+// 32 bits and only need their result sign-extended; execute32 decodes the rest
+// itself.
+
+// XLEN returns the register width in bits of mode: misa.MXL for M-mode,
+// mstatus.SXL and UXL for S- and U-mode, and hstatus.VSXL and vsstatus.UXL for
+// VS- and VU-mode.
+func (c *CSR) XLEN(mode Mode, virt bool) uint64 {
+	var xl uint64
+	switch {
+	case mode == Machine:
+		xl = c.csrs[MISA] >> 62
+	case virt && mode == Supervisor:
+		xl = (c.csrs[HSTATUS] & MASK_VSXL) >> 32
+	case virt:
+		xl = (c.csrs[VSSTATUS] & MASK_UXL) >> 32
+	case mode == Supervisor:
+		xl = (c.csrs[MSTATUS] & MASK_SXL) >> 34
+	default:
+		xl = (c.csrs[MSTATUS] & MASK_UXL) >> 32
+	}
+	if xl == XL_32 {
+		return 32
+	}
+	return 64
+}
+
+// XLEN returns the register width in bits of the current mode.
+func (cpu *Cpu) XLEN() uint64 {
+	return cpu.Csr.XLEN(cpu.Mode, cpu.Csr.V)
+}
+
+// SetXLEN makes the hart an RV32 or an RV64 machine. An RV32 machine has no
+// hypervisor extension, and runs every mode with 32-bit registers.
+func (cpu *Cpu) SetXLEN(xlen uint64) error {
+	misa := cpu.Csr.csrs[MISA] &^ (0b11 << 62)
+	mstatus := cpu.Csr.csrs[MSTATUS] &^ (MASK_UXL | MASK_SXL)
+	switch xlen {
+	case 32:
+		cpu.Csr.csrs[MISA] = misa&^MISA_H | MISA_MXL_32
+		cpu.Csr.csrs[MSTATUS] = mstatus | XL_32<<34 | XL_32<<32
+		for i := range cpu.Regs {
+			cpu.Regs[i] = signExtend(cpu.Regs[i], 32)
+		}
+	case 64:
+		cpu.Csr.csrs[MISA] = misa | MISA_H | MISA_MXL_64
+		cpu.Csr.csrs[MSTATUS] = mstatus | XL_64<<34 | XL_64<<32
+	default:
+		return fmt.Errorf("XLEN must be 32 or 64, not %d", xlen)
+	}
+	return nil
+}
+
+// csrHigh returns the CSR whose upper 32 bits an RV32-only CSR accesses: the
+// high halves of the 64-bit CSRs, and the odd pmpcfg registers, which hold
+// PMP entries 4-7 of the even register below them.
+func csrHigh(addr uint64) (uint64, bool) {
+	switch {
+	case addr == MSTATUSH, addr == MENVCFGH, addr == MSECCFGH, addr == STIMECMPH:
+		return addr - 0x10, true
+	case addr >= MHPMEVENT3H && addr <= MHPMEVENT31H:
+		return addr - 0x400, true
+	case addr >= CYCLEH && addr <= HPMCOUNTER31H, addr >= MCYCLEH && addr <= MHPMCOUNTER31H:
+		return addr - 0x80, true
+	case addr >= PMPCFG0 && addr <= PMPCFG14+1 && addr%2 == 1:
+		return addr - 1, true
+	}
+	return 0, false
+}
+
+// narrowCSR converts the value of a CSR to the layout an RV32 mode reads,
+// where the fields at the top of the register sit at bit 31.
+func narrowCSR(addr, value uint64) uint64 {
+	switch addr {
+	case MSTATUS, SSTATUS, VSSTATUS:
+		// SD
+		value = value&0x7fff_ffff | value>>63<<31
+	case MCAUSE, SCAUSE, VSCAUSE:
+		// The interrupt bit.
+		value = value&0x7fff_ffff | value>>63<<31
+	case MISA:
+		value = value&0x3ff_ffff | value>>62<<30
+	case TDATA1:
+		// type, dmode and the itrigger/etrigger hit bit sit at XLEN-6 up.
+		value = value&(1<<26-1) | value>>58<<26
+	case SATP:
+		if value>>60 == SATP_MODE_SV32 {
+			value = 1<<31 | (value>>44)&0x1ff<<22 | value&(1<<22-1)
+		} else {
+			value &= 1<<22 - 1
+		}
+	}
+	return signExtend(value, 32)
+}
+
+// widenCSR converts a value an RV32 mode writes to CSR addr to the RV64 layout,
+// keeping the upper 32 bits of old.
+func widenCSR(addr, value, old uint64) uint64 {
+	value = uint64(uint32(value))
+	switch addr {
+	case MSTATUS, SSTATUS, VSSTATUS:
+		// SD is computed from the other fields.
+		return old&^0xffff_ffff | value&0x7fff_ffff
+	case MCAUSE, SCAUSE, VSCAUSE:
+		return value&0x7fff_ffff | value>>31<<63
+	case TDATA1:
+		return value&(1<<26-1) | value>>26<<58
+	case SATP:
+		ppn := value & (1<<22 - 1)
+		if value>>31 == 0 {
+			return SATP_MODE_BARE<<60 | ppn
+		}
+		return SATP_MODE_SV32<<60 | (value>>22)&0x1ff<<44 | ppn
+	}
+	return old&^0xffff_ffff | value
+}
+
+// readCSR32 reads a CSR as a CSR instruction in a 32-bit mode sees it.
+func (cpu *Cpu) readCSR32(csrAddr uint64) uint64 {
+	if addr, ok := csrHigh(csrAddr); ok {
+		return signExtend(cpu.readCSR(addr)>>32, 32)
+	}
+	return narrowCSR(csrAddr, cpu.readCSR(csrAddr))
+}
+
+// writeCSR32 writes the 32 bits of a CSR a 32-bit mode can see.
+func (cpu *Cpu) writeCSR32(csrAddr, value uint64) {
+	if addr, ok := csrHigh(csrAddr); ok {
+		old := cpu.Csr.Load(addr)
+		cpu.Csr.Store(addr, old&0xffff_ffff|uint64(uint32(value))<<32)
+		return
+	}
+	cpu.writeCSR(csrAddr, widenCSR(csrAddr, value, cpu.Csr.Load(csrAddr)))
+}
+
+// execute32 executes inst in a 32-bit mode. It rejects the RV64-only
+// instructions, decodes those whose RV64 result differs in its low 32 bits,
+// and sign-extends the result of the rest.
+func (cpu *Cpu) execute32(inst uint64) (uint64, *Exception) {
+	opcode := inst & 0x7f
+	rd := (inst >> 7) & 0x1f
+	rs1 := (inst >> 15) & 0x1f
+	rs2 := (inst >> 20) & 0x1f
+	funct3 := (inst >> 12) & 0x7
+	funct7 := (inst >> 25) & 0x7f
+	x1 := uint32(cpu.Regs[rs1])
+	x2 := uint32(cpu.Regs[rs2])
+
+	cpu.Regs[0] = 0
+
+	switch opcode {
+	case 0x03:
+		if funct3 == 0x3 || funct3 == 0x6 {
+			// ld, lwu
+			return 0, NewException(IllegalInstruction, inst)
+		}
+	case 0x1b, 0x3b:
+		// The *w instructions.
+		return 0, NewException(IllegalInstruction, inst)
+	case 0x23:
+		if funct3 == 0x3 {
+			// sd
+			return 0, NewException(IllegalInstruction, inst)
+		}
+	case 0x2f:
+		if funct3 == 0x3 && funct7>>2 != 0x05 || funct3 == 0x4 {
+			// lr.d, sc.d, amo*.d and amocas.q. amocas.d remains, taking
+			// register pairs.
+			return 0, NewException(IllegalInstruction, inst)
+		}
+	case 0x13:
+		shamt := int(rs2)
+		switch {
+		case (funct3 == 0x1 || funct3 == 0x5) && funct7&1 != 0:
+			// shamt[5] is reserved, which also excludes the RV64 rev8.
+			return 0, NewException(IllegalInstruction, inst)
+		case funct3 == 0x1 && funct7 == 0x18, funct3 == 0x1 && funct7 == 0x08 && rs2 >= 0x4 && rs2 <= 0x7:
+			// aes64im, aes64ks1i, sha512sum0/1, sha512sig0/1. Their RV32
+			// counterparts are not implemented.
+			return 0, NewException(IllegalInstruction, inst)
+		case funct3 == 0x1 && inst>>20 == 0x08f && cpu.Ext.Zbkb:
+			// zip
+			cpu.Regs[rd] = signExtend(uint64(zip(x1)), 32)
+			return cpu.UpdatePC()
+		case funct3 == 0x5 && inst>>20 == 0x08f && cpu.Ext.Zbkb:
+			// unzip
+			cpu.Regs[rd] = signExtend(uint64(unzip(x1)), 32)
+			return cpu.UpdatePC()
+		case funct3 == 0x1 && funct7 == 0x30 && rs2 <= 0x2 && cpu.Ext.Zbb:
+			switch rs2 {
+			case 0x0:
+				// clz
+				cpu.Regs[rd] = uint64(bits.LeadingZeros32(x1))
+			case 0x1:
+				// ctz
+				cpu.Regs[rd] = uint64(bits.TrailingZeros32(x1))
+			case 0x2:
+				// cpop
+				cpu.Regs[rd] = uint64(bits.OnesCount32(x1))
+			}
+			return cpu.UpdatePC()
+		case funct3 == 0x5 && funct7 == 0x00:
+			// srli
+			cpu.Regs[rd] = signExtend(uint64(x1>>shamt), 32)
+			return cpu.UpdatePC()
+		case funct3 == 0x5 && funct7 == 0x30 && (cpu.Ext.Zbb || cpu.Ext.Zbkb):
+			// rori
+			cpu.Regs[rd] = signExtend(uint64(bits.RotateLeft32(x1, -shamt)), 32)
+			return cpu.UpdatePC()
+		case funct3 == 0x5 && inst>>20 == 0x698 && (cpu.Ext.Zbb || cpu.Ext.Zbkb):
+			// rev8
+			cpu.Regs[rd] = signExtend(uint64(bits.ReverseBytes32(x1)), 32)
+			return cpu.UpdatePC()
+		}
+	case 0x33:
+		shamt := int(x2 & 0x1f)
+		switch {
+		case funct7 == 0x00 && funct3 == 0x1:
+			// sll
+			cpu.Regs[rd] = signExtend(uint64(x1<<shamt), 32)
+			return cpu.UpdatePC()
+		case funct7 == 0x00 && funct3 == 0x5:
+			// srl
+			cpu.Regs[rd] = signExtend(uint64(x1>>shamt), 32)
+			return cpu.UpdatePC()
+		case funct7 == 0x20 && funct3 == 0x5:
+			// sra
+			cpu.Regs[rd] = uint64(int64(int32(x1) >> shamt))
+			return cpu.UpdatePC()
+		case funct7 == 0x01 && funct3 == 0x1:
+			// mulh
+			cpu.Regs[rd] = uint64(int64(int32(x1)) * int64(int32(x2)) >> 32)
+			return cpu.UpdatePC()
+		case funct7 == 0x01 && funct3 == 0x2:
+			// mulhsu
+			cpu.Regs[rd] = uint64(int64(int32(x1)) * int64(x2) >> 32)
+			return cpu.UpdatePC()
+		case funct7 == 0x01 && funct3 == 0x3:
+			// mulhu
+			cpu.Regs[rd] = signExtend(uint64(x1)*uint64(x2)>>32, 32)
+			return cpu.UpdatePC()
+		case funct7 == 0x01 && funct3 == 0x5:
+			// divu
+			if x2 == 0 {
+				cpu.Regs[rd] = 0xffffffffffffffff
+			} else {
+				cpu.Regs[rd] = signExtend(uint64(x1/x2), 32)
+			}
+			return cpu.UpdatePC()
+		case funct7 == 0x01 && funct3 == 0x7:
+			// remu
+			if x2 == 0 {
+				cpu.Regs[rd] = signExtend(uint64(x1), 32)
+			} else {
+				cpu.Regs[rd] = signExtend(uint64(x1%x2), 32)
+			}
+			return cpu.UpdatePC()
+		case funct7 == 0x05 && funct3 == 0x2 && cpu.Ext.Zbc:
+			// clmulr
+			cpu.Regs[rd] = signExtend(clmul(uint64(x1), uint64(x2))>>31, 32)
+			return cpu.UpdatePC()
+		case funct7 == 0x05 && funct3 == 0x3 && (cpu.Ext.Zbc || cpu.Ext.Zbkc):
+			// clmulh
+			cpu.Regs[rd] = signExtend(clmul(uint64(x1), uint64(x2))>>32, 32)
+			return cpu.UpdatePC()
+		case funct7 == 0x30 && (funct3 == 0x1 || funct3 == 0x5) && (cpu.Ext.Zbb || cpu.Ext.Zbkb):
+			// rol, ror
+			if funct3 == 0x5 {
+				shamt = -shamt
+			}
+			cpu.Regs[rd] = signExtend(uint64(bits.RotateLeft32(x1, shamt)), 32)
+			return cpu.UpdatePC()
+		case (funct7 == 0x14 || funct7 == 0x24 || funct7 == 0x34) && funct3 == 0x1 && cpu.Ext.Zbs:
+			// bset, bclr, binv
+			bit := uint32(1) << shamt
+			switch funct7 {
+			case 0x14:
+				x1 |= bit
+			case 0x24:
+				x1 &^= bit
+			case 0x34:
+				x1 ^= bit
+			}
+			cpu.Regs[rd] = signExtend(uint64(x1), 32)
+			return cpu.UpdatePC()
+		case funct7 == 0x24 && funct3 == 0x5 && cpu.Ext.Zbs:
+			// bext
+			cpu.Regs[rd] = uint64(x1>>shamt) & 1
+			return cpu.UpdatePC()
+		case funct7 == 0x04 && funct3 == 0x4 && (cpu.Ext.Zbkb || (cpu.Ext.Zbb && rs2 == 0)):
+			// pack, which is zext.h with rs2 = x0
+			cpu.Regs[rd] = signExtend(uint64(x1&0xffff|x2<<16), 32)
+			return cpu.UpdatePC()
+		case funct7 == 0x14 && (funct3 == 0x2 || funct3 == 0x4) && cpu.Ext.Zbkx:
+			// xperm4, xperm8
+			width := uint(4)
+			if funct3 == 0x4 {
+				width = 8
+			}
+			cpu.Regs[rd] = signExtend(xperm(uint64(x1), uint64(x2), width), 32)
+			return cpu.UpdatePC()
+		case funct3 == 0x0 && (funct7 == 0x19 || funct7 == 0x1b || funct7 == 0x1d || funct7 == 0x1f || funct7 == 0x3f):
+			// aes64es, aes64esm, aes64ds, aes64dsm, aes64ks2
+			return 0, NewException(IllegalInstruction, inst)
+		}
+	}
+
+	newPC, exception := cpu.execute(inst)
+	if exception != nil {
+		return 0, exception
+	}
+	switch opcode {
+	case 0x03, 0x13, 0x17, 0x2f, 0x33, 0x37, 0x67, 0x6f, 0x73:
+		cpu.Regs[rd] = signExtend(cpu.Regs[rd], 32)
+	}
+	return newPC, nil
+}
@@ -0,0 +1,252 @@
+package main
+
+// Encoders for the base 32-bit instruction formats, used to expand RVC
+// instructions into their uncompressed equivalents.
+
+func encodeR(opcode, rd, funct3, rs1, rs2, funct7 uint64) uint64 {
+	return funct7<<25 | rs2<<20 | rs1<<15 | funct3<<12 | rd<<7 | opcode
+}
+
+func encodeI(opcode, rd, funct3, rs1, imm uint64) uint64 {
+	return (imm&0xfff)<<20 | rs1<<15 | funct3<<12 | rd<<7 | opcode
+}
+
+func encodeS(opcode, funct3, rs1, rs2, imm uint64) uint64 {
+	return ((imm>>5)&0x7f)<<25 | rs2<<20 | rs1<<15 | funct3<<12 | (imm&0x1f)<<7 | opcode
+}
+
+func encodeB(opcode, funct3, rs1, rs2, imm uint64) uint64 {
+	return ((imm>>12)&1)<<31 | ((imm>>5)&0x3f)<<25 | rs2<<20 | rs1<<15 | funct3<<12 |
+		((imm>>1)&0xf)<<8 | ((imm>>11)&1)<<7 | opcode
+}
+
+func encodeU(opcode, rd, imm uint64) uint64 {
+	return (imm & 0xfffff000) | rd<<7 | opcode
+}
+
+func encodeJ(opcode, rd, imm uint64) uint64 {
+	return ((imm>>20)&1)<<31 | ((imm>>1)&0x3ff)<<21 | ((imm>>11)&1)<<20 |
+		((imm>>12)&0xff)<<12 | rd<<7 | opcode
+}
+
+// bit returns inst[hi:lo] shifted down to bit 0.
+func bit(inst uint64, hi, lo uint64) uint64 {
+	return (inst >> lo) & ((1 << (hi - lo + 1)) - 1)
+}
+
+// ExpandCompressed translates a 16-bit RV32C or RV64C instruction, as selected
+// by xlen, into the 32-bit instruction it is defined to be equivalent to. It
+// reports false for reserved and illegal encodings.
+func ExpandCompressed(inst, xlen uint64) (uint64, bool) {
+	op := inst & 0b11
+	funct3 := bit(inst, 15, 13)
+	// rd'/rs1' and rs2' select x8-x15.
+	rdp := bit(inst, 4, 2) + 8
+	rs1p := bit(inst, 9, 7) + 8
+	rd := bit(inst, 11, 7)
+	rs2 := bit(inst, 6, 2)
+	// imm[5]=inst[12], imm[4:0]=inst[6:2], sign-extended.
+	imm6 := signExtend(bit(inst, 12, 12)<<5|bit(inst, 6, 2), 6)
+
+	switch op {
+	case 0b00:
+		switch funct3 {
+		case 0b000:
+			// c.addi4spn
+			nzuimm := bit(inst, 12, 11)<<4 | bit(inst, 10, 7)<<6 | bit(inst, 6, 6)<<2 | bit(inst, 5, 5)<<3
+			if nzuimm == 0 {
+				return 0, false
+			}
+			return encodeI(0x13, rdp, 0x0, 2, nzuimm), true
+		case 0b001:
+			// c.fld
+			uimm := bit(inst, 12, 10)<<3 | bit(inst, 6, 5)<<6
+			return encodeI(0x07, rdp, 0x3, rs1p, uimm), true
+		case 0b010:
+			// c.lw
+			uimm := bit(inst, 12, 10)<<3 | bit(inst, 6, 6)<<2 | bit(inst, 5, 5)<<6
+			return encodeI(0x03, rdp, 0x2, rs1p, uimm), true
+		case 0b011:
+			if xlen == 32 {
+				// c.flw
+				uimm := bit(inst, 12, 10)<<3 | bit(inst, 6, 6)<<2 | bit(inst, 5, 5)<<6
+				return encodeI(0x07, rdp, 0x2, rs1p, uimm), true
+			}
+			// c.ld
+			uimm := bit(inst, 12, 10)<<3 | bit(inst, 6, 5)<<6
+			return encodeI(0x03, rdp, 0x3, rs1p, uimm), true
+		case 0b101:
+			// c.fsd
+			uimm := bit(inst, 12, 10)<<3 | bit(inst, 6, 5)<<6
+			return encodeS(0x27, 0x3, rs1p, rdp, uimm), true
+		case 0b110:
+			// c.sw
+			uimm := bit(inst, 12, 10)<<3 | bit(inst, 6, 6)<<2 | bit(inst, 5, 5)<<6
+			return encodeS(0x23, 0x2, rs1p, rdp, uimm), true
+		case 0b111:
+			if xlen == 32 {
+				// c.fsw
+				uimm := bit(inst, 12, 10)<<3 | bit(inst, 6, 6)<<2 | bit(inst, 5, 5)<<6
+				return encodeS(0x27, 0x2, rs1p, rdp, uimm), true
+			}
+			// c.sd
+			uimm := bit(inst, 12, 10)<<3 | bit(inst, 6, 5)<<6
+			return encodeS(0x23, 0x3, rs1p, rdp, uimm), true
+		}
+	case 0b01:
+		switch funct3 {
+		case 0b000:
+			// c.addi, c.nop
+			return encodeI(0x13, rd, 0x0, rd, imm6), true
+		case 0b001:
+			if xlen == 32 {
+				// c.jal
+				return encodeJ(0x6f, 1, cjImm(inst)), true
+			}
+			// c.addiw
+			if rd == 0 {
+				return 0, false
+			}
+			return encodeI(0x1b, rd, 0x0, rd, imm6), true
+		case 0b010:
+			// c.li
+			return encodeI(0x13, rd, 0x0, 0, imm6), true
+		case 0b011:
+			if rd == 2 {
+				// c.addi16sp
+				nzimm := signExtend(bit(inst, 12, 12)<<9|bit(inst, 6, 6)<<4|bit(inst, 5, 5)<<6|
+					bit(inst, 4, 3)<<7|bit(inst, 2, 2)<<5, 10)
+				if nzimm == 0 {
+					return 0, false
+				}
+				return encodeI(0x13, 2, 0x0, 2, nzimm), true
+			}
+			// c.lui
+			nzimm := signExtend(bit(inst, 12, 12)<<17|bit(inst, 6, 2)<<12, 18)
+			if nzimm == 0 {
+				return 0, false
+			}
+			return encodeU(0x37, rd, nzimm), true
+		case 0b100:
+			shamt := bit(inst, 12, 12)<<5 | bit(inst, 6, 2)
+			switch bit(inst, 11, 10) {
+			case 0b00:
+				// c.srli
+				return encodeI(0x13, rs1p, 0x5, rs1p, shamt), true
+			case 0b01:
+				// c.srai
+				return encodeI(0x13, rs1p, 0x5, rs1p, 0x400|shamt), true
+			case 0b10:
+				// c.andi
+				return encodeI(0x13, rs1p, 0x7, rs1p, imm6), true
+			case 0b11:
+				rs2p := rdp
+				switch bit(inst, 12, 12)<<2 | bit(inst, 6, 5) {
+				case 0b000:
+					// c.sub
+					return encodeR(0x33, rs1p, 0x0, rs1p, rs2p, 0x20), true
+				case 0b001:
+					// c.xor
+					return encodeR(0x33, rs1p, 0x4, rs1p, rs2p, 0x00), true
+				case 0b010:
+					// c.or
+					return encodeR(0x33, rs1p, 0x6, rs1p, rs2p, 0x00), true
+				case 0b011:
+					// c.and
+					return encodeR(0x33, rs1p, 0x7, rs1p, rs2p, 0x00), true
+				case 0b100:
+					// c.subw
+					return encodeR(0x3b, rs1p, 0x0, rs1p, rs2p, 0x20), true
+				case 0b101:
+					// c.addw
+					return encodeR(0x3b, rs1p, 0x0, rs1p, rs2p, 0x00), true
+				}
+			}
+		case 0b101:
+			// c.j
+			return encodeJ(0x6f, 0, cjImm(inst)), true
+		case 0b110, 0b111:
+			// c.beqz, c.bnez
+			imm := signExtend(bit(inst, 12, 12)<<8|bit(inst, 11, 10)<<3|bit(inst, 6, 5)<<6|
+				bit(inst, 4, 3)<<1|bit(inst, 2, 2)<<5, 9)
+			return encodeB(0x63, funct3&1, rs1p, 0, imm), true
+		}
+	case 0b10:
+		switch funct3 {
+		case 0b000:
+			// c.slli
+			shamt := bit(inst, 12, 12)<<5 | bit(inst, 6, 2)
+			return encodeI(0x13, rd, 0x1, rd, shamt), true
+		case 0b001:
+			// c.fldsp
+			uimm := bit(inst, 12, 12)<<5 | bit(inst, 6, 5)<<3 | bit(inst, 4, 2)<<6
+			return encodeI(0x07, rd, 0x3, 2, uimm), true
+		case 0b010:
+			// c.lwsp
+			if rd == 0 {
+				return 0, false
+			}
+			uimm := bit(inst, 12, 12)<<5 | bit(inst, 6, 4)<<2 | bit(inst, 3, 2)<<6
+			return encodeI(0x03, rd, 0x2, 2, uimm), true
+		case 0b011:
+			if xlen == 32 {
+				// c.flwsp
+				uimm := bit(inst, 12, 12)<<5 | bit(inst, 6, 4)<<2 | bit(inst, 3, 2)<<6
+				return encodeI(0x07, rd, 0x2, 2, uimm), true
+			}
+			// c.ldsp
+			if rd == 0 {
+				return 0, false
+			}
+			uimm := bit(inst, 12, 12)<<5 | bit(inst, 6, 5)<<3 | bit(inst, 4, 2)<<6
+			return encodeI(0x03, rd, 0x3, 2, uimm), true
+		case 0b100:
+			if bit(inst, 12, 12) == 0 {
+				if rs2 == 0 {
+					// c.jr
+					if rd == 0 {
+						return 0, false
+					}
+					return encodeI(0x67, 0, 0x0, rd, 0), true
+				}
+				// c.mv
+				return encodeR(0x33, rd, 0x0, 0, rs2, 0x00), true
+			}
+			if rs2 == 0 {
+				if rd == 0 {
+					// c.ebreak
+					return encodeI(0x73, 0, 0x0, 0, 1), true
+				}
+				// c.jalr
+				return encodeI(0x67, 1, 0x0, rd, 0), true
+			}
+			// c.add
+			return encodeR(0x33, rd, 0x0, rd, rs2, 0x00), true
+		case 0b101:
+			// c.fsdsp
+			uimm := bit(inst, 12, 10)<<3 | bit(inst, 9, 7)<<6
+			return encodeS(0x27, 0x3, 2, rs2, uimm), true
+		case 0b110:
+			// c.swsp
+			uimm := bit(inst, 12, 9)<<2 | bit(inst, 8, 7)<<6
+			return encodeS(0x23, 0x2, 2, rs2, uimm), true
+		case 0b111:
+			if xlen == 32 {
+				// c.fswsp
+				uimm := bit(inst, 12, 9)<<2 | bit(inst, 8, 7)<<6
+				return encodeS(0x27, 0x2, 2, rs2, uimm), true
+			}
+			// c.sdsp
+			uimm := bit(inst, 12, 10)<<3 | bit(inst, 9, 7)<<6
+			return encodeS(0x23, 0x3, 2, rs2, uimm), true
+		}
+	}
+	return 0, false
+}
+
+// cjImm decodes the jump offset of c.j and c.jal.
+func cjImm(inst uint64) uint64 {
+	return signExtend(bit(inst, 12, 12)<<11|bit(inst, 11, 11)<<4|bit(inst, 10, 9)<<8|
+		bit(inst, 8, 8)<<10|bit(inst, 7, 7)<<6|bit(inst, 6, 6)<<7|bit(inst, 5, 3)<<1|
+		bit(inst, 2, 2)<<5, 12)
+}
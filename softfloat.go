@@ -0,0 +1,648 @@
+package main
+
+import (
+	"math"
+	"math/big"
+)
+
+// IEEE 754 binary floating-point arithmetic on raw bit patterns.
+//
+// Operands are unpacked into an exact sign/mantissa/exponent triple backed by
+// big.Int, the operation is carried out exactly (or with a sticky bit for
+// division and square root), and the result is rounded once into the
+// destination format. This gives every rounding mode and exception flag
+// without relying on the host FPU.
+
+type RoundingMode uint64
+
+const (
+	RoundNearestEven RoundingMode = 0
+	RoundTowardZero  RoundingMode = 1
+	RoundDown        RoundingMode = 2
+	RoundUp          RoundingMode = 3
+	RoundNearestMax  RoundingMode = 4
+	RoundDynamic     RoundingMode = 7
+)
+
+type FloatFormat struct {
+	ExpBits  uint
+	FracBits uint
+}
+
+var (
+	Float16 = FloatFormat{ExpBits: 5, FracBits: 10}
+	Float32 = FloatFormat{ExpBits: 8, FracBits: 23}
+	Float64 = FloatFormat{ExpBits: 11, FracBits: 52}
+)
+
+type floatKind int
+
+const (
+	kindZero floatKind = iota
+	kindFinite
+	kindInf
+	kindQNaN
+	kindSNaN
+)
+
+// floatValue is an unpacked operand. Finite values equal mant * 2^exp.
+type floatValue struct {
+	kind floatKind
+	sign bool
+	mant *big.Int
+	exp  int
+}
+
+func (v floatValue) isNaN() bool {
+	return v.kind == kindQNaN || v.kind == kindSNaN
+}
+
+func (f FloatFormat) bias() int {
+	return 1<<(f.ExpBits-1) - 1
+}
+
+func (f FloatFormat) expMax() uint64 {
+	return 1<<f.ExpBits - 1
+}
+
+func (f FloatFormat) signBit() uint64 {
+	return 1 << (f.ExpBits + f.FracBits)
+}
+
+// mask covers every bit of the format.
+func (f FloatFormat) mask() uint64 {
+	return f.signBit()<<1 - 1
+}
+
+func (f FloatFormat) CanonicalNaN() uint64 {
+	return f.expMax()<<f.FracBits | 1<<(f.FracBits-1)
+}
+
+func (f FloatFormat) zero(sign bool) uint64 {
+	if sign {
+		return f.signBit()
+	}
+	return 0
+}
+
+func (f FloatFormat) inf(sign bool) uint64 {
+	return f.zero(sign) | f.expMax()<<f.FracBits
+}
+
+// Box NaN-boxes v into a 64-bit floating-point register.
+func (f FloatFormat) Box(v uint64) uint64 {
+	return (v & f.mask()) | ^f.mask()
+}
+
+// Unbox extracts a value from a 64-bit floating-point register. Values that
+// are not properly NaN-boxed read as the canonical NaN.
+func (f FloatFormat) Unbox(r uint64) uint64 {
+	if r|f.mask() != ^uint64(0) {
+		return f.CanonicalNaN()
+	}
+	return r & f.mask()
+}
+
+func (f FloatFormat) unpack(bits uint64) floatValue {
+	sign := bits&f.signBit() != 0
+	e := (bits >> f.FracBits) & f.expMax()
+	frac := bits & (1<<f.FracBits - 1)
+	switch {
+	case e == f.expMax() && frac == 0:
+		return floatValue{kind: kindInf, sign: sign}
+	case e == f.expMax() && frac&(1<<(f.FracBits-1)) != 0:
+		return floatValue{kind: kindQNaN, sign: sign}
+	case e == f.expMax():
+		return floatValue{kind: kindSNaN, sign: sign}
+	case e == 0 && frac == 0:
+		return floatValue{kind: kindZero, sign: sign, mant: new(big.Int)}
+	case e == 0:
+		return floatValue{kind: kindFinite, sign: sign, mant: new(big.Int).SetUint64(frac),
+			exp: 1 - f.bias() - int(f.FracBits)}
+	default:
+		return floatValue{kind: kindFinite, sign: sign, mant: new(big.Int).SetUint64(frac | 1<<f.FracBits),
+			exp: int(e) - f.bias() - int(f.FracBits)}
+	}
+}
+
+// nanFlags returns the flags raised by propagating a NaN operand.
+func nanFlags(vs ...floatValue) uint64 {
+	for _, v := range vs {
+		if v.kind == kindSNaN {
+			return FFLAGS_NV
+		}
+	}
+	return 0
+}
+
+// roundShift shifts mant right by shift bits, rounding the discarded bits per
+// rm. sticky reports that the true value has nonzero bits below mant.
+func roundShift(mant *big.Int, shift int, sticky, sign bool, rm RoundingMode) (*big.Int, bool) {
+	q := new(big.Int)
+	inexact := sticky
+	// Comparison of the discarded part with half an ulp.
+	half := -1
+	if shift <= 0 {
+		q.Lsh(mant, uint(-shift))
+	} else {
+		q.Rsh(mant, uint(shift))
+		rem := new(big.Int).Sub(mant, new(big.Int).Lsh(q, uint(shift)))
+		if rem.Sign() != 0 {
+			inexact = true
+		}
+		half = rem.Cmp(new(big.Int).Lsh(big.NewInt(1), uint(shift-1)))
+		if half == 0 && sticky {
+			half = 1
+		}
+	}
+	var up bool
+	switch rm {
+	case RoundNearestEven:
+		up = half > 0 || (half == 0 && q.Bit(0) == 1)
+	case RoundNearestMax:
+		up = half >= 0
+	case RoundDown:
+		up = sign && inexact
+	case RoundUp:
+		up = !sign && inexact
+	}
+	if up {
+		q.Add(q, big.NewInt(1))
+	}
+	return q, inexact
+}
+
+func (f FloatFormat) overflow(sign bool, rm RoundingMode) (uint64, uint64) {
+	flags := uint64(FFLAGS_OF | FFLAGS_NX)
+	switch {
+	case rm == RoundNearestEven, rm == RoundNearestMax,
+		rm == RoundUp && !sign, rm == RoundDown && sign:
+		return f.inf(sign), flags
+	default:
+		return f.zero(sign) | (f.expMax()-1)<<f.FracBits | (1<<f.FracBits - 1), flags
+	}
+}
+
+// round packs sign * mant * 2^exp into the format. Tininess is detected after
+// rounding, as RISC-V requires.
+func (f FloatFormat) round(sign bool, mant *big.Int, exp int, sticky bool, rm RoundingMode) (uint64, uint64) {
+	if mant.Sign() == 0 {
+		return f.zero(sign), 0
+	}
+	frac := int(f.FracBits)
+	emin := 1 - f.bias()
+	e := exp + mant.BitLen() - 1
+	if e > f.bias() {
+		return f.overflow(sign, rm)
+	}
+	lsb := e
+	if lsb < emin {
+		lsb = emin
+	}
+	q, inexact := roundShift(mant, lsb-frac-exp, sticky, sign, rm)
+	var flags uint64
+	if inexact {
+		flags |= FFLAGS_NX
+		if e < emin {
+			tiny := true
+			if e == emin-1 {
+				full, _ := roundShift(mant, e-frac-exp, sticky, sign, rm)
+				tiny = full.BitLen() <= frac+1
+			}
+			if tiny {
+				flags |= FFLAGS_UF
+			}
+		}
+	}
+	bits := q.Uint64()
+	if e >= emin {
+		// q carries the implicit bit, which lands in the exponent field.
+		bits += uint64(e+f.bias()-1) << f.FracBits
+	}
+	if bits >= f.expMax()<<f.FracBits {
+		return f.overflow(sign, rm)
+	}
+	return f.zero(sign) | bits, flags
+}
+
+func (f FloatFormat) add(x, y floatValue, rm RoundingMode) (uint64, uint64) {
+	if x.isNaN() || y.isNaN() {
+		return f.CanonicalNaN(), nanFlags(x, y)
+	}
+	if x.kind == kindInf && y.kind == kindInf && x.sign != y.sign {
+		return f.CanonicalNaN(), FFLAGS_NV
+	}
+	if x.kind == kindInf {
+		return f.inf(x.sign), 0
+	}
+	if y.kind == kindInf {
+		return f.inf(y.sign), 0
+	}
+	if x.kind == kindZero && y.kind == kindZero {
+		if x.sign == y.sign {
+			return f.zero(x.sign), 0
+		}
+		return f.zero(rm == RoundDown), 0
+	}
+	if x.kind == kindZero {
+		return f.round(y.sign, y.mant, y.exp, false, rm)
+	}
+	if y.kind == kindZero {
+		return f.round(x.sign, x.mant, x.exp, false, rm)
+	}
+	exp := x.exp
+	if y.exp < exp {
+		exp = y.exp
+	}
+	a := new(big.Int).Lsh(x.mant, uint(x.exp-exp))
+	b := new(big.Int).Lsh(y.mant, uint(y.exp-exp))
+	if x.sign {
+		a.Neg(a)
+	}
+	if y.sign {
+		b.Neg(b)
+	}
+	sum := a.Add(a, b)
+	if sum.Sign() == 0 {
+		return f.zero(rm == RoundDown), 0
+	}
+	return f.round(sum.Sign() < 0, sum.Abs(sum), exp, false, rm)
+}
+
+func (f FloatFormat) Add(a, b uint64, rm RoundingMode) (uint64, uint64) {
+	return f.add(f.unpack(a), f.unpack(b), rm)
+}
+
+func (f FloatFormat) Sub(a, b uint64, rm RoundingMode) (uint64, uint64) {
+	y := f.unpack(b)
+	y.sign = !y.sign
+	return f.add(f.unpack(a), y, rm)
+}
+
+func (f FloatFormat) Mul(a, b uint64, rm RoundingMode) (uint64, uint64) {
+	x, y := f.unpack(a), f.unpack(b)
+	sign := x.sign != y.sign
+	switch {
+	case x.isNaN() || y.isNaN():
+		return f.CanonicalNaN(), nanFlags(x, y)
+	case x.kind == kindInf && y.kind == kindZero, x.kind == kindZero && y.kind == kindInf:
+		return f.CanonicalNaN(), FFLAGS_NV
+	case x.kind == kindInf || y.kind == kindInf:
+		return f.inf(sign), 0
+	case x.kind == kindZero || y.kind == kindZero:
+		return f.zero(sign), 0
+	}
+	return f.round(sign, new(big.Int).Mul(x.mant, y.mant), x.exp+y.exp, false, rm)
+}
+
+// MulAdd computes (a * b) + c with a single rounding. negProduct and negAddend
+// negate the product and the addend, giving fmsub, fnmsub and fnmadd.
+func (f FloatFormat) MulAdd(a, b, c uint64, negProduct, negAddend bool, rm RoundingMode) (uint64, uint64) {
+	x, y, z := f.unpack(a), f.unpack(b), f.unpack(c)
+	if (x.kind == kindInf && y.kind == kindZero) || (x.kind == kindZero && y.kind == kindInf) {
+		return f.CanonicalNaN(), FFLAGS_NV
+	}
+	if x.isNaN() || y.isNaN() || z.isNaN() {
+		return f.CanonicalNaN(), nanFlags(x, y, z)
+	}
+	z.sign = z.sign != negAddend
+	product := floatValue{sign: (x.sign != y.sign) != negProduct}
+	switch {
+	case x.kind == kindInf || y.kind == kindInf:
+		product.kind = kindInf
+	case x.kind == kindZero || y.kind == kindZero:
+		product.kind = kindZero
+		product.mant = new(big.Int)
+	default:
+		product.kind = kindFinite
+		product.mant = new(big.Int).Mul(x.mant, y.mant)
+		product.exp = x.exp + y.exp
+	}
+	return f.add(product, z, rm)
+}
+
+func (f FloatFormat) Div(a, b uint64, rm RoundingMode) (uint64, uint64) {
+	x, y := f.unpack(a), f.unpack(b)
+	sign := x.sign != y.sign
+	switch {
+	case x.isNaN() || y.isNaN():
+		return f.CanonicalNaN(), nanFlags(x, y)
+	case x.kind == kindInf && y.kind == kindInf, x.kind == kindZero && y.kind == kindZero:
+		return f.CanonicalNaN(), FFLAGS_NV
+	case x.kind == kindInf:
+		return f.inf(sign), 0
+	case y.kind == kindZero:
+		return f.inf(sign), FFLAGS_DZ
+	case x.kind == kindZero || y.kind == kindInf:
+		return f.zero(sign), 0
+	}
+	// Scale the dividend so the quotient keeps a few bits beyond the
+	// significand; the remainder becomes the sticky bit.
+	shift := int(f.FracBits) + 3 + y.mant.BitLen() - x.mant.BitLen()
+	if shift < 0 {
+		shift = 0
+	}
+	q, r := new(big.Int).QuoRem(new(big.Int).Lsh(x.mant, uint(shift)), y.mant, new(big.Int))
+	return f.round(sign, q, x.exp-y.exp-shift, r.Sign() != 0, rm)
+}
+
+func (f FloatFormat) Sqrt(a uint64, rm RoundingMode) (uint64, uint64) {
+	x := f.unpack(a)
+	switch {
+	case x.isNaN():
+		return f.CanonicalNaN(), nanFlags(x)
+	case x.kind == kindZero:
+		return f.zero(x.sign), 0
+	case x.sign:
+		return f.CanonicalNaN(), FFLAGS_NV
+	case x.kind == kindInf:
+		return f.inf(false), 0
+	}
+	shift := 2*(int(f.FracBits)+3) - x.mant.BitLen()
+	if shift < 0 {
+		shift = 0
+	}
+	if (x.exp-shift)%2 != 0 {
+		shift++
+	}
+	m := new(big.Int).Lsh(x.mant, uint(shift))
+	q := new(big.Int).Sqrt(m)
+	sticky := new(big.Int).Mul(q, q).Cmp(m) != 0
+	return f.round(false, q, (x.exp-shift)/2, sticky, rm)
+}
+
+// orderKey maps a non-NaN value onto an integer with the same ordering,
+// where -0 and +0 compare equal.
+func (f FloatFormat) orderKey(bits uint64) int64 {
+	magnitude := int64(bits & (f.signBit() - 1))
+	if bits&f.signBit() != 0 {
+		return -magnitude
+	}
+	return magnitude
+}
+
+// Eq is a quiet comparison: only signaling NaNs raise the invalid flag.
+func (f FloatFormat) Eq(a, b uint64) (bool, uint64) {
+	x, y := f.unpack(a), f.unpack(b)
+	if x.isNaN() || y.isNaN() {
+		return false, nanFlags(x, y)
+	}
+	return f.orderKey(a) == f.orderKey(b), 0
+}
+
+// Lt is a signaling comparison: any NaN raises the invalid flag.
+func (f FloatFormat) Lt(a, b uint64) (bool, uint64) {
+	if f.unpack(a).isNaN() || f.unpack(b).isNaN() {
+		return false, FFLAGS_NV
+	}
+	return f.orderKey(a) < f.orderKey(b), 0
+}
+
+// Le is a signaling comparison: any NaN raises the invalid flag.
+func (f FloatFormat) Le(a, b uint64) (bool, uint64) {
+	if f.unpack(a).isNaN() || f.unpack(b).isNaN() {
+		return false, FFLAGS_NV
+	}
+	return f.orderKey(a) <= f.orderKey(b), 0
+}
+
+// LtQuiet is Lt as a quiet comparison, for fltq.
+func (f FloatFormat) LtQuiet(a, b uint64) (bool, uint64) {
+	x, y := f.unpack(a), f.unpack(b)
+	if x.isNaN() || y.isNaN() {
+		return false, nanFlags(x, y)
+	}
+	return f.orderKey(a) < f.orderKey(b), 0
+}
+
+// LeQuiet is Le as a quiet comparison, for fleq.
+func (f FloatFormat) LeQuiet(a, b uint64) (bool, uint64) {
+	x, y := f.unpack(a), f.unpack(b)
+	if x.isNaN() || y.isNaN() {
+		return false, nanFlags(x, y)
+	}
+	return f.orderKey(a) <= f.orderKey(b), 0
+}
+
+// Min follows IEEE 754-2019 minimumNumber: a single NaN operand is ignored and
+// -0 is less than +0.
+func (f FloatFormat) Min(a, b uint64) (uint64, uint64) {
+	return f.minMax(a, b, false)
+}
+
+// Max follows IEEE 754-2019 maximumNumber.
+func (f FloatFormat) Max(a, b uint64) (uint64, uint64) {
+	return f.minMax(a, b, true)
+}
+
+// Minimum follows IEEE 754-2019 minimum: any NaN operand gives NaN.
+func (f FloatFormat) Minimum(a, b uint64) (uint64, uint64) {
+	if f.unpack(a).isNaN() || f.unpack(b).isNaN() {
+		return f.CanonicalNaN(), nanFlags(f.unpack(a), f.unpack(b))
+	}
+	return f.minMax(a, b, false)
+}
+
+// Maximum follows IEEE 754-2019 maximum.
+func (f FloatFormat) Maximum(a, b uint64) (uint64, uint64) {
+	if f.unpack(a).isNaN() || f.unpack(b).isNaN() {
+		return f.CanonicalNaN(), nanFlags(f.unpack(a), f.unpack(b))
+	}
+	return f.minMax(a, b, true)
+}
+
+func (f FloatFormat) minMax(a, b uint64, max bool) (uint64, uint64) {
+	x, y := f.unpack(a), f.unpack(b)
+	flags := nanFlags(x, y)
+	switch {
+	case x.isNaN() && y.isNaN():
+		return f.CanonicalNaN(), flags
+	case x.isNaN():
+		return b, flags
+	case y.isNaN():
+		return a, flags
+	}
+	ka, kb := f.orderKey(a), f.orderKey(b)
+	switch {
+	case ka == kb && max:
+		return a & b, 0
+	case ka == kb:
+		return a | b, 0
+	case (ka < kb) != max:
+		return a, 0
+	default:
+		return b, 0
+	}
+}
+
+// Classify returns the fclass bit mask.
+func (f FloatFormat) Classify(a uint64) uint64 {
+	x := f.unpack(a)
+	subnormal := (a>>f.FracBits)&f.expMax() == 0
+	var i uint
+	switch x.kind {
+	case kindInf:
+		i = 0
+	case kindFinite:
+		if subnormal {
+			i = 2
+		} else {
+			i = 1
+		}
+	case kindZero:
+		i = 3
+	case kindSNaN:
+		return 1 << 8
+	case kindQNaN:
+		return 1 << 9
+	}
+	if x.sign {
+		return 1 << i
+	}
+	return 1 << (7 - i)
+}
+
+// ToInt converts to a width-bit integer. Out-of-range inputs and NaNs raise
+// the invalid flag and saturate. 32-bit results are sign-extended.
+func (f FloatFormat) ToInt(a uint64, width uint, signed bool, rm RoundingMode) (uint64, uint64) {
+	min, max := new(big.Int), new(big.Int).Lsh(big.NewInt(1), width)
+	if signed {
+		max.Rsh(max, 1)
+		min.Neg(max)
+	}
+	max.Sub(max, big.NewInt(1))
+	clip := func(v *big.Int) uint64 {
+		if width == 32 {
+			return uint64(int64(int32(v.Int64())))
+		}
+		if v.Sign() < 0 {
+			return uint64(v.Int64())
+		}
+		return v.Uint64()
+	}
+	x := f.unpack(a)
+	switch x.kind {
+	case kindQNaN, kindSNaN:
+		return clip(max), FFLAGS_NV
+	case kindInf:
+		if x.sign {
+			return clip(min), FFLAGS_NV
+		}
+		return clip(max), FFLAGS_NV
+	case kindZero:
+		return 0, 0
+	}
+	q, inexact := roundShift(x.mant, -x.exp, false, x.sign, rm)
+	if x.sign {
+		q.Neg(q)
+	}
+	if q.Cmp(min) < 0 {
+		return clip(min), FFLAGS_NV
+	}
+	if q.Cmp(max) > 0 {
+		return clip(max), FFLAGS_NV
+	}
+	if inexact {
+		return clip(q), FFLAGS_NX
+	}
+	return clip(q), 0
+}
+
+// ToInt32Modular converts toward zero to a 32-bit integer, keeping the low 32
+// bits of out-of-range results as fcvtmod.w.d does. Those, and infinities and
+// NaNs, which give 0, raise the invalid flag instead of inexact.
+func (f FloatFormat) ToInt32Modular(a uint64) (uint64, uint64) {
+	x := f.unpack(a)
+	switch x.kind {
+	case kindQNaN, kindSNaN, kindInf:
+		return 0, FFLAGS_NV
+	case kindZero:
+		return 0, 0
+	}
+	q, inexact := roundShift(x.mant, -x.exp, false, x.sign, RoundTowardZero)
+	if x.sign {
+		q.Neg(q)
+	}
+	var flags uint64
+	if q.Cmp(big.NewInt(math.MinInt32)) < 0 || q.Cmp(big.NewInt(math.MaxInt32)) > 0 {
+		flags = FFLAGS_NV
+	} else if inexact {
+		flags = FFLAGS_NX
+	}
+	low := new(big.Int).And(q, big.NewInt(0xffffffff)).Uint64()
+	return uint64(int64(int32(uint32(low)))), flags
+}
+
+// RoundToInt rounds to an integral value in the same format. Only signaling
+// NaNs raise the invalid flag, and inexact is raised only when exact is set,
+// as for froundnx.
+func (f FloatFormat) RoundToInt(a uint64, rm RoundingMode, exact bool) (uint64, uint64) {
+	x := f.unpack(a)
+	switch x.kind {
+	case kindQNaN, kindSNaN:
+		return f.CanonicalNaN(), nanFlags(x)
+	case kindInf, kindZero:
+		return a, 0
+	}
+	if x.exp >= 0 {
+		return a, 0
+	}
+	q, inexact := roundShift(x.mant, -x.exp, false, x.sign, rm)
+	var flags uint64
+	if inexact && exact {
+		flags = FFLAGS_NX
+	}
+	if q.Sign() == 0 {
+		return f.zero(x.sign), flags
+	}
+	result, _ := f.round(x.sign, q, 0, false, rm)
+	return result, flags
+}
+
+// fliConstants holds the values loaded by fli as mant * 2^exp. Entry 1, the
+// smallest normal number, and entries 30 and 31, infinity and NaN, depend on
+// the format.
+var fliConstants = [32]struct {
+	mant int64
+	exp  int
+}{
+	{-1, 0}, {}, {1, -16}, {1, -15}, {1, -8}, {1, -7}, {1, -4}, {1, -3},
+	{1, -2}, {5, -4}, {3, -3}, {7, -4}, {1, -1}, {5, -3}, {3, -2}, {7, -3},
+	{1, 0}, {5, -2}, {3, -1}, {7, -2}, {1, 1}, {5, -1}, {3, 0}, {1, 2},
+	{1, 3}, {1, 4}, {1, 7}, {1, 8}, {1, 15}, {1, 16}, {}, {},
+}
+
+// FLI returns constant i of the fli table. Constants out of range of a
+// narrow format round to nearest, so 2^16 is infinity for half precision.
+func (f FloatFormat) FLI(i uint64) uint64 {
+	switch i {
+	case 1:
+		return 1 << f.FracBits
+	case 30:
+		return f.inf(false)
+	case 31:
+		return f.CanonicalNaN()
+	}
+	c := fliConstants[i]
+	result, _ := f.round(c.mant < 0, new(big.Int).SetUint64(abs64(c.mant)), c.exp, false, RoundNearestEven)
+	return result
+}
+
+// FromInt converts the integer with the given sign and magnitude.
+func (f FloatFormat) FromInt(negative bool, magnitude uint64, rm RoundingMode) (uint64, uint64) {
+	return f.round(negative, new(big.Int).SetUint64(magnitude), 0, false, rm)
+}
+
+// ConvertFloat converts a value between floating-point formats.
+func ConvertFloat(from, to FloatFormat, a uint64, rm RoundingMode) (uint64, uint64) {
+	x := from.unpack(a)
+	switch x.kind {
+	case kindQNaN, kindSNaN:
+		return to.CanonicalNaN(), nanFlags(x)
+	case kindInf:
+		return to.inf(x.sign), 0
+	case kindZero:
+		return to.zero(x.sign), 0
+	}
+	return to.round(x.sign, x.mant, x.exp, false, rm)
+}
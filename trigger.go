@@ -0,0 +1,226 @@
+package main
+
+import "math/bits"
+
+// trigger is one trigger of the Sdtrig trigger module. The type in tdata1
+// bits 63:60 selects the layout of the rest of tdata1 and the meaning of
+// tdata2; tdata3 (textra) is read-only zero, as no context matching is
+// implemented.
+type trigger struct {
+	data1, data2 uint64
+	// pending is set when an itrigger or etrigger has matched a trap and
+	// fires before the next instruction.
+	pending bool
+}
+
+// triggerType returns the type field of tdata1.
+func triggerType(data1 uint64) uint64 {
+	return data1 >> 60
+}
+
+// loadTrigger reads tdata1, tdata2, tdata3 or tinfo of the selected trigger.
+func (c *CSR) loadTrigger(addr uint64) uint64 {
+	t := &c.triggers[c.csrs[TSELECT]]
+	switch addr {
+	case TDATA1:
+		return t.data1
+	case TDATA2:
+		return t.data2
+	case TINFO:
+		return TINFO_VERSION_1 | MASK_TINFO_INFO
+	}
+	return 0
+}
+
+// storeTdata1 writes tdata1 of the selected trigger. Type 0 and the types that
+// are not supported leave the trigger disabled, and unsupported mcontrol6
+// match types fall back to an exact match.
+func (c *CSR) storeTdata1(value uint64) {
+	t := &c.triggers[c.csrs[TSELECT]]
+	t.pending = false
+	var mask uint64
+	switch triggerType(value) {
+	case TRIGGER_MCONTROL6:
+		mask = MASK_MCONTROL6_WRITABLE
+		switch (value & MASK_MCONTROL6_MATCH) >> 7 {
+		case 0, 1, 2, 3, 4, 5, 8, 9, 12, 13:
+		default:
+			value &^= MASK_MCONTROL6_MATCH
+		}
+	case TRIGGER_ICOUNT:
+		mask = MASK_ICOUNT_WRITABLE
+	case TRIGGER_ITRIGGER, TRIGGER_ETRIGGER:
+		mask = MASK_XTRIGGER_WRITABLE
+	default:
+		t.data1 = TRIGGER_DISABLED << 60
+		return
+	}
+	t.data1 = triggerType(value)<<60 | value&mask
+}
+
+// triggerSelects reports whether a trigger's mode bits m, s, u, vs and vu,
+// whose positions differ between types, select mode.
+func triggerSelects(data1, m, s, u, vs, vu uint64, mode Mode, virt bool) bool {
+	switch {
+	case mode == Machine:
+		return data1&m != 0
+	case virt && mode == Supervisor:
+		return data1&vs != 0
+	case virt:
+		return data1&vu != 0
+	case mode == Supervisor:
+		return data1&s != 0
+	default:
+		return data1&u != 0
+	}
+}
+
+// triggersCanFire reports whether triggers may raise breakpoint exceptions in
+// the current mode. In M-mode that needs tcontrol.MTE, which traps into M-mode
+// clear so that a trigger cannot fire again inside the handler.
+func (cpu *Cpu) triggersCanFire() bool {
+	return cpu.Mode != Machine || cpu.Csr.Load(TCONTROL)&TCONTROL_MTE != 0
+}
+
+// triggerMatch applies an mcontrol6 match type to value and tdata2, compared
+// as xlen-bit numbers.
+func triggerMatch(match, value, tdata2, xlen uint64) bool {
+	if xlen == 32 {
+		value, tdata2 = uint64(uint32(value)), uint64(uint32(tdata2))
+	}
+	half := xlen / 2
+	lowMask := uint64(1)<<half - 1
+	var matched bool
+	switch match &^ 0b1000 {
+	case 0:
+		matched = value == tdata2
+	case 1:
+		// The bits up to the lowest zero bit of tdata2 are ignored.
+		z := uint64(bits.TrailingZeros64(^tdata2))
+		care := ^uint64(0)
+		if z+1 < 64 {
+			care <<= z + 1
+		} else {
+			care = 0
+		}
+		matched = value&care == tdata2&care
+	case 2:
+		matched = value >= tdata2
+	case 3:
+		matched = value < tdata2
+	case 4:
+		matched = value&lowMask&(tdata2>>half) == tdata2&lowMask
+	case 5:
+		matched = (value>>half)&(tdata2>>half) == tdata2&lowMask
+	}
+	// Match types 8, 9, 12 and 13 negate 0, 1, 4 and 5.
+	return matched != (match&0b1000 != 0)
+}
+
+// checkMcontrol6 evaluates the mcontrol6 triggers for an access of kind
+// (MCONTROL6_EXECUTE, MCONTROL6_LOAD and/or MCONTROL6_STORE) at addr, and
+// raises a breakpoint exception with addr in tval when a trigger, or every
+// trigger of a chain, matches. data is the instruction or the data accessed
+// when hasData is set; triggers matching on data never match without it.
+func (cpu *Cpu) checkMcontrol6(kind, addr, data uint64, hasData bool) *Exception {
+	if !cpu.triggersCanFire() {
+		return nil
+	}
+	xlen := cpu.XLEN()
+	start := 0
+	chained := true
+	for i := range cpu.Csr.triggers {
+		t := &cpu.Csr.triggers[i]
+		if triggerType(t.data1) != TRIGGER_MCONTROL6 {
+			start, chained = i+1, true
+			continue
+		}
+		matched := chained && t.data1&kind != 0 &&
+			triggerSelects(t.data1, MCONTROL6_M, MCONTROL6_S, MCONTROL6_U, MCONTROL6_VS, MCONTROL6_VU, cpu.Mode, cpu.Csr.V)
+		if matched {
+			value := addr
+			if t.data1&MCONTROL6_SELECT != 0 {
+				value = data
+				matched = hasData
+			}
+			matched = matched && triggerMatch((t.data1&MASK_MCONTROL6_MATCH)>>7, value, t.data2, xlen)
+		}
+		if t.data1&MCONTROL6_CHAIN != 0 && i+1 < len(cpu.Csr.triggers) {
+			chained = matched
+			continue
+		}
+		if matched {
+			for j := start; j <= i; j++ {
+				cpu.Csr.triggers[j].data1 |= MCONTROL6_HIT0
+			}
+			return NewException(Breakpoint, addr)
+		}
+		start, chained = i+1, true
+	}
+	return nil
+}
+
+// checkPendingTriggers fires icount triggers whose count has run out and
+// itrigger/etrigger triggers that matched the last trap, before the next
+// instruction executes.
+func (cpu *Cpu) checkPendingTriggers() *Exception {
+	if !cpu.triggersCanFire() {
+		return nil
+	}
+	for i := range cpu.Csr.triggers {
+		t := &cpu.Csr.triggers[i]
+		switch triggerType(t.data1) {
+		case TRIGGER_ICOUNT:
+			if t.data1&ICOUNT_PENDING != 0 &&
+				triggerSelects(t.data1, ICOUNT_M, ICOUNT_S, ICOUNT_U, ICOUNT_VS, ICOUNT_VU, cpu.Mode, cpu.Csr.V) {
+				t.data1 = t.data1&^ICOUNT_PENDING | ICOUNT_HIT
+				return NewException(Breakpoint, 0)
+			}
+		case TRIGGER_ITRIGGER, TRIGGER_ETRIGGER:
+			if t.pending {
+				t.pending = false
+				t.data1 |= XTRIGGER_HIT
+				return NewException(Breakpoint, 0)
+			}
+		}
+	}
+	return nil
+}
+
+// countInstruction decrements the icount triggers selecting the mode an
+// instruction completed in. A count reaching zero leaves the trigger pending.
+func (cpu *Cpu) countInstruction(mode Mode, virt bool) {
+	for i := range cpu.Csr.triggers {
+		t := &cpu.Csr.triggers[i]
+		if triggerType(t.data1) != TRIGGER_ICOUNT ||
+			!triggerSelects(t.data1, ICOUNT_M, ICOUNT_S, ICOUNT_U, ICOUNT_VS, ICOUNT_VU, mode, virt) {
+			continue
+		}
+		count := (t.data1 & MASK_ICOUNT_COUNT) >> 10
+		if count == 0 {
+			continue
+		}
+		t.data1 = t.data1&^MASK_ICOUNT_COUNT | (count-1)<<10
+		if count == 1 {
+			t.data1 |= ICOUNT_PENDING
+		}
+	}
+}
+
+// matchTrap marks the itrigger (for interrupts) or etrigger (for exceptions)
+// triggers whose tdata2 holds the cause of a trap taken from mode, so that
+// they fire before the first instruction of the handler.
+func (cpu *Cpu) matchTrap(cause uint64, mode Mode, virt bool) {
+	kind := uint64(TRIGGER_ETRIGGER)
+	if cause&MASK_INTERRUPT_BIT != 0 {
+		kind = TRIGGER_ITRIGGER
+	}
+	code := cause &^ MASK_INTERRUPT_BIT
+	for i := range cpu.Csr.triggers {
+		t := &cpu.Csr.triggers[i]
+		if triggerType(t.data1) == kind && code < 64 && (t.data2>>code)&1 != 0 &&
+			triggerSelects(t.data1, XTRIGGER_M, XTRIGGER_S, XTRIGGER_U, XTRIGGER_VS, XTRIGGER_VU, mode, virt) {
+			t.pending = true
+		}
+	}
+}
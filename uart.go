@@ -85,6 +85,12 @@ func (u *Uart) Store(addr, size, value uint64) *Exception {
 	}
 }
 
+// Pending reports whether a received byte has raised an interrupt that has not
+// been taken yet.
+func (u *Uart) Pending() bool {
+	return u.interrupt.Load()
+}
+
 func (u *Uart) IsInterrupting() bool {
 	return u.interrupt.Swap(false)
 }
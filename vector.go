@@ -0,0 +1,1415 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+)
+
+// OP-V funct3 operand categories.
+const (
+	OPIVV = 0b000
+	OPFVV = 0b001
+	OPMVV = 0b010
+	OPIVI = 0b011
+	OPIVX = 0b100
+	OPFVF = 0b101
+	OPMVX = 0b110
+	OPCFG = 0b111
+)
+
+// VType is a decoded vtype CSR.
+type VType struct {
+	Ill bool
+	// SEW is the selected element width in bits.
+	SEW uint64
+	// LMUL8 is the register group multiplier times 8, so the fractional
+	// multipliers 1/8, 1/4 and 1/2 are 1, 2 and 4.
+	LMUL8 uint64
+	TA    bool
+	MA    bool
+}
+
+func DecodeVType(vtype uint64) VType {
+	vlmul := vtype & 0b111
+	t := VType{
+		SEW: 8 << ((vtype >> 3) & 0b111),
+		TA:  (vtype>>6)&1 == 1,
+		MA:  (vtype>>7)&1 == 1,
+	}
+	if vlmul < 4 {
+		t.LMUL8 = 8 << vlmul
+	} else {
+		t.LMUL8 = 8 >> (8 - vlmul)
+	}
+	t.Ill = vtype>>8 != 0 || vlmul == 4 || t.SEW > ELEN || t.SEW*8 > ELEN*t.LMUL8
+	return t
+}
+
+// SetVLEN resizes the vector registers to vlen bits, clearing them.
+func (cpu *Cpu) SetVLEN(vlen uint64) error {
+	if vlen < ELEN || vlen > 65536 || vlen&(vlen-1) != 0 {
+		return fmt.Errorf("invalid VLEN %d: must be a power of two from %d to 65536", vlen, ELEN)
+	}
+	cpu.VLEN = vlen
+	cpu.VRegs = make([]byte, 32*vlen/8)
+	return nil
+}
+
+// VLMAX returns the number of elements a register group holds under t.
+func (cpu *Cpu) VLMAX(t VType) uint64 {
+	return cpu.VLEN * t.LMUL8 / (8 * t.SEW)
+}
+
+// VElement reads element i of the register group starting at v, with eew-bit
+// elements.
+func (cpu *Cpu) VElement(v, eew, i uint64) uint64 {
+	b := cpu.VRegs[v*cpu.VLEN/8+i*eew/8:]
+	switch eew {
+	case 8:
+		return uint64(b[0])
+	case 16:
+		return uint64(binary.LittleEndian.Uint16(b))
+	case 32:
+		return uint64(binary.LittleEndian.Uint32(b))
+	default:
+		return binary.LittleEndian.Uint64(b)
+	}
+}
+
+func (cpu *Cpu) SetVElement(v, eew, i, value uint64) {
+	b := cpu.VRegs[v*cpu.VLEN/8+i*eew/8:]
+	switch eew {
+	case 8:
+		b[0] = uint8(value)
+	case 16:
+		binary.LittleEndian.PutUint16(b, uint16(value))
+	case 32:
+		binary.LittleEndian.PutUint32(b, uint32(value))
+	default:
+		binary.LittleEndian.PutUint64(b, value)
+	}
+}
+
+// VMaskBit reads bit i of mask register v.
+func (cpu *Cpu) VMaskBit(v, i uint64) bool {
+	return (cpu.VRegs[v*cpu.VLEN/8+i/8]>>(i%8))&1 == 1
+}
+
+func (cpu *Cpu) SetVMaskBit(v, i uint64, set bool) {
+	b := &cpu.VRegs[v*cpu.VLEN/8+i/8]
+	if set {
+		*b |= 1 << (i % 8)
+	} else {
+		*b &= ^uint8(1 << (i % 8))
+	}
+}
+
+// vectorType returns the current vtype, or an illegal-instruction exception
+// if it is vill.
+func (cpu *Cpu) vectorType(inst uint64) (VType, *Exception) {
+	t := DecodeVType(cpu.Csr.Load(VTYPE))
+	if t.Ill {
+		return t, NewException(IllegalInstruction, inst)
+	}
+	return t, nil
+}
+
+// elementMask covers the low sew bits.
+func elementMask(sew uint64) uint64 {
+	if sew == 64 {
+		return ^uint64(0)
+	}
+	return 1<<sew - 1
+}
+
+// groupRegs returns the number of registers in a group with multiplier emul8/8.
+func groupRegs(emul8 uint64) uint64 {
+	if emul8 < 8 {
+		return 1
+	}
+	return emul8 / 8
+}
+
+// groupOK reports whether v can start a register group with multiplier
+// emul8/8.
+func groupOK(v, emul8 uint64) bool {
+	if emul8 == 0 || emul8 > 64 {
+		return false
+	}
+	return v%groupRegs(emul8) == 0
+}
+
+func groupsOverlap(a, emulA8, b, emulB8 uint64) bool {
+	return a < b+groupRegs(emulB8) && b < a+groupRegs(emulA8)
+}
+
+// widenOverlapOK reports whether a destination group may be written from a
+// narrower source group: they must be disjoint, or the source must fill the
+// highest-numbered part of the destination and have a multiplier of at least 1.
+func widenOverlapOK(vd, demul8, vs, semul8 uint64) bool {
+	if !groupsOverlap(vd, demul8, vs, semul8) {
+		return true
+	}
+	return semul8 >= 8 && vs+groupRegs(semul8) == vd+groupRegs(demul8)
+}
+
+// narrowOverlapOK reports whether a destination group may be written from a
+// wider source group: they must be disjoint, or the destination must be the
+// lowest-numbered part of the source.
+func narrowOverlapOK(vd, demul8, vs, semul8 uint64) bool {
+	return vd == vs || !groupsOverlap(vd, demul8, vs, semul8)
+}
+
+// roundingIncrement returns the value added after shifting v right by d bits
+// under the fixed-point rounding mode vxrm.
+func roundingIncrement(v, d, vxrm uint64) uint64 {
+	if d == 0 {
+		return 0
+	}
+	bit := func(n uint64) uint64 {
+		return (v >> n) & 1
+	}
+	switch vxrm {
+	case VXRM_RNU:
+		return bit(d - 1)
+	case VXRM_RNE:
+		if bit(d-1) == 1 && (v&(1<<(d-1)-1) != 0 || bit(d) == 1) {
+			return 1
+		}
+	case VXRM_ROD:
+		if bit(d) == 0 && v&(1<<d-1) != 0 {
+			return 1
+		}
+	}
+	return 0
+}
+
+// averagingIncrement returns the rounding increment for halving a sum whose
+// low bit is lsb and whose halved value is half.
+func averagingIncrement(half, lsb, vxrm uint64) uint64 {
+	return roundingIncrement((half&1)<<1|lsb&1, 1, vxrm)
+}
+
+// ExecuteVector executes the OP-V major opcode: vset{i}vl{i} and the vector
+// integer, fixed-point, mask, permutation and floating-point instructions.
+func (cpu *Cpu) ExecuteVector(inst uint64) (uint64, *Exception) {
+	funct3 := (inst >> 12) & 0x7
+	if !cpu.Csr.VSEnabled() {
+		return 0, NewException(IllegalInstruction, inst)
+	}
+	var exception *Exception
+	switch funct3 {
+	case OPCFG:
+		return cpu.executeVectorConfig(inst)
+	case OPIVV, OPIVX, OPIVI:
+		exception = cpu.executeVectorOPI(inst)
+	case OPMVV, OPMVX:
+		exception = cpu.executeVectorOPM(inst)
+	case OPFVV, OPFVF:
+		exception = cpu.executeVectorOPF(inst)
+	}
+	if exception != nil {
+		return 0, exception
+	}
+	cpu.Csr.Store(VSTART, 0)
+	return cpu.UpdatePC()
+}
+
+func (cpu *Cpu) executeVectorConfig(inst uint64) (uint64, *Exception) {
+	rd := (inst >> 7) & 0x1f
+	rs1 := (inst >> 15) & 0x1f
+	rs2 := (inst >> 20) & 0x1f
+	var vtype, avl uint64
+	switch {
+	case inst>>31 == 0:
+		// vsetvli
+		vtype = (inst >> 20) & 0x7ff
+	case (inst>>30)&1 == 1:
+		// vsetivli
+		vtype = (inst >> 20) & 0x3ff
+		avl = rs1
+	case (inst>>25)&0x3f == 0:
+		// vsetvl
+		vtype = cpu.Regs[rs2]
+	default:
+		return 0, NewException(IllegalInstruction, inst)
+	}
+	if (inst>>30)&0b11 != 0b11 {
+		switch {
+		case rs1 != 0:
+			avl = cpu.Regs[rs1]
+		case rd != 0:
+			avl = ^uint64(0)
+		default:
+			// Keep the current vl.
+			avl = cpu.Csr.Load(VL)
+		}
+	}
+	t := DecodeVType(vtype)
+	if t.Ill {
+		cpu.Csr.SetVectorConfig(0, VTYPE_VILL)
+		cpu.Regs[rd] = 0
+		return cpu.UpdatePC()
+	}
+	vl := avl
+	if vlmax := cpu.VLMAX(t); vl > vlmax {
+		vl = vlmax
+	}
+	cpu.Csr.SetVectorConfig(vl, vtype)
+	cpu.Regs[rd] = vl
+	return cpu.UpdatePC()
+}
+
+// vectorMemEEW decodes the width field of a vector load or store.
+func vectorMemEEW(width uint64) uint64 {
+	switch width {
+	case 0b000:
+		return 8
+	case 0b101:
+		return 16
+	case 0b110:
+		return 32
+	default:
+		return 64
+	}
+}
+
+// vectorAccess moves element i of the register group at v to or from memory
+// at addr.
+func (cpu *Cpu) vectorAccess(store bool, addr, v, eew, i uint64) *Exception {
+	if store {
+		return cpu.Store(addr, eew, cpu.VElement(v, eew, i))
+	}
+	value, exception := cpu.Load(addr, eew)
+	if exception != nil {
+		return exception
+	}
+	cpu.SetVElement(v, eew, i, value)
+	return nil
+}
+
+// ExecuteVectorMemory executes the vector loads and stores, which share the
+// LOAD-FP and STORE-FP opcodes with the scalar floating-point ones. A fault
+// leaves vstart at the faulting element so the access can be resumed.
+func (cpu *Cpu) ExecuteVectorMemory(inst uint64) (uint64, *Exception) {
+	store := inst&0x7f == 0x27
+	vd := (inst >> 7) & 0x1f
+	rs1 := (inst >> 15) & 0x1f
+	rs2 := (inst >> 20) & 0x1f
+	vm := (inst>>25)&1 == 1
+	mop := (inst >> 26) & 0b11
+	mew := (inst >> 28) & 1
+	nf := (inst>>29)&0b111 + 1
+	eew := vectorMemEEW((inst >> 12) & 0x7)
+
+	if !cpu.Csr.VSEnabled() || mew != 0 {
+		return 0, NewException(IllegalInstruction, inst)
+	}
+	base := cpu.Regs[rs1]
+	vstart := cpu.Csr.Load(VSTART)
+
+	if mop == 0b00 && rs2 == 0b01000 {
+		// vl<nf>re<eew>.v, vs<nf>r.v
+		if nf&(nf-1) != 0 || vd%nf != 0 || !vm || (store && eew != 8) {
+			return 0, NewException(IllegalInstruction, inst)
+		}
+		for i := vstart; i < nf*cpu.VLEN/eew; i++ {
+			if exception := cpu.vectorAccess(store, base+i*eew/8, vd, eew, i); exception != nil {
+				cpu.Csr.Store(VSTART, i)
+				return 0, exception
+			}
+		}
+		cpu.Csr.Store(VSTART, 0)
+		return cpu.UpdatePC()
+	}
+
+	t, exception := cpu.vectorType(inst)
+	if exception != nil {
+		return 0, exception
+	}
+	vl := cpu.Csr.Load(VL)
+
+	if mop == 0b00 && rs2 == 0b01011 {
+		// vlm.v, vsm.v
+		if eew != 8 || nf != 1 || !vm {
+			return 0, NewException(IllegalInstruction, inst)
+		}
+		for i := vstart; i < (vl+7)/8; i++ {
+			if exception := cpu.vectorAccess(store, base+i, vd, 8, i); exception != nil {
+				cpu.Csr.Store(VSTART, i)
+				return 0, exception
+			}
+		}
+		cpu.Csr.Store(VSTART, 0)
+		return cpu.UpdatePC()
+	}
+
+	// Indexed accesses use eew for the index and SEW for the data.
+	indexed := mop&1 == 1
+	dataEEW, emul8 := eew, eew*t.LMUL8/t.SEW
+	if indexed {
+		dataEEW, emul8 = t.SEW, t.LMUL8
+	}
+	regs := groupRegs(emul8)
+	if !groupOK(vd, emul8) || nf*regs > 8 || vd+nf*regs > 32 || (!vm && vd == 0 && !store) {
+		return 0, NewException(IllegalInstruction, inst)
+	}
+	if indexed && !groupOK(rs2, eew*t.LMUL8/t.SEW) {
+		return 0, NewException(IllegalInstruction, inst)
+	}
+	faultOnlyFirst := false
+	if mop == 0b00 {
+		switch {
+		case rs2 == 0b00000:
+			// vle<eew>.v, vse<eew>.v, vlseg<nf>e<eew>.v, vsseg<nf>e<eew>.v
+		case rs2 == 0b10000 && !store:
+			// vle<eew>ff.v, vlseg<nf>e<eew>ff.v
+			faultOnlyFirst = true
+		default:
+			return 0, NewException(IllegalInstruction, inst)
+		}
+	}
+
+	for i := vstart; i < vl; i++ {
+		if !vm && !cpu.VMaskBit(0, i) {
+			continue
+		}
+		for f := uint64(0); f < nf; f++ {
+			var addr uint64
+			switch mop {
+			case 0b00:
+				addr = base + (i*nf+f)*dataEEW/8
+			case 0b10:
+				// vlse<eew>.v, vsse<eew>.v
+				addr = base + i*cpu.Regs[rs2] + f*dataEEW/8
+			default:
+				// vluxei<eew>.v, vloxei<eew>.v, vsuxei<eew>.v, vsoxei<eew>.v
+				addr = base + cpu.VElement(rs2, eew, i) + f*dataEEW/8
+			}
+			if exception := cpu.vectorAccess(store, addr, vd+f*regs, dataEEW, i); exception != nil {
+				if faultOnlyFirst && i > 0 {
+					// Trim vl to the elements loaded instead of trapping.
+					cpu.Csr.SetVectorConfig(i, cpu.Csr.Load(VTYPE))
+					return cpu.UpdatePC()
+				}
+				cpu.Csr.Store(VSTART, i)
+				return 0, exception
+			}
+		}
+	}
+	cpu.Csr.Store(VSTART, 0)
+	return cpu.UpdatePC()
+}
+
+// Operand forms accepted by an OP-V funct6.
+const (
+	formVV = 1 << 0
+	formVX = 1 << 1
+	formVI = 1 << 2
+	formVF = formVX
+)
+
+// vectorForm maps an OP-V funct3 to its operand form.
+func vectorForm(funct3 uint64) uint8 {
+	switch funct3 {
+	case OPIVV, OPMVV, OPFVV:
+		return formVV
+	case OPIVI:
+		return formVI
+	default:
+		return formVX
+	}
+}
+
+var opiForms = map[uint64]uint8{
+	0x00: formVV | formVX | formVI, 0x02: formVV | formVX, 0x03: formVX | formVI,
+	0x04: formVV | formVX, 0x05: formVV | formVX, 0x06: formVV | formVX, 0x07: formVV | formVX,
+	0x09: formVV | formVX | formVI, 0x0a: formVV | formVX | formVI, 0x0b: formVV | formVX | formVI,
+	0x0c: formVV | formVX | formVI, 0x0e: formVV | formVX | formVI, 0x0f: formVX | formVI,
+	0x10: formVV | formVX | formVI, 0x11: formVV | formVX | formVI, 0x12: formVV | formVX, 0x13: formVV | formVX,
+	0x17: formVV | formVX | formVI,
+	0x18: formVV | formVX | formVI, 0x19: formVV | formVX | formVI, 0x1a: formVV | formVX, 0x1b: formVV | formVX,
+	0x1c: formVV | formVX | formVI, 0x1d: formVV | formVX | formVI, 0x1e: formVX | formVI, 0x1f: formVX | formVI,
+	0x20: formVV | formVX | formVI, 0x21: formVV | formVX | formVI, 0x22: formVV | formVX, 0x23: formVV | formVX,
+	0x25: formVV | formVX | formVI, 0x27: formVV | formVX,
+	0x28: formVV | formVX | formVI, 0x29: formVV | formVX | formVI, 0x2a: formVV | formVX | formVI, 0x2b: formVV | formVX | formVI,
+	0x2c: formVV | formVX | formVI, 0x2d: formVV | formVX | formVI, 0x2e: formVV | formVX | formVI, 0x2f: formVV | formVX | formVI,
+	0x30: formVV, 0x31: formVV,
+}
+
+// opiUnsignedImm reports whether the .vi form of funct6 takes a zero-extended
+// immediate: shift amounts, slide offsets and gather indices.
+func opiUnsignedImm(funct6 uint64) bool {
+	switch funct6 {
+	case 0x0c, 0x0e, 0x0f, 0x25, 0x28, 0x29, 0x2a, 0x2b, 0x2c, 0x2d, 0x2e, 0x2f:
+		return true
+	default:
+		return false
+	}
+}
+
+// vectorIntOp returns the element operation of a single-width integer
+// instruction, where a is the vs2 element and b the vs1/rs1/imm operand.
+func (cpu *Cpu) vectorIntOp(funct6, sew uint64) func(a, b uint64) uint64 {
+	mask := elementMask(sew)
+	minS := uint64(1) << (sew - 1)
+	maxS := minS - 1
+	vxrm := cpu.Csr.Load(VXRM)
+	sx := func(v uint64) int64 {
+		return int64(signExtend(v, sew))
+	}
+	saturate := func(v uint64) uint64 {
+		cpu.Csr.Store(VXSAT, 1)
+		return v
+	}
+	switch funct6 {
+	case 0x00:
+		// vadd
+		return func(a, b uint64) uint64 { return a + b }
+	case 0x02:
+		// vsub
+		return func(a, b uint64) uint64 { return a - b }
+	case 0x03:
+		// vrsub
+		return func(a, b uint64) uint64 { return b - a }
+	case 0x04:
+		// vminu
+		return func(a, b uint64) uint64 {
+			if a < b {
+				return a
+			}
+			return b
+		}
+	case 0x05:
+		// vmin
+		return func(a, b uint64) uint64 {
+			if sx(a) < sx(b) {
+				return a
+			}
+			return b
+		}
+	case 0x06:
+		// vmaxu
+		return func(a, b uint64) uint64 {
+			if a > b {
+				return a
+			}
+			return b
+		}
+	case 0x07:
+		// vmax
+		return func(a, b uint64) uint64 {
+			if sx(a) > sx(b) {
+				return a
+			}
+			return b
+		}
+	case 0x09:
+		// vand
+		return func(a, b uint64) uint64 { return a & b }
+	case 0x0a:
+		// vor
+		return func(a, b uint64) uint64 { return a | b }
+	case 0x0b:
+		// vxor
+		return func(a, b uint64) uint64 { return a ^ b }
+	case 0x20:
+		// vsaddu
+		return func(a, b uint64) uint64 {
+			r := (a + b) & mask
+			if r < a {
+				return saturate(mask)
+			}
+			return r
+		}
+	case 0x21:
+		// vsadd
+		return func(a, b uint64) uint64 {
+			r := (a + b) & mask
+			if (a^r)&(b^r)&minS != 0 {
+				if a&minS != 0 {
+					return saturate(minS)
+				}
+				return saturate(maxS)
+			}
+			return r
+		}
+	case 0x22:
+		// vssubu
+		return func(a, b uint64) uint64 {
+			if a < b {
+				return saturate(0)
+			}
+			return a - b
+		}
+	case 0x23:
+		// vssub
+		return func(a, b uint64) uint64 {
+			r := (a - b) & mask
+			if (a^b)&(a^r)&minS != 0 {
+				if a&minS != 0 {
+					return saturate(minS)
+				}
+				return saturate(maxS)
+			}
+			return r
+		}
+	case 0x25:
+		// vsll
+		return func(a, b uint64) uint64 { return a << (b & (sew - 1)) }
+	case 0x27:
+		// vsmul
+		return func(a, b uint64) uint64 {
+			if a == minS && b == minS {
+				return saturate(maxS)
+			}
+			if sew == 64 {
+				lo := a * b
+				return (mulh(a, b)<<1 | lo>>63) + roundingIncrement(lo, 63, vxrm)
+			}
+			p := uint64(sx(a) * sx(b))
+			return uint64(int64(p)>>(sew-1)) + roundingIncrement(p, sew-1, vxrm)
+		}
+	case 0x28:
+		// vsrl
+		return func(a, b uint64) uint64 { return a >> (b & (sew - 1)) }
+	case 0x29:
+		// vsra
+		return func(a, b uint64) uint64 { return uint64(sx(a) >> (b & (sew - 1))) }
+	case 0x2a:
+		// vssrl
+		return func(a, b uint64) uint64 {
+			shamt := b & (sew - 1)
+			return a>>shamt + roundingIncrement(a, shamt, vxrm)
+		}
+	case 0x2b:
+		// vssra
+		return func(a, b uint64) uint64 {
+			shamt := b & (sew - 1)
+			return uint64(sx(a)>>shamt) + roundingIncrement(a, shamt, vxrm)
+		}
+	}
+	return nil
+}
+
+// executeVectorOPI executes the OPIVV, OPIVX and OPIVI instructions.
+func (cpu *Cpu) executeVectorOPI(inst uint64) *Exception {
+	funct3 := (inst >> 12) & 0x7
+	funct6 := inst >> 26
+	vd := (inst >> 7) & 0x1f
+	vs1 := (inst >> 15) & 0x1f
+	vs2 := (inst >> 20) & 0x1f
+	vm := (inst>>25)&1 == 1
+	vstart := cpu.Csr.Load(VSTART)
+
+	if funct6 == 0x27 && funct3 == OPIVI {
+		// vmv1r.v, vmv2r.v, vmv4r.v, vmv8r.v
+		nr := vs1 + 1
+		if nr&(nr-1) != 0 || nr > 8 || !vm || vd%nr != 0 || vs2%nr != 0 {
+			return NewException(IllegalInstruction, inst)
+		}
+		eew := uint64(8)
+		if t := DecodeVType(cpu.Csr.Load(VTYPE)); !t.Ill {
+			eew = t.SEW
+		}
+		for i := vstart; i < nr*cpu.VLEN/eew; i++ {
+			cpu.SetVElement(vd, eew, i, cpu.VElement(vs2, eew, i))
+		}
+		return nil
+	}
+
+	t, exception := cpu.vectorType(inst)
+	if exception != nil {
+		return exception
+	}
+	if opiForms[funct6]&vectorForm(funct3) == 0 {
+		return NewException(IllegalInstruction, inst)
+	}
+	sew, lmul8 := t.SEW, t.LMUL8
+	vl := cpu.Csr.Load(VL)
+	vlmax := cpu.VLMAX(t)
+	mask := elementMask(sew)
+	active := func(i uint64) bool {
+		return vm || cpu.VMaskBit(0, i)
+	}
+	var scalar uint64
+	switch {
+	case funct3 == OPIVX:
+		scalar = cpu.Regs[vs1] & mask
+	case opiUnsignedImm(funct6):
+		scalar = vs1
+	default:
+		scalar = signExtend(vs1, 5) & mask
+	}
+	operand := func(i uint64) uint64 {
+		if funct3 == OPIVV {
+			return cpu.VElement(vs1, sew, i)
+		}
+		return scalar
+	}
+	sourcesOK := groupOK(vs2, lmul8) && (funct3 != OPIVV || groupOK(vs1, lmul8))
+
+	switch funct6 {
+	case 0x0c, 0x0e, 0x0f:
+		if funct6 == 0x0e && funct3 == OPIVV {
+			// vrgatherei16.vv
+			emul8 := 16 * lmul8 / sew
+			if !groupOK(vd, lmul8) || !groupOK(vs2, lmul8) || !groupOK(vs1, emul8) ||
+				groupsOverlap(vd, lmul8, vs2, lmul8) || groupsOverlap(vd, lmul8, vs1, emul8) ||
+				(!vm && vd == 0) {
+				return NewException(IllegalInstruction, inst)
+			}
+			for i := vstart; i < vl; i++ {
+				if active(i) {
+					index := cpu.VElement(vs1, 16, i)
+					var value uint64
+					if index < vlmax {
+						value = cpu.VElement(vs2, sew, index)
+					}
+					cpu.SetVElement(vd, sew, i, value)
+				}
+			}
+			return nil
+		}
+		if !groupOK(vd, lmul8) || !sourcesOK || groupsOverlap(vd, lmul8, vs2, lmul8) ||
+			(funct3 == OPIVV && groupsOverlap(vd, lmul8, vs1, lmul8)) || (!vm && vd == 0) {
+			return NewException(IllegalInstruction, inst)
+		}
+		offset := scalar
+		if funct3 == OPIVX {
+			offset = cpu.Regs[vs1]
+		}
+		switch funct6 {
+		case 0x0c:
+			// vrgather.vv, vrgather.vx, vrgather.vi
+			for i := vstart; i < vl; i++ {
+				if active(i) {
+					index := offset
+					if funct3 == OPIVV {
+						index = cpu.VElement(vs1, sew, i)
+					}
+					var value uint64
+					if index < vlmax {
+						value = cpu.VElement(vs2, sew, index)
+					}
+					cpu.SetVElement(vd, sew, i, value)
+				}
+			}
+		case 0x0e:
+			// vslideup.vx, vslideup.vi
+			start := vstart
+			if offset > start {
+				start = offset
+			}
+			for i := start; i < vl; i++ {
+				if active(i) {
+					cpu.SetVElement(vd, sew, i, cpu.VElement(vs2, sew, i-offset))
+				}
+			}
+		case 0x0f:
+			// vslidedown.vx, vslidedown.vi
+			for i := vstart; i < vl; i++ {
+				if active(i) {
+					var value uint64
+					if offset < vlmax && i+offset < vlmax {
+						value = cpu.VElement(vs2, sew, i+offset)
+					}
+					cpu.SetVElement(vd, sew, i, value)
+				}
+			}
+		}
+		return nil
+	case 0x10, 0x12:
+		// vadc.vvm, vadc.vxm, vadc.vim, vsbc.vvm, vsbc.vxm
+		if vm || vd == 0 || !groupOK(vd, lmul8) || !sourcesOK {
+			return NewException(IllegalInstruction, inst)
+		}
+		for i := vstart; i < vl; i++ {
+			var carry uint64
+			if cpu.VMaskBit(0, i) {
+				carry = 1
+			}
+			a, b := cpu.VElement(vs2, sew, i), operand(i)
+			if funct6 == 0x10 {
+				cpu.SetVElement(vd, sew, i, a+b+carry)
+			} else {
+				cpu.SetVElement(vd, sew, i, a-b-carry)
+			}
+		}
+		return nil
+	case 0x11, 0x13:
+		// vmadc.vvm, vmadc.vxm, vmadc.vim, vmadc.vv, vmadc.vx, vmadc.vi,
+		// vmsbc.vvm, vmsbc.vxm, vmsbc.vv, vmsbc.vx
+		if !sourcesOK {
+			return NewException(IllegalInstruction, inst)
+		}
+		for i := vstart; i < vl; i++ {
+			var carry uint64
+			if !vm && cpu.VMaskBit(0, i) {
+				carry = 1
+			}
+			a, b := cpu.VElement(vs2, sew, i), operand(i)
+			var out uint64
+			if funct6 == 0x11 {
+				sum, c := bits.Add64(a, b, carry)
+				if sew < 64 {
+					c = (sum >> sew) & 1
+				}
+				out = c
+			} else {
+				_, out = bits.Sub64(a, b, carry)
+			}
+			cpu.SetVMaskBit(vd, i, out == 1)
+		}
+		return nil
+	case 0x17:
+		if !groupOK(vd, lmul8) || !sourcesOK {
+			return NewException(IllegalInstruction, inst)
+		}
+		if vm {
+			// vmv.v.v, vmv.v.x, vmv.v.i
+			if vs2 != 0 {
+				return NewException(IllegalInstruction, inst)
+			}
+			for i := vstart; i < vl; i++ {
+				cpu.SetVElement(vd, sew, i, operand(i))
+			}
+			return nil
+		}
+		// vmerge.vvm, vmerge.vxm, vmerge.vim
+		if vd == 0 {
+			return NewException(IllegalInstruction, inst)
+		}
+		for i := vstart; i < vl; i++ {
+			if cpu.VMaskBit(0, i) {
+				cpu.SetVElement(vd, sew, i, operand(i))
+			} else {
+				cpu.SetVElement(vd, sew, i, cpu.VElement(vs2, sew, i))
+			}
+		}
+		return nil
+	case 0x18, 0x19, 0x1a, 0x1b, 0x1c, 0x1d, 0x1e, 0x1f:
+		if !sourcesOK {
+			return NewException(IllegalInstruction, inst)
+		}
+		sx := func(v uint64) int64 {
+			return int64(signExtend(v, sew))
+		}
+		for i := vstart; i < vl; i++ {
+			if !active(i) {
+				continue
+			}
+			a, b := cpu.VElement(vs2, sew, i), operand(i)
+			var result bool
+			switch funct6 {
+			case 0x18:
+				// vmseq
+				result = a == b
+			case 0x19:
+				// vmsne
+				result = a != b
+			case 0x1a:
+				// vmsltu
+				result = a < b
+			case 0x1b:
+				// vmslt
+				result = sx(a) < sx(b)
+			case 0x1c:
+				// vmsleu
+				result = a <= b
+			case 0x1d:
+				// vmsle
+				result = sx(a) <= sx(b)
+			case 0x1e:
+				// vmsgtu
+				result = a > b
+			case 0x1f:
+				// vmsgt
+				result = sx(a) > sx(b)
+			}
+			cpu.SetVMaskBit(vd, i, result)
+		}
+		return nil
+	case 0x2c, 0x2d, 0x2e, 0x2f:
+		// vnsrl, vnsra, vnclipu, vnclip
+		wide8 := 2 * lmul8
+		if sew > 32 || !groupOK(vd, lmul8) || !groupOK(vs2, wide8) ||
+			(funct3 == OPIVV && !groupOK(vs1, lmul8)) ||
+			!narrowOverlapOK(vd, lmul8, vs2, wide8) || (!vm && vd == 0) {
+			return NewException(IllegalInstruction, inst)
+		}
+		vxrm := cpu.Csr.Load(VXRM)
+		maxS := int64(1)<<(sew-1) - 1
+		minS := -maxS - 1
+		for i := vstart; i < vl; i++ {
+			if !active(i) {
+				continue
+			}
+			a := cpu.VElement(vs2, 2*sew, i)
+			shamt := operand(i) & (2*sew - 1)
+			signed := int64(signExtend(a, 2*sew))
+			var result uint64
+			switch funct6 {
+			case 0x2c:
+				result = a >> shamt
+			case 0x2d:
+				result = uint64(signed >> shamt)
+			case 0x2e:
+				result = a>>shamt + roundingIncrement(a, shamt, vxrm)
+				if result > mask {
+					result = mask
+					cpu.Csr.Store(VXSAT, 1)
+				}
+			case 0x2f:
+				r := signed>>shamt + int64(roundingIncrement(a, shamt, vxrm))
+				if r > maxS {
+					r = maxS
+					cpu.Csr.Store(VXSAT, 1)
+				} else if r < minS {
+					r = minS
+					cpu.Csr.Store(VXSAT, 1)
+				}
+				result = uint64(r)
+			}
+			cpu.SetVElement(vd, sew, i, result)
+		}
+		return nil
+	case 0x30, 0x31:
+		// vwredsumu.vs, vwredsum.vs
+		if sew > 32 || vstart != 0 || !groupOK(vs2, lmul8) {
+			return NewException(IllegalInstruction, inst)
+		}
+		sum := cpu.VElement(vs1, 2*sew, 0)
+		for i := uint64(0); i < vl; i++ {
+			if active(i) {
+				a := cpu.VElement(vs2, sew, i)
+				if funct6 == 0x31 {
+					a = signExtend(a, sew)
+				}
+				sum += a
+			}
+		}
+		if vl > 0 {
+			cpu.SetVElement(vd, 2*sew, 0, sum)
+		}
+		return nil
+	}
+
+	op := cpu.vectorIntOp(funct6, sew)
+	if op == nil || !groupOK(vd, lmul8) || !sourcesOK || (!vm && vd == 0) {
+		return NewException(IllegalInstruction, inst)
+	}
+	for i := vstart; i < vl; i++ {
+		if active(i) {
+			cpu.SetVElement(vd, sew, i, op(cpu.VElement(vs2, sew, i), operand(i)))
+		}
+	}
+	return nil
+}
+
+var opmForms = map[uint64]uint8{
+	0x00: formVV, 0x01: formVV, 0x02: formVV, 0x03: formVV,
+	0x04: formVV, 0x05: formVV, 0x06: formVV, 0x07: formVV,
+	0x08: formVV | formVX, 0x09: formVV | formVX, 0x0a: formVV | formVX, 0x0b: formVV | formVX,
+	0x0e: formVX, 0x0f: formVX, 0x10: formVV | formVX, 0x12: formVV, 0x14: formVV, 0x17: formVV,
+	0x18: formVV, 0x19: formVV, 0x1a: formVV, 0x1b: formVV,
+	0x1c: formVV, 0x1d: formVV, 0x1e: formVV, 0x1f: formVV,
+	0x20: formVV | formVX, 0x21: formVV | formVX, 0x22: formVV | formVX, 0x23: formVV | formVX,
+	0x24: formVV | formVX, 0x25: formVV | formVX, 0x26: formVV | formVX, 0x27: formVV | formVX,
+	0x29: formVV | formVX, 0x2b: formVV | formVX, 0x2d: formVV | formVX, 0x2f: formVV | formVX,
+	0x30: formVV | formVX, 0x31: formVV | formVX, 0x32: formVV | formVX, 0x33: formVV | formVX,
+	0x34: formVV | formVX, 0x35: formVV | formVX, 0x36: formVV | formVX, 0x37: formVV | formVX,
+	0x38: formVV | formVX, 0x3a: formVV | formVX, 0x3b: formVV | formVX,
+	0x3c: formVV | formVX, 0x3d: formVV | formVX, 0x3e: formVX, 0x3f: formVV | formVX,
+}
+
+// executeVectorOPM executes the OPMVV and OPMVX instructions.
+func (cpu *Cpu) executeVectorOPM(inst uint64) *Exception {
+	funct3 := (inst >> 12) & 0x7
+	funct6 := inst >> 26
+	vd := (inst >> 7) & 0x1f
+	vs1 := (inst >> 15) & 0x1f
+	vs2 := (inst >> 20) & 0x1f
+	vm := (inst>>25)&1 == 1
+	vstart := cpu.Csr.Load(VSTART)
+
+	t, exception := cpu.vectorType(inst)
+	if exception != nil {
+		return exception
+	}
+	if opmForms[funct6]&vectorForm(funct3) == 0 {
+		return NewException(IllegalInstruction, inst)
+	}
+	sew, lmul8 := t.SEW, t.LMUL8
+	vl := cpu.Csr.Load(VL)
+	mask := elementMask(sew)
+	active := func(i uint64) bool {
+		return vm || cpu.VMaskBit(0, i)
+	}
+	sx := func(v uint64) uint64 {
+		return signExtend(v, sew)
+	}
+	scalar := cpu.Regs[vs1] & mask
+	operand := func(i uint64) uint64 {
+		if funct3 == OPMVV {
+			return cpu.VElement(vs1, sew, i)
+		}
+		return scalar
+	}
+	sourcesOK := groupOK(vs2, lmul8) && (funct3 != OPMVV || groupOK(vs1, lmul8))
+
+	switch funct6 {
+	case 0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07:
+		if vstart != 0 || !groupOK(vs2, lmul8) {
+			return NewException(IllegalInstruction, inst)
+		}
+		acc := cpu.VElement(vs1, sew, 0)
+		for i := uint64(0); i < vl; i++ {
+			if !active(i) {
+				continue
+			}
+			a := cpu.VElement(vs2, sew, i)
+			switch funct6 {
+			case 0x00:
+				// vredsum.vs
+				acc += a
+			case 0x01:
+				// vredand.vs
+				acc &= a
+			case 0x02:
+				// vredor.vs
+				acc |= a
+			case 0x03:
+				// vredxor.vs
+				acc ^= a
+			case 0x04:
+				// vredminu.vs
+				if a < acc {
+					acc = a
+				}
+			case 0x05:
+				// vredmin.vs
+				if int64(sx(a)) < int64(sx(acc)) {
+					acc = a
+				}
+			case 0x06:
+				// vredmaxu.vs
+				if a > acc {
+					acc = a
+				}
+			case 0x07:
+				// vredmax.vs
+				if int64(sx(a)) > int64(sx(acc)) {
+					acc = a
+				}
+			}
+		}
+		if vl > 0 {
+			cpu.SetVElement(vd, sew, 0, acc)
+		}
+		return nil
+	case 0x0e, 0x0f:
+		if !groupOK(vd, lmul8) || !groupOK(vs2, lmul8) || groupsOverlap(vd, lmul8, vs2, lmul8) ||
+			(!vm && vd == 0) {
+			return NewException(IllegalInstruction, inst)
+		}
+		for i := vstart; i < vl; i++ {
+			if !active(i) {
+				continue
+			}
+			value := scalar
+			if funct6 == 0x0e && i > 0 {
+				// vslide1up.vx
+				value = cpu.VElement(vs2, sew, i-1)
+			} else if funct6 == 0x0f && i+1 < vl {
+				// vslide1down.vx
+				value = cpu.VElement(vs2, sew, i+1)
+			}
+			cpu.SetVElement(vd, sew, i, value)
+		}
+		return nil
+	case 0x10:
+		if funct3 == OPMVX {
+			// vmv.s.x
+			if vs2 != 0 || !vm {
+				return NewException(IllegalInstruction, inst)
+			}
+			if vstart < vl {
+				cpu.SetVElement(vd, sew, 0, scalar)
+			}
+			return nil
+		}
+		if !vm && vs1 == 0x00 {
+			return NewException(IllegalInstruction, inst)
+		}
+		switch vs1 {
+		case 0x00:
+			// vmv.x.s
+			cpu.Regs[vd] = sx(cpu.VElement(vs2, sew, 0))
+		case 0x10:
+			// vcpop.m
+			if vstart != 0 {
+				return NewException(IllegalInstruction, inst)
+			}
+			var count uint64
+			for i := uint64(0); i < vl; i++ {
+				if active(i) && cpu.VMaskBit(vs2, i) {
+					count++
+				}
+			}
+			cpu.Regs[vd] = count
+		case 0x11:
+			// vfirst.m
+			if vstart != 0 {
+				return NewException(IllegalInstruction, inst)
+			}
+			first := ^uint64(0)
+			for i := uint64(0); i < vl; i++ {
+				if active(i) && cpu.VMaskBit(vs2, i) {
+					first = i
+					break
+				}
+			}
+			cpu.Regs[vd] = first
+		default:
+			return NewException(IllegalInstruction, inst)
+		}
+		return nil
+	case 0x12:
+		// vzext.vf8, vsext.vf8, vzext.vf4, vsext.vf4, vzext.vf2, vsext.vf2
+		var factor uint64
+		switch vs1 {
+		case 0b00010, 0b00011:
+			factor = 8
+		case 0b00100, 0b00101:
+			factor = 4
+		case 0b00110, 0b00111:
+			factor = 2
+		default:
+			return NewException(IllegalInstruction, inst)
+		}
+		eew, emul8 := sew/factor, lmul8/factor
+		if eew < 8 || emul8 == 0 || !groupOK(vd, lmul8) || !groupOK(vs2, emul8) ||
+			!widenOverlapOK(vd, lmul8, vs2, emul8) || (!vm && vd == 0) {
+			return NewException(IllegalInstruction, inst)
+		}
+		for i := vstart; i < vl; i++ {
+			if active(i) {
+				value := cpu.VElement(vs2, eew, i)
+				if vs1&1 == 1 {
+					value = signExtend(value, eew)
+				}
+				cpu.SetVElement(vd, sew, i, value)
+			}
+		}
+		return nil
+	case 0x14:
+		switch vs1 {
+		case 0b00001, 0b00010, 0b00011:
+			// vmsbf.m, vmsof.m, vmsif.m
+			if vstart != 0 || vd == vs2 || (!vm && vd == 0) {
+				return NewException(IllegalInstruction, inst)
+			}
+			found := false
+			for i := uint64(0); i < vl; i++ {
+				if !active(i) {
+					continue
+				}
+				set := cpu.VMaskBit(vs2, i)
+				switch vs1 {
+				case 0b00001:
+					cpu.SetVMaskBit(vd, i, !found && !set)
+				case 0b00010:
+					cpu.SetVMaskBit(vd, i, !found && set)
+				case 0b00011:
+					cpu.SetVMaskBit(vd, i, !found)
+				}
+				found = found || set
+			}
+		case 0b10000:
+			// viota.m
+			if vstart != 0 || !groupOK(vd, lmul8) || groupsOverlap(vd, lmul8, vs2, 8) || (!vm && vd == 0) {
+				return NewException(IllegalInstruction, inst)
+			}
+			var count uint64
+			for i := uint64(0); i < vl; i++ {
+				if active(i) {
+					cpu.SetVElement(vd, sew, i, count)
+					if cpu.VMaskBit(vs2, i) {
+						count++
+					}
+				}
+			}
+		case 0b10001:
+			// vid.v
+			if vs2 != 0 || !groupOK(vd, lmul8) || (!vm && vd == 0) {
+				return NewException(IllegalInstruction, inst)
+			}
+			for i := vstart; i < vl; i++ {
+				if active(i) {
+					cpu.SetVElement(vd, sew, i, i)
+				}
+			}
+		default:
+			return NewException(IllegalInstruction, inst)
+		}
+		return nil
+	case 0x17:
+		// vcompress.vm
+		if !vm || vstart != 0 || !groupOK(vd, lmul8) || !groupOK(vs2, lmul8) ||
+			groupsOverlap(vd, lmul8, vs2, lmul8) || groupsOverlap(vd, lmul8, vs1, 8) {
+			return NewException(IllegalInstruction, inst)
+		}
+		var j uint64
+		for i := uint64(0); i < vl; i++ {
+			if cpu.VMaskBit(vs1, i) {
+				cpu.SetVElement(vd, sew, j, cpu.VElement(vs2, sew, i))
+				j++
+			}
+		}
+		return nil
+	case 0x18, 0x19, 0x1a, 0x1b, 0x1c, 0x1d, 0x1e, 0x1f:
+		if !vm {
+			return NewException(IllegalInstruction, inst)
+		}
+		for i := vstart; i < vl; i++ {
+			a, b := cpu.VMaskBit(vs2, i), cpu.VMaskBit(vs1, i)
+			var result bool
+			switch funct6 {
+			case 0x18:
+				// vmandn.mm
+				result = a && !b
+			case 0x19:
+				// vmand.mm
+				result = a && b
+			case 0x1a:
+				// vmor.mm
+				result = a || b
+			case 0x1b:
+				// vmxor.mm
+				result = a != b
+			case 0x1c:
+				// vmorn.mm
+				result = a || !b
+			case 0x1d:
+				// vmnand.mm
+				result = !(a && b)
+			case 0x1e:
+				// vmnor.mm
+				result = !(a || b)
+			case 0x1f:
+				// vmxnor.mm
+				result = a == b
+			}
+			cpu.SetVMaskBit(vd, i, result)
+		}
+		return nil
+	}
+
+	if funct6 >= 0x30 {
+		return cpu.executeVectorWidening(inst, t)
+	}
+
+	if !groupOK(vd, lmul8) || !sourcesOK || (!vm && vd == 0) {
+		return NewException(IllegalInstruction, inst)
+	}
+	vxrm := cpu.Csr.Load(VXRM)
+	for i := vstart; i < vl; i++ {
+		if !active(i) {
+			continue
+		}
+		a, b := cpu.VElement(vs2, sew, i), operand(i)
+		var result uint64
+		switch funct6 {
+		case 0x08:
+			// vaaddu
+			half := a>>1 + b>>1 + a&b&1
+			result = half + averagingIncrement(half, a^b, vxrm)
+		case 0x09:
+			// vaadd
+			sa, sb := int64(sx(a)), int64(sx(b))
+			half := uint64(sa>>1 + sb>>1 + sa&sb&1)
+			result = half + averagingIncrement(half, a^b, vxrm)
+		case 0x0a:
+			// vasubu
+			half := a>>1 - b>>1 - ^a&b&1
+			result = half + averagingIncrement(half, a^b, vxrm)
+		case 0x0b:
+			// vasub
+			sa, sb := int64(sx(a)), int64(sx(b))
+			half := uint64(sa>>1 - sb>>1 - ^sa&sb&1)
+			result = half + averagingIncrement(half, a^b, vxrm)
+		case 0x20:
+			// vdivu
+			if b == 0 {
+				result = mask
+			} else {
+				result = a / b
+			}
+		case 0x21:
+			// vdiv
+			if b == 0 {
+				result = mask
+			} else {
+				result = uint64(int64(sx(a)) / int64(sx(b)))
+			}
+		case 0x22:
+			// vremu
+			if b == 0 {
+				result = a
+			} else {
+				result = a % b
+			}
+		case 0x23:
+			// vrem
+			if b == 0 {
+				result = a
+			} else {
+				result = uint64(int64(sx(a)) % int64(sx(b)))
+			}
+		case 0x24:
+			// vmulhu
+			if sew == 64 {
+				result, _ = bits.Mul64(a, b)
+			} else {
+				result = (a * b) >> sew
+			}
+		case 0x25:
+			// vmul
+			result = a * b
+		case 0x26:
+			// vmulhsu
+			if sew == 64 {
+				result = mulhsu(a, b)
+			} else {
+				result = uint64(int64(sx(a))*int64(b)) >> sew
+			}
+		case 0x27:
+			// vmulh
+			if sew == 64 {
+				result = mulh(a, b)
+			} else {
+				result = uint64(int64(sx(a))*int64(sx(b))) >> sew
+			}
+		case 0x29:
+			// vmadd
+			result = b*cpu.VElement(vd, sew, i) + a
+		case 0x2b:
+			// vnmsub
+			result = a - b*cpu.VElement(vd, sew, i)
+		case 0x2d:
+			// vmacc
+			result = b*a + cpu.VElement(vd, sew, i)
+		case 0x2f:
+			// vnmsac
+			result = cpu.VElement(vd, sew, i) - b*a
+		default:
+			return NewException(IllegalInstruction, inst)
+		}
+		cpu.SetVElement(vd, sew, i, result)
+	}
+	return nil
+}
+
+// executeVectorWidening executes the widening integer add, subtract,
+// multiply and multiply-add instructions, which write 2*SEW-bit elements.
+func (cpu *Cpu) executeVectorWidening(inst uint64, t VType) *Exception {
+	funct3 := (inst >> 12) & 0x7
+	funct6 := inst >> 26
+	vd := (inst >> 7) & 0x1f
+	vs1 := (inst >> 15) & 0x1f
+	vs2 := (inst >> 20) & 0x1f
+	vm := (inst>>25)&1 == 1
+	vstart := cpu.Csr.Load(VSTART)
+	sew, lmul8 := t.SEW, t.LMUL8
+	vl := cpu.Csr.Load(VL)
+	wide8 := 2 * lmul8
+
+	// vwaddu.wv, vwadd.wv, vwsubu.wv and vwsub.wv take a wide vs2.
+	wideVs2 := funct6 >= 0x34 && funct6 <= 0x37
+	vs2emul8 := lmul8
+	if wideVs2 {
+		vs2emul8 = wide8
+	}
+	if sew > 32 || !groupOK(vd, wide8) || !groupOK(vs2, vs2emul8) ||
+		(!wideVs2 && !widenOverlapOK(vd, wide8, vs2, lmul8)) ||
+		(funct3 == OPMVV && (!groupOK(vs1, lmul8) || !widenOverlapOK(vd, wide8, vs1, lmul8))) ||
+		(!vm && vd == 0) {
+		return NewException(IllegalInstruction, inst)
+	}
+	zx := func(v uint64) uint64 {
+		return v & elementMask(sew)
+	}
+	sx := func(v uint64) uint64 {
+		return signExtend(v, sew)
+	}
+	for i := vstart; i < vl; i++ {
+		if !vm && !cpu.VMaskBit(0, i) {
+			continue
+		}
+		var a, b uint64
+		if wideVs2 {
+			a = cpu.VElement(vs2, 2*sew, i)
+		} else {
+			a = cpu.VElement(vs2, sew, i)
+		}
+		if funct3 == OPMVV {
+			b = cpu.VElement(vs1, sew, i)
+		} else {
+			b = cpu.Regs[vs1] & elementMask(sew)
+		}
+		var result uint64
+		switch funct6 {
+		case 0x30:
+			// vwaddu
+			result = zx(a) + zx(b)
+		case 0x31:
+			// vwadd
+			result = sx(a) + sx(b)
+		case 0x32:
+			// vwsubu
+			result = zx(a) - zx(b)
+		case 0x33:
+			// vwsub
+			result = sx(a) - sx(b)
+		case 0x34:
+			// vwaddu.w
+			result = a + zx(b)
+		case 0x35:
+			// vwadd.w
+			result = a + sx(b)
+		case 0x36:
+			// vwsubu.w
+			result = a - zx(b)
+		case 0x37:
+			// vwsub.w
+			result = a - sx(b)
+		case 0x38:
+			// vwmulu
+			result = zx(a) * zx(b)
+		case 0x3a:
+			// vwmulsu
+			result = sx(a) * zx(b)
+		case 0x3b:
+			// vwmul
+			result = sx(a) * sx(b)
+		case 0x3c:
+			// vwmaccu
+			result = zx(b)*zx(a) + cpu.VElement(vd, 2*sew, i)
+		case 0x3d:
+			// vwmacc
+			result = sx(b)*sx(a) + cpu.VElement(vd, 2*sew, i)
+		case 0x3e:
+			// vwmaccus
+			result = zx(b)*sx(a) + cpu.VElement(vd, 2*sew, i)
+		case 0x3f:
+			// vwmaccsu
+			result = sx(b)*zx(a) + cpu.VElement(vd, 2*sew, i)
+		default:
+			return NewException(IllegalInstruction, inst)
+		}
+		cpu.SetVElement(vd, 2*sew, i, result)
+	}
+	return nil
+}
@@ -0,0 +1,604 @@
+package main
+
+import (
+	"math"
+	"math/bits"
+)
+
+// vectorFloatFormat returns the floating-point format of sew-bit elements.
+func vectorFloatFormat(sew uint64) (FloatFormat, bool) {
+	switch sew {
+	case 32:
+		return Float32, true
+	case 64:
+		return Float64, true
+	default:
+		return FloatFormat{}, false
+	}
+}
+
+var opfForms = map[uint64]uint8{
+	0x00: formVV | formVF, 0x01: formVV, 0x02: formVV | formVF, 0x03: formVV,
+	0x04: formVV | formVF, 0x05: formVV, 0x06: formVV | formVF, 0x07: formVV,
+	0x08: formVV | formVF, 0x09: formVV | formVF, 0x0a: formVV | formVF,
+	0x0e: formVF, 0x0f: formVF, 0x10: formVV | formVF, 0x12: formVV, 0x13: formVV, 0x17: formVF,
+	0x18: formVV | formVF, 0x19: formVV | formVF, 0x1b: formVV | formVF, 0x1c: formVV | formVF,
+	0x1d: formVF, 0x1f: formVF,
+	0x20: formVV | formVF, 0x21: formVF, 0x24: formVV | formVF, 0x27: formVF,
+	0x28: formVV | formVF, 0x29: formVV | formVF, 0x2a: formVV | formVF, 0x2b: formVV | formVF,
+	0x2c: formVV | formVF, 0x2d: formVV | formVF, 0x2e: formVV | formVF, 0x2f: formVV | formVF,
+	0x30: formVV | formVF, 0x31: formVV, 0x32: formVV | formVF, 0x33: formVV,
+	0x34: formVV | formVF, 0x36: formVV | formVF, 0x38: formVV | formVF,
+	0x3c: formVV | formVF, 0x3d: formVV | formVF, 0x3e: formVV | formVF, 0x3f: formVV | formVF,
+}
+
+// executeVectorOPF executes the OPFVV and OPFVF instructions. Like the scalar
+// ones they need mstatus.FS enabled and accrue fflags.
+func (cpu *Cpu) executeVectorOPF(inst uint64) *Exception {
+	funct3 := (inst >> 12) & 0x7
+	funct6 := inst >> 26
+	vd := (inst >> 7) & 0x1f
+	vs1 := (inst >> 15) & 0x1f
+	vs2 := (inst >> 20) & 0x1f
+	vm := (inst>>25)&1 == 1
+	vstart := cpu.Csr.Load(VSTART)
+
+	if !cpu.Csr.FSEnabled() {
+		return NewException(IllegalInstruction, inst)
+	}
+	t, exception := cpu.vectorType(inst)
+	if exception != nil {
+		return exception
+	}
+	rm, ok := cpu.RoundingMode(uint64(RoundDynamic))
+	if !ok || opfForms[funct6]&vectorForm(funct3) == 0 {
+		return NewException(IllegalInstruction, inst)
+	}
+	sew, lmul8 := t.SEW, t.LMUL8
+	vl := cpu.Csr.Load(VL)
+	active := func(i uint64) bool {
+		return vm || cpu.VMaskBit(0, i)
+	}
+	var flags uint64
+	defer func() {
+		cpu.AccrueFFlags(flags)
+	}()
+
+	// Conversions pick their formats per instruction.
+	if funct6 == 0x12 {
+		return cpu.executeVectorConvert(inst, t)
+	}
+
+	f, ok := vectorFloatFormat(sew)
+	if !ok {
+		return NewException(IllegalInstruction, inst)
+	}
+	scalar := f.Unbox(cpu.FRegs[vs1])
+	operand := func(i uint64) uint64 {
+		if funct3 == OPFVV {
+			return cpu.VElement(vs1, sew, i)
+		}
+		return scalar
+	}
+	sourcesOK := groupOK(vs2, lmul8) && (funct3 != OPFVV || groupOK(vs1, lmul8))
+
+	switch funct6 {
+	case 0x01, 0x03, 0x05, 0x07:
+		if vstart != 0 || !groupOK(vs2, lmul8) {
+			return NewException(IllegalInstruction, inst)
+		}
+		acc := cpu.VElement(vs1, sew, 0)
+		for i := uint64(0); i < vl; i++ {
+			if !active(i) {
+				continue
+			}
+			a := cpu.VElement(vs2, sew, i)
+			var fl uint64
+			switch funct6 {
+			case 0x01, 0x03:
+				// vfredusum.vs, vfredosum.vs
+				acc, fl = f.Add(acc, a, rm)
+			case 0x05:
+				// vfredmin.vs
+				acc, fl = f.Min(acc, a)
+			case 0x07:
+				// vfredmax.vs
+				acc, fl = f.Max(acc, a)
+			}
+			flags |= fl
+		}
+		if vl > 0 {
+			cpu.SetVElement(vd, sew, 0, acc)
+		}
+		return nil
+	case 0x31, 0x33:
+		// vfwredusum.vs, vfwredosum.vs
+		if sew != 32 || vstart != 0 || !groupOK(vs2, lmul8) {
+			return NewException(IllegalInstruction, inst)
+		}
+		acc := cpu.VElement(vs1, 64, 0)
+		for i := uint64(0); i < vl; i++ {
+			if active(i) {
+				a, fl := ConvertFloat(Float32, Float64, cpu.VElement(vs2, sew, i), rm)
+				flags |= fl
+				acc, fl = Float64.Add(acc, a, rm)
+				flags |= fl
+			}
+		}
+		if vl > 0 {
+			cpu.SetVElement(vd, 64, 0, acc)
+		}
+		return nil
+	case 0x0e, 0x0f:
+		if !groupOK(vd, lmul8) || !groupOK(vs2, lmul8) || groupsOverlap(vd, lmul8, vs2, lmul8) ||
+			(!vm && vd == 0) {
+			return NewException(IllegalInstruction, inst)
+		}
+		for i := vstart; i < vl; i++ {
+			if !active(i) {
+				continue
+			}
+			value := scalar
+			if funct6 == 0x0e && i > 0 {
+				// vfslide1up.vf
+				value = cpu.VElement(vs2, sew, i-1)
+			} else if funct6 == 0x0f && i+1 < vl {
+				// vfslide1down.vf
+				value = cpu.VElement(vs2, sew, i+1)
+			}
+			cpu.SetVElement(vd, sew, i, value)
+		}
+		return nil
+	case 0x10:
+		if funct3 == OPFVF {
+			// vfmv.s.f
+			if vs2 != 0 || !vm {
+				return NewException(IllegalInstruction, inst)
+			}
+			if vstart < vl {
+				cpu.SetVElement(vd, sew, 0, scalar)
+			}
+			return nil
+		}
+		// vfmv.f.s
+		if vs1 != 0 || !vm {
+			return NewException(IllegalInstruction, inst)
+		}
+		cpu.SetFReg(vd, f.Box(cpu.VElement(vs2, sew, 0)))
+		return nil
+	case 0x17:
+		if !groupOK(vd, lmul8) || !groupOK(vs2, lmul8) {
+			return NewException(IllegalInstruction, inst)
+		}
+		if vm {
+			// vfmv.v.f
+			if vs2 != 0 {
+				return NewException(IllegalInstruction, inst)
+			}
+			for i := vstart; i < vl; i++ {
+				cpu.SetVElement(vd, sew, i, scalar)
+			}
+			return nil
+		}
+		// vfmerge.vfm
+		if vd == 0 {
+			return NewException(IllegalInstruction, inst)
+		}
+		for i := vstart; i < vl; i++ {
+			if cpu.VMaskBit(0, i) {
+				cpu.SetVElement(vd, sew, i, scalar)
+			} else {
+				cpu.SetVElement(vd, sew, i, cpu.VElement(vs2, sew, i))
+			}
+		}
+		return nil
+	case 0x18, 0x19, 0x1b, 0x1c, 0x1d, 0x1f:
+		if !sourcesOK {
+			return NewException(IllegalInstruction, inst)
+		}
+		for i := vstart; i < vl; i++ {
+			if !active(i) {
+				continue
+			}
+			a, b := cpu.VElement(vs2, sew, i), operand(i)
+			var result bool
+			var fl uint64
+			switch funct6 {
+			case 0x18:
+				// vmfeq
+				result, fl = f.Eq(a, b)
+			case 0x19:
+				// vmfle
+				result, fl = f.Le(a, b)
+			case 0x1b:
+				// vmflt
+				result, fl = f.Lt(a, b)
+			case 0x1c:
+				// vmfne
+				result, fl = f.Eq(a, b)
+				result = !result
+			case 0x1d:
+				// vmfgt
+				result, fl = f.Lt(b, a)
+			case 0x1f:
+				// vmfge
+				result, fl = f.Le(b, a)
+			}
+			flags |= fl
+			cpu.SetVMaskBit(vd, i, result)
+		}
+		return nil
+	}
+
+	if funct6 >= 0x30 {
+		return cpu.executeVectorFloatWidening(inst, t, rm, &flags)
+	}
+
+	if !groupOK(vd, lmul8) || !sourcesOK || (!vm && vd == 0) {
+		return NewException(IllegalInstruction, inst)
+	}
+	if funct6 == 0x13 {
+		switch vs1 {
+		case 0b00000, 0b00100, 0b00101, 0b10000:
+		default:
+			return NewException(IllegalInstruction, inst)
+		}
+	}
+	sign := f.signBit()
+	for i := vstart; i < vl; i++ {
+		if !active(i) {
+			continue
+		}
+		a, b := cpu.VElement(vs2, sew, i), operand(i)
+		var result, fl uint64
+		switch funct6 {
+		case 0x00:
+			// vfadd
+			result, fl = f.Add(a, b, rm)
+		case 0x02:
+			// vfsub
+			result, fl = f.Sub(a, b, rm)
+		case 0x04:
+			// vfmin
+			result, fl = f.Min(a, b)
+		case 0x06:
+			// vfmax
+			result, fl = f.Max(a, b)
+		case 0x08:
+			// vfsgnj
+			result = (a & ^sign) | (b & sign)
+		case 0x09:
+			// vfsgnjn
+			result = (a & ^sign) | (^b & sign)
+		case 0x0a:
+			// vfsgnjx
+			result = a ^ (b & sign)
+		case 0x13:
+			switch vs1 {
+			case 0b00000:
+				// vfsqrt.v
+				result, fl = f.Sqrt(a, rm)
+			case 0b00100:
+				// vfrsqrt7.v
+				result, fl = f.RecipSqrtEstimate(a)
+			case 0b00101:
+				// vfrec7.v
+				result, fl = f.RecipEstimate(a, rm)
+			case 0b10000:
+				// vfclass.v
+				result = f.Classify(a)
+			}
+		case 0x20:
+			// vfdiv
+			result, fl = f.Div(a, b, rm)
+		case 0x21:
+			// vfrdiv
+			result, fl = f.Div(b, a, rm)
+		case 0x24:
+			// vfmul
+			result, fl = f.Mul(a, b, rm)
+		case 0x27:
+			// vfrsub
+			result, fl = f.Sub(b, a, rm)
+		case 0x28:
+			// vfmadd
+			result, fl = f.MulAdd(b, cpu.VElement(vd, sew, i), a, false, false, rm)
+		case 0x29:
+			// vfnmadd
+			result, fl = f.MulAdd(b, cpu.VElement(vd, sew, i), a, true, true, rm)
+		case 0x2a:
+			// vfmsub
+			result, fl = f.MulAdd(b, cpu.VElement(vd, sew, i), a, false, true, rm)
+		case 0x2b:
+			// vfnmsub
+			result, fl = f.MulAdd(b, cpu.VElement(vd, sew, i), a, true, false, rm)
+		case 0x2c:
+			// vfmacc
+			result, fl = f.MulAdd(b, a, cpu.VElement(vd, sew, i), false, false, rm)
+		case 0x2d:
+			// vfnmacc
+			result, fl = f.MulAdd(b, a, cpu.VElement(vd, sew, i), true, true, rm)
+		case 0x2e:
+			// vfmsac
+			result, fl = f.MulAdd(b, a, cpu.VElement(vd, sew, i), false, true, rm)
+		case 0x2f:
+			// vfnmsac
+			result, fl = f.MulAdd(b, a, cpu.VElement(vd, sew, i), true, false, rm)
+		default:
+			return NewException(IllegalInstruction, inst)
+		}
+		flags |= fl
+		cpu.SetVElement(vd, sew, i, result)
+	}
+	return nil
+}
+
+// executeVectorFloatWidening executes the widening floating-point add,
+// subtract, multiply and multiply-add instructions. Narrow operands are
+// widened exactly before the operation, which then rounds once.
+func (cpu *Cpu) executeVectorFloatWidening(inst uint64, t VType, rm RoundingMode, flags *uint64) *Exception {
+	funct3 := (inst >> 12) & 0x7
+	funct6 := inst >> 26
+	vd := (inst >> 7) & 0x1f
+	vs1 := (inst >> 15) & 0x1f
+	vs2 := (inst >> 20) & 0x1f
+	vm := (inst>>25)&1 == 1
+	vstart := cpu.Csr.Load(VSTART)
+	lmul8, wide8 := t.LMUL8, 2*t.LMUL8
+	vl := cpu.Csr.Load(VL)
+
+	// vfwadd.w and vfwsub.w take a wide vs2.
+	wideVs2 := funct6 == 0x34 || funct6 == 0x36
+	vs2emul8 := lmul8
+	if wideVs2 {
+		vs2emul8 = wide8
+	}
+	if t.SEW != 32 || !groupOK(vd, wide8) || !groupOK(vs2, vs2emul8) ||
+		(!wideVs2 && !widenOverlapOK(vd, wide8, vs2, lmul8)) ||
+		(funct3 == OPFVV && (!groupOK(vs1, lmul8) || !widenOverlapOK(vd, wide8, vs1, lmul8))) ||
+		(!vm && vd == 0) {
+		return NewException(IllegalInstruction, inst)
+	}
+	widen := func(v uint64) uint64 {
+		w, fl := ConvertFloat(Float32, Float64, v, rm)
+		*flags |= fl
+		return w
+	}
+	scalar := Float32.Unbox(cpu.FRegs[vs1])
+	f := Float64
+	for i := vstart; i < vl; i++ {
+		if !vm && !cpu.VMaskBit(0, i) {
+			continue
+		}
+		var a, b uint64
+		if wideVs2 {
+			a = cpu.VElement(vs2, 64, i)
+		} else {
+			a = widen(cpu.VElement(vs2, 32, i))
+		}
+		if funct3 == OPFVV {
+			b = widen(cpu.VElement(vs1, 32, i))
+		} else {
+			b = widen(scalar)
+		}
+		var result, fl uint64
+		switch funct6 {
+		case 0x30, 0x34:
+			// vfwadd, vfwadd.w
+			result, fl = f.Add(a, b, rm)
+		case 0x32, 0x36:
+			// vfwsub, vfwsub.w
+			result, fl = f.Sub(a, b, rm)
+		case 0x38:
+			// vfwmul
+			result, fl = f.Mul(a, b, rm)
+		case 0x3c:
+			// vfwmacc
+			result, fl = f.MulAdd(b, a, cpu.VElement(vd, 64, i), false, false, rm)
+		case 0x3d:
+			// vfwnmacc
+			result, fl = f.MulAdd(b, a, cpu.VElement(vd, 64, i), true, true, rm)
+		case 0x3e:
+			// vfwmsac
+			result, fl = f.MulAdd(b, a, cpu.VElement(vd, 64, i), false, true, rm)
+		case 0x3f:
+			// vfwnmsac
+			result, fl = f.MulAdd(b, a, cpu.VElement(vd, 64, i), true, false, rm)
+		default:
+			return NewException(IllegalInstruction, inst)
+		}
+		*flags |= fl
+		cpu.SetVElement(vd, 64, i, result)
+	}
+	return nil
+}
+
+// executeVectorConvert executes the VFUNARY0 conversions between integers
+// and floats, in single-width, widening and narrowing forms.
+func (cpu *Cpu) executeVectorConvert(inst uint64, t VType) *Exception {
+	vd := (inst >> 7) & 0x1f
+	op := (inst >> 15) & 0x1f
+	vs2 := (inst >> 20) & 0x1f
+	vm := (inst>>25)&1 == 1
+	vstart := cpu.Csr.Load(VSTART)
+	sew, lmul8 := t.SEW, t.LMUL8
+	vl := cpu.Csr.Load(VL)
+
+	rm, ok := cpu.RoundingMode(uint64(RoundDynamic))
+	if !ok {
+		return NewException(IllegalInstruction, inst)
+	}
+	// Bits 4:3 of the vs1 field select single-width, widening or narrowing
+	// and the low bits the kind of conversion.
+	kind := op & 0b111
+	if kind == 0b110 || kind == 0b111 || (op>>3 == 0b10 && kind == 0b101) {
+		rm = RoundTowardZero
+	}
+	srcEEW, dstEEW := sew, sew
+	srcEMUL8, dstEMUL8 := lmul8, lmul8
+	switch op >> 3 {
+	case 0b00:
+	case 0b01:
+		dstEEW, dstEMUL8 = 2*sew, 2*lmul8
+	case 0b10:
+		srcEEW, srcEMUL8 = 2*sew, 2*lmul8
+	default:
+		return NewException(IllegalInstruction, inst)
+	}
+	if dstEEW > 64 || srcEEW > 64 || !groupOK(vd, dstEMUL8) || !groupOK(vs2, srcEMUL8) ||
+		(!vm && vd == 0) {
+		return NewException(IllegalInstruction, inst)
+	}
+	if (op>>3 == 0b01 && !widenOverlapOK(vd, dstEMUL8, vs2, srcEMUL8)) ||
+		(op>>3 == 0b10 && !narrowOverlapOK(vd, dstEMUL8, vs2, srcEMUL8)) {
+		return NewException(IllegalInstruction, inst)
+	}
+
+	// convert maps one element, reporting false for unsupported formats.
+	var convert func(a uint64) (uint64, uint64)
+	switch {
+	case kind == 0b000 || kind == 0b001 || kind == 0b110 || kind == 0b111:
+		// vfcvt.xu.f.v, vfcvt.x.f.v, vfcvt.rtz.xu.f.v, vfcvt.rtz.x.f.v,
+		// vfwcvt.xu.f.v, vfwcvt.x.f.v, vfwcvt.rtz.xu.f.v, vfwcvt.rtz.x.f.v,
+		// vfncvt.xu.f.w, vfncvt.x.f.w, vfncvt.rtz.xu.f.w, vfncvt.rtz.x.f.w
+		from, ok := vectorFloatFormat(srcEEW)
+		if !ok {
+			return NewException(IllegalInstruction, inst)
+		}
+		signed := kind&1 == 1
+		convert = func(a uint64) (uint64, uint64) {
+			return from.ToInt(a, uint(dstEEW), signed, rm)
+		}
+	case kind == 0b010 || kind == 0b011:
+		// vfcvt.f.xu.v, vfcvt.f.x.v, vfwcvt.f.xu.v, vfwcvt.f.x.v,
+		// vfncvt.f.xu.w, vfncvt.f.x.w
+		to, ok := vectorFloatFormat(dstEEW)
+		if !ok {
+			return NewException(IllegalInstruction, inst)
+		}
+		signed := kind&1 == 1
+		convert = func(a uint64) (uint64, uint64) {
+			if signed {
+				v := int64(signExtend(a, srcEEW))
+				return to.FromInt(v < 0, abs64(v), rm)
+			}
+			return to.FromInt(false, a, rm)
+		}
+	case (kind == 0b100 && op>>3 != 0b00) || (kind == 0b101 && op>>3 == 0b10):
+		// vfwcvt.f.f.v, vfncvt.f.f.w, vfncvt.rod.f.f.w
+		from, ok1 := vectorFloatFormat(srcEEW)
+		to, ok2 := vectorFloatFormat(dstEEW)
+		if !ok1 || !ok2 {
+			return NewException(IllegalInstruction, inst)
+		}
+		roundToOdd := kind == 0b101
+		convert = func(a uint64) (uint64, uint64) {
+			result, fl := ConvertFloat(from, to, a, rm)
+			// Round to odd: truncate, then set the lsb of inexact results.
+			if roundToOdd && fl&FFLAGS_NX != 0 && (result>>to.FracBits)&to.expMax() != to.expMax() {
+				result |= 1
+			}
+			return result, fl
+		}
+	default:
+		return NewException(IllegalInstruction, inst)
+	}
+
+	var flags uint64
+	for i := vstart; i < vl; i++ {
+		if !vm && !cpu.VMaskBit(0, i) {
+			continue
+		}
+		result, fl := convert(cpu.VElement(vs2, srcEEW, i))
+		flags |= fl
+		cpu.SetVElement(vd, dstEEW, i, result)
+	}
+	cpu.AccrueFFlags(flags)
+	return nil
+}
+
+// The vfrec7 and vfrsqrt7 lookup tables. Each entry is the 7-bit significand
+// of the estimate for the midpoint of its input interval, rounded to nearest.
+var (
+	recipTable     [128]uint64
+	recipSqrtTable [128]uint64
+)
+
+func init() {
+	for i := range recipTable {
+		recipTable[i] = uint64(math.Round(1<<15/(128+float64(i)+0.5))) - 128
+	}
+	for i := range recipSqrtTable {
+		// Bit 6 is the exponent lsb: clear means an odd unbiased exponent,
+		// so the input lies in [2, 4).
+		x := 1 + (float64(i&0x3f)+0.5)/64
+		if i&0x40 == 0 {
+			x *= 2
+		}
+		recipSqrtTable[i] = uint64(math.Round(2/math.Sqrt(x)*128)) - 128
+	}
+}
+
+// normalize returns the biased exponent and fraction of a finite nonzero
+// value, shifting subnormals up so the implicit bit is set. The exponent is
+// zero or negative for subnormals.
+func (f FloatFormat) normalize(a uint64) (int, uint64) {
+	exp := int((a >> f.FracBits) & f.expMax())
+	frac := a & (1<<f.FracBits - 1)
+	if exp == 0 {
+		shift := bits.LeadingZeros64(frac) - (64 - int(f.FracBits))
+		exp -= shift
+		frac = (frac << (shift + 1)) & (1<<f.FracBits - 1)
+	}
+	return exp, frac
+}
+
+// RecipEstimate returns the vfrec7 estimate of 1/a, accurate to 7 bits.
+func (f FloatFormat) RecipEstimate(a uint64, rm RoundingMode) (uint64, uint64) {
+	x := f.unpack(a)
+	switch x.kind {
+	case kindSNaN:
+		return f.CanonicalNaN(), FFLAGS_NV
+	case kindQNaN:
+		return f.CanonicalNaN(), 0
+	case kindInf:
+		return f.zero(x.sign), 0
+	case kindZero:
+		return f.inf(x.sign), FFLAGS_DZ
+	}
+	exp, frac := f.normalize(a)
+	if exp < -1 {
+		// 1/a overflows.
+		return f.overflow(x.sign, rm)
+	}
+	bias := f.bias()
+	outExp := 2*bias - 1 - exp
+	outFrac := recipTable[frac>>(f.FracBits-7)] << (f.FracBits - 7)
+	if outExp <= 0 {
+		outFrac = (outFrac | 1<<f.FracBits) >> (1 - outExp)
+		outExp = 0
+	}
+	return f.zero(x.sign) | uint64(outExp)<<f.FracBits | outFrac, 0
+}
+
+// RecipSqrtEstimate returns the vfrsqrt7 estimate of 1/sqrt(a), accurate to
+// 7 bits.
+func (f FloatFormat) RecipSqrtEstimate(a uint64) (uint64, uint64) {
+	x := f.unpack(a)
+	switch {
+	case x.kind == kindSNaN:
+		return f.CanonicalNaN(), FFLAGS_NV
+	case x.kind == kindQNaN:
+		return f.CanonicalNaN(), 0
+	case x.kind == kindZero:
+		return f.inf(x.sign), FFLAGS_DZ
+	case x.sign:
+		return f.CanonicalNaN(), FFLAGS_NV
+	case x.kind == kindInf:
+		return 0, 0
+	}
+	exp, frac := f.normalize(a)
+	index := uint64(exp&1)<<6 | frac>>(f.FracBits-6)
+	outExp := (3*f.bias() - 1 - exp) / 2
+	return uint64(outExp)<<f.FracBits | recipSqrtTable[index]<<(f.FracBits-7), 0
+}
@@ -23,6 +23,11 @@ func NewVirtioBlock(diskImage []uint8) VirtioBlock {
 	}
 }
 
+// Pending reports whether a queue notification is waiting to be served.
+func (v *VirtioBlock) Pending() bool {
+	return v.queueNotify < MAX_BLOCK_QUEUE
+}
+
 func (v *VirtioBlock) IsInterrupting() bool {
 	if v.queueNotify < MAX_BLOCK_QUEUE {
 		v.queueNotify = MAX_BLOCK_QUEUE